@@ -20,9 +20,308 @@ func TestUnpackDir(t *testing.T) {
 	b := testunpackbytes
 	for len(b) > 0 {
 		var err error
-		if _, b, _, err = UnpackDir(b, true); err != nil {
+		if _, b, _, err = UnpackDir(b, Dialect9P2000u); err != nil {
 			t.Fatalf("Unpackdir: %v", err)
 		}
 	}
 }
 
+func TestPackUnpackDotl(t *testing.T) {
+	qid := Qid{QTDIR, 3, 0x1234}
+	attr := Attr{Valid: GetattrBasic, Qid: qid, Mode: 040755, Uid: 1000, Gid: 100,
+		Nlink: 2, Size: 4096, Blksize: 4096, Blocks: 8,
+		Atime: Timespec{1, 2}, Mtime: Timespec{3, 4}, Ctime: Timespec{5, 6}}
+	sa := SetAttr{Valid: SetattrMode | SetattrMtimeSet, Mode: 0644, Mtime: Timespec{7, 8}}
+	st := Statfs{0x01021997, 4096, 100, 50, 40, 1000, 900, 0xdead, 255}
+	fl := Flock{LockTypeWrlck, LockFlagsBlock, 10, 20, 42, "host"}
+
+	tests := []struct {
+		pack func(fc *Fcall) error
+		chk  func(fc *Fcall) bool
+	}{
+		{func(fc *Fcall) error { return PackTlopen(fc, 1, LORDWR|LOTRUNC) },
+			func(fc *Fcall) bool { return fc.Fid == 1 && fc.Flags == LORDWR|LOTRUNC }},
+		{func(fc *Fcall) error { return PackRlopen(fc, &qid, 8192) },
+			func(fc *Fcall) bool { return fc.Qid == qid && fc.Iounit == 8192 }},
+		{func(fc *Fcall) error { return PackTlcreate(fc, 2, "file", LOCREATE, 0644, 100) },
+			func(fc *Fcall) bool {
+				return fc.Fid == 2 && fc.Name == "file" && fc.Flags == LOCREATE && fc.Perm == 0644 && fc.Ngid == 100
+			}},
+		{func(fc *Fcall) error { return PackTsymlink(fc, 3, "link", "target", 100) },
+			func(fc *Fcall) bool {
+				return fc.Fid == 3 && fc.Name == "link" && fc.Target == "target" && fc.Ngid == 100
+			}},
+		{func(fc *Fcall) error { return PackTmknod(fc, 4, "dev", 020644, 1, 3, 100) },
+			func(fc *Fcall) bool {
+				return fc.Fid == 4 && fc.Name == "dev" && fc.Perm == 020644 && fc.Major == 1 && fc.Minor == 3
+			}},
+		{func(fc *Fcall) error { return PackTrename(fc, 5, 6, "new") },
+			func(fc *Fcall) bool { return fc.Fid == 5 && fc.Dfid == 6 && fc.Name == "new" }},
+		{func(fc *Fcall) error { return PackRreadlink(fc, "target") },
+			func(fc *Fcall) bool { return fc.Target == "target" }},
+		{func(fc *Fcall) error { return PackTgetattr(fc, 7, GetattrAll) },
+			func(fc *Fcall) bool { return fc.Fid == 7 && fc.Mask == GetattrAll }},
+		{func(fc *Fcall) error { return PackRgetattr(fc, &attr) },
+			func(fc *Fcall) bool { return fc.Attr == attr }},
+		{func(fc *Fcall) error { return PackTsetattr(fc, 8, &sa) },
+			func(fc *Fcall) bool { return fc.Fid == 8 && fc.SetAttr == sa }},
+		{func(fc *Fcall) error { return PackTxattrwalk(fc, 9, 10, "user.foo") },
+			func(fc *Fcall) bool { return fc.Fid == 9 && fc.Newfid == 10 && fc.Name == "user.foo" }},
+		{func(fc *Fcall) error { return PackRxattrwalk(fc, 12) },
+			func(fc *Fcall) bool { return fc.Attrsize == 12 }},
+		{func(fc *Fcall) error { return PackTxattrcreate(fc, 11, "user.bar", 5, XattrCreate) },
+			func(fc *Fcall) bool {
+				return fc.Fid == 11 && fc.Name == "user.bar" && fc.Attrsize == 5 && fc.Flags == XattrCreate
+			}},
+		{func(fc *Fcall) error { return PackTreaddir(fc, 12, 100, 8192) },
+			func(fc *Fcall) bool { return fc.Fid == 12 && fc.Offset == 100 && fc.Count == 8192 }},
+		{func(fc *Fcall) error { return PackTfsync(fc, 13, 1) },
+			func(fc *Fcall) bool { return fc.Fid == 13 && fc.Datasync == 1 }},
+		{func(fc *Fcall) error { return PackTlock(fc, 14, &fl) },
+			func(fc *Fcall) bool { return fc.Fid == 14 && fc.Flock == fl }},
+		{func(fc *Fcall) error { return PackRlock(fc, LockBlocked) },
+			func(fc *Fcall) bool { return fc.Status == LockBlocked }},
+		{func(fc *Fcall) error { return PackRgetlock(fc, &fl) },
+			func(fc *Fcall) bool {
+				return fc.Flock.Type == fl.Type && fc.Flock.ClientId == fl.ClientId && fc.Flock.Flags == 0
+			}},
+		{func(fc *Fcall) error { return PackTstatfs(fc, 15) },
+			func(fc *Fcall) bool { return fc.Fid == 15 }},
+		{func(fc *Fcall) error { return PackRstatfs(fc, &st) },
+			func(fc *Fcall) bool { return fc.Statfs == st }},
+		{func(fc *Fcall) error { return PackTlink(fc, 16, 17, "hard") },
+			func(fc *Fcall) bool { return fc.Dfid == 16 && fc.Fid == 17 && fc.Name == "hard" }},
+		{func(fc *Fcall) error { return PackTmkdir(fc, 18, "dir", 0755, 100) },
+			func(fc *Fcall) bool { return fc.Fid == 18 && fc.Name == "dir" && fc.Perm == 0755 && fc.Ngid == 100 }},
+		{func(fc *Fcall) error { return PackRmkdir(fc, &qid) },
+			func(fc *Fcall) bool { return fc.Qid == qid }},
+		{func(fc *Fcall) error { return PackTrenameat(fc, 19, "old", 20, "new") },
+			func(fc *Fcall) bool { return fc.Fid == 19 && fc.Name == "old" && fc.Dfid == 20 && fc.Newname == "new" }},
+		{func(fc *Fcall) error { return PackTunlinkat(fc, 21, "gone", AtRemovedir) },
+			func(fc *Fcall) bool { return fc.Fid == 21 && fc.Name == "gone" && fc.Flags == AtRemovedir }},
+		{func(fc *Fcall) error { return PackRerror(fc, "ignored", ENOENT, Dialect9P2000L) },
+			func(fc *Fcall) bool { return fc.Type == Rlerror && fc.Errornum == ENOENT }},
+	}
+
+	for i, tt := range tests {
+		fc := NewFcall(MSIZE)
+		if err := tt.pack(fc); err != nil {
+			t.Fatalf("%d: pack: %v", i, err)
+		}
+
+		rc, err, n := Unpack(fc.Pkt, Dialect9P2000L)
+		if err != nil {
+			t.Fatalf("%d: unpack %v: %v", i, fc, err)
+		}
+
+		if n != len(fc.Pkt) || rc.Type != fc.Type || !tt.chk(rc) {
+			t.Errorf("%d: got %v, want %v", i, rc, fc)
+		}
+
+		if _, err, _ := Unpack(fc.Pkt, Dialect9P2000u); err == nil {
+			t.Errorf("%d: %v accepted by 9P2000.u", i, fc)
+		}
+	}
+}
+
+func TestDirent(t *testing.T) {
+	var buf [256]byte
+
+	ents := []Dirent{{Qid{QTDIR, 0, 1}, 1, 4, "."}, {Qid{QTFILE, 2, 3}, 2, 8, "file"}}
+	b := buf[:]
+	n := 0
+	for i := range ents {
+		m := PackDirent(&ents[i], b)
+		if m == 0 {
+			t.Fatalf("PackDirent: no space")
+		}
+		b = b[m:]
+		n += m
+	}
+
+	fc := NewFcall(MSIZE)
+	if err := PackRreaddir(fc, buf[:n]); err != nil {
+		t.Fatalf("PackRreaddir: %v", err)
+	}
+
+	rc, err, _ := Unpack(fc.Pkt, Dialect9P2000L)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	b = rc.Data
+	for i := 0; len(b) > 0; i++ {
+		var d *Dirent
+		if d, b, _, err = UnpackDirent(b); err != nil {
+			t.Fatalf("UnpackDirent: %v", err)
+		}
+
+		if *d != ents[i] {
+			t.Errorf("entry %d: got %v, want %v", i, d, ents[i])
+		}
+	}
+
+	if PackDirent(&ents[1], buf[:10]) != 0 {
+		t.Errorf("PackDirent: expected no space")
+	}
+}
+
+func TestUnpackFcall(t *testing.T) {
+	tc := NewFcall(MSIZE)
+	if err := PackTwalk(tc, 1, 2, []string{"a", "b"}); err != nil {
+		t.Fatalf("PackTwalk: %v", err)
+	}
+
+	fc := NewFcall(MSIZE)
+	if err, n := UnpackFcall(fc, tc.Pkt, Dialect9P2000); err != nil || n != len(tc.Pkt) {
+		t.Fatalf("UnpackFcall: got %d, %v, want %d", n, err, len(tc.Pkt))
+	}
+	if fc.Fid != 1 || fc.Newfid != 2 || len(fc.Wname) != 2 || fc.Wname[1] != "b" {
+		t.Errorf("UnpackFcall: got %v", fc)
+	}
+
+	// the names are copied, overwriting the buffer doesn't change them
+	name := fc.Wname[1]
+	for i := range tc.Pkt {
+		tc.Pkt[i] = 0
+	}
+	if name != "b" {
+		t.Errorf("UnpackFcall: name changed to %q after the buffer was reused", name)
+	}
+
+	// the fields of the previous message are cleared
+	if err := PackTread(tc, 3, 100, 200); err != nil {
+		t.Fatalf("PackTread: %v", err)
+	}
+	if err, _ := UnpackFcall(fc, tc.Pkt, Dialect9P2000); err != nil {
+		t.Fatalf("UnpackFcall: %v", err)
+	}
+	if fc.Type != Tread || fc.Fid != 3 || fc.Offset != 100 || fc.Count != 200 || len(fc.Wname) != 0 || fc.Newfid != NOFID {
+		t.Errorf("UnpackFcall: got %v", fc)
+	}
+
+	// decoding the reads and the writes doesn't allocate
+	data := make([]byte, 8192)
+	rc := NewFcall(MSIZE)
+	if err := PackRread(rc, data); err != nil {
+		t.Fatalf("PackRread: %v", err)
+	}
+	if err := PackTwrite(tc, 3, 0, uint32(len(data)), data); err != nil {
+		t.Fatalf("PackTwrite: %v", err)
+	}
+	for _, pkt := range [][]byte{rc.Pkt, tc.Pkt} {
+		allocs := testing.AllocsPerRun(100, func() {
+			UnpackFcall(fc, pkt, Dialect9P2000u)
+		})
+		if allocs != 0 {
+			t.Errorf("UnpackFcall %v: got %v allocations, want 0", fc.Type, allocs)
+		}
+	}
+}
+
+func TestFcallPool(t *testing.T) {
+	fp := NewFcallPool(MSIZE)
+	fc := fp.Get()
+	if len(fc.Buf) != MSIZE {
+		t.Fatalf("Get: got buffer of %d bytes, want %d", len(fc.Buf), MSIZE)
+	}
+
+	fc.Buf = fc.Buf[:100]
+	fp.Put(fc)
+	fp.Put(NewFcall(100))
+	for i := 0; i < 10; i++ {
+		if fc := fp.Get(); len(fc.Buf) != MSIZE {
+			t.Fatalf("Get: got buffer of %d bytes, want %d", len(fc.Buf), MSIZE)
+		}
+	}
+}
+
+func BenchmarkTread(b *testing.B) {
+	fp := NewFcallPool(MSIZE)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tc := fp.Get()
+		PackTread(tc, 1, uint64(i), 8192)
+		fc := fp.Get()
+		UnpackFcall(fc, tc.Pkt, Dialect9P2000u)
+		fp.Put(fc)
+		fp.Put(tc)
+	}
+}
+
+func BenchmarkRread(b *testing.B) {
+	fp := NewFcallPool(MSIZE)
+	data := make([]byte, 8192)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rc := fp.Get()
+		InitRread(rc, uint32(len(data)))
+		copy(rc.Data, data)
+		fc := fp.Get()
+		UnpackFcall(fc, rc.Pkt, Dialect9P2000u)
+		fp.Put(fc)
+		fp.Put(rc)
+	}
+}
+
+// Unpack allocates the Fcall, for comparison with BenchmarkRread.
+func BenchmarkUnpackRread(b *testing.B) {
+	data := make([]byte, 8192)
+	rc := NewFcall(MSIZE)
+	PackRread(rc, data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Unpack(rc.Pkt, Dialect9P2000u)
+	}
+}
+
+// 9P2000.u Tattach and Tauth without n_uname are accepted.
+func TestUnpackNoUnamenum(t *testing.T) {
+	fc := NewFcall(MSIZE)
+	for _, tp := range []uint8{Tauth, Tattach} {
+		var err error
+		if tp == Tauth {
+			err = PackTauth(fc, 1, "glenda", "", 0, Dialect9P2000)
+		} else {
+			err = PackTattach(fc, 1, NOFID, "glenda", "", 0, Dialect9P2000)
+		}
+		if err != nil {
+			t.Fatalf("Pack %d: %v", tp, err)
+		}
+
+		rc, err, _ := Unpack(fc.Pkt, Dialect9P2000u)
+		if err != nil {
+			t.Fatalf("Unpack %d: %v", tp, err)
+		}
+		if rc.Uname != "glenda" || rc.Unamenum != NOUID {
+			t.Errorf("Unpack %d: got %v", tp, rc)
+		}
+	}
+}
+
+func TestUnpackTruncatedUnamenum(t *testing.T) {
+	fc := NewFcall(MSIZE)
+	for _, tp := range []uint8{Tauth, Tattach} {
+		var err error
+		if tp == Tauth {
+			err = PackTauth(fc, 1, "glenda", "", 5, Dialect9P2000u)
+		} else {
+			err = PackTattach(fc, 1, NOFID, "glenda", "", 5, Dialect9P2000u)
+		}
+		if err != nil {
+			t.Fatalf("Pack %d: %v", tp, err)
+		}
+
+		// n_uname with its last 1, 2 or 3 bytes cut off
+		for cut := 1; cut < 4; cut++ {
+			pkt := make([]byte, len(fc.Pkt)-cut)
+			copy(pkt, fc.Pkt)
+			pint32(uint32(len(pkt)), pkt)
+			if rc, err, _ := Unpack(pkt, Dialect9P2000u); err == nil {
+				t.Errorf("Unpack %d, %d bytes cut: got %v, want error", tp, cut, rc)
+			}
+		}
+	}
+}
@@ -5,17 +5,25 @@
 package clnt
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
 	"github.com/lionkov/go9p/p/srv/ufs"
 )
 
@@ -149,7 +157,7 @@ func TestAttachOpenReaddir(t *testing.T) {
 		}
 		for b != nil && len(b) > 0 {
 			var d *p.Dir
-			if d, b, amt, err = p.UnpackDir(b, ufs.Dotu); err != nil {
+			if d, b, amt, err = p.UnpackDir(b, clnt.Dialect); err != nil {
 				t.Errorf("UnpackDir returns %v", err)
 				break
 			} else {
@@ -336,3 +344,1001 @@ func TestRename(t *testing.T) {
 	}
 
 }
+
+// Starts a 9P2000.L ufs server in a temporary directory and connects to it.
+func dotlConnect(t *testing.T) (*ufs.Ufs, *Clnt, string, string) {
+	var err error
+	flag.Parse()
+	ufs := new(ufs.Ufs)
+	ufs.Dotu = true
+	ufs.Dotl = true
+	ufs.Id = "ufs"
+	ufs.Debuglevel = *debug
+	ufs.Msize = 8192
+	ufs.Start(ufs)
+
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	ufs.Root = tmpDir
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	srvAddr := l.Addr().String()
+	go func() {
+		if err := ufs.StartListener(l); err != nil && err != srv.Eshutdown {
+			t.Errorf("Can not start listener: %v", err)
+		}
+	}()
+	var conn net.Conn
+	if conn, err = net.Dial("unix", srvAddr); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	clnt, err := Connect(conn, 8192, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return ufs, clnt, tmpDir, srvAddr
+}
+
+func TestDotl(t *testing.T) {
+	ufs, clnt, tmpDir, srvAddr := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	defer clnt.Unmount()
+	if clnt.Dialect != p.Dialect9P2000L {
+		t.Fatalf("Dialect: got %v, want 9P2000.L", clnt.Dialect)
+	}
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	rootfid, err := clnt.Attach(nil, user, "/")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err = clnt.Mkdir(rootfid, "dir", 0755, p.NOUID); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if st, err := os.Stat(path.Join(tmpDir, "dir")); err != nil || !st.IsDir() {
+		t.Fatalf("Mkdir did not create a directory: %v", err)
+	}
+
+	f := clnt.FidAlloc()
+	if _, err = clnt.Walk(rootfid, f, []string{"dir"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = clnt.Lcreate(f, "a", p.LORDWR, 0600, p.NOUID); err != nil {
+		t.Fatalf("Lcreate: %v", err)
+	}
+	if _, err = clnt.Write(f, []byte("hello"), 0); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err = clnt.Fsync(f, false); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+
+	sa := &p.SetAttr{
+		Valid: p.SetattrMode | p.SetattrMtime | p.SetattrMtimeSet,
+		Mode:  0640,
+		Mtime: p.Timespec{Sec: 1000000000, Nsec: 123456789},
+	}
+	if err = clnt.Setattr(f, sa); err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	attr, err := clnt.Getattr(f, p.GetattrAll)
+	if err != nil {
+		t.Fatalf("Getattr: %v", err)
+	}
+	if attr.Size != 5 || attr.Mode&0777 != 0640 || attr.Mtime != sa.Mtime {
+		t.Errorf("Getattr: got size %d mode %o mtime %v", attr.Size, attr.Mode, attr.Mtime)
+	}
+	clnt.Clunk(f)
+
+	dir := clnt.FidAlloc()
+	if _, err = clnt.Walk(rootfid, dir, []string{"dir"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = clnt.Symlink(dir, "l", "a", p.NOUID); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	lfid := clnt.FidAlloc()
+	if _, err = clnt.Walk(dir, lfid, []string{"l"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if target, err := clnt.Readlink(lfid); err != nil || target != "a" {
+		t.Errorf("Readlink: got %q, %v, want \"a\"", target, err)
+	}
+	clnt.Clunk(lfid)
+
+	if err = clnt.Renameat(dir, "a", rootfid, "b"); err != nil {
+		t.Fatalf("Renameat: %v", err)
+	}
+	if _, err = os.Stat(path.Join(tmpDir, "b")); err != nil {
+		t.Errorf("Renameat: %v", err)
+	}
+
+	if err = clnt.Unlinkat(dir, "nonexistent", 0); err == nil {
+		t.Errorf("Unlinkat: got nil, want error")
+	} else if e, ok := err.(*p.Error); !ok || e.Errornum != p.ENOENT {
+		t.Errorf("Unlinkat: got %v, want ENOENT", err)
+	}
+	if err = clnt.Unlinkat(dir, "l", 0); err != nil {
+		t.Errorf("Unlinkat: %v", err)
+	}
+
+	if _, err = clnt.Statfs(rootfid); err != nil {
+		t.Errorf("Statfs: %v", err)
+	}
+
+	if err = clnt.Lopen(dir, p.LORDONLY|p.LODIRECTORY); err != nil {
+		t.Fatalf("Lopen: %v", err)
+	}
+	dirfile := NewFile(dir, 0)
+	d, err := dirfile.ReadDirents(0)
+	if err != nil {
+		t.Fatalf("ReadDirents: %v", err)
+	}
+	if len(d) != 2 || d[0].Name != "." || d[1].Name != ".." {
+		t.Errorf("ReadDirents: got %v, want . and ..", d)
+	}
+	if _, err = dirfile.ReadDirents(0); err != io.EOF {
+		t.Errorf("ReadDirents: got %v, want EOF", err)
+	}
+	dirfile.Close()
+
+	// a server that doesn't support 9P2000.L should get us 9P2000.u
+	ufs.Dotl = false
+	conn, err := net.Dial("unix", srvAddr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	uclnt, err := Connect(conn, 8192, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer uclnt.Unmount()
+	if uclnt.Dialect != p.Dialect9P2000u {
+		t.Errorf("Dialect: got %v, want 9P2000.u", uclnt.Dialect)
+	}
+}
+
+// The 9P2000 operations work on 9P2000.L connections.
+func TestDotlCompat(t *testing.T) {
+	_, clnt, tmpDir, _ := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	defer clnt.Unmount()
+
+	var err error
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	if clnt.Root, err = clnt.Attach(nil, user, ""); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	f, err := clnt.FCreate("f", 0640, p.ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	f.Close()
+	if _, err = clnt.FCreate("f", 0640, p.ORDWR); err == nil {
+		t.Errorf("FCreate: created the existing file")
+	}
+
+	d, err := clnt.FStat("f")
+	if err != nil || d.Name != "f" || d.Length != 5 || d.Mode != 0640 {
+		t.Fatalf("FStat: got %v, %v", d, err)
+	}
+
+	// the file is truncated, its mode changed and renamed
+	fid, err := clnt.FWalk("f")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	d = p.NewWstatDir()
+	d.Mode = 0600
+	d.Length = 2
+	d.Name = "g"
+	if err = clnt.Wstat(fid, d); err != nil {
+		t.Errorf("Wstat: %v", err)
+	}
+	if st, err := os.Stat(path.Join(tmpDir, "g")); err != nil || st.Size() != 2 || st.Mode() != 0600 {
+		t.Errorf("Wstat: got %v, %v", st, err)
+	}
+	if d, err = clnt.Stat(fid); err != nil || d.Name != "g" {
+		t.Errorf("Stat: got %v, %v", d, err)
+	}
+	clnt.Clunk(fid)
+
+	f, err = clnt.FOpen("g", p.OWRITE|p.OTRUNC)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	f.Close()
+	if st, err := os.Stat(path.Join(tmpDir, "g")); err != nil || st.Size() != 0 {
+		t.Errorf("FOpen: got %v, %v, want the file truncated", st, err)
+	}
+
+	// the directories and the symlinks are created too
+	f, err = clnt.FCreate("d", p.DMDIR|0750, p.OREAD)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+	dfid, err := clnt.FWalk(".")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	if err = clnt.Create(dfid, "l", p.DMSYMLINK|0777, p.OREAD, "g"); err != nil {
+		t.Errorf("Create: %v", err)
+	}
+	clnt.Clunk(dfid)
+	if d, err = clnt.FStat("l"); err != nil || d.Mode&p.DMSYMLINK == 0 || d.Ext != "g" {
+		t.Errorf("FStat: got %v, %v, want the symlink to g", d, err)
+	}
+
+	f, err = clnt.FOpen(".", p.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	dirs, err := f.Readdir(0)
+	f.Close()
+	if err != nil && err != io.EOF {
+		t.Fatalf("Readdir: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, d := range dirs {
+		names[d.Name] = true
+	}
+	if len(dirs) != 3 || !names["d"] || !names["g"] || !names["l"] {
+		t.Errorf("Readdir: got %v, want d, g and l", dirs)
+	}
+}
+
+func TestLock(t *testing.T) {
+	_, clnt, tmpDir, _ := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	defer clnt.Unmount()
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	if _, err := clnt.Attach(nil, user, "/"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "f"), []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	open := func() *File {
+		fid, err := clnt.FWalk("f")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = clnt.Lopen(fid, p.LORDWR); err != nil {
+			t.Fatalf("Lopen: %v", err)
+		}
+		return NewFile(fid, 0)
+	}
+
+	f1, f2 := open(), open()
+	wrlck := &p.Flock{Type: p.LockTypeWrlck, Start: 0, Length: 5, ProcId: 1, ClientId: "a"}
+	if status, err := f1.Lock(wrlck); err != nil || status != p.LockSuccess {
+		t.Fatalf("Lock: got %v, %v, want success", status, err)
+	}
+
+	// non-overlapping locks don't conflict
+	if status, err := f2.Lock(&p.Flock{Type: p.LockTypeWrlck, Start: 5, Length: 5}); err != nil || status != p.LockSuccess {
+		t.Errorf("Lock: got %v, %v, want success", status, err)
+	}
+
+	rdlck := &p.Flock{Type: p.LockTypeRdlck, Start: 2, Length: 1, ProcId: 2, ClientId: "b"}
+	if status, err := f2.Lock(rdlck); err != nil || status != p.LockBlocked {
+		t.Errorf("Lock: got %v, %v, want blocked", status, err)
+	}
+
+	fl, err := f2.Getlock(rdlck)
+	if err != nil {
+		t.Fatalf("Getlock: %v", err)
+	}
+	if fl.Type != p.LockTypeWrlck || fl.Start != 0 || fl.Length != 5 || fl.ProcId != 1 || fl.ClientId != "a" {
+		t.Errorf("Getlock: got %+v, want %+v", fl, wrlck)
+	}
+
+	// a blocking lock succeeds once the conflicting lock is released by clunk
+	done := make(chan uint8)
+	go func() {
+		rdlck.Flags = p.LockFlagsBlock
+		status, _ := f2.Lock(rdlck)
+		done <- status
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f1.Close()
+	select {
+	case status := <-done:
+		if status != p.LockSuccess {
+			t.Errorf("Lock: got %v, want success", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lock: blocked lock not granted after clunk")
+	}
+
+	if fl, err = f2.Getlock(&p.Flock{Type: p.LockTypeWrlck, Start: 0, Length: 5, ProcId: 2, ClientId: "b"}); err != nil || fl.Type != p.LockTypeUnlck {
+		t.Errorf("Getlock: got %+v, %v, want unlocked", fl, err)
+	}
+	f2.Close()
+
+	// the locks are owned by the process, not by the fid
+	f1, f2 = open(), open()
+	wrlck = &p.Flock{Type: p.LockTypeWrlck, Start: 0, Length: 5, ProcId: 3, ClientId: "c"}
+	if status, err := f1.Lock(wrlck); err != nil || status != p.LockSuccess {
+		t.Fatalf("Lock: got %v, %v, want success", status, err)
+	}
+	if status, err := f2.Lock(wrlck); err != nil || status != p.LockSuccess {
+		t.Errorf("Lock: same owner, other fid: got %v, %v, want success", status, err)
+	}
+	if status, err := f2.Lock(&p.Flock{Type: p.LockTypeWrlck, Start: 0, Length: 5, ProcId: 4, ClientId: "c"}); err != nil || status != p.LockBlocked {
+		t.Errorf("Lock: other owner: got %v, %v, want blocked", status, err)
+	}
+	f1.Close()
+	f2.Close()
+}
+
+func TestXattr(t *testing.T) {
+	_, clnt, tmpDir, _ := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	defer clnt.Unmount()
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	if _, err := clnt.Attach(nil, user, "/"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "f"), nil, 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fid, err := clnt.FWalk("f")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clnt.Clunk(fid)
+
+	value := []byte("some value")
+	if err := clnt.SetXattr(fid, "user.go9p", value, 0); err != nil {
+		if perr, ok := err.(*p.Error); ok && perr.Errornum == p.EOPNOTSUPP {
+			t.Skipf("extended attributes not supported in %v", tmpDir)
+		}
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	v, err := clnt.GetXattr(fid, "user.go9p")
+	if err != nil || string(v) != string(value) {
+		t.Errorf("GetXattr: got %q, %v, want %q", v, err, value)
+	}
+
+	names, err := clnt.ListXattr(fid)
+	if err != nil {
+		t.Fatalf("ListXattr: %v", err)
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "user.go9p"
+	}
+	if !found {
+		t.Errorf("ListXattr: got %v, want user.go9p", names)
+	}
+
+	if err := clnt.RemoveXattr(fid, "user.go9p"); err != nil {
+		t.Errorf("RemoveXattr: %v", err)
+	}
+	if _, err := clnt.GetXattr(fid, "user.go9p"); err == nil {
+		t.Errorf("GetXattr: attribute still present after RemoveXattr")
+	}
+}
+
+// A server that never responds to Tread with offset 0. A Tread
+// with offset 1 is responded to only when it is flushed, before
+// Rflush is sent.
+func flushServer(t *testing.T, c net.Conn, flushed chan uint16) {
+	pending := make(map[uint16]*p.Fcall)
+	for {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		sz, _ := p.Gint32(buf)
+		buf = append(buf, make([]byte, sz-4)...)
+		if _, err := io.ReadFull(c, buf[4:]); err != nil {
+			return
+		}
+		tc, err, _ := p.Unpack(buf, p.Dialect9P2000)
+		if err != nil {
+			t.Errorf("Unpack: %v", err)
+			return
+		}
+
+		var out []*p.Fcall
+		rc := p.NewFcall(8192)
+		switch tc.Type {
+		case p.Tversion:
+			p.PackRversion(rc, tc.Msize, "9P2000")
+		case p.Tread:
+			pending[tc.Tag] = tc
+			continue
+		case p.Tflush:
+			if old, ok := pending[tc.Oldtag]; ok && old.Offset == 1 {
+				r := p.NewFcall(8192)
+				p.PackRread(r, []byte("data"))
+				p.SetTag(r, tc.Oldtag)
+				out = append(out, r)
+			}
+			delete(pending, tc.Oldtag)
+			p.PackRflush(rc)
+			flushed <- tc.Oldtag
+		case p.Tclunk:
+			p.PackRclunk(rc)
+		}
+		p.SetTag(rc, tc.Tag)
+		for _, fc := range append(out, rc) {
+			if _, err := c.Write(fc.Pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestRpcContext(t *testing.T) {
+	c, s := net.Pipe()
+	flushed := make(chan uint16, 2)
+	go flushServer(t, s, flushed)
+	defer s.Close()
+
+	clnt, err := Connect(c, 8192, false)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer clnt.Unmount()
+
+	fid := clnt.FidAlloc()
+	fid.Iounit = 1024
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := clnt.ReadContext(ctx, fid, 0, 16); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-flushed:
+	default:
+		t.Errorf("ReadContext: request not flushed")
+	}
+
+	// the response that arrives before Rflush is honored
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	data, err := clnt.ReadContext(ctx, fid, 1, 16)
+	if err != nil || string(data) != "data" {
+		t.Errorf("ReadContext: got %q, %v, want \"data\"", data, err)
+	}
+	<-flushed
+
+	// the client is still usable
+	tc := clnt.NewFcall()
+	p.PackTclunk(tc, fid.Fid)
+	if _, err := clnt.Rpc(tc); err != nil {
+		t.Errorf("Rpc: %v", err)
+	}
+
+	// cancelled context doesn't send anything
+	if _, err := clnt.ReadContext(ctx, fid, 0, 16); err != context.Canceled {
+		t.Errorf("ReadContext: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	_, clnt, tmpDir, srvAddr := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	clnt.Unmount()
+
+	var conn net.Conn
+	dial := func() (net.Conn, error) {
+		c, err := net.Dial("unix", srvAddr)
+		conn = c
+		return c, err
+	}
+
+	if err := ioutil.WriteFile(path.Join(tmpDir, "f"), []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	rc, err := DialReconnect(dial, "/", 8192, p.Dialect9P2000u, user)
+	if err != nil {
+		t.Fatalf("DialReconnect: %v", err)
+	}
+	defer rc.Unmount()
+	rc.Backoff = time.Millisecond
+
+	f, err := rc.FOpen("f", p.ORDWR)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	buf := make([]byte, 5)
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "01234" {
+		t.Fatalf("Read: got %q, %v, want \"01234\"", buf[:n], err)
+	}
+
+	// the file is reopened and the read replayed on the new connection
+	conn.Close()
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "56789" {
+		t.Errorf("Read after reconnect: got %q, %v, want \"56789\"", buf[:n], err)
+	}
+
+	conn.Close()
+	if _, err := f.WriteAt([]byte("abc"), 0); err != nil {
+		t.Errorf("WriteAt after reconnect: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(tmpDir, "f")); string(b) != "abc3456789" {
+		t.Errorf("WriteAt: file contains %q, want \"abc3456789\"", b)
+	}
+
+	// requests that can't be replayed fail
+	conn.Close()
+	if _, err := rc.FCreate("g", 0600, p.OWRITE); err != Ereplay {
+		t.Errorf("FCreate: got %v, want %v", err, Ereplay)
+	}
+	if _, err := rc.FStat("f"); err != nil {
+		t.Errorf("FStat: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	_, clnt, tmpDir, srvAddr := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	defer clnt.Unmount()
+
+	if err := os.MkdirAll(path.Join(tmpDir, "dir", "sub"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	files := map[string]string{"a": "file a", "dir/b": "file b", "dir/sub/c": ""}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(tmpDir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	for _, dialect := range []p.Dialect{p.Dialect9P2000L, p.Dialect9P2000u} {
+		c, err := net.Dial("unix", srvAddr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		clnt, err := ConnectDialect(c, 8192, dialect)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer clnt.Unmount()
+		if _, err := clnt.Attach(nil, user, "/"); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		fsys := clnt.FS()
+		if err := fstest.TestFS(fsys, "a", "dir/b", "dir/sub/c"); err != nil {
+			t.Errorf("%v: %v", dialect, err)
+		}
+
+		if data, err := fsys.ReadFile("dir/b"); err != nil || string(data) != "file b" {
+			t.Errorf("%v: ReadFile: got %q, %v, want \"file b\"", dialect, data, err)
+		}
+		if _, err := fsys.Stat("nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%v: Stat: got %v, want %v", dialect, err, fs.ErrNotExist)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	_, lclnt, tmpDir, srvAddr := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	lclnt.Unmount()
+
+	c, err := net.Dial("unix", srvAddr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clnt, err := ConnectDialect(c, 8192, p.Dialect9P2000u)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clnt.Unmount()
+	if _, err := clnt.Attach(nil, p.OsUsers.Uid2User(os.Geteuid()), "/"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	clnt.Cache = NewCache(4*cacheBlockSize, 0)
+
+	fname := path.Join(tmpDir, "f")
+	data := make([]byte, 3*cacheBlockSize-100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	f, err := clnt.FOpen("f", p.ORDWR)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(data))
+	for i := 0; i < 2; i++ {
+		if n, err := f.Readn(buf, 0); err != nil || n != len(data) || !bytes.Equal(buf[:n], data) {
+			t.Errorf("Readn: got %d, %v, want %d", n, err, len(data))
+		}
+	}
+	if st := clnt.Cache.Stats(); st.Misses != 3 || st.Hits < 3 {
+		t.Errorf("got %d hits, %d misses, want 3 misses", st.Hits, st.Misses)
+	}
+
+	// the writes update the cached data
+	if n, err := f.WriteAt([]byte("hello"), cacheBlockSize-2); err != nil || n != 5 {
+		t.Errorf("WriteAt: got %d, %v", n, err)
+	}
+	copy(data[cacheBlockSize-2:], "hello")
+	misses := clnt.Cache.Stats().Misses
+	if n, err := f.Readn(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("Readn after write: got %d, %v", n, err)
+	}
+	if st := clnt.Cache.Stats(); st.Misses != misses {
+		t.Errorf("Readn after write: got %d misses, want %d", st.Misses, misses)
+	}
+	if d, err := clnt.FStat("f"); err != nil || d.Length != uint64(len(data)) {
+		t.Errorf("FStat: got %v, %v", d, err)
+	}
+	hits := clnt.Cache.Stats().StatHits
+	if _, err := clnt.FStat("f"); err != nil || clnt.Cache.Stats().StatHits != hits+1 {
+		t.Errorf("FStat: the Dir wasn't cached: %v", err)
+	}
+
+	// the data is read again once walk returns a new version
+	copy(data, "changed on the server")
+	if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n, err := f.Readn(buf, 0); err != nil || bytes.Equal(buf[:n], data) {
+		t.Errorf("Readn: the cached data wasn't used")
+	}
+	if d, err := clnt.FStat("f"); err != nil || d.Mtime != uint32(mtime.Unix()) {
+		t.Errorf("FStat: got %v, %v", d, err)
+	}
+	if n, err := f.Readn(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("Readn: got stale data after the version changed: %d, %v", n, err)
+	}
+
+	// the size limit
+	big := make([]byte, 8*cacheBlockSize)
+	if err := ioutil.WriteFile(path.Join(tmpDir, "big"), big, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if b, err := clnt.FOpen("big", p.OREAD); err != nil {
+		t.Errorf("FOpen: %v", err)
+	} else {
+		if n, err := b.Readn(make([]byte, len(big)), 0); err != nil || n != len(big) {
+			t.Errorf("Readn: got %d, %v, want %d", n, err, len(big))
+		}
+		b.Close()
+	}
+	if st := clnt.Cache.Stats(); st.Size > clnt.Cache.MaxSize || st.Evictions == 0 {
+		t.Errorf("got size %d, %d evictions, want at most %d", st.Size, st.Evictions, clnt.Cache.MaxSize)
+	}
+
+	// the TTL
+	clnt.Cache.Purge()
+	clnt.Cache.TTL = 50 * time.Millisecond
+	f.Readn(buf, 0)
+	time.Sleep(100 * time.Millisecond)
+	misses = clnt.Cache.Stats().Misses
+	f.Readn(buf, 0)
+	if st := clnt.Cache.Stats(); st.Misses != misses+3 {
+		t.Errorf("TTL: got %d misses, want %d", st.Misses, misses+3)
+	}
+}
+
+// Test server with a single slow file, counts the outstanding and
+// the flushed requests. The reads and writes starting after block
+// (if not zero) wait until they are flushed.
+type raSrv struct {
+	srv.Srv
+	sync.Mutex
+	size        int
+	block       uint64
+	outstanding int
+	max         int
+	flushed     int
+	written     int
+}
+
+func (s *raSrv) Attach(req *srv.Req) { req.RespondRattach(&p.Qid{Type: p.QTFILE}) }
+func (s *raSrv) Walk(req *srv.Req)   { req.RespondRwalk(nil) }
+func (s *raSrv) Open(req *srv.Req)   { req.RespondRopen(&p.Qid{Type: p.QTFILE}, 0) }
+func (s *raSrv) Create(req *srv.Req) { req.RespondError(srv.Enotimpl) }
+func (s *raSrv) Clunk(req *srv.Req)  { req.RespondRclunk() }
+func (s *raSrv) Remove(req *srv.Req) { req.RespondError(srv.Enotimpl) }
+func (s *raSrv) Stat(req *srv.Req)   { req.RespondError(srv.Enotimpl) }
+func (s *raSrv) Wstat(req *srv.Req)  { req.RespondError(srv.Enotimpl) }
+
+// Waits before the request is processed, returns the error
+// if the request is flushed.
+func (s *raSrv) delay(req *srv.Req) error {
+	s.Lock()
+	s.outstanding++
+	if s.outstanding > s.max {
+		s.max = s.outstanding
+	}
+	delay := 20 * time.Millisecond
+	if s.block != 0 && req.Tc.Offset > s.block {
+		delay = time.Hour
+	}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.outstanding--
+		s.Unlock()
+	}()
+
+	ctx := req.Context()
+	select {
+	case <-ctx.Done():
+		s.Lock()
+		s.flushed++
+		s.Unlock()
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+
+	return nil
+}
+
+func (s *raSrv) Read(req *srv.Req) {
+	if err := s.delay(req); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	tc := req.Tc
+	rc := req.Rc
+	p.InitRread(rc, tc.Count)
+	n := 0
+	for off := int(tc.Offset); n < int(tc.Count) && off < s.size; off++ {
+		rc.Data[n] = byte(off % 251)
+		n++
+	}
+	p.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+func (s *raSrv) Write(req *srv.Req) {
+	if err := s.delay(req); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	s.Lock()
+	s.written += len(req.Tc.Data)
+	s.Unlock()
+	req.RespondRwrite(req.Tc.Count)
+}
+
+func TestReadAhead(t *testing.T) {
+	s := &raSrv{size: 100000}
+	s.Id = "readahead"
+	s.Msize = 8192
+	s.Start(s)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	defer l.Close()
+	go s.StartListener(l)
+
+	clnt, err := Mount("unix", l.Addr().String(), "", 8192, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer clnt.Unmount()
+
+	if err = clnt.Open(clnt.Root, p.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	f := NewFile(clnt.Root, 0)
+	f.SetReadAhead(4)
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil || len(data) != s.size {
+		t.Fatalf("ReadAll: got %d bytes, %v, want %d", len(data), err, s.size)
+	}
+	for i, b := range data {
+		if b != byte(i%251) {
+			t.Fatalf("ReadAll: wrong data at offset %d", i)
+		}
+	}
+	s.Lock()
+	if s.max < 4 {
+		t.Errorf("got %d outstanding reads, want 4", s.max)
+	}
+	s.Unlock()
+
+	// seeking flushes the outstanding reads
+	buf := make([]byte, 100)
+	s.Lock()
+	s.block = 1000
+	s.Unlock()
+	f.Seek(0, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := f.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if _, err := f.Seek(50000, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.Lock()
+		flushed := s.flushed
+		s.Unlock()
+		if flushed == 3 {
+			break
+		}
+
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("Seek: the outstanding reads weren't flushed")
+			break
+		}
+	}
+
+	s.Lock()
+	s.block = 0
+	s.Unlock()
+	if n, err := io.ReadFull(f, buf); err != nil || n != len(buf) {
+		t.Fatalf("ReadFull: got %d, %v", n, err)
+	}
+	for i, b := range buf {
+		if b != byte((50000+i)%251) {
+			t.Fatalf("Read after Seek: wrong data at offset %d", 50000+i)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	s := &raSrv{}
+	s.Id = "writebehind"
+	s.Msize = 8192
+	s.Start(s)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	defer l.Close()
+	go s.StartListener(l)
+
+	clnt, err := Mount("unix", l.Addr().String(), "", 8192, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer clnt.Unmount()
+
+	for _, mode := range []uint8{p.OWRITE, p.OWRITE | p.OAPPEND} {
+		fid := clnt.FidAlloc()
+		if _, err := clnt.Walk(clnt.Root, fid, nil); err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		if err := clnt.Open(fid, mode); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+
+		s.Lock()
+		s.max = 0
+		s.written = 0
+		s.Unlock()
+
+		f := NewFile(fid, 0)
+		f.SetWriteBehind(1 << 20)
+		data := make([]byte, 8*fid.Iounit)
+		if n, err := f.Write(data); err != nil || n != len(data) {
+			t.Errorf("Write: got %d, %v, want %d", n, err, len(data))
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+
+		want := 8
+		if mode&p.OAPPEND != 0 {
+			want = 1
+		}
+		s.Lock()
+		if s.written != len(data) || s.max != want {
+			t.Errorf("mode %#x: got %d bytes written, %d outstanding, want %d, %d", mode, s.written, s.max, len(data), want)
+		}
+		s.Unlock()
+	}
+}
+
+func TestWriteBehindError(t *testing.T) {
+	_, lclnt, tmpDir, srvAddr := dotlConnect(t)
+	defer os.RemoveAll(tmpDir)
+	lclnt.Unmount()
+
+	c, err := net.Dial("unix", srvAddr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clnt, err := ConnectDialect(c, 8192, p.Dialect9P2000u)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer clnt.Unmount()
+	if _, err := clnt.Attach(nil, p.OsUsers.Uid2User(os.Geteuid()), "/"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	f, err := clnt.FCreate("f", 0644, p.ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.SetWriteBehind(4 * 8192)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for n := 0; n < len(data); n += 1000 {
+		if _, err := f.Write(data[n : n+1000]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// the reads wait for the writes
+	buf := make([]byte, len(data))
+	if n, err := f.Readn(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("Readn: got %d, %v, want %d", n, err, len(data))
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("Sync: %v", err)
+	}
+	f.Close()
+
+	// the error is reported by Sync
+	f, err = clnt.FOpen("f", p.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	defer f.Close()
+	f.SetWriteBehind(8192)
+	if _, err := f.Write(data); err != nil {
+		t.Errorf("Write: got %v, want nil", err)
+	}
+	if err := f.Sync(); err == nil {
+		t.Errorf("Sync: got nil, want error")
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("Sync: the error was reported twice: %v", err)
+	}
+}
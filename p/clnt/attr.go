@@ -0,0 +1,112 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "github.com/lionkov/go9p/p"
+
+// Returns the attributes of the file associated with the Fid, or an
+// Error. The mask is a combination of p.Getattr* values and specifies
+// the attributes the client is interested in. Requires 9P2000.L.
+func (clnt *Clnt) Getattr(fid *Fid, mask uint64) (*p.Attr, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTgetattr(tc, fid.Fid, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Attr, nil
+}
+
+// Modifies the attributes of the file associated with the Fid. Only
+// the attributes specified in sa.Valid are changed. Requires 9P2000.L.
+func (clnt *Clnt) Setattr(fid *Fid, sa *p.SetAttr) error {
+	tc := clnt.NewFcall()
+	err := p.PackTsetattr(tc, fid.Fid, sa)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
+
+// Returns the information about the file system that contains the file
+// associated with the Fid, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Statfs(fid *Fid) (*p.Statfs, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTstatfs(tc, fid.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Statfs, nil
+}
+
+// Flushes the content of the file associated with the (opened) Fid to
+// the storage. If datasync is true, only the data is flushed. Requires
+// 9P2000.L.
+func (clnt *Clnt) Fsync(fid *Fid, datasync bool) error {
+	var ds uint32
+
+	if datasync {
+		ds = 1
+	}
+
+	tc := clnt.NewFcall()
+	err := p.PackTfsync(tc, fid.Fid, ds)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
+
+// Returns the target of the symbolic link associated with the Fid,
+// or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Readlink(fid *Fid) (string, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTreadlink(tc, fid.Fid)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.Target, nil
+}
+
+// Returns the attributes of the File, or an Error.
+func (file *File) Getattr(mask uint64) (*p.Attr, error) {
+	return file.fid.Clnt.Getattr(file.fid, mask)
+}
+
+// Modifies the attributes of the File.
+func (file *File) Setattr(sa *p.SetAttr) error {
+	return file.fid.Clnt.Setattr(file.fid, sa)
+}
+
+// Returns the information about the file system the File is on, or an Error.
+func (file *File) Statfs() (*p.Statfs, error) {
+	return file.fid.Clnt.Statfs(file.fid)
+}
+
+// Flushes the content of the File to the storage.
+func (file *File) Fsync(datasync bool) error {
+	return file.fid.Clnt.Fsync(file.fid, datasync)
+}
@@ -0,0 +1,392 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Size of the data blocks kept in the cache.
+const cacheBlockSize = 8192
+
+// Approximate size of a cached Dir, not including the strings.
+const cacheDirSize = 64
+
+// The CacheStats type contains the counters of a Cache.
+type CacheStats struct {
+	Hits       uint64 // data blocks found in the cache
+	Misses     uint64 // data blocks read from the server
+	StatHits   uint64 // Dirs found in the cache
+	StatMisses uint64 // Dirs read from the server
+	Evictions  uint64 // blocks and Dirs evicted because of the size limit
+	Size       int64  // bytes currently cached
+}
+
+type cacheKey struct {
+	path  uint64
+	block int64 // -1 for the Dir of the file
+}
+
+type cacheItem struct {
+	key  cacheKey
+	data []byte
+	dir  *p.Dir
+	size int64
+	time time.Time // when the item was read from the server
+}
+
+type cacheFile struct {
+	version   uint32
+	written   bool      // modified by the client, adopt the next version seen
+	validated time.Time // when the version was last confirmed by the server
+	items     map[int64]*list.Element
+}
+
+// The Cache type keeps the data blocks and the metadata of the files
+// read by a client. The files are identified by Qid.Path. When the client
+// sees a Qid from walk, open or stat with a different Version, the data
+// for the file is dropped. The cached data is not used after TTL unless
+// the Version was confirmed again. Servers that don't change the Version
+// when the file is modified should set a short TTL. The least recently used
+// items are evicted when the cache grows larger than MaxSize bytes. The
+// writes are sent to the server and update the cached blocks.
+//
+// Only regular files are cached. A Cache can't be shared between
+// clients connected to different servers.
+type Cache struct {
+	sync.Mutex
+	MaxSize int64         // maximum number of bytes cached
+	TTL     time.Duration // if not zero, how long the cached data is used without revalidation
+
+	size  int64
+	lru   *list.List // most recently used items at the front
+	files map[uint64]*cacheFile
+	stats CacheStats
+}
+
+// Creates a cache that keeps up to maxsize bytes for ttl (no limit if zero).
+// The cache is used after it is assigned to Clnt.Cache.
+func NewCache(maxsize int64, ttl time.Duration) *Cache {
+	return &Cache{
+		MaxSize: maxsize,
+		TTL:     ttl,
+		lru:     list.New(),
+		files:   make(map[uint64]*cacheFile),
+	}
+}
+
+// Returns the counters of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	st := c.stats
+	st.Size = c.size
+	return st
+}
+
+// Drops all cached data.
+func (c *Cache) Purge() {
+	c.Lock()
+	c.lru.Init()
+	c.files = make(map[uint64]*cacheFile)
+	c.size = 0
+	c.Unlock()
+}
+
+// Returns true if the data of the file can be cached.
+func cacheable(qid *p.Qid) bool {
+	return qid.Type&(p.QTDIR|p.QTAPPEND|p.QTEXCL|p.QTAUTH) == 0
+}
+
+// Checks the cached data against the Qid returned by the server.
+// Should be called with the lock held.
+func (c *Cache) validate(qid *p.Qid) {
+	f := c.files[qid.Path]
+	if f == nil {
+		return
+	}
+
+	if f.version != qid.Version && !f.written {
+		c.remove(qid.Path)
+		return
+	}
+
+	f.version = qid.Version
+	f.written = false
+	f.validated = time.Now()
+}
+
+// Removes the file from the cache. Should be called with the lock held.
+func (c *Cache) remove(path uint64) {
+	f := c.files[path]
+	if f == nil {
+		return
+	}
+
+	for _, e := range f.items {
+		c.lru.Remove(e)
+		c.size -= e.Value.(*cacheItem).size
+	}
+	delete(c.files, path)
+}
+
+func (c *Cache) removeItem(f *cacheFile, e *list.Element) {
+	it := e.Value.(*cacheItem)
+	c.lru.Remove(e)
+	c.size -= it.size
+	delete(f.items, it.key.block)
+	if len(f.items) == 0 {
+		delete(c.files, it.key.path)
+	}
+}
+
+// Returns the cached item, or nil if it's not cached or expired.
+// Should be called with the lock held.
+func (c *Cache) get(key cacheKey) *cacheItem {
+	f := c.files[key.path]
+	if f == nil {
+		return nil
+	}
+
+	e := f.items[key.block]
+	if e == nil {
+		return nil
+	}
+
+	it := e.Value.(*cacheItem)
+	if c.TTL != 0 {
+		t := it.time
+		if f.validated.After(t) {
+			t = f.validated
+		}
+
+		if time.Since(t) >= c.TTL {
+			c.removeItem(f, e)
+			return nil
+		}
+	}
+
+	c.lru.MoveToFront(e)
+	return it
+}
+
+// Adds the item to the cache and evicts the least recently used items
+// if the cache is too big. Should be called with the lock held.
+func (c *Cache) put(qid *p.Qid, it *cacheItem) {
+	f := c.files[qid.Path]
+	if f == nil {
+		f = &cacheFile{version: qid.Version, items: make(map[int64]*list.Element)}
+		c.files[qid.Path] = f
+	}
+
+	if e := f.items[it.key.block]; e != nil {
+		c.removeItem(f, e)
+		c.files[qid.Path] = f
+	}
+
+	it.time = time.Now()
+	f.items[it.key.block] = c.lru.PushFront(it)
+	c.size += it.size
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		c.removeItem(c.files[e.Value.(*cacheItem).key.path], e)
+		c.stats.Evictions++
+	}
+}
+
+// Returns a copy of the cached Dir for the file, or nil.
+func (c *Cache) dir(qid *p.Qid) *p.Dir {
+	c.Lock()
+	defer c.Unlock()
+	it := c.get(cacheKey{qid.Path, -1})
+	if it == nil {
+		c.stats.StatMisses++
+		return nil
+	}
+
+	c.stats.StatHits++
+	d := *it.dir
+	return &d
+}
+
+func (c *Cache) setDir(d *p.Dir) {
+	c.Lock()
+	defer c.Unlock()
+	c.validate(&d.Qid)
+	dd := *d
+	size := int64(cacheDirSize + len(d.Name) + len(d.Uid) + len(d.Gid) + len(d.Muid) + len(d.Ext))
+	c.put(&d.Qid, &cacheItem{key: cacheKey{d.Qid.Path, -1}, dir: &dd, size: size})
+}
+
+// Returns the cached data block, or nil.
+func (c *Cache) block(qid *p.Qid, block int64) []byte {
+	c.Lock()
+	defer c.Unlock()
+	it := c.get(cacheKey{qid.Path, block})
+	if it == nil {
+		c.stats.Misses++
+		return nil
+	}
+
+	c.stats.Hits++
+	return it.data
+}
+
+func (c *Cache) setBlock(qid *p.Qid, block int64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.put(qid, &cacheItem{key: cacheKey{qid.Path, block}, data: data, size: int64(len(data))})
+}
+
+// Updates the cached blocks with the data written to the file. The
+// blocks that can't be updated are dropped, as is the Dir of the file.
+func (c *Cache) write(qid *p.Qid, offset uint64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	f := c.files[qid.Path]
+	if f == nil {
+		return
+	}
+
+	f.written = true
+	off := int64(offset)
+	end := off + int64(len(data))
+	for _, e := range f.items {
+		it := e.Value.(*cacheItem)
+		if it.key.block < 0 {
+			c.removeItem(f, e)
+			continue
+		}
+
+		// the block is shorter than the file now, drop it
+		bstart := it.key.block * cacheBlockSize
+		blen := int64(len(it.data))
+		if blen < cacheBlockSize && bstart+blen < off {
+			c.removeItem(f, e)
+			continue
+		}
+
+		if end <= bstart || off >= bstart+cacheBlockSize {
+			continue
+		}
+
+		s := off - bstart
+		if s < 0 {
+			s = 0
+		}
+
+		n := end - bstart
+		if n > cacheBlockSize {
+			n = cacheBlockSize
+		}
+
+		if n > blen {
+			b := make([]byte, n)
+			copy(b, it.data)
+			it.data = b
+			it.size = n
+			c.size += n - blen
+		} else {
+			// don't modify the slices returned to readers
+			it.data = append([]byte(nil), it.data...)
+		}
+
+		copy(it.data[s:n], data[bstart+s-off:])
+	}
+
+	if len(f.items) == 0 {
+		delete(c.files, qid.Path)
+	}
+}
+
+// Drops the data of the file.
+func (c *Cache) invalidate(qid *p.Qid) {
+	c.Lock()
+	c.remove(qid.Path)
+	c.Unlock()
+}
+
+// Reads the block from the server. A short read is treated as
+// the end of the file.
+func (c *Cache) fetch(ctx context.Context, fid *Fid, block int64) ([]byte, error) {
+	data := make([]byte, 0, cacheBlockSize)
+	offset := uint64(block * cacheBlockSize)
+	for len(data) < cacheBlockSize {
+		count := uint32(cacheBlockSize - len(data))
+		b, err := fid.Clnt.ReadContext(ctx, fid, offset+uint64(len(data)), count)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, b...)
+		if count > fid.Iounit {
+			count = fid.Iounit
+		}
+
+		if len(b) == 0 || uint32(len(b)) < count {
+			break
+		}
+	}
+
+	c.setBlock(&fid.Qid, block, data)
+	return data, nil
+}
+
+// Reads from the cache, the missing blocks are read from the server.
+func (c *Cache) readAt(ctx context.Context, fid *Fid, buf []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(buf) {
+		off := offset + int64(n)
+		block := off / cacheBlockSize
+		data := c.block(&fid.Qid, block)
+		if data == nil {
+			var err error
+			data, err = c.fetch(ctx, fid, block)
+			if err != nil {
+				if n > 0 {
+					break
+				}
+
+				return 0, err
+			}
+		}
+
+		boff := int(off - block*cacheBlockSize)
+		if boff >= len(data) {
+			break
+		}
+
+		n += copy(buf[n:], data[boff:])
+		if len(data) < cacheBlockSize {
+			break
+		}
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// Revalidates the cached data with the Qids returned by the server.
+func (clnt *Clnt) cacheValidate(qids ...p.Qid) {
+	c := clnt.Cache
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	for i := range qids {
+		c.validate(&qids[i])
+	}
+	c.Unlock()
+}
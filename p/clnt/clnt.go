@@ -7,12 +7,14 @@
 package clnt
 
 import (
+	"context"
 	"fmt"
 	"github.com/lionkov/go9p/p"
 	"log"
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 )
 
 // Debug flags
@@ -33,12 +35,14 @@ type StatsOps interface {
 // the files exported by the server.
 type Clnt struct {
 	sync.Mutex
-	Debuglevel int    // =0 don't print anything, >0 print Fcalls, >1 print raw packets
-	Msize      uint32 // Maximum size of the 9P messages
-	Dotu       bool   // If true, 9P2000.u protocol is spoken
-	Root       *Fid   // Fid that points to the rood directory
-	Id         string // Used when printing debug messages
+	Debuglevel int       // =0 don't print anything, >0 print Fcalls, >1 print raw packets
+	Msize      uint32    // Maximum size of the 9P messages
+	Dotu       bool      // If true, 9P2000.u protocol is spoken
+	Dialect    p.Dialect // Protocol dialect spoken on the connection
+	Root       *Fid      // Fid that points to the rood directory
+	Id         string    // Used when printing debug messages
 	Log        *p.Logger
+	Cache      *Cache // If not nil, caches the file data and metadata
 
 	conn     net.Conn
 	tagpool  *pool
@@ -50,7 +54,7 @@ type Clnt struct {
 	err      error
 
 	reqchan chan *Req
-	tchan   chan *p.Fcall
+	fcpool  *p.FcallPool // T messages, sized for the initial Msize
 
 	next, prev *Clnt
 }
@@ -61,11 +65,13 @@ type Fid struct {
 	sync.Mutex
 	Clnt   *Clnt // Client the fid belongs to
 	Iounit uint32
-	p.Qid         // The Qid description for the file
-	Mode   uint8  // Open mode (one of p.O* values) (if file is open)
-	Fid    uint32 // Fid number
-	p.User        // The user the fid belongs to
-	walked bool   // true if the fid points to a walked file on the server
+	p.Qid           // The Qid description for the file
+	Mode   uint8    // Open mode (one of p.O* values) (if file is open)
+	Fid    uint32   // Fid number
+	p.User          // The user the fid belongs to
+	walked bool     // true if the fid points to a walked file on the server
+	root   *Fid     // the attached fid the fid was walked from
+	path   []string // names walked from root, used on 9P2000.L connections
 }
 
 // The file is similar to the Fid, but is used in the high-level client
@@ -73,6 +79,8 @@ type Fid struct {
 type File struct {
 	fid    *Fid
 	offset uint64
+	ra     *readAhead   // if not nil, read-ahead is enabled
+	wb     *writeBehind // if not nil, write-behind is enabled
 }
 
 type pool struct {
@@ -135,21 +143,116 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 }
 
 func (clnt *Clnt) Rpc(tc *p.Fcall) (rc *p.Fcall, err error) {
+	return clnt.RpcContext(context.Background(), tc)
+}
+
+// Sends the request and waits for the response. If the context is
+// cancelled before the response arrives, the request is flushed and
+// ctx.Err() is returned. If the response arrives before the server
+// acknowledges the flush, the request wasn't cancelled and the
+// response is returned.
+func (clnt *Clnt) RpcContext(ctx context.Context, tc *p.Fcall) (rc *p.Fcall, err error) {
+	if err = ctx.Err(); err != nil {
+		clnt.FreeFcall(tc)
+		return
+	}
+
 	r := clnt.ReqAlloc()
 	r.Tc = tc
-	r.Done = make(chan *Req)
+	r.Done = make(chan *Req, 1)
 	err = clnt.Rpcnb(r)
 	if err != nil {
 		return
 	}
 
-	<-r.Done
+	select {
+	case <-r.Done:
+	case <-ctx.Done():
+		if !clnt.flush(r) {
+			err = ctx.Err()
+			clnt.ReqFree(r)
+			return
+		}
+	}
+
 	rc = r.Rc
 	err = r.Err
 	clnt.ReqFree(r)
 	return
 }
 
+// Sends Tflush for the outstanding request r and waits for Rflush.
+// Returns true if the response to r arrived before Rflush (and
+// the request should be treated as completed), false if the
+// request was flushed. The tag of r is not in use when flush returns.
+func (clnt *Clnt) flush(r *Req) bool {
+	fr := clnt.ReqAlloc()
+	fr.Tc = clnt.NewFcall()
+	fr.Done = make(chan *Req, 1)
+	err := p.PackTflush(fr.Tc, r.tag)
+	if err == nil {
+		err = clnt.Rpcnb(fr)
+	}
+
+	if err != nil {
+		// the connection is closed, r will get an error
+		clnt.ReqFree(fr)
+		<-r.Done
+		return true
+	}
+
+	select {
+	case <-r.Done:
+		<-fr.Done
+		clnt.ReqFree(fr)
+		return true
+	case <-fr.Done:
+		clnt.ReqFree(fr)
+	}
+
+	// The responses are processed in order, so if r is still
+	// outstanding, the server won't respond to it anymore.
+	clnt.Lock()
+	var o *Req
+	for o = clnt.reqfirst; o != nil && o != r; o = o.next {
+	}
+
+	if o != nil {
+		clnt.reqUnlink(r)
+	}
+	clnt.Unlock()
+
+	if o == nil {
+		<-r.Done
+		return true
+	}
+
+	return false
+}
+
+// Removes the request from the list of outstanding requests.
+// Should be called with the client locked.
+func (clnt *Clnt) reqUnlink(r *Req) {
+	switch {
+	case r.next == nil && r.prev == nil:
+		clnt.reqlast = nil
+		clnt.reqfirst = nil
+	case r.next == nil:
+		clnt.reqlast = r.prev
+		r.prev.next = nil
+		r.prev = nil
+	case r.prev == nil:
+		clnt.reqfirst = r.next
+		r.next.prev = nil
+		r.next = nil
+	default:
+		r.next.prev = r.prev
+		r.prev.next = r.next
+		r.next = nil
+		r.prev = nil
+	}
+}
+
 func (clnt *Clnt) recv() {
 	var err error
 	var buf []byte
@@ -189,7 +292,7 @@ func (clnt *Clnt) recv() {
 				break
 			}
 
-			fc, err, fcsize := p.Unpack(buf, clnt.Dotu)
+			fc, err, fcsize := p.Unpack(buf, clnt.Dialect)
 			clnt.Lock()
 			if err != nil {
 				clnt.err = err
@@ -224,35 +327,26 @@ func (clnt *Clnt) recv() {
 			}
 
 			r.Rc = fc
-			switch {
-			case r.next == nil && r.prev == nil:
-				clnt.reqlast = nil
-				clnt.reqfirst = nil
-			case r.next == nil:
-				clnt.reqlast = r.prev
-				r.prev.next = nil
-				r.prev = nil
-			case r.prev == nil:
-				clnt.reqfirst = r.next
-				r.next.prev = nil
-				r.next = nil
-			default:
-				r.next.prev = r.prev
-				r.prev.next = r.next
-				r.next = nil
-				r.prev = nil
-			}
+			clnt.reqUnlink(r)
 			clnt.Unlock()
 
 			if r.Tc.Type != r.Rc.Type-1 {
-				if r.Rc.Type != p.Rerror {
-					r.Err = &p.Error{"invalid response", p.EINVAL}
-					log.Println(fmt.Sprintf("TTT %v", r.Tc))
-					log.Println(fmt.Sprintf("RRR %v", r.Rc))
-				} else {
+				switch r.Rc.Type {
+				case p.Rerror:
 					if r.Err == nil {
 						r.Err = &p.Error{r.Rc.Error, r.Rc.Errornum}
 					}
+
+				case p.Rlerror:
+					// 9P2000.L errors are Linux errno values only
+					if r.Err == nil {
+						r.Err = &p.Error{Err: syscall.Errno(r.Rc.Errornum).Error(), Errornum: r.Rc.Errornum}
+					}
+
+				default:
+					r.Err = &p.Error{"invalid response", p.EINVAL}
+					log.Println(fmt.Sprintf("TTT %v", r.Tc))
+					log.Println(fmt.Sprintf("RRR %v", r.Rc))
 				}
 			}
 
@@ -348,6 +442,9 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	clnt.conn = c
 	clnt.Msize = msize
 	clnt.Dotu = dotu
+	if dotu {
+		clnt.Dialect = p.Dialect9P2000u
+	}
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
 	clnt.Id = c.RemoteAddr().String() + ":"
@@ -356,7 +453,7 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
 	clnt.reqchan = make(chan *Req, 16)
-	clnt.tchan = make(chan *p.Fcall, 16)
+	clnt.fcpool = p.NewFcallPool(msize)
 
 	go clnt.recv()
 	go clnt.send()
@@ -381,32 +478,67 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 
 // Establishes a new socket connection to the 9P server and creates
 // a client object for it. Negotiates the dialect and msize for the
-// connection. Returns a Clnt object, or Error.
+// connection. If dotu is true, proposes 9P2000.L and falls back to
+// 9P2000.u and 9P2000, otherwise proposes 9P2000. Returns a Clnt
+// object, or Error.
+//
+// On 9P2000.L connections Open, Create, Stat, Wstat and File.Readdir
+// send the 9P2000.L messages (Tlopen, Tlcreate, Tgetattr, ...) instead
+// of the ones 9P2000.L servers don't support. The data read from a
+// directory with Read is in the Rreaddir format, not the stat format.
 func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
-	clnt := NewClnt(c, msize, dotu)
-	ver := "9P2000"
-	if clnt.Dotu {
-		ver = "9P2000.u"
+	dialect := p.Dialect9P2000
+	if dotu {
+		dialect = p.Dialect9P2000L
 	}
 
-	clntmsize := atomic.LoadUint32(&clnt.Msize)
-	tc := p.NewFcall(clntmsize)
-	err := p.PackTversion(tc, clntmsize, ver)
-	if err != nil {
-		return nil, err
-	}
+	return ConnectDialect(c, msize, dialect)
+}
 
-	rc, err := clnt.Rpc(tc)
-	if err != nil {
-		return nil, err
-	}
+// Establishes a new socket connection to the 9P server and creates a
+// client object for it. Proposes the specified dialect to the server,
+// falling back from 9P2000.L to 9P2000.u to 9P2000 if the server doesn't
+// support it. Returns a Clnt object, or Error.
+func ConnectDialect(c net.Conn, msize uint32, dialect p.Dialect) (*Clnt, error) {
+	clnt := NewClnt(c, msize, dialect.Dotu())
+	for {
+		clnt.Dialect = dialect
+		clntmsize := atomic.LoadUint32(&clnt.Msize)
+		tc := p.NewFcall(clntmsize)
+		err := p.PackTversion(tc, clntmsize, dialect.String())
+		if err != nil {
+			return nil, err
+		}
 
-	if rc.Msize < atomic.LoadUint32(&clnt.Msize) {
-		atomic.StoreUint32(&clnt.Msize, rc.Msize)
-	}
+		rc, err := clnt.Rpc(tc)
+		if err != nil {
+			if dialect == p.Dialect9P2000 {
+				return nil, err
+			}
+
+			dialect--
+			continue
+		}
+
+		// the server can answer with a dialect older than the proposed one
+		d, ok := p.ParseDialect(rc.Version)
+		if !ok || d > dialect {
+			if dialect != p.Dialect9P2000 {
+				dialect--
+				continue
+			}
+
+			d = p.Dialect9P2000
+		}
+
+		if rc.Msize < atomic.LoadUint32(&clnt.Msize) {
+			atomic.StoreUint32(&clnt.Msize, rc.Msize)
+		}
 
-	clnt.Dotu = rc.Version == "9P2000.u" && clnt.Dotu
-	return clnt, nil
+		clnt.Dialect = d
+		clnt.Dotu = d.Dotu()
+		return clnt, nil
+	}
 }
 
 // Creates a new Fid object for the client
@@ -418,23 +550,15 @@ func (clnt *Clnt) FidAlloc() *Fid {
 	return fid
 }
 
+// Returns a Fcall for a T message, recycled if possible.
 func (clnt *Clnt) NewFcall() *p.Fcall {
-	select {
-	case tc := <-clnt.tchan:
-		return tc
-	default:
-	}
-	return p.NewFcall(atomic.LoadUint32(&clnt.Msize))
+	return clnt.fcpool.Get()
 }
 
+// Returns the Fcall of a T message to the client's pool. Called when
+// the request is completed, the Fcall shouldn't be used afterwards.
 func (clnt *Clnt) FreeFcall(fc *p.Fcall) {
-	if false && fc != nil && len(fc.Buf) >= int(atomic.LoadUint32(&clnt.Msize)) {
-		select {
-		case clnt.tchan <- fc:
-			break
-		default:
-		}
-	}
+	clnt.fcpool.Put(fc)
 }
 
 func (clnt *Clnt) ReqAlloc() *Req {
@@ -466,7 +590,7 @@ func (clnt *Clnt) ReqFree(req *Req) {
 }
 
 func NewFile(f *Fid, offset uint64) *File {
-	return &File{f, offset}
+	return &File{fid: f, offset: offset}
 }
 
 func (f *File) Fid() *Fid {
@@ -484,6 +608,12 @@ func (clnt *Clnt) logFcall(fc *p.Fcall) {
 		f := new(p.Fcall)
 		*f = *fc
 		f.Pkt = nil
+
+		// the Fcall and its buffer are recycled
+		f.Buf = nil
+		f.Data = append([]byte(nil), fc.Data...)
+		f.Wname = append([]string(nil), fc.Wname...)
+		f.Wqid = append([]p.Qid(nil), fc.Wqid...)
 		clnt.Log.Log(f, clnt, DbgLogFcalls)
 	}
 }
@@ -11,7 +11,7 @@ func (clnt *Clnt) Clunk(fid *Fid) (err error) {
 	err = nil
 	if fid.walked {
 		tc := clnt.NewFcall()
-		err := p.PackTclunk(tc, fid.Fid)
+		err = p.PackTclunk(tc, fid.Fid)
 		if err != nil {
 			return err
 		}
@@ -27,6 +27,18 @@ func (clnt *Clnt) Clunk(fid *Fid) (err error) {
 
 // Closes a file. Returns nil if successful.
 func (file *File) Close() error {
-	// Should we cancel all pending requests for the File
-	return file.fid.Clnt.Clunk(file.fid)
+	if file.ra != nil {
+		file.ra.reset()
+	}
+
+	var err error
+	if file.wb != nil {
+		err = file.wb.wait()
+	}
+
+	if cerr := file.fid.Clnt.Clunk(file.fid); err == nil {
+		err = cerr
+	}
+
+	return err
 }
@@ -0,0 +1,464 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Unix file types (st_mode) and Linux directory entry types
+const (
+	sIFMT   = 0170000
+	sIFIFO  = 0010000
+	sIFCHR  = 0020000
+	sIFDIR  = 0040000
+	sIFBLK  = 0060000
+	sIFLNK  = 0120000
+	sIFSOCK = 0140000
+	sISUID  = 0004000
+	sISGID  = 0002000
+
+	dtFIFO = 1
+	dtCHR  = 2
+	dtDIR  = 4
+	dtBLK  = 6
+	dtLNK  = 10
+	dtSOCK = 12
+)
+
+// The FS type provides access to the file tree of a file server through
+// the io/fs interfaces. It implements fs.FS, fs.ReadDirFS, fs.StatFS,
+// fs.ReadFileFS and fs.SubFS. The files are opened read-only.
+type FS struct {
+	root  *Fid
+	owned bool // if true, the root fid is clunked by Close
+}
+
+// Returns an FS for the file tree rooted at the file associated
+// with the fid.
+func NewFS(root *Fid) *FS {
+	return &FS{root: root}
+}
+
+// Returns an FS for the file tree rooted at the client's Root.
+func (clnt *Clnt) FS() *FS {
+	return NewFS(clnt.Root)
+}
+
+// Releases the resources of an FS returned by Sub.
+func (fsys *FS) Close() error {
+	if !fsys.owned {
+		return nil
+	}
+
+	return fsys.root.Clnt.Clunk(fsys.root)
+}
+
+// Converts a client error to the error returned by the FS methods.
+func fsError(op, name string, err error) error {
+	if perr, ok := err.(*p.Error); ok {
+		switch perr.Errornum {
+		case p.ENOENT:
+			err = fs.ErrNotExist
+		case p.EPERM, p.EACCES:
+			err = fs.ErrPermission
+		case p.EEXIST:
+			err = fs.ErrExist
+		}
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Walks to the named file. Returns a Fid associated with the file.
+func (fsys *FS) walk(op, name string) (*Fid, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	wpath := name
+	if wpath == "." {
+		wpath = ""
+	}
+
+	fid, err := fsys.root.Clnt.walkPath(context.Background(), fsys.root, wpath)
+	if err != nil {
+		return nil, fsError(op, name, err)
+	}
+
+	return fid, nil
+}
+
+// Returns the metadata of the file associated with the fid. On
+// 9P2000.L connections the attributes are converted to p.Dir.
+func (clnt *Clnt) fstat(fid *Fid, name string) (*p.Dir, error) {
+	if !clnt.Dialect.Dotl() {
+		return clnt.Stat(fid)
+	}
+
+	attr, err := clnt.Getattr(fid, p.GetattrBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	return attr2Dir(path.Base(name), attr), nil
+}
+
+// Converts the 9P2000.L attributes of a file to p.Dir
+func attr2Dir(name string, a *p.Attr) *p.Dir {
+	d := &p.Dir{
+		Qid:     a.Qid,
+		Mode:    a.Mode & 0777,
+		Length:  a.Size,
+		Atime:   uint32(a.Atime.Sec),
+		Mtime:   uint32(a.Mtime.Sec),
+		Name:    name,
+		Uidnum:  a.Uid,
+		Gidnum:  a.Gid,
+		Muidnum: p.NOUID,
+	}
+
+	switch a.Mode & sIFMT {
+	case sIFDIR:
+		d.Mode |= p.DMDIR
+	case sIFLNK:
+		d.Mode |= p.DMSYMLINK
+	case sIFIFO:
+		d.Mode |= p.DMNAMEDPIPE
+	case sIFSOCK:
+		d.Mode |= p.DMSOCKET
+	case sIFCHR, sIFBLK:
+		d.Mode |= p.DMDEVICE
+	}
+
+	if a.Mode&sISUID != 0 {
+		d.Mode |= p.DMSETUID
+	}
+
+	if a.Mode&sISGID != 0 {
+		d.Mode |= p.DMSETGID
+	}
+
+	return d
+}
+
+// Opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	fid, err := fsys.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt := fid.Clnt
+	if clnt.Dialect.Dotl() {
+		err = clnt.Lopen(fid, p.LORDONLY)
+	} else {
+		err = clnt.Open(fid, p.OREAD)
+	}
+
+	if err != nil {
+		clnt.Clunk(fid)
+		return nil, fsError("open", name, err)
+	}
+
+	return &fsFile{File: NewFile(fid, 0), fsys: fsys, name: name}, nil
+}
+
+// Returns a FileInfo describing the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	fid, err := fsys.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := fid.Clnt.fstat(fid, name)
+	fid.Clnt.Clunk(fid)
+	if err != nil {
+		return nil, fsError("stat", name, err)
+	}
+
+	return &fileInfo{d, path.Base(name)}, nil
+}
+
+// Reads the named directory and returns its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dirs, err := f.(*fsFile).ReadDir(-1)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
+	return dirs, err
+}
+
+// Reads the named file and returns its contents.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var data []byte
+	buf := make([]byte, f.(*fsFile).fid.Iounit)
+	for {
+		n, err := f.Read(buf)
+		data = append(data, buf[0:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// Returns an FS corresponding to the subtree rooted at dir. The
+// returned FS should be closed when no longer used.
+func (fsys *FS) Sub(dir string) (fs.FS, error) {
+	fid, err := fsys.walk("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if fid.Qid.Type&p.QTDIR == 0 {
+		fid.Clnt.Clunk(fid)
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	return &FS{root: fid, owned: true}, nil
+}
+
+// The fileInfo type implements fs.FileInfo and fs.DirEntry for p.Dir.
+type fileInfo struct {
+	d    *p.Dir
+	name string
+}
+
+// Converts the 9P2000 file mode to fs.FileMode
+func dir2FileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch {
+	case mode&p.DMDIR != 0:
+		m |= fs.ModeDir
+	case mode&p.DMSYMLINK != 0:
+		m |= fs.ModeSymlink
+	case mode&p.DMNAMEDPIPE != 0:
+		m |= fs.ModeNamedPipe
+	case mode&p.DMSOCKET != 0:
+		m |= fs.ModeSocket
+	case mode&p.DMDEVICE != 0:
+		m |= fs.ModeDevice
+	}
+
+	if mode&p.DMAPPEND != 0 {
+		m |= fs.ModeAppend
+	}
+
+	if mode&p.DMEXCL != 0 {
+		m |= fs.ModeExclusive
+	}
+
+	if mode&p.DMTMP != 0 {
+		m |= fs.ModeTemporary
+	}
+
+	if mode&p.DMSETUID != 0 {
+		m |= fs.ModeSetuid
+	}
+
+	if mode&p.DMSETGID != 0 {
+		m |= fs.ModeSetgid
+	}
+
+	return m
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return int64(fi.d.Length) }
+func (fi *fileInfo) Mode() fs.FileMode          { return dir2FileMode(fi.d.Mode) }
+func (fi *fileInfo) ModTime() time.Time         { return time.Unix(int64(fi.d.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool                { return fi.d.Mode&p.DMDIR != 0 }
+func (fi *fileInfo) Sys() interface{}           { return fi.d }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// The direntInfo type implements fs.DirEntry for the 9P2000.L
+// directory entries. The file is stat-ed only if Info is called.
+type direntInfo struct {
+	fsys *FS
+	path string
+	de   *p.Dirent
+}
+
+// Converts the Linux directory entry type to fs.FileMode
+func dirent2FileMode(typ uint8) fs.FileMode {
+	switch typ {
+	case dtDIR:
+		return fs.ModeDir
+	case dtLNK:
+		return fs.ModeSymlink
+	case dtFIFO:
+		return fs.ModeNamedPipe
+	case dtSOCK:
+		return fs.ModeSocket
+	case dtCHR:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case dtBLK:
+		return fs.ModeDevice
+	}
+
+	return 0
+}
+
+func (de *direntInfo) Name() string               { return de.de.Name }
+func (de *direntInfo) IsDir() bool                { return de.de.Type == dtDIR }
+func (de *direntInfo) Type() fs.FileMode          { return dirent2FileMode(de.de.Type) }
+func (de *direntInfo) Info() (fs.FileInfo, error) { return de.fsys.Stat(de.path) }
+
+// The fsFile type implements fs.File, fs.ReadDirFile, io.Seeker
+// and io.ReaderAt for a file opened through FS.
+type fsFile struct {
+	*File
+	fsys   *FS
+	name   string
+	dirs   []fs.DirEntry // entries read from the server but not returned yet
+	diroff uint64        // offset of the next directory read
+	direof bool
+}
+
+func (f *fsFile) Close() error {
+	if f.fid.Fid == p.NOFID {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return f.File.Close()
+}
+
+func (f *fsFile) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	return f.File.Read(buf)
+}
+
+// Unlike File.ReadAt, returns an error if less than len(buf)
+// bytes are read, as required by io.ReaderAt.
+func (f *fsFile) ReadAt(buf []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := f.File.ReadAt(buf[n:], offset+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	d, err := f.fid.Clnt.fstat(f.fid, f.name)
+	if err != nil {
+		return nil, fsError("stat", f.name, err)
+	}
+
+	return &fileInfo{d, path.Base(f.name)}, nil
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		offset += fi.Size()
+		whence = io.SeekStart
+	}
+
+	return f.File.Seek(offset, whence)
+}
+
+// Reads more entries from the directory.
+func (f *fsFile) readdir() error {
+	clnt := f.fid.Clnt
+	if clnt.Dialect.Dotl() {
+		dirents, err := clnt.Readdir(f.fid, f.diroff, f.fid.Iounit)
+		if err != nil {
+			return err
+		}
+
+		f.direof = len(dirents) == 0
+		for _, de := range dirents {
+			f.diroff = de.Offset
+			if de.Name != "." && de.Name != ".." {
+				f.dirs = append(f.dirs, &direntInfo{f.fsys, path.Join(f.name, de.Name), de})
+			}
+		}
+
+		return nil
+	}
+
+	b, err := clnt.Read(f.fid, f.diroff, f.fid.Iounit)
+	if err != nil {
+		return err
+	}
+
+	f.direof = len(b) == 0
+	f.diroff += uint64(len(b))
+	for len(b) > 0 {
+		var d *p.Dir
+		d, b, _, err = p.UnpackDir(b, clnt.Dialect)
+		if err != nil {
+			return err
+		}
+
+		f.dirs = append(f.dirs, &fileInfo{d, d.Name})
+	}
+
+	return nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.fid.Qid.Type&p.QTDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	for (n <= 0 || len(f.dirs) < n) && !f.direof {
+		if err := f.readdir(); err != nil {
+			return nil, fsError("readdir", f.name, err)
+		}
+	}
+
+	dirs := f.dirs
+	if n <= 0 {
+		f.dirs = nil
+		return dirs, nil
+	}
+
+	if len(dirs) == 0 {
+		return nil, io.EOF
+	}
+
+	if len(dirs) > n {
+		dirs = dirs[0:n]
+	}
+
+	f.dirs = f.dirs[len(dirs):]
+	return dirs, nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// The 9P2000 operations that 9P2000.L servers don't support (Topen,
+// Tcreate, Tstat, Twstat and reading the directories) are converted
+// to the 9P2000.L ones on the 9P2000.L connections.
+
+// Returns the path of the file walked to from path with wnames.
+func walked(path []string, wnames []string) []string {
+	np := append([]string(nil), path...)
+	for _, w := range wnames {
+		switch w {
+		case "", ".":
+		case "..":
+			if len(np) > 0 {
+				np = np[0 : len(np)-1]
+			}
+		default:
+			np = append(np, w)
+		}
+	}
+
+	return np
+}
+
+// Returns the name of the file associated with fid.
+func (fid *Fid) lname() string {
+	if len(fid.path) == 0 {
+		return "/"
+	}
+
+	return fid.path[len(fid.path)-1]
+}
+
+// Converts the 9P2000 open mode to Linux open flags.
+func lflags(mode uint8) (uint32, error) {
+	if mode&p.ORCLOSE != 0 {
+		return 0, &p.Error{"ORCLOSE not supported by 9P2000.L", p.EINVAL}
+	}
+
+	flags := uint32(mode & 3)
+	if flags == p.OEXEC {
+		flags = p.LORDONLY
+	}
+
+	if mode&p.OTRUNC != 0 {
+		flags |= p.LOTRUNC
+	}
+
+	if mode&p.OAPPEND != 0 {
+		flags |= p.LOAPPEND
+	}
+
+	return flags, nil
+}
+
+// Converts the permission bits of the 9P2000 mode to the Linux mode.
+func lperm(perm uint32) uint32 {
+	mode := perm & 0777
+	if perm&p.DMSETUID != 0 {
+		mode |= sISUID
+	}
+
+	if perm&p.DMSETGID != 0 {
+		mode |= sISGID
+	}
+
+	return mode
+}
+
+// Returns the group the files created through the fid belong to.
+func lgid(fid *Fid) uint32 {
+	if fid.User != nil {
+		if groups := fid.User.Groups(); len(groups) > 0 {
+			return uint32(groups[0].Id())
+		}
+	}
+
+	return p.NOUID
+}
+
+// Creates the file with Tlcreate, Tmkdir, Tsymlink or Tmknod. As with
+// Tcreate, the fid is associated with the new file, and opened unless
+// it is a symlink or a special file. The directories are opened for
+// reading.
+func (clnt *Clnt) lcreate(ctx context.Context, fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	flags, err := lflags(mode)
+	if err != nil {
+		return err
+	}
+
+	gid := lgid(fid)
+	tc := clnt.NewFcall()
+	switch {
+	case perm&p.DMDIR != 0:
+		err = p.PackTmkdir(tc, fid.Fid, name, lperm(perm), gid)
+
+	case perm&p.DMSYMLINK != 0:
+		err = p.PackTsymlink(tc, fid.Fid, name, ext, gid)
+
+	case perm&p.DMNAMEDPIPE != 0:
+		err = p.PackTmknod(tc, fid.Fid, name, lperm(perm)|sIFIFO, 0, 0, gid)
+
+	case perm&p.DMSOCKET != 0:
+		err = p.PackTmknod(tc, fid.Fid, name, lperm(perm)|sIFSOCK, 0, 0, gid)
+
+	case perm&p.DMDEVICE != 0:
+		var c byte
+		var major, minor uint32
+
+		n, _ := fmt.Sscanf(ext, "%c %d %d", &c, &major, &minor)
+		switch {
+		case n == 3 && c == 'c':
+			err = p.PackTmknod(tc, fid.Fid, name, lperm(perm)|sIFCHR, major, minor, gid)
+		case n == 3 && c == 'b':
+			err = p.PackTmknod(tc, fid.Fid, name, lperm(perm)|sIFBLK, major, minor, gid)
+		default:
+			err = &p.Error{"invalid device: " + ext, p.EINVAL}
+		}
+
+	case perm&p.DMLINK != 0:
+		err = &p.Error{"DMLINK not supported by 9P2000.L", p.EINVAL}
+
+	default:
+		err = p.PackTlcreate(tc, fid.Fid, name, flags|p.LOCREATE|p.LOEXCL, lperm(perm), gid)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	if rc.Type == p.Rlcreate {
+		clnt.lopened(fid, rc, flags)
+		fid.Mode = mode
+		fid.path = walked(fid.path, []string{name})
+		return nil
+	}
+
+	if _, err = clnt.WalkContext(ctx, fid, fid, []string{name}); err != nil {
+		return err
+	}
+
+	// the directories can only be read
+	if perm&p.DMDIR != 0 {
+		return clnt.OpenContext(ctx, fid, p.OREAD)
+	}
+
+	return nil
+}
+
+// Returns the metadata of the file, from its attributes. As in
+// 9P2000.u, Ext is the target of a symlink, or the type and the
+// numbers of a device.
+func (clnt *Clnt) lstat(ctx context.Context, fid *Fid) (*p.Dir, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTgetattr(tc, fid.Fid, p.GetattrBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &rc.Attr
+	d := attr2Dir(fid.lname(), a)
+	major := uint32(a.Rdev>>8&0xfff | a.Rdev>>32&^0xfff)
+	minor := uint32(a.Rdev&0xff | a.Rdev>>12&^0xff)
+	switch a.Mode & sIFMT {
+	case sIFCHR:
+		d.Ext = fmt.Sprintf("c %d %d", major, minor)
+	case sIFBLK:
+		d.Ext = fmt.Sprintf("b %d %d", major, minor)
+	case sIFLNK:
+		tc := clnt.NewFcall()
+		if err = p.PackTreadlink(tc, fid.Fid); err != nil {
+			return nil, err
+		}
+
+		if rc, err = clnt.RpcContext(ctx, tc); err != nil {
+			return nil, err
+		}
+
+		d.Ext = rc.Target
+	}
+
+	return d, nil
+}
+
+// Modifies the metadata of the file with Tsetattr and Trename. The
+// owners can be changed only by their numeric ids. As with Twstat, if
+// nothing is changed, the file is synced with Tfsync.
+func (clnt *Clnt) lwstat(ctx context.Context, fid *Fid, dir *p.Dir) error {
+	var sa p.SetAttr
+
+	if (dir.Uid != "" && dir.Uidnum == p.NOUID) || (dir.Gid != "" && dir.Gidnum == p.NOUID) {
+		return &p.Error{"owner names not supported by 9P2000.L", p.EINVAL}
+	}
+
+	if dir.Mode != ^uint32(0) {
+		sa.Valid |= p.SetattrMode
+		sa.Mode = lperm(dir.Mode)
+	}
+
+	if dir.Uidnum != p.NOUID {
+		sa.Valid |= p.SetattrUid
+		sa.Uid = dir.Uidnum
+	}
+
+	if dir.Gidnum != p.NOUID {
+		sa.Valid |= p.SetattrGid
+		sa.Gid = dir.Gidnum
+	}
+
+	if dir.Length != ^uint64(0) {
+		sa.Valid |= p.SetattrSize
+		sa.Size = dir.Length
+	}
+
+	if dir.Atime != ^uint32(0) {
+		sa.Valid |= p.SetattrAtime | p.SetattrAtimeSet
+		sa.Atime.Sec = uint64(dir.Atime)
+	}
+
+	if dir.Mtime != ^uint32(0) {
+		sa.Valid |= p.SetattrMtime | p.SetattrMtimeSet
+		sa.Mtime.Sec = uint64(dir.Mtime)
+	}
+
+	if sa.Valid == 0 && dir.Name == "" {
+		tc := clnt.NewFcall()
+		if err := p.PackTfsync(tc, fid.Fid, 0); err != nil {
+			return err
+		}
+
+		_, err := clnt.RpcContext(ctx, tc)
+		return err
+	}
+
+	if sa.Valid != 0 {
+		tc := clnt.NewFcall()
+		if err := p.PackTsetattr(tc, fid.Fid, &sa); err != nil {
+			return err
+		}
+
+		if _, err := clnt.RpcContext(ctx, tc); err != nil {
+			return err
+		}
+	}
+
+	if dir.Name == "" {
+		return nil
+	}
+
+	// the file is renamed within its directory, walked to from the
+	// attached fid as the files can't be walked to their directories
+	if fid.root == nil || len(fid.path) == 0 {
+		return &p.Error{"can't rename the root", p.EINVAL}
+	}
+
+	dfid, err := clnt.walkPath(ctx, fid.root, strings.Join(fid.path[0:len(fid.path)-1], "/"))
+	if err != nil {
+		return err
+	}
+
+	defer clnt.Clunk(dfid)
+	tc := clnt.NewFcall()
+	if err := p.PackTrename(tc, fid.Fid, dfid.Fid, dir.Name); err != nil {
+		return err
+	}
+
+	if _, err := clnt.RpcContext(ctx, tc); err != nil {
+		return err
+	}
+
+	fid.path = walked(fid.path[0:len(fid.path)-1], []string{dir.Name})
+	return nil
+}
+
+// Reads the entries of the directory with Treaddir, and their
+// metadata with Tgetattr. The entries are walked to from the attached
+// fid, as the opened directory can't be walked from. The entries that
+// are removed meanwhile are skipped.
+func (file *File) lreaddir(num int) ([]*p.Dir, error) {
+	fid := file.fid
+	clnt := fid.Clnt
+	if fid.root == nil {
+		return nil, &p.Error{"fid not attached", p.EINVAL}
+	}
+
+	var dirs []*p.Dir
+	for {
+		dirents, err := clnt.Readdir(fid, file.offset, fid.Iounit)
+		if err != nil {
+			return dirs, err
+		}
+
+		if len(dirents) == 0 {
+			return dirs, io.EOF
+		}
+
+		for _, de := range dirents {
+			file.offset = de.Offset
+			if de.Name == "." || de.Name == ".." {
+				continue
+			}
+
+			efid, err := clnt.walkPath(context.Background(), fid.root, strings.Join(walked(fid.path, []string{de.Name}), "/"))
+			if err != nil {
+				continue
+			}
+
+			d, err := clnt.lstat(context.Background(), efid)
+			clnt.Clunk(efid)
+			if err != nil {
+				continue
+			}
+
+			dirs = append(dirs, d)
+			if num != 0 && len(dirs) >= num {
+				return dirs, nil
+			}
+		}
+	}
+}
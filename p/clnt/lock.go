@@ -0,0 +1,78 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"github.com/lionkov/go9p/p"
+	"time"
+)
+
+// Maximum time between the retries of a blocking lock
+var MaxLockRetry = time.Second
+
+// Acquires (or releases, if fl.Type is p.LockTypeUnlck) a byte-range
+// lock on the file associated with the (opened) fid. The method doesn't
+// wait for a conflicting lock to be released. Returns one of the p.Lock*
+// status values, or an Error. (The method is not called Lock because it
+// would clash with the Clnt's mutex.) Requires 9P2000.L.
+func (clnt *Clnt) Flock(fid *Fid, fl *p.Flock) (uint8, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTlock(tc, fid.Fid, fl)
+	if err != nil {
+		return p.LockError, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return p.LockError, err
+	}
+
+	return rc.Status, nil
+}
+
+// Returns the lock that prevents fl from being acquired on the file
+// associated with the (opened) fid. If there is no such lock, the Type
+// of the returned value is p.LockTypeUnlck. Requires 9P2000.L.
+func (clnt *Clnt) Getlock(fid *Fid, fl *p.Flock) (*p.Flock, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTgetlock(tc, fid.Fid, fl)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Flock, nil
+}
+
+// Acquires (or releases) a byte-range lock on the File. If fl.Flags
+// contains p.LockFlagsBlock, the request is retried until the conflicting
+// lock is released. Returns p.LockSuccess if the lock is acquired, or
+// p.LockBlocked if it is held by someone else and fl doesn't ask for
+// blocking.
+func (file *File) Lock(fl *p.Flock) (uint8, error) {
+	wait := 10 * time.Millisecond
+	for {
+		status, err := file.fid.Clnt.Flock(file.fid, fl)
+		if err != nil || status != p.LockBlocked || fl.Flags&p.LockFlagsBlock == 0 {
+			return status, err
+		}
+
+		time.Sleep(wait)
+		if wait *= 2; wait > MaxLockRetry {
+			wait = MaxLockRetry
+		}
+	}
+}
+
+// Returns the lock that prevents fl from being acquired on the File.
+// If there is no such lock, the Type of the returned value is
+// p.LockTypeUnlck.
+func (file *File) Getlock(fl *p.Flock) (*p.Flock, error) {
+	return file.fid.Clnt.Getlock(file.fid, fl)
+}
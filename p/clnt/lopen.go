@@ -0,0 +1,147 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "github.com/lionkov/go9p/p"
+
+// Sets the fields of the opened fid from the Rlopen or Rlcreate message.
+func (clnt *Clnt) lopened(fid *Fid, rc *p.Fcall, flags uint32) {
+	fid.Qid = rc.Qid
+	fid.Iounit = rc.Iounit
+	if fid.Iounit == 0 || fid.Iounit > clnt.Msize-p.IOHDRSZ {
+		fid.Iounit = clnt.Msize - p.IOHDRSZ
+	}
+	fid.Mode = uint8(flags & p.LOACCMODE)
+}
+
+// Opens the file associated with the fid. The flags are Linux open
+// flags (p.LO* values). Returns nil if the operation is successful.
+// Requires 9P2000.L.
+func (clnt *Clnt) Lopen(fid *Fid, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := p.PackTlopen(tc, fid.Fid, flags)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return err
+	}
+
+	clnt.lopened(fid, rc, flags)
+	return nil
+}
+
+// Creates a file in the directory associated with the fid. On success
+// the fid is associated with the new file and opened. Requires 9P2000.L.
+func (clnt *Clnt) Lcreate(fid *Fid, name string, flags uint32, mode uint32, gid uint32) error {
+	tc := clnt.NewFcall()
+	err := p.PackTlcreate(tc, fid.Fid, name, flags, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return err
+	}
+
+	clnt.lopened(fid, rc, flags)
+	return nil
+}
+
+// Creates a directory in the directory associated with dfid. Returns
+// the Qid of the new directory, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Mkdir(dfid *Fid, name string, mode uint32, gid uint32) (*p.Qid, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTmkdir(tc, dfid.Fid, name, mode, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Creates a symbolic link pointing to target in the directory associated
+// with dfid. Returns the Qid of the link, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Symlink(dfid *Fid, name string, target string, gid uint32) (*p.Qid, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTsymlink(tc, dfid.Fid, name, target, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Creates a device file, named pipe or socket in the directory associated
+// with dfid. The mode includes the file type bits. Returns the Qid of the
+// new file, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Mknod(dfid *Fid, name string, mode uint32, major uint32, minor uint32, gid uint32) (*p.Qid, error) {
+	tc := clnt.NewFcall()
+	err := p.PackTmknod(tc, dfid.Fid, name, mode, major, minor, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Qid, nil
+}
+
+// Creates a hard link to the file associated with fid in the directory
+// associated with dfid. Returns nil if successful. Requires 9P2000.L.
+func (clnt *Clnt) Link(dfid *Fid, fid *Fid, name string) error {
+	tc := clnt.NewFcall()
+	err := p.PackTlink(tc, dfid.Fid, fid.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
+
+// Renames the file oldname in the directory associated with olddir to
+// newname in the directory associated with newdir. Returns nil if
+// successful. Requires 9P2000.L.
+func (clnt *Clnt) Renameat(olddir *Fid, oldname string, newdir *Fid, newname string) error {
+	tc := clnt.NewFcall()
+	err := p.PackTrenameat(tc, olddir.Fid, oldname, newdir.Fid, newname)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
+
+// Removes the file name from the directory associated with dfid. If
+// flags contains p.AtRemovedir, the file should be a directory. Returns
+// nil if successful. Requires 9P2000.L.
+func (clnt *Clnt) Unlinkat(dfid *Fid, name string, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := p.PackTunlinkat(tc, dfid.Fid, name, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
@@ -14,16 +14,17 @@ import (
 func (clnt *Clnt) Auth(user p.User, aname string) (*Fid, error) {
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := p.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := p.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dialect)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = clnt.Rpc(tc)
+	rc, err := clnt.Rpc(tc)
 	if err != nil {
 		return nil, err
 	}
 
+	fid.Qid = rc.Qid
 	fid.Iounit = clnt.Msize - p.IOHDRSZ
 	fid.User = user
 	fid.walked = true
@@ -44,7 +45,7 @@ func (clnt *Clnt) Attach(afid *Fid, user p.User, aname string) (*Fid, error) {
 
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := p.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := p.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dialect)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +58,7 @@ func (clnt *Clnt) Attach(afid *Fid, user p.User, aname string) (*Fid, error) {
 	fid.Qid = rc.Qid
 	fid.User = user
 	fid.walked = true
+	fid.root = fid
 	clnt.Root = fid
 	return fid, nil
 }
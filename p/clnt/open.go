@@ -5,20 +5,37 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/go9p/p"
 	"strings"
 )
 
 // Opens the file associated with the fid. Returns nil if
-// the operation is successful.
+// the operation is successful. On 9P2000.L connections
+// Tlopen is sent, with the mode converted to Linux flags.
 func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
+	return clnt.OpenContext(context.Background(), fid, mode)
+}
+
+// Same as Open, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the open completes.
+func (clnt *Clnt) OpenContext(ctx context.Context, fid *Fid, mode uint8) error {
+	var err error
+
 	tc := clnt.NewFcall()
-	err := p.PackTopen(tc, fid.Fid, mode)
+	if clnt.Dialect.Dotl() {
+		var flags uint32
+		if flags, err = lflags(mode); err == nil {
+			err = p.PackTlopen(tc, fid.Fid, flags)
+		}
+	} else {
+		err = p.PackTopen(tc, fid.Fid, mode)
+	}
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
@@ -29,19 +46,34 @@ func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
 		fid.Iounit = clnt.Msize - p.IOHDRSZ
 	}
 	fid.Mode = mode
+	if clnt.Cache != nil && mode&p.OTRUNC != 0 {
+		clnt.Cache.invalidate(&fid.Qid)
+	}
+	clnt.cacheValidate(fid.Qid)
 	return nil
 }
 
 // Creates a file in the directory associated with the fid. Returns nil
-// if the operation is successful.
+// if the operation is successful. On 9P2000.L connections the file is
+// created with Tlcreate, Tmkdir, Tsymlink or Tmknod, depending on perm.
 func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	return clnt.CreateContext(context.Background(), fid, name, perm, mode, ext)
+}
+
+// Same as Create, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the create completes.
+func (clnt *Clnt) CreateContext(ctx context.Context, fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	if clnt.Dialect.Dotl() {
+		return clnt.lcreate(ctx, fid, name, perm, mode, ext)
+	}
+
 	tc := clnt.NewFcall()
-	err := p.PackTcreate(tc, fid.Fid, name, perm, mode, ext, clnt.Dotu)
+	err := p.PackTcreate(tc, fid.Fid, name, perm, mode, ext, clnt.Dialect)
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
@@ -52,6 +84,7 @@ func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext str
 		fid.Iounit = clnt.Msize - p.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.path = walked(fid.path, []string{name})
 	return nil
 }
 
@@ -78,21 +111,26 @@ func (clnt *Clnt) FCreate(path string, perm uint32, mode uint8) (*File, error) {
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{fid: fid}, nil
 }
 
 // Opens a named file. Returns the opened file, or an Error.
 func (clnt *Clnt) FOpen(path string, mode uint8) (*File, error) {
-	fid, err := clnt.FWalk(path)
+	return clnt.FOpenContext(context.Background(), path, mode)
+}
+
+// Same as FOpen, but the operation is cancelled if the context is done.
+func (clnt *Clnt) FOpenContext(ctx context.Context, path string, mode uint8) (*File, error) {
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = clnt.Open(fid, mode)
+	err = clnt.OpenContext(ctx, fid, mode)
 	if err != nil {
 		clnt.Clunk(fid)
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{fid: fid}, nil
 }
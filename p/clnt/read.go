@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/go9p/p"
 	"io"
 )
@@ -13,6 +14,12 @@ import (
 // Returns a slice with the data read, if the operation was successful, or an
 // Error.
 func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
+	return clnt.ReadContext(context.Background(), fid, offset, count)
+}
+
+// Same as Read, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the read completes.
+func (clnt *Clnt) ReadContext(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]byte, error) {
 	if count > fid.Iounit {
 		count = fid.Iounit
 	}
@@ -23,7 +30,7 @@ func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +52,24 @@ func (file *File) Read(buf []byte) (int, error) {
 // Reads up to len(buf) bytes from the file starting from offset.
 // Returns the number of bytes read, or an Error.
 func (file *File) ReadAt(buf []byte, offset int64) (int, error) {
-	b, err := file.fid.Clnt.Read(file.fid, uint64(offset), uint32(len(buf)))
+	return file.ReadAtContext(context.Background(), buf, offset)
+}
+
+// Same as ReadAt, but the read is cancelled if the context is done.
+func (file *File) ReadAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if file.wb != nil {
+		file.wb.drain()
+	}
+
+	if c := file.fid.Clnt.Cache; c != nil && cacheable(&file.fid.Qid) {
+		return c.readAt(ctx, file.fid, buf, offset)
+	}
+
+	if file.ra != nil && cacheable(&file.fid.Qid) {
+		return file.ra.readAt(ctx, buf, offset)
+	}
+
+	b, err := file.fid.Clnt.ReadContext(ctx, file.fid, uint64(offset), uint32(len(buf)))
 	if err != nil {
 		return 0, err
 	}
@@ -86,6 +110,10 @@ func (file *File) Readn(buf []byte, offset uint64) (int, error) {
 // all entries from the directory). If the operation fails, returns
 // an Error.
 func (file *File) Readdir(num int) ([]*p.Dir, error) {
+	if file.fid.Clnt.Dialect.Dotl() {
+		return file.lreaddir(num)
+	}
+
 	buf := make([]byte, file.fid.Clnt.Msize-p.IOHDRSZ)
 	var dirs []*p.Dir
 	pos := 0
@@ -103,7 +131,7 @@ func (file *File) Readdir(num int) ([]*p.Dir, error) {
 		b := buf[:n]
 		for len(b) > 0 {
 			var perr error
-			d, b, _, perr = p.UnpackDir(b, file.Fid().Clnt.Dotu)
+			d, b, _, perr = p.UnpackDir(b, file.Fid().Clnt.Dialect)
 			if perr != nil {
 				// If we have unpacked anything, it is almost certainly
 				// a too-short buffer. So return what we got.
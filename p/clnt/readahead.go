@@ -0,0 +1,212 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// An outstanding read-ahead request.
+type raReq struct {
+	r      *Req
+	offset uint64
+	count  uint32
+	done   bool // the response was received
+}
+
+// The readAhead type keeps up to n Treads outstanding while the
+// file is read sequentially.
+type readAhead struct {
+	sync.Mutex
+	file *File
+	n    int
+	reqs []*raReq // outstanding requests, in offset order
+	next uint64   // offset of the next Tread
+	pos  uint64   // offset expected by the next sequential read
+	seq  bool     // true if pos is valid
+	data []byte   // data at pos that wasn't returned yet
+}
+
+// Enables read-ahead for the File. Once the File is read sequentially,
+// up to n Treads of Iounit bytes are kept outstanding, each on its own
+// tag. The outstanding reads are flushed if the File is read from
+// another offset, written to, seeked or closed. If n is 0, read-ahead
+// is disabled. Read-ahead is not used if the client caches the file.
+func (file *File) SetReadAhead(n int) {
+	if file.ra != nil {
+		file.ra.Lock()
+		file.ra.cancel()
+		file.ra.Unlock()
+		file.ra = nil
+	}
+
+	if n > 0 {
+		file.ra = &readAhead{file: file, n: n}
+	}
+}
+
+// Flushes the outstanding reads started after pos and drops the
+// data that wasn't returned yet. Should be called with the lock held.
+func (ra *readAhead) cancel() {
+	clnt := ra.file.fid.Clnt
+	var wg sync.WaitGroup
+	for _, rr := range ra.reqs {
+		if !rr.done {
+			select {
+			case <-rr.r.Done:
+				rr.done = true
+			default:
+			}
+		}
+
+		if rr.done {
+			clnt.ReqFree(rr.r)
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *Req) {
+			defer wg.Done()
+			clnt.flush(r)
+			clnt.ReqFree(r)
+		}(rr.r)
+	}
+
+	wg.Wait()
+	ra.reqs = nil
+	ra.data = nil
+	ra.next = ra.pos
+}
+
+// Stops the read-ahead, the next read is not sequential.
+func (ra *readAhead) reset() {
+	ra.Lock()
+	ra.cancel()
+	ra.seq = false
+	ra.Unlock()
+}
+
+// Sends Treads until n of them are outstanding.
+func (ra *readAhead) fill() error {
+	fid := ra.file.fid
+	clnt := fid.Clnt
+	for len(ra.reqs) < ra.n {
+		tc := clnt.NewFcall()
+		err := p.PackTread(tc, fid.Fid, ra.next, fid.Iounit)
+		if err != nil {
+			return err
+		}
+
+		r := clnt.ReqAlloc()
+		r.Tc = tc
+		r.Done = make(chan *Req, 1)
+		if err := clnt.Rpcnb(r); err != nil {
+			clnt.ReqFree(r)
+			return err
+		}
+
+		ra.reqs = append(ra.reqs, &raReq{r: r, offset: ra.next, count: fid.Iounit})
+		ra.next += uint64(fid.Iounit)
+	}
+
+	return nil
+}
+
+func (ra *readAhead) readAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	ra.Lock()
+	defer ra.Unlock()
+
+	clnt := ra.file.fid.Clnt
+	if !ra.seq || uint64(offset) != ra.pos {
+		ra.cancel()
+		ra.seq = false
+		b, err := clnt.ReadContext(ctx, ra.file.fid, uint64(offset), uint32(len(buf)))
+		if err != nil {
+			return 0, err
+		}
+
+		if len(b) == 0 {
+			return 0, io.EOF
+		}
+
+		ra.pos = uint64(offset) + uint64(len(b))
+		ra.next = ra.pos
+		ra.seq = true
+		return copy(buf, b), nil
+	}
+
+	n := 0
+	for n < len(buf) {
+		if len(ra.data) > 0 {
+			m := copy(buf[n:], ra.data)
+			ra.data = ra.data[m:]
+			ra.pos += uint64(m)
+			n += m
+			continue
+		}
+
+		if err := ra.fill(); err != nil && len(ra.reqs) == 0 {
+			if n > 0 {
+				break
+			}
+
+			return 0, err
+		}
+
+		// don't wait for more data if some was read already
+		rr := ra.reqs[0]
+		if n > 0 {
+			select {
+			case <-rr.r.Done:
+			default:
+				return n, nil
+			}
+		} else {
+			select {
+			case <-rr.r.Done:
+			case <-ctx.Done():
+				ra.cancel()
+				ra.seq = false
+				return 0, ctx.Err()
+			}
+		}
+
+		ra.reqs = ra.reqs[1:]
+		rc, err := rr.r.Rc, rr.r.Err
+		clnt.ReqFree(rr.r)
+		if err != nil {
+			ra.cancel()
+			ra.seq = false
+			if n > 0 {
+				break
+			}
+
+			return 0, err
+		}
+
+		// after a short read the following requests are not
+		// at the right offset
+		if uint32(len(rc.Data)) < rr.count {
+			ra.cancel()
+			ra.next = rr.offset + uint64(len(rc.Data))
+		}
+
+		if len(rc.Data) == 0 {
+			break
+		}
+
+		ra.data = rc.Data
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
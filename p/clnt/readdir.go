@@ -0,0 +1,77 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"github.com/lionkov/go9p/p"
+	"io"
+)
+
+// Reads the directory entries starting from offset from the directory
+// associated with the (opened) fid. The offset is either 0 or the Offset
+// of the last entry returned by the previous call. Returns at most
+// count bytes worth of entries, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) Readdir(fid *Fid, offset uint64, count uint32) ([]*p.Dirent, error) {
+	if count > fid.Iounit {
+		count = fid.Iounit
+	}
+
+	tc := clnt.NewFcall()
+	err := p.PackTreaddir(tc, fid.Fid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirents []*p.Dirent
+	for b := rc.Data; len(b) > 0; {
+		var d *p.Dirent
+		d, b, _, err = p.UnpackDirent(b)
+		if err != nil {
+			return nil, err
+		}
+
+		dirents = append(dirents, d)
+	}
+
+	return dirents, nil
+}
+
+// Reads the 9P2000.L entries of the directory associated with the File.
+// Returns an array of maximum num entries (if num is 0, returns all
+// remaining entries). Returns io.EOF if there are no more entries.
+// If the operation fails, returns an Error.
+func (file *File) ReadDirents(num int) ([]*p.Dirent, error) {
+	var dirents []*p.Dirent
+
+	fid := file.fid
+	for num == 0 || len(dirents) < num {
+		d, err := fid.Clnt.Readdir(fid, file.offset, fid.Iounit)
+		if err != nil {
+			return dirents, err
+		}
+
+		if len(d) == 0 {
+			if len(dirents) == 0 {
+				return nil, io.EOF
+			}
+
+			break
+		}
+
+		if num != 0 && len(dirents)+len(d) > num {
+			d = d[0 : num-len(dirents)]
+		}
+
+		dirents = append(dirents, d...)
+		file.offset = d[len(d)-1].Offset
+	}
+
+	return dirents, nil
+}
@@ -0,0 +1,393 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+var Ereplay = &p.Error{Err: "connection lost, operation may have been performed", Errornum: p.EIO}
+var Eunmounted = &p.Error{Err: "connection closed", Errornum: p.EIO}
+
+// The RClnt type represents a client that survives the loss of the
+// connection to the server. If the connection is lost, RClnt dials the
+// server again (with exponential backoff), re-attaches, walks all live
+// files to their paths and reopens them with their original mode.
+// The requests that can be safely replayed are retried on the new
+// connection, the others fail with Ereplay.
+type RClnt struct {
+	sync.Mutex
+	Dial       func() (net.Conn, error) // establishes a new connection to the server
+	Backoff    time.Duration            // initial delay between dial attempts
+	MaxBackoff time.Duration            // maximum delay between dial attempts
+	MaxDials   int                      // maximum dial attempts per reconnect (0 means no limit)
+
+	aname   string
+	msize   uint32
+	dialect p.Dialect
+	user    p.User
+	clnt    *Clnt
+	gen     int // incremented each time the client reconnects
+	files   map[*RFile]bool
+	closed  bool
+	closing chan bool // closed by Unmount to stop reconnecting
+	once    sync.Once
+}
+
+// The RFile type is a file opened through RClnt. The file is reopened
+// automatically when RClnt reconnects to the server.
+type RFile struct {
+	rclnt  *RClnt
+	path   string
+	mode   uint8
+	offset uint64
+	append bool  // if true, the file is append-only (QTAPPEND)
+	fid    *Fid  // guarded by rclnt.Lock
+	err    error // set if the file can't be reopened, guarded by rclnt.Lock
+}
+
+// Connects to the server using the dial function and attaches to it
+// as the specified user. Returns the client, or an Error.
+func DialReconnect(dial func() (net.Conn, error), aname string, msize uint32, dialect p.Dialect, user p.User) (*RClnt, error) {
+	rc := &RClnt{
+		Dial:       dial,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		aname:      aname,
+		msize:      msize,
+		dialect:    dialect,
+		user:       user,
+		files:      make(map[*RFile]bool),
+		closing:    make(chan bool),
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, &p.Error{Err: err.Error(), Errornum: p.EIO}
+	}
+
+	rc.clnt, err = rc.mount(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func (rc *RClnt) mount(c net.Conn) (*Clnt, error) {
+	clnt, err := ConnectDialect(c, rc.msize, rc.dialect)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	_, err = clnt.Attach(nil, rc.user, rc.aname)
+	if err != nil {
+		clnt.Unmount()
+		return nil, err
+	}
+
+	return clnt, nil
+}
+
+// Returns the client for the current connection and its generation.
+func (rc *RClnt) current() (*Clnt, int, error) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.closed {
+		return nil, 0, Eunmounted
+	}
+
+	return rc.clnt, rc.gen, nil
+}
+
+// Returns true if the connection of the client is lost.
+func (clnt *Clnt) dead() bool {
+	clnt.Lock()
+	defer clnt.Unlock()
+	return clnt.err != nil
+}
+
+// Establishes a new connection, unless the connection of generation
+// gen was already replaced. Reopens all live files.
+func (rc *RClnt) reconnect(gen int) error {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.closed {
+		return Eunmounted
+	}
+
+	if rc.gen != gen {
+		return nil
+	}
+
+	rc.clnt.Unmount()
+	delay := rc.Backoff
+	for n := 1; ; n++ {
+		c, err := rc.Dial()
+		if err == nil {
+			var clnt *Clnt
+			clnt, err = rc.mount(c)
+			if err == nil {
+				rc.clnt = clnt
+				break
+			}
+		}
+
+		if rc.MaxDials > 0 && n >= rc.MaxDials {
+			return &p.Error{Err: "reconnect failed: " + err.Error(), Errornum: p.EIO}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-rc.closing:
+			return Eunmounted
+		}
+
+		delay *= 2
+		if delay > rc.MaxBackoff {
+			delay = rc.MaxBackoff
+		}
+	}
+
+	rc.gen++
+	for f := range rc.files {
+		f.fid, f.err = rc.clnt.reopen(f.path, f.mode&^p.OTRUNC)
+	}
+
+	return nil
+}
+
+// Walks to the file and opens it with the specified mode.
+func (clnt *Clnt) reopen(path string, mode uint8) (*Fid, error) {
+	fid, err := clnt.FWalk(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = clnt.Open(fid, mode)
+	if err != nil {
+		clnt.Clunk(fid)
+		return nil, err
+	}
+
+	return fid, nil
+}
+
+// Runs op on the current connection. If the connection is lost,
+// reconnects and, if replay is true, runs op again. Otherwise
+// returns Ereplay.
+func (rc *RClnt) do(replay bool, op func(clnt *Clnt) error) error {
+	for {
+		clnt, gen, err := rc.current()
+		if err != nil {
+			return err
+		}
+
+		err = op(clnt)
+		if err == nil || !clnt.dead() {
+			return err
+		}
+
+		err = rc.reconnect(gen)
+		if err != nil {
+			return err
+		}
+
+		if !replay {
+			return Ereplay
+		}
+	}
+}
+
+// Opens a named file. Returns the opened file, or an Error.
+func (rc *RClnt) FOpen(path string, mode uint8) (*RFile, error) {
+	f := &RFile{rclnt: rc, path: path, mode: mode}
+	err := rc.do(true, func(clnt *Clnt) error {
+		fid, err := clnt.reopen(path, mode)
+		if err == nil {
+			f.add(clnt, fid)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Creates and opens a named file. The request is not replayed if the
+// connection is lost. Returns the file, or an Error.
+func (rc *RClnt) FCreate(path string, perm uint32, mode uint8) (*RFile, error) {
+	f := &RFile{rclnt: rc, path: path, mode: mode}
+	err := rc.do(false, func(clnt *Clnt) error {
+		file, err := clnt.FCreate(path, perm, mode)
+		if err == nil {
+			f.add(clnt, file.fid)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Returns the metadata of a named file, or an Error.
+func (rc *RClnt) FStat(path string) (d *p.Dir, err error) {
+	err = rc.do(true, func(clnt *Clnt) error {
+		d, err = clnt.FStat(path)
+		return err
+	})
+
+	return
+}
+
+// Removes a named file. The request is not replayed if the connection
+// is lost. Returns nil if successful.
+func (rc *RClnt) FRemove(path string) error {
+	return rc.do(false, func(clnt *Clnt) error {
+		return clnt.FRemove(path)
+	})
+}
+
+// Closes the connection to the file server. The client doesn't
+// reconnect anymore.
+func (rc *RClnt) Unmount() {
+	rc.once.Do(func() { close(rc.closing) })
+	rc.Lock()
+	rc.closed = true
+	rc.clnt.Unmount()
+	rc.Unlock()
+}
+
+// Registers the file opened on the client's connection clnt. If the
+// client reconnected in the meantime, the file is reopened on the new
+// connection.
+func (f *RFile) add(clnt *Clnt, fid *Fid) {
+	rc := f.rclnt
+	rc.Lock()
+	f.fid = fid
+	f.append = fid.Qid.Type&p.QTAPPEND != 0
+	if clnt != rc.clnt {
+		f.fid, f.err = rc.clnt.reopen(f.path, f.mode&^p.OTRUNC)
+	}
+	rc.files[f] = true
+	rc.Unlock()
+}
+
+// Returns the fid of the file on the connection clnt.
+func (f *RFile) getFid(clnt *Clnt) (*Fid, error) {
+	rc := f.rclnt
+	rc.Lock()
+	defer rc.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if f.fid == nil || f.fid.Clnt != clnt {
+		return nil, Eunmounted
+	}
+
+	return f.fid, nil
+}
+
+// Reads up to len(buf) bytes from the file starting from offset.
+// Returns the number of bytes read, or an Error.
+func (f *RFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	err = f.rclnt.do(true, func(clnt *Clnt) error {
+		fid, err := f.getFid(clnt)
+		if err != nil {
+			return err
+		}
+
+		b, err := clnt.Read(fid, uint64(offset), uint32(len(buf)))
+		n = copy(buf, b)
+		return err
+	})
+
+	if err == nil && n == 0 && len(buf) > 0 {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Reads up to len(buf) bytes from the file. Returns the number
+// of bytes read, or an Error.
+func (f *RFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, int64(f.offset))
+	f.offset += uint64(n)
+	return n, err
+}
+
+// Writes up to len(buf) bytes starting from offset. Writes to files
+// opened in append mode (or append-only files) are not replayed if
+// the connection is lost. Returns the number of bytes written, or
+// an Error.
+func (f *RFile) WriteAt(buf []byte, offset int64) (n int, err error) {
+	replay := f.mode&p.OAPPEND == 0 && !f.append
+	err = f.rclnt.do(replay, func(clnt *Clnt) error {
+		fid, err := f.getFid(clnt)
+		if err != nil {
+			return err
+		}
+
+		n, err = clnt.Write(fid, buf, uint64(offset))
+		return err
+	})
+
+	return
+}
+
+// Writes up to len(buf) bytes to the file. Returns the number of
+// bytes written, or an Error.
+func (f *RFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, int64(f.offset))
+	f.offset += uint64(n)
+	return n, err
+}
+
+// Returns the metadata of the file, or an Error.
+func (f *RFile) Stat() (d *p.Dir, err error) {
+	err = f.rclnt.do(true, func(clnt *Clnt) error {
+		fid, err := f.getFid(clnt)
+		if err != nil {
+			return err
+		}
+
+		d, err = clnt.Stat(fid)
+		return err
+	})
+
+	return
+}
+
+// Closes the file.
+func (f *RFile) Close() error {
+	rc := f.rclnt
+	rc.Lock()
+	delete(rc.files, f)
+	fid := f.fid
+	f.fid = nil
+	rc.Unlock()
+
+	if fid == nil || fid.Clnt.dead() {
+		return nil
+	}
+
+	return fid.Clnt.Clunk(fid)
+}
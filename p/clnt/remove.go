@@ -4,18 +4,33 @@
 
 package clnt
 
-import "github.com/lionkov/go9p/p"
+import (
+	"context"
+
+	"github.com/lionkov/go9p/p"
+)
 
 // Removes the file associated with the Fid. Returns nil if the
 // operation is successful.
 func (clnt *Clnt) Remove(fid *Fid) error {
+	return clnt.RemoveContext(context.Background(), fid)
+}
+
+// Same as Remove, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the remove completes. The fid
+// is released in either case.
+func (clnt *Clnt) RemoveContext(ctx context.Context, fid *Fid) error {
 	tc := clnt.NewFcall()
 	err := p.PackTremove(tc, fid.Fid)
 	if err != nil {
 		return err
 	}
 
-	_, err = clnt.Rpc(tc)
+	_, err = clnt.RpcContext(ctx, tc)
+	if err == nil && clnt.Cache != nil {
+		clnt.Cache.invalidate(&fid.Qid)
+	}
+
 	clnt.fidpool.putId(fid.Fid)
 	fid.Fid = p.NOFID
 
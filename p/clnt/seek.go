@@ -57,6 +57,9 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	if off < 0 {
 		return 0, Enegoff
 	}
+	if f.ra != nil && uint64(off) != f.offset {
+		f.ra.reset()
+	}
 	f.offset = uint64(off)
 
 	return off, nil
@@ -4,22 +4,54 @@
 
 package clnt
 
-import "github.com/lionkov/go9p/p"
+import (
+	"context"
+
+	"github.com/lionkov/go9p/p"
+)
 
 // Returns the metadata for the file associated with the Fid, or an Error.
+// On 9P2000.L connections the metadata is converted from the attributes
+// returned by Tgetattr.
 func (clnt *Clnt) Stat(fid *Fid) (*p.Dir, error) {
-	tc := clnt.NewFcall()
-	err := p.PackTstat(tc, fid.Fid)
-	if err != nil {
-		return nil, err
+	return clnt.StatContext(context.Background(), fid)
+}
+
+// Same as Stat, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the stat completes.
+func (clnt *Clnt) StatContext(ctx context.Context, fid *Fid) (*p.Dir, error) {
+	if clnt.Cache != nil && fid.walked && fid.Type&p.QTAUTH == 0 {
+		if d := clnt.Cache.dir(&fid.Qid); d != nil {
+			return d, nil
+		}
 	}
 
-	rc, err := clnt.Rpc(tc)
-	if err != nil {
-		return nil, err
+	var d *p.Dir
+	if clnt.Dialect.Dotl() {
+		var err error
+		if d, err = clnt.lstat(ctx, fid); err != nil {
+			return nil, err
+		}
+	} else {
+		tc := clnt.NewFcall()
+		err := p.PackTstat(tc, fid.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		rc, err := clnt.RpcContext(ctx, tc)
+		if err != nil {
+			return nil, err
+		}
+
+		d = &rc.Dir
+	}
+
+	if clnt.Cache != nil && fid.Type&p.QTAUTH == 0 {
+		clnt.Cache.setDir(d)
 	}
 
-	return &rc.Dir, nil
+	return d, nil
 }
 
 // Returns the metadata for a named file, or an Error.
@@ -35,20 +67,43 @@ func (clnt *Clnt) FStat(path string) (*p.Dir, error) {
 }
 
 // Modifies the data of the file associated with the Fid, or an Error.
+// On 9P2000.L connections Tsetattr and Trename are sent instead.
 func (clnt *Clnt) Wstat(fid *Fid, dir *p.Dir) error {
-	tc := clnt.NewFcall()
-	err := p.PackTwstat(tc, fid.Fid, dir, clnt.Dotu)
-	if err != nil {
-		return err
+	return clnt.WstatContext(context.Background(), fid, dir)
+}
+
+// Same as Wstat, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the wstat completes.
+func (clnt *Clnt) WstatContext(ctx context.Context, fid *Fid, dir *p.Dir) error {
+	var err error
+
+	if clnt.Dialect.Dotl() {
+		err = clnt.lwstat(ctx, fid, dir)
+	} else {
+		tc := clnt.NewFcall()
+		err = p.PackTwstat(tc, fid.Fid, dir, clnt.Dialect)
+		if err != nil {
+			return err
+		}
+
+		_, err = clnt.RpcContext(ctx, tc)
+	}
+
+	if err == nil && clnt.Cache != nil {
+		clnt.Cache.invalidate(&fid.Qid)
 	}
 
-	_, err = clnt.Rpc(tc)
 	return err
 }
 
 // FSync syncs the file for a fid. It does this by sending a NewWstatDir, i.e. a
-// Dir with all fields set to 'not set'.
+// Dir with all fields set to 'not set'. On 9P2000.L connections Tfsync is used
+// instead.
 func (clnt *Clnt) FSync(fid *Fid) error {
+	if clnt.Dialect.Dotl() {
+		return clnt.Fsync(fid, false)
+	}
+
 	return clnt.Wstat(fid, p.NewWstatDir())
 }
 
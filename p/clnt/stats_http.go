@@ -14,6 +14,15 @@ func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", clnt.Id))
 	defer io.WriteString(c, "</body></html>")
 
+	// cache
+	if clnt.Cache != nil {
+		st := clnt.Cache.Stats()
+		io.WriteString(c, "<h2>Cache</h2>")
+		io.WriteString(c, fmt.Sprintf("Data: %d hits, %d misses<br>", st.Hits, st.Misses))
+		io.WriteString(c, fmt.Sprintf("Stat: %d hits, %d misses<br>", st.StatHits, st.StatMisses))
+		io.WriteString(c, fmt.Sprintf("Size: %d of %d bytes, %d evictions<br>", st.Size, clnt.Cache.MaxSize, st.Evictions))
+	}
+
 	// fcalls
 	if clnt.Debuglevel&DbgLogFcalls != 0 {
 		fs := clnt.Log.Filter(clnt, DbgLogFcalls)
@@ -6,6 +6,10 @@ package clnt
 
 import "github.com/lionkov/go9p/p"
 
+// The Tag type sends the requests without waiting for the responses,
+// each request is sent as a single message. On 9P2000.L connections
+// Open sends Tlopen, while Create, Stat and Wstat send the 9P2000
+// messages, which 9P2000.L servers don't support.
 type Tag struct {
 	clnt     *Clnt
 	tag      uint16
@@ -54,7 +58,7 @@ func (tag *Tag) reqproc() {
 		case r := <-tag.respchan:
 			rc := r.Rc
 			fid := r.fid
-			err := r.Rc.Type == p.Rerror
+			err := r.Rc.Type == p.Rerror || r.Rc.Type == p.Rlerror
 
 			switch r.Tc.Type {
 			case p.Tauth:
@@ -79,8 +83,7 @@ func (tag *Tag) reqproc() {
 					fid.User = nil
 				}
 
-			case p.Topen:
-			case p.Tcreate:
+			case p.Topen, p.Tlopen, p.Tcreate:
 				if !err {
 					fid.Iounit = rc.Iounit
 					fid.Qid = rc.Qid
@@ -101,7 +104,7 @@ func (tag *Tag) reqproc() {
 func (tag *Tag) Auth(afid *Fid, user p.User, aname string) error {
 	req := tag.reqAlloc()
 	req.fid = afid
-	err := p.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := p.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dialect)
 	if err != nil {
 		return err
 	}
@@ -121,7 +124,7 @@ func (tag *Tag) Attach(fid, afid *Fid, user p.User, aname string) error {
 
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := p.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := p.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dialect)
 	if err != nil {
 		return err
 	}
@@ -147,9 +150,18 @@ func (tag *Tag) Walk(fid *Fid, newfid *Fid, wnames []string) error {
 }
 
 func (tag *Tag) Open(fid *Fid, mode uint8) error {
+	var err error
+
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := p.PackTopen(req.Tc, fid.Fid, mode)
+	if tag.clnt.Dialect.Dotl() {
+		var flags uint32
+		if flags, err = lflags(mode); err == nil {
+			err = p.PackTlopen(req.Tc, fid.Fid, flags)
+		}
+	} else {
+		err = p.PackTopen(req.Tc, fid.Fid, mode)
+	}
 	if err != nil {
 		return err
 	}
@@ -161,7 +173,7 @@ func (tag *Tag) Open(fid *Fid, mode uint8) error {
 func (tag *Tag) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := p.PackTcreate(req.Tc, fid.Fid, name, perm, mode, ext, tag.clnt.Dotu)
+	err := p.PackTcreate(req.Tc, fid.Fid, name, perm, mode, ext, tag.clnt.Dialect)
 	if err != nil {
 		return err
 	}
@@ -228,7 +240,7 @@ func (tag *Tag) Stat(fid *Fid) error {
 func (tag *Tag) Wstat(fid *Fid, dir *p.Dir) error {
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := p.PackTwstat(req.Tc, fid.Fid, dir, tag.clnt.Dotu)
+	err := p.PackTwstat(req.Tc, fid.Fid, dir, tag.clnt.Dialect)
 	if err != nil {
 		return err
 	}
@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/go9p/p"
 	"strings"
 )
@@ -14,24 +15,58 @@ import (
 // were walked successfully, an Error is returned. Otherwise a slice with a
 // Qid for each walked name is returned.
 func (clnt *Clnt) Walk(fid *Fid, newfid *Fid, wnames []string) ([]p.Qid, error) {
+	return clnt.WalkContext(context.Background(), fid, newfid, wnames)
+}
+
+// Same as Walk, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the walk completes.
+func (clnt *Clnt) WalkContext(ctx context.Context, fid *Fid, newfid *Fid, wnames []string) ([]p.Qid, error) {
 	tc := clnt.NewFcall()
 	err := p.PackTwalk(tc, fid.Fid, newfid.Fid, wnames)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
 
 	newfid.walked = true
+	if len(rc.Wqid) == len(wnames) {
+		if len(rc.Wqid) > 0 {
+			newfid.Qid = rc.Wqid[len(rc.Wqid)-1]
+		} else {
+			newfid.Qid = fid.Qid
+		}
+
+		newfid.root = fid.root
+		newfid.path = walked(fid.path, wnames)
+	}
+
+	clnt.cacheValidate(rc.Wqid...)
 	return rc.Wqid, nil
 }
 
 // Walks to a named file. Returns a Fid associated with the file,
 // or an Error.
 func (clnt *Clnt) FWalk(path string) (*Fid, error) {
+	return clnt.FWalkContext(context.Background(), path)
+}
+
+// Same as FWalk, but the walk is cancelled if the context is done.
+func (clnt *Clnt) FWalkContext(ctx context.Context, path string) (*Fid, error) {
+	if clnt.Root == nil {
+		panic("clnt.Root is nil")
+	}
+
+	return clnt.walkPath(ctx, clnt.Root, path)
+}
+
+// Walks from fid to the named file. The path is relative to
+// the file associated with fid. Returns a Fid associated with
+// the file, or an Error.
+func (clnt *Clnt) walkPath(ctx context.Context, fid *Fid, path string) (*Fid, error) {
 	var err error = nil
 
 	var i, m int
@@ -47,10 +82,6 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 
 	wnames := strings.Split(path, "/")
 	newfid := clnt.FidAlloc()
-	fid := clnt.Root
-	if fid == nil {
-		panic("clnt.Root is nil")
-	}
 	newfid.User = fid.User
 
 	/* get rid of the empty names */
@@ -75,12 +106,13 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 		}
 
 		var rc *p.Fcall
-		rc, err = clnt.Rpc(tc)
+		rc, err = clnt.RpcContext(ctx, tc)
 		if err != nil {
 			goto error
 		}
 
 		newfid.walked = true
+		clnt.cacheValidate(rc.Wqid...)
 		if len(rc.Wqid) != n {
 			err = &p.Error{"file not found", p.ENOENT}
 			goto error
@@ -92,6 +124,8 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 			newfid.Qid = fid.Qid
 		}
 
+		newfid.root = fid.root
+		newfid.path = walked(fid.path, wnames[0:n])
 		wnames = wnames[n:]
 		fid = newfid
 		if len(wnames) == 0 {
@@ -4,11 +4,20 @@
 
 package clnt
 
-import "github.com/lionkov/go9p/p"
+import (
+	"context"
+	"github.com/lionkov/go9p/p"
+)
 
 // Write up to len(data) bytes starting from offset. Returns the
 // number of bytes written, or an Error.
 func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
+	return clnt.WriteContext(context.Background(), fid, data, offset)
+}
+
+// Same as Write, but the request is flushed and ctx.Err() returned
+// if the context is cancelled before the write completes.
+func (clnt *Clnt) WriteContext(ctx context.Context, fid *Fid, data []byte, offset uint64) (int, error) {
 	if uint32(len(data)) > fid.Iounit {
 		data = data[0:fid.Iounit]
 	}
@@ -19,11 +28,15 @@ func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
 		return 0, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return 0, err
 	}
 
+	if clnt.Cache != nil && rc.Count > 0 && rc.Count <= uint32(len(data)) {
+		clnt.Cache.write(&fid.Qid, offset, data[0:rc.Count])
+	}
+
 	return int(rc.Count), nil
 }
 
@@ -41,7 +54,20 @@ func (file *File) Write(buf []byte) (int, error) {
 // Writes up to len(buf) bytes starting from offset. Returns the number
 // of bytes written, or an Error.
 func (file *File) WriteAt(buf []byte, offset int64) (int, error) {
-	return file.fid.Clnt.Write(file.fid, buf, uint64(offset))
+	return file.WriteAtContext(context.Background(), buf, offset)
+}
+
+// Same as WriteAt, but the write is cancelled if the context is done.
+func (file *File) WriteAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if file.ra != nil {
+		file.ra.reset()
+	}
+
+	if file.wb != nil {
+		return file.wb.writeAt(ctx, buf, offset)
+	}
+
+	return file.fid.Clnt.WriteContext(ctx, file.fid, buf, uint64(offset))
 }
 
 // Writes exactly len(buf) bytes starting from offset. Returns the number of
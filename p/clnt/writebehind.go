@@ -0,0 +1,177 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// An outstanding write-behind request.
+type wbReq struct {
+	offset uint64
+	data   []byte
+}
+
+// The writeBehind type sends the writes to the file without
+// waiting for the responses.
+type writeBehind struct {
+	sync.Mutex
+	cond     *sync.Cond
+	file     *File
+	max      int             // maximum number of bytes in flight
+	inflight int             // number of bytes in flight
+	reqs     map[*wbReq]bool // outstanding requests
+	err      error           // first error not reported yet
+}
+
+// Enables write-behind for the File. The writes are copied, split in
+// Iounit sized chunks and sent on separate tags without waiting for
+// the responses, up to maxbytes bytes can be in flight. The first
+// error is returned by the following Write, Sync or Close. Writes to
+// overlapping ranges of the file, and all writes to append-only files,
+// are sent in order. If maxbytes is 0, write-behind is disabled and
+// the error of the outstanding writes, if any, is returned.
+func (file *File) SetWriteBehind(maxbytes int) error {
+	var err error
+	if file.wb != nil {
+		err = file.wb.wait()
+		file.wb = nil
+	}
+
+	if maxbytes > 0 {
+		wb := &writeBehind{file: file, max: maxbytes, reqs: make(map[*wbReq]bool)}
+		wb.cond = sync.NewCond(wb)
+		file.wb = wb
+	}
+
+	return err
+}
+
+// Waits for the outstanding writes and the file to be committed
+// to stable storage by the server.
+func (file *File) Sync() error {
+	if file.wb != nil {
+		if err := file.wb.wait(); err != nil {
+			return err
+		}
+	}
+
+	return file.fid.Clnt.FSync(file.fid)
+}
+
+// Returns true if an outstanding write overlaps with the range.
+// Should be called with the lock held.
+func (wb *writeBehind) overlaps(offset uint64, count int) bool {
+	for r := range wb.reqs {
+		if offset < r.offset+uint64(len(r.data)) && r.offset < offset+uint64(count) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Waits until the outstanding writes are completed.
+func (wb *writeBehind) drain() {
+	wb.Lock()
+	for wb.inflight > 0 {
+		wb.cond.Wait()
+	}
+	wb.Unlock()
+}
+
+// Waits until the outstanding writes are completed and returns the
+// error that wasn't reported yet.
+func (wb *writeBehind) wait() error {
+	wb.Lock()
+	for wb.inflight > 0 {
+		wb.cond.Wait()
+	}
+
+	err := wb.err
+	wb.err = nil
+	wb.Unlock()
+	return err
+}
+
+func (wb *writeBehind) complete(r *Req, wr *wbReq) {
+	<-r.Done
+	clnt := r.Clnt
+	err := r.Err
+	if err == nil {
+		if n := int(r.Rc.Count); n < len(wr.data) {
+			err = io.ErrShortWrite
+		} else if clnt.Cache != nil {
+			clnt.Cache.write(&wb.file.fid.Qid, wr.offset, wr.data)
+		}
+	}
+	clnt.ReqFree(r)
+
+	wb.Lock()
+	delete(wb.reqs, wr)
+	wb.inflight -= len(wr.data)
+	if err != nil && wb.err == nil {
+		wb.err = err
+	}
+	wb.cond.Broadcast()
+	wb.Unlock()
+}
+
+func (wb *writeBehind) writeAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	wb.Lock()
+	defer wb.Unlock()
+
+	if err := wb.err; err != nil {
+		wb.err = nil
+		return 0, err
+	}
+
+	fid := wb.file.fid
+	clnt := fid.Clnt
+	appendonly := fid.Mode&p.OAPPEND != 0 || fid.Qid.Type&p.QTAPPEND != 0
+	data := append([]byte(nil), buf...)
+	n := 0
+	for n < len(data) {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		m := len(data) - n
+		if m > int(fid.Iounit) {
+			m = int(fid.Iounit)
+		}
+
+		off := uint64(offset) + uint64(n)
+		for wb.inflight > 0 && (appendonly || wb.inflight+m > wb.max || wb.overlaps(off, m)) {
+			wb.cond.Wait()
+		}
+
+		tc := clnt.NewFcall()
+		err := p.PackTwrite(tc, fid.Fid, off, uint32(m), data[n:n+m])
+		if err != nil {
+			return n, err
+		}
+
+		r := clnt.ReqAlloc()
+		r.Tc = tc
+		r.Done = make(chan *Req, 1)
+		if err := clnt.Rpcnb(r); err != nil {
+			clnt.ReqFree(r)
+			return n, err
+		}
+
+		wr := &wbReq{offset: off, data: data[n : n+m]}
+		wb.reqs[wr] = true
+		wb.inflight += m
+		go wb.complete(r, wr)
+		n += m
+	}
+
+	return n, nil
+}
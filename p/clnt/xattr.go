@@ -0,0 +1,123 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Walks to the extended attribute name of the file associated with
+// fid and reads its value. If name is empty, the value is the list of
+// attribute names. Requires 9P2000.L.
+func (clnt *Clnt) xattr(fid *Fid, name string) ([]byte, error) {
+	xfid := clnt.FidAlloc()
+	tc := clnt.NewFcall()
+	err := p.PackTxattrwalk(tc, fid.Fid, xfid.Fid, name)
+	if err != nil {
+		clnt.fidpool.putId(xfid.Fid)
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		clnt.fidpool.putId(xfid.Fid)
+		return nil, err
+	}
+
+	xfid.walked = true
+	xfid.Iounit = clnt.Msize - p.IOHDRSZ
+	defer clnt.Clunk(xfid)
+
+	buf := make([]byte, 0, rc.Attrsize)
+	for uint64(len(buf)) < rc.Attrsize {
+		data, err := clnt.Read(xfid, uint64(len(buf)), uint32(rc.Attrsize-uint64(len(buf))))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) == 0 {
+			break
+		}
+
+		buf = append(buf, data...)
+	}
+
+	return buf, nil
+}
+
+// Returns the value of the extended attribute of the file associated
+// with the fid, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) GetXattr(fid *Fid, name string) ([]byte, error) {
+	if name == "" {
+		return nil, &p.Error{Err: "invalid attribute name", Errornum: p.EINVAL}
+	}
+
+	return clnt.xattr(fid, name)
+}
+
+// Returns the names of the extended attributes of the file associated
+// with the fid, or an Error. Requires 9P2000.L.
+func (clnt *Clnt) ListXattr(fid *Fid) ([]string, error) {
+	buf, err := clnt.xattr(fid, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(buf), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Sets the value of the extended attribute of the file associated
+// with the fid. The flags are the Linux setxattr flags (XATTR_CREATE,
+// XATTR_REPLACE). If value is empty, the attribute is removed.
+// Returns nil if successful. Requires 9P2000.L.
+func (clnt *Clnt) SetXattr(fid *Fid, name string, value []byte, flags uint32) error {
+	xfid := clnt.FidAlloc()
+	xfid.User = fid.User
+	_, err := clnt.Walk(fid, xfid, nil)
+	if err != nil {
+		clnt.fidpool.putId(xfid.Fid)
+		return err
+	}
+
+	tc := clnt.NewFcall()
+	err = p.PackTxattrcreate(tc, xfid.Fid, name, uint64(len(value)), flags)
+	if err == nil {
+		_, err = clnt.Rpc(tc)
+	}
+
+	if err != nil {
+		clnt.Clunk(xfid)
+		return err
+	}
+
+	xfid.Iounit = clnt.Msize - p.IOHDRSZ
+	for off := 0; off < len(value); {
+		n, err := clnt.Write(xfid, value[off:], uint64(off))
+		if err != nil {
+			clnt.Clunk(xfid)
+			return err
+		}
+
+		off += n
+	}
+
+	// the attribute is set when the fid is clunked
+	return clnt.Clunk(xfid)
+}
+
+// Removes the extended attribute of the file associated with
+// the fid. Returns nil if successful. Requires 9P2000.L.
+func (clnt *Clnt) RemoveXattr(fid *Fid, name string) error {
+	return clnt.SetXattr(fid, name, nil, 0)
+}
@@ -155,6 +155,105 @@ func (fc *Fcall) String() string {
 		ret = fmt.Sprintf("Rremove tag %d", fc.Tag)
 	case Rwstat:
 		ret = fmt.Sprintf("Rwstat tag %d", fc.Tag)
+	case Rlerror:
+		ret = fmt.Sprintf("Rlerror tag %d ecode %d", fc.Tag, fc.Errornum)
+	case Tstatfs:
+		ret = fmt.Sprintf("Tstatfs tag %d fid %d", fc.Tag, fc.Fid)
+	case Rstatfs:
+		st := &fc.Statfs
+		ret = fmt.Sprintf("Rstatfs tag %d type %x bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %x namelen %d",
+			fc.Tag, st.Type, st.Bsize, st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree, st.Fsid, st.Namelen)
+	case Tlopen:
+		ret = fmt.Sprintf("Tlopen tag %d fid %d flags %x", fc.Tag, fc.Fid, fc.Flags)
+	case Rlopen:
+		ret = fmt.Sprintf("Rlopen tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		ret = fmt.Sprintf("Tlcreate tag %d fid %d name '%s' flags %x mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Flags, fc.Perm, fc.Ngid)
+	case Rlcreate:
+		ret = fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		ret = fmt.Sprintf("Tsymlink tag %d fid %d name '%s' target '%s' gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Target, fc.Ngid)
+	case Rsymlink:
+		ret = fmt.Sprintf("Rsymlink tag %d qid %v", fc.Tag, &fc.Qid)
+	case Tmknod:
+		ret = fmt.Sprintf("Tmknod tag %d dfid %d name '%s' mode %o major %d minor %d gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Major, fc.Minor, fc.Ngid)
+	case Rmknod:
+		ret = fmt.Sprintf("Rmknod tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trename:
+		ret = fmt.Sprintf("Trename tag %d fid %d dfid %d name '%s'", fc.Tag, fc.Fid, fc.Dfid, fc.Name)
+	case Rrename:
+		ret = fmt.Sprintf("Rrename tag %d", fc.Tag)
+	case Treadlink:
+		ret = fmt.Sprintf("Treadlink tag %d fid %d", fc.Tag, fc.Fid)
+	case Rreadlink:
+		ret = fmt.Sprintf("Rreadlink tag %d target '%s'", fc.Tag, fc.Target)
+	case Tgetattr:
+		ret = fmt.Sprintf("Tgetattr tag %d fid %d mask %x", fc.Tag, fc.Fid, fc.Mask)
+	case Rgetattr:
+		a := &fc.Attr
+		ret = fmt.Sprintf("Rgetattr tag %d valid %x qid %v mode %o uid %d gid %d nlink %d rdev %d size %d blksize %d blocks %d",
+			fc.Tag, a.Valid, &a.Qid, a.Mode, a.Uid, a.Gid, a.Nlink, a.Rdev, a.Size, a.Blksize, a.Blocks)
+		ret += fmt.Sprintf(" at %d.%09d mt %d.%09d ct %d.%09d bt %d.%09d gen %d dv %d",
+			a.Atime.Sec, a.Atime.Nsec, a.Mtime.Sec, a.Mtime.Nsec, a.Ctime.Sec, a.Ctime.Nsec,
+			a.Btime.Sec, a.Btime.Nsec, a.Gen, a.DataVersion)
+	case Tsetattr:
+		sa := &fc.SetAttr
+		ret = fmt.Sprintf("Tsetattr tag %d fid %d valid %x mode %o uid %d gid %d size %d at %d.%09d mt %d.%09d",
+			fc.Tag, fc.Fid, sa.Valid, sa.Mode, sa.Uid, sa.Gid, sa.Size, sa.Atime.Sec, sa.Atime.Nsec,
+			sa.Mtime.Sec, sa.Mtime.Nsec)
+	case Rsetattr:
+		ret = fmt.Sprintf("Rsetattr tag %d", fc.Tag)
+	case Txattrwalk:
+		ret = fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name '%s'", fc.Tag, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		ret = fmt.Sprintf("Rxattrwalk tag %d size %d", fc.Tag, fc.Attrsize)
+	case Txattrcreate:
+		ret = fmt.Sprintf("Txattrcreate tag %d fid %d name '%s' size %d flags %x",
+			fc.Tag, fc.Fid, fc.Name, fc.Attrsize, fc.Flags)
+	case Rxattrcreate:
+		ret = fmt.Sprintf("Rxattrcreate tag %d", fc.Tag)
+	case Treaddir:
+		ret = fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", fc.Tag, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		ret = fmt.Sprintf("Rreaddir tag %d count %d", fc.Tag, fc.Count)
+	case Tfsync:
+		ret = fmt.Sprintf("Tfsync tag %d fid %d datasync %d", fc.Tag, fc.Fid, fc.Datasync)
+	case Rfsync:
+		ret = fmt.Sprintf("Rfsync tag %d", fc.Tag)
+	case Tlock:
+		fl := &fc.Flock
+		ret = fmt.Sprintf("Tlock tag %d fid %d type %d flags %x start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, fl.Type, fl.Flags, fl.Start, fl.Length, fl.ProcId, fl.ClientId)
+	case Rlock:
+		ret = fmt.Sprintf("Rlock tag %d status %d", fc.Tag, fc.Status)
+	case Tgetlock:
+		fl := &fc.Flock
+		ret = fmt.Sprintf("Tgetlock tag %d fid %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, fl.Type, fl.Start, fl.Length, fl.ProcId, fl.ClientId)
+	case Rgetlock:
+		fl := &fc.Flock
+		ret = fmt.Sprintf("Rgetlock tag %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fl.Type, fl.Start, fl.Length, fl.ProcId, fl.ClientId)
+	case Tlink:
+		ret = fmt.Sprintf("Tlink tag %d dfid %d fid %d name '%s'", fc.Tag, fc.Dfid, fc.Fid, fc.Name)
+	case Rlink:
+		ret = fmt.Sprintf("Rlink tag %d", fc.Tag)
+	case Tmkdir:
+		ret = fmt.Sprintf("Tmkdir tag %d dfid %d name '%s' mode %o gid %d", fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Ngid)
+	case Rmkdir:
+		ret = fmt.Sprintf("Rmkdir tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trenameat:
+		ret = fmt.Sprintf("Trenameat tag %d olddirfid %d oldname '%s' newdirfid %d newname '%s'",
+			fc.Tag, fc.Fid, fc.Name, fc.Dfid, fc.Newname)
+	case Rrenameat:
+		ret = fmt.Sprintf("Rrenameat tag %d", fc.Tag)
+	case Tunlinkat:
+		ret = fmt.Sprintf("Tunlinkat tag %d dirfid %d name '%s' flags %x", fc.Tag, fc.Fid, fc.Name, fc.Flags)
+	case Runlinkat:
+		ret = fmt.Sprintf("Runlinkat tag %d", fc.Tag)
 	}
 
 	return ret
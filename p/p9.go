@@ -3,7 +3,7 @@
 // license that can be found in the LICENSE file.
 
 // The p9 package provides the definitions and functions used to implement
-// the 9P2000 protocol.
+// the 9P2000 protocol and its 9P2000.u and 9P2000.L dialects.
 package p
 
 import (
@@ -43,6 +43,60 @@ const (
 	Tlast
 )
 
+// 9P2000.L message types
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
+// Dialect identifies the variant of the protocol spoken on a connection.
+type Dialect int
+
+// Protocol dialects
+const (
+	Dialect9P2000  Dialect = iota // plain 9P2000
+	Dialect9P2000u                // 9P2000.u (Unix extensions)
+	Dialect9P2000L                // 9P2000.L (Linux extensions)
+)
+
 const (
 	MSIZE   = 1048576 + IOHDRSZ // default message size (1048576+IOHdrSz)
 	IOHDRSZ = 24                // the non-data size of the Twrite messages
@@ -95,6 +149,95 @@ const (
 	DMEXEC      = 0x1        // mode bit for execute permission
 )
 
+// Flags for the flags field in Tlopen and Tlcreate messages (9P2000.L).
+// The values match the Linux open(2) flags.
+const (
+	LORDONLY    = 00000000 // open read-only
+	LOWRONLY    = 00000001 // open write-only
+	LORDWR      = 00000002 // open read-write
+	LOACCMODE   = 00000003 // mask for the access mode
+	LOCREATE    = 00000100 // create the file if it doesn't exist
+	LOEXCL      = 00000200 // fail if the file exists (with LOCREATE)
+	LONOCTTY    = 00000400 // don't assign a controlling terminal
+	LOTRUNC     = 00001000 // truncate file first
+	LOAPPEND    = 00002000 // append only
+	LONONBLOCK  = 00004000 // non-blocking I/O
+	LODSYNC     = 00010000 // synchronized data I/O
+	LOFASYNC    = 00020000 // signal-driven I/O
+	LODIRECT    = 00040000 // direct I/O
+	LOLARGEFILE = 00100000 // large file support
+	LODIRECTORY = 00200000 // fail if not a directory
+	LONOFOLLOW  = 00400000 // don't follow symbolic links
+	LONOATIME   = 01000000 // don't update the access time
+	LOCLOEXEC   = 02000000 // close on exec
+	LOSYNC      = 04000000 // synchronized I/O
+)
+
+// Bits in the request mask of Tgetattr and the valid mask of Rgetattr
+const (
+	GetattrMode        = 0x00000001
+	GetattrNlink       = 0x00000002
+	GetattrUid         = 0x00000004
+	GetattrGid         = 0x00000008
+	GetattrRdev        = 0x00000010
+	GetattrAtime       = 0x00000020
+	GetattrMtime       = 0x00000040
+	GetattrCtime       = 0x00000080
+	GetattrIno         = 0x00000100
+	GetattrSize        = 0x00000200
+	GetattrBlocks      = 0x00000400
+	GetattrBtime       = 0x00000800
+	GetattrGen         = 0x00001000
+	GetattrDataVersion = 0x00002000
+	GetattrBasic       = 0x000007ff // all fields up to GetattrBlocks
+	GetattrAll         = 0x00003fff // all fields
+)
+
+// Bits in the valid mask of Tsetattr
+const (
+	SetattrMode     = 0x00000001
+	SetattrUid      = 0x00000002
+	SetattrGid      = 0x00000004
+	SetattrSize     = 0x00000008
+	SetattrAtime    = 0x00000010 // set atime to the current time
+	SetattrMtime    = 0x00000020 // set mtime to the current time
+	SetattrCtime    = 0x00000040
+	SetattrAtimeSet = 0x00000080 // set atime to the value in the message
+	SetattrMtimeSet = 0x00000100 // set mtime to the value in the message
+)
+
+// Lock types used by Tlock and Tgetlock (9P2000.L)
+const (
+	LockTypeRdlck = 0 // shared (read) lock
+	LockTypeWrlck = 1 // exclusive (write) lock
+	LockTypeUnlck = 2 // unlock
+)
+
+// Lock flags used by Tlock (9P2000.L)
+const (
+	LockFlagsBlock   = 1 // blocking request
+	LockFlagsReclaim = 2 // reclaim a lock after a server restart
+)
+
+// Lock status values returned by Rlock (9P2000.L)
+const (
+	LockSuccess = 0 // the lock was acquired (or released)
+	LockBlocked = 1 // the lock is held by somebody else, retry later
+	LockError   = 2 // the lock request failed
+	LockGrace   = 3 // the server is in grace period, retry later
+)
+
+// Flags used by Txattrcreate (9P2000.L)
+const (
+	XattrCreate  = 1 // fail if the attribute already exists
+	XattrReplace = 2 // fail if the attribute doesn't exist
+)
+
+// Flags used by Tunlinkat (9P2000.L)
+const (
+	AtRemovedir = 0x200 // remove a directory instead of a file
+)
+
 const (
 	NOTAG uint16 = 0xFFFF     // no tag specified
 	NOFID uint32 = 0xFFFFFFFF // no fid specified
@@ -103,13 +246,16 @@ const (
 
 // Error values
 const (
-	EPERM   = 1
-	ENOENT  = 2
-	EIO     = 5
-	EACCES  = 13
-	EEXIST  = 17
-	ENOTDIR = 20
-	EINVAL  = 22
+	EPERM      = 1
+	ENOENT     = 2
+	EIO        = 5
+	EACCES     = 13
+	EEXIST     = 17
+	ENOTDIR    = 20
+	EINVAL     = 22
+	EROFS      = 30
+	EOPNOTSUPP = 95
+	ETIMEDOUT  = 110
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error
@@ -147,6 +293,74 @@ type Dir struct {
 	Muidnum uint32 // ID of the last user that modified the file
 }
 
+// Timespec is a time value with nanosecond precision (9P2000.L)
+type Timespec struct {
+	Sec  uint64 // seconds since the epoch
+	Nsec uint64 // nanoseconds
+}
+
+// Attr describes a file in the 9P2000.L dialect (used by Rgetattr)
+type Attr struct {
+	Valid       uint64 // mask of the fields that are set (Getattr* values)
+	Qid                // file's Qid
+	Mode        uint32 // file type and permissions (Unix st_mode)
+	Uid         uint32 // owner ID
+	Gid         uint32 // group ID
+	Nlink       uint64 // number of hard links
+	Rdev        uint64 // device ID (if special file)
+	Size        uint64 // file length in bytes
+	Blksize     uint64 // block size for file system I/O
+	Blocks      uint64 // number of 512 byte blocks allocated
+	Atime       Timespec
+	Mtime       Timespec
+	Ctime       Timespec
+	Btime       Timespec // creation time
+	Gen         uint64   // inode generation number
+	DataVersion uint64   // data version
+}
+
+// SetAttr describes the changes of a file's attributes (used by Tsetattr)
+type SetAttr struct {
+	Valid uint32 // mask of the fields to change (Setattr* values)
+	Mode  uint32 // file permissions
+	Uid   uint32 // owner ID
+	Gid   uint32 // group ID
+	Size  uint64 // file length in bytes
+	Atime Timespec
+	Mtime Timespec
+}
+
+// Statfs describes a file system (used by Rstatfs)
+type Statfs struct {
+	Type    uint32 // type of the file system
+	Bsize   uint32 // block size
+	Blocks  uint64 // total number of blocks
+	Bfree   uint64 // free blocks
+	Bavail  uint64 // free blocks available to unprivileged users
+	Files   uint64 // total number of files
+	Ffree   uint64 // free file nodes
+	Fsid    uint64 // file system ID
+	Namelen uint32 // maximum length of file names
+}
+
+// Flock describes a POSIX byte-range lock (used by Tlock, Tgetlock, Rgetlock)
+type Flock struct {
+	Type     uint8  // lock type (LockType* values)
+	Flags    uint32 // lock flags (LockFlags* values, Tlock only)
+	Start    uint64 // starting offset of the lock
+	Length   uint64 // length of the lock, 0 means to the end of the file
+	ProcId   uint32 // process ID of the lock owner
+	ClientId string // client ID of the lock owner
+}
+
+// Dirent describes a directory entry returned by Rreaddir (9P2000.L)
+type Dirent struct {
+	Qid           // file's Qid
+	Offset uint64 // offset of the next entry
+	Type   uint8  // file type (Linux DT_* values)
+	Name   string // file name
+}
+
 // Fcall represents a 9P2000 message
 type Fcall struct {
 	Size    uint32   // size of the message
@@ -174,9 +388,26 @@ type Fcall struct {
 	Dir              // file description (used by Rstat, Twstat)
 
 	/* 9P2000.u extensions */
-	Errornum uint32 // error code, 9P2000.u only (used by Rerror)
+	Errornum uint32 // error code, 9P2000.u and 9P2000.L (used by Rerror, Rlerror)
 	Ext      string // special file description, 9P2000.u only (used by Tcreate)
-	Unamenum uint32 // user ID, 9P2000.u only (used by Tauth, Tattach)
+	Unamenum uint32 // user ID, 9P2000.u and 9P2000.L (used by Tauth, Tattach)
+
+	/* 9P2000.L extensions */
+	Flags    uint32  // open flags (used by Tlopen, Tlcreate), Txattrcreate and Tunlinkat flags
+	Ngid     uint32  // group ID of the new file (used by Tlcreate, Tsymlink, Tmknod, Tmkdir)
+	Major    uint32  // major device number (used by Tmknod)
+	Minor    uint32  // minor device number (used by Tmknod)
+	Dfid     uint32  // target directory (used by Trename, Trenameat, Tlink)
+	Newname  string  // new file name (used by Trenameat)
+	Target   string  // symbolic link target (used by Tsymlink, Rreadlink)
+	Mask     uint64  // mask of the requested attributes (used by Tgetattr)
+	Attr     Attr    // file attributes (used by Rgetattr)
+	SetAttr  SetAttr // attribute changes (used by Tsetattr)
+	Statfs   Statfs  // file system description (used by Rstatfs)
+	Flock    Flock   // lock description (used by Tlock, Tgetlock, Rgetlock)
+	Status   uint8   // lock status (used by Rlock)
+	Attrsize uint64  // size of the extended attribute (used by Rxattrwalk, Txattrcreate)
+	Datasync uint32  // if not 0, sync only the data (used by Tfsync)
 
 	Pkt []uint8 // raw packet data
 	Buf []uint8 // buffer to put the raw data in
@@ -243,13 +474,14 @@ var minFcsize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
-// minimum size of a 9P2000.u message for a type
+// minimum size of a 9P2000.u message for a type, n_uname in Tauth and
+// Tattach is optional so that clients that don't send it are accepted
 var minFcusize = [...]uint32{
 	6,  /* Tversion msize[4] version[s] */
 	6,  /* Rversion msize[4] version[s] */
-	12, /* Tauth fid[4] uname[s] aname[s] */
+	8,  /* Tauth fid[4] uname[s] aname[s] (n_uname[4]) */
 	13, /* Rauth aqid[13] */
-	16, /* Tattach fid[4] afid[4] uname[s] aname[s] */
+	12, /* Tattach fid[4] afid[4] uname[s] aname[s] (n_uname[4]) */
 	13, /* Rattach qid[13] */
 	0,  /* Terror */
 	6,  /* Rerror ename[s] (ecode[4]) */
@@ -281,6 +513,89 @@ var minFcusize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
+// minimum size of a 9P2000.L specific message for a type
+var minFclsize = map[uint8]uint32{
+	Rlerror:      4,   /* ecode[4] */
+	Tstatfs:      4,   /* fid[4] */
+	Rstatfs:      60,  /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	Tlopen:       8,   /* fid[4] flags[4] */
+	Rlopen:       17,  /* qid[13] iounit[4] */
+	Tlcreate:     18,  /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	Rlcreate:     17,  /* qid[13] iounit[4] */
+	Tsymlink:     12,  /* fid[4] name[s] symtgt[s] gid[4] */
+	Rsymlink:     13,  /* qid[13] */
+	Tmknod:       22,  /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	Rmknod:       13,  /* qid[13] */
+	Trename:      10,  /* fid[4] dfid[4] name[s] */
+	Rrename:      0,   /* */
+	Treadlink:    4,   /* fid[4] */
+	Rreadlink:    2,   /* target[s] */
+	Tgetattr:     12,  /* fid[4] request_mask[8] */
+	Rgetattr:     153, /* valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8] */
+	Tsetattr:     60,  /* fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16] */
+	Rsetattr:     0,   /* */
+	Txattrwalk:   10,  /* fid[4] newfid[4] name[s] */
+	Rxattrwalk:   8,   /* size[8] */
+	Txattrcreate: 18,  /* fid[4] name[s] attr_size[8] flags[4] */
+	Rxattrcreate: 0,   /* */
+	Treaddir:     16,  /* fid[4] offset[8] count[4] */
+	Rreaddir:     4,   /* count[4] */
+	Tfsync:       4,   /* fid[4] (datasync[4]) */
+	Rfsync:       0,   /* */
+	Tlock:        31,  /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	Rlock:        1,   /* status[1] */
+	Tgetlock:     27,  /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Rgetlock:     23,  /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Tlink:        10,  /* dfid[4] fid[4] name[s] */
+	Rlink:        0,   /* */
+	Tmkdir:       14,  /* dfid[4] name[s] mode[4] gid[4] */
+	Rmkdir:       13,  /* qid[13] */
+	Trenameat:    12,  /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	Rrenameat:    0,   /* */
+	Tunlinkat:    10,  /* dirfd[4] name[s] flags[4] */
+	Runlinkat:    0,   /* */
+}
+
+var dialectVersions = [...]string{
+	Dialect9P2000:  "9P2000",
+	Dialect9P2000u: "9P2000.u",
+	Dialect9P2000L: "9P2000.L",
+}
+
+// Returns the version string used in the Tversion and Rversion
+// messages for the dialect.
+func (d Dialect) String() string {
+	if d < 0 || int(d) >= len(dialectVersions) {
+		return "unknown"
+	}
+
+	return dialectVersions[d]
+}
+
+// Dotu returns true if the messages shared with 9P2000 carry the
+// 9P2000.u specific fields. This is the case for both 9P2000.u and
+// 9P2000.L.
+func (d Dialect) Dotu() bool {
+	return d == Dialect9P2000u || d == Dialect9P2000L
+}
+
+// Dotl returns true if the dialect is 9P2000.L.
+func (d Dialect) Dotl() bool {
+	return d == Dialect9P2000L
+}
+
+// Returns the dialect for a version string received in Tversion or
+// Rversion. If the version string is not known, returns false.
+func ParseDialect(version string) (Dialect, bool) {
+	for d, v := range dialectVersions {
+		if v == version {
+			return Dialect(d), true
+		}
+	}
+
+	return Dialect9P2000, false
+}
+
 func gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:] }
 
 func gint16(buf []byte) (uint16, []byte) {
@@ -325,7 +640,14 @@ func gqid(buf []byte, qid *Qid) []byte {
 	return buf
 }
 
-func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
+func gtime(buf []byte, t *Timespec) []byte {
+	t.Sec, buf = gint64(buf)
+	t.Nsec, buf = gint64(buf)
+
+	return buf
+}
+
+func gstat(buf []byte, d *Dir, dialect Dialect) ([]byte, error) {
 	sz := len(buf)
 	d.Size, buf = gint16(buf)
 	d.Type, buf = gint16(buf)
@@ -356,7 +678,7 @@ func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
 		return nil, &Error{"d.Muid failed", EINVAL}
 	}
 
-	if dotu {
+	if dialect.Dotu() {
 		d.Ext, buf = gstr(buf)
 		if buf == nil {
 			return nil, &Error{"d.Ext failed", EINVAL}
@@ -421,16 +743,23 @@ func pqid(val *Qid, buf []byte) []byte {
 	return buf
 }
 
-func statsz(d *Dir, dotu bool) int {
+func ptime(t *Timespec, buf []byte) []byte {
+	buf = pint64(t.Sec, buf)
+	buf = pint64(t.Nsec, buf)
+
+	return buf
+}
+
+func statsz(d *Dir, dialect Dialect) int {
 	sz := 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 2 + 2 + 2 + 2 + len(d.Name) + len(d.Uid) + len(d.Gid) + len(d.Muid)
-	if dotu {
+	if dialect.Dotu() {
 		sz += 2 + 4 + 4 + 4 + len(d.Ext)
 	}
 	return sz
 }
 
-func pstat(d *Dir, buf []byte, dotu bool) []byte {
-	sz := statsz(d, dotu)
+func pstat(d *Dir, buf []byte, dialect Dialect) []byte {
+	sz := statsz(d, dialect)
 	buf = pint16(uint16(sz-2), buf)
 	buf = pint16(d.Type, buf)
 	buf = pint32(d.Dev, buf)
@@ -443,7 +772,7 @@ func pstat(d *Dir, buf []byte, dotu bool) []byte {
 	buf = pstr(d.Uid, buf)
 	buf = pstr(d.Gid, buf)
 	buf = pstr(d.Muid, buf)
-	if dotu {
+	if dialect.Dotu() {
 		buf = pstr(d.Ext, buf)
 		buf = pint32(d.Uidnum, buf)
 		buf = pint32(d.Gidnum, buf)
@@ -455,22 +784,22 @@ func pstat(d *Dir, buf []byte, dotu bool) []byte {
 
 // Converts a Dir value to its on-the-wire representation and writes it to
 // the buf. Returns the number of bytes written, 0 if there is not enough space.
-func PackDir(d *Dir, dotu bool) []byte {
-	sz := statsz(d, dotu)
+func PackDir(d *Dir, dialect Dialect) []byte {
+	sz := statsz(d, dialect)
 	buf := make([]byte, sz)
-	pstat(d, buf, dotu)
+	pstat(d, buf, dialect)
 	return buf
 }
 
 // Converts the on-the-wire representation of a stat to Stat value.
 // Returns an error if the conversion is impossible, otherwise
 // a pointer to a Stat value.
-func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
+func UnpackDir(buf []byte, dialect Dialect) (d *Dir, b []byte, amt int, err error) {
 	sz := 2 + 2 + 4 + 13 + 4 + /* size[2] type[2] dev[4] qid[13] mode[4] */
 		4 + 4 + 8 + /* atime[4] mtime[4] length[8] */
 		2 + 2 + 2 + 2 /* name[s] uid[s] gid[s] muid[s] */
 
-	if dotu {
+	if dialect.Dotu() {
 		sz += 2 + 4 + 4 + 4 /* extension[s] n_uid[4] n_gid[4] n_muid[4] */
 	}
 
@@ -480,7 +809,7 @@ func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
 	}
 
 	d = new(Dir)
-	b, err = gstat(buf, d, dotu)
+	b, err = gstat(buf, d, dialect)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -489,6 +818,49 @@ func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
 
 }
 
+// Returns the size of the on-the-wire representation of the Dirent.
+func DirentSize(d *Dirent) int {
+	return 13 + 8 + 1 + 2 + len(d.Name) /* qid[13] offset[8] type[1] name[s] */
+}
+
+// Converts a Dirent value to its on-the-wire representation and writes it
+// to buf. Returns the number of bytes written, 0 if there is not enough space.
+func PackDirent(d *Dirent, buf []byte) int {
+	sz := DirentSize(d)
+	if len(buf) < sz {
+		return 0
+	}
+
+	buf = pqid(&d.Qid, buf)
+	buf = pint64(d.Offset, buf)
+	buf = pint8(d.Type, buf)
+	buf = pstr(d.Name, buf)
+	return sz
+}
+
+// Converts the on-the-wire representation of a directory entry returned
+// by Rreaddir to a Dirent value. Returns an error if the conversion is
+// impossible, otherwise a pointer to a Dirent value, the rest of the
+// buffer and the number of bytes used.
+func UnpackDirent(buf []byte) (d *Dirent, b []byte, amt int, err error) {
+	sz := 13 + 8 + 1 + 2 /* qid[13] offset[8] type[1] name[s] */
+	if len(buf) < sz {
+		s := fmt.Sprintf("short buffer: Need %d and have %v", sz, len(buf))
+		return nil, nil, 0, &Error{s, EINVAL}
+	}
+
+	d = new(Dirent)
+	b = gqid(buf, &d.Qid)
+	d.Offset, b = gint64(b)
+	d.Type, b = gint8(b)
+	d.Name, b = gstr(b)
+	if b == nil {
+		return nil, nil, 0, &Error{"d.Name failed", EINVAL}
+	}
+
+	return d, b, len(buf) - len(b), nil
+}
+
 // ChangeMode returns true if Dir contains a mode change value. This should be used in
 // conjunction with Twstat and Rwstat.
 func (d *Dir) ChangeMode() bool {
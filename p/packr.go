@@ -33,12 +33,17 @@ func PackRauth(fc *Fcall, aqid *Qid) error {
 	return nil
 }
 
-// Create a Rerror message in the specified Fcall. If dotu is true,
-// the function will create a 9P2000.u message. If false, nerror is
-// ignored.
-func PackRerror(fc *Fcall, error string, errornum uint32, dotu bool) error {
+// Create a Rerror message in the specified Fcall. If the dialect is
+// 9P2000.u, the function will create a 9P2000.u message. If 9P2000,
+// nerror is ignored. 9P2000.L doesn't have Rerror, so for that dialect
+// the function creates a Rlerror message and the error string is ignored.
+func PackRerror(fc *Fcall, error string, errornum uint32, dialect Dialect) error {
+	if dialect.Dotl() {
+		return PackRlerror(fc, errornum)
+	}
+
 	size := 2 + len(error) /* ename[s] */
-	if dotu {
+	if dialect.Dotu() {
 		size += 4 /* ecode[4] */
 	}
 
@@ -49,7 +54,7 @@ func PackRerror(fc *Fcall, error string, errornum uint32, dotu bool) error {
 
 	fc.Error = error
 	p = pstr(error, p)
-	if dotu {
+	if dialect.Dotu() {
 		fc.Errornum = errornum
 		p = pint32(errornum, p)
 	}
@@ -194,12 +199,12 @@ func PackRremove(fc *Fcall) error {
 	return err
 }
 
-// Create a Rstat message in the specified Fcall. If dotu is true, the
-// function will create a 9P2000.u stat representation that includes
-// st.Nuid, st.Ngid, st.Nmuid and st.Ext. Otherwise these values will be
-// ignored.
-func PackRstat(fc *Fcall, d *Dir, dotu bool) error {
-	stsz := statsz(d, dotu)
+// Create a Rstat message in the specified Fcall. If the dialect is
+// 9P2000.u or 9P2000.L, the function will create a 9P2000.u stat
+// representation that includes st.Nuid, st.Ngid, st.Nmuid and st.Ext.
+// Otherwise these values will be ignored.
+func PackRstat(fc *Fcall, d *Dir, dialect Dialect) error {
+	stsz := statsz(d, dialect)
 	size := 2 + stsz /* stat[n] */
 	p, err := packCommon(fc, size, Rstat)
 	if err != nil {
@@ -207,7 +212,7 @@ func PackRstat(fc *Fcall, d *Dir, dotu bool) error {
 	}
 
 	p = pint16(uint16(stsz), p)
-	p = pstat(d, p, dotu)
+	p = pstat(d, p, dialect)
 	fc.Dir = *d
 	return nil
 }
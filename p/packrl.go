@@ -0,0 +1,269 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p
+
+// Create a Rlerror message in the specified Fcall.
+func PackRlerror(fc *Fcall, errornum uint32) error {
+	p, err := packCommon(fc, 4, Rlerror) /* ecode[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Errornum = errornum
+	p = pint32(errornum, p)
+	return nil
+}
+
+// Create a Rstatfs message in the specified Fcall.
+func PackRstatfs(fc *Fcall, st *Statfs) error {
+	size := 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 4 /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	p, err := packCommon(fc, size, Rstatfs)
+	if err != nil {
+		return err
+	}
+
+	fc.Statfs = *st
+	p = pint32(st.Type, p)
+	p = pint32(st.Bsize, p)
+	p = pint64(st.Blocks, p)
+	p = pint64(st.Bfree, p)
+	p = pint64(st.Bavail, p)
+	p = pint64(st.Files, p)
+	p = pint64(st.Ffree, p)
+	p = pint64(st.Fsid, p)
+	p = pint32(st.Namelen, p)
+	return nil
+}
+
+// Create a Rlopen message in the specified Fcall.
+func PackRlopen(fc *Fcall, qid *Qid, iounit uint32) error {
+	size := 13 + 4 /* qid[13] iounit[4] */
+	p, err := packCommon(fc, size, Rlopen)
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+// Create a Rlcreate message in the specified Fcall.
+func PackRlcreate(fc *Fcall, qid *Qid, iounit uint32) error {
+	size := 13 + 4 /* qid[13] iounit[4] */
+	p, err := packCommon(fc, size, Rlcreate)
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+// Create a Rsymlink message in the specified Fcall.
+func PackRsymlink(fc *Fcall, qid *Qid) error {
+	p, err := packCommon(fc, 13, Rsymlink) /* qid[13] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	p = pqid(qid, p)
+	return nil
+}
+
+// Create a Rmknod message in the specified Fcall.
+func PackRmknod(fc *Fcall, qid *Qid) error {
+	p, err := packCommon(fc, 13, Rmknod) /* qid[13] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	p = pqid(qid, p)
+	return nil
+}
+
+// Create a Rrename message in the specified Fcall.
+func PackRrename(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrename)
+	return err
+}
+
+// Create a Rreadlink message in the specified Fcall.
+func PackRreadlink(fc *Fcall, target string) error {
+	size := 2 + len(target) /* target[s] */
+	p, err := packCommon(fc, size, Rreadlink)
+	if err != nil {
+		return err
+	}
+
+	fc.Target = target
+	p = pstr(target, p)
+	return nil
+}
+
+// Create a Rgetattr message in the specified Fcall.
+func PackRgetattr(fc *Fcall, a *Attr) error {
+	size := 8 + 13 + 4 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + 16 + 16 + 16 + 16 + 8 + 8
+	/* valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8]
+	   atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8] */
+	p, err := packCommon(fc, size, Rgetattr)
+	if err != nil {
+		return err
+	}
+
+	fc.Attr = *a
+	p = pint64(a.Valid, p)
+	p = pqid(&a.Qid, p)
+	p = pint32(a.Mode, p)
+	p = pint32(a.Uid, p)
+	p = pint32(a.Gid, p)
+	p = pint64(a.Nlink, p)
+	p = pint64(a.Rdev, p)
+	p = pint64(a.Size, p)
+	p = pint64(a.Blksize, p)
+	p = pint64(a.Blocks, p)
+	p = ptime(&a.Atime, p)
+	p = ptime(&a.Mtime, p)
+	p = ptime(&a.Ctime, p)
+	p = ptime(&a.Btime, p)
+	p = pint64(a.Gen, p)
+	p = pint64(a.DataVersion, p)
+	return nil
+}
+
+// Create a Rsetattr message in the specified Fcall.
+func PackRsetattr(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rsetattr)
+	return err
+}
+
+// Create a Rxattrwalk message in the specified Fcall.
+func PackRxattrwalk(fc *Fcall, attrsize uint64) error {
+	p, err := packCommon(fc, 8, Rxattrwalk) /* size[8] */
+	if err != nil {
+		return err
+	}
+
+	fc.Attrsize = attrsize
+	p = pint64(attrsize, p)
+	return nil
+}
+
+// Create a Rxattrcreate message in the specified Fcall.
+func PackRxattrcreate(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rxattrcreate)
+	return err
+}
+
+// Initializes the specified Fcall value to contain Rreaddir message.
+// The user should pack the directory entries (see PackDirent) in the
+// slice pointed by fc.Data and call SetRreaddirCount to update the
+// data size to the actual value.
+func InitRreaddir(fc *Fcall, count uint32) error {
+	size := int(4 + count) /* count[4] data[count] */
+	p, err := packCommon(fc, size, Rreaddir)
+	if err != nil {
+		return err
+	}
+
+	fc.Count = count
+	fc.Data = p[4 : fc.Count+4]
+	p = pint32(count, p)
+	return nil
+}
+
+// Updates the size of the data returned by Rreaddir. Expects that
+// the Fcall value is already initialized by InitRreaddir.
+func SetRreaddirCount(fc *Fcall, count uint32) {
+	// Rreaddir has the same layout as Rread
+	SetRreadCount(fc, count)
+}
+
+// Create a Rreaddir message in the specified Fcall. The data should
+// contain directory entries packed by PackDirent.
+func PackRreaddir(fc *Fcall, data []byte) error {
+	count := uint32(len(data))
+	err := InitRreaddir(fc, count)
+	if err != nil {
+		return err
+	}
+
+	copy(fc.Data, data)
+	return nil
+}
+
+// Create a Rfsync message in the specified Fcall.
+func PackRfsync(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rfsync)
+	return err
+}
+
+// Create a Rlock message in the specified Fcall.
+func PackRlock(fc *Fcall, status uint8) error {
+	p, err := packCommon(fc, 1, Rlock) /* status[1] */
+	if err != nil {
+		return err
+	}
+
+	fc.Status = status
+	p = pint8(status, p)
+	return nil
+}
+
+// Create a Rgetlock message in the specified Fcall. The Flags
+// field of fl is ignored.
+func PackRgetlock(fc *Fcall, fl *Flock) error {
+	size := 1 + 8 + 8 + 4 + 2 + len(fl.ClientId) /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Rgetlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Flock = *fl
+	fc.Flock.Flags = 0
+	p = pint8(fl.Type, p)
+	p = pint64(fl.Start, p)
+	p = pint64(fl.Length, p)
+	p = pint32(fl.ProcId, p)
+	p = pstr(fl.ClientId, p)
+	return nil
+}
+
+// Create a Rlink message in the specified Fcall.
+func PackRlink(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rlink)
+	return err
+}
+
+// Create a Rmkdir message in the specified Fcall.
+func PackRmkdir(fc *Fcall, qid *Qid) error {
+	p, err := packCommon(fc, 13, Rmkdir) /* qid[13] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	p = pqid(qid, p)
+	return nil
+}
+
+// Create a Rrenameat message in the specified Fcall.
+func PackRrenameat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrenameat)
+	return err
+}
+
+// Create a Runlinkat message in the specified Fcall.
+func PackRunlinkat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Runlinkat)
+	return err
+}
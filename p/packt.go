@@ -21,9 +21,9 @@ func PackTversion(fc *Fcall, msize uint32, version string) error {
 }
 
 // Create a Tauth message in the specified Fcall.
-func PackTauth(fc *Fcall, fid uint32, uname string, aname string, unamenum uint32, dotu bool) error {
+func PackTauth(fc *Fcall, fid uint32, uname string, aname string, unamenum uint32, dialect Dialect) error {
 	size := 4 + 2 + 2 + len(uname) + len(aname) /* fid[4] uname[s] aname[s] */
-	if dotu {
+	if dialect.Dotu() {
 		size += 4 /* n_uname[4] */
 	}
 
@@ -38,7 +38,7 @@ func PackTauth(fc *Fcall, fid uint32, uname string, aname string, unamenum uint3
 	p = pint32(fid, p)
 	p = pstr(uname, p)
 	p = pstr(aname, p)
-	if dotu {
+	if dialect.Dotu() {
 		fc.Unamenum = unamenum
 		p = pint32(unamenum, p)
 	}
@@ -58,12 +58,12 @@ func PackTflush(fc *Fcall, oldtag uint16) error {
 	return nil
 }
 
-// Create a Tattach message in the specified Fcall. If dotu is true,
-// the function will create 9P2000.u including the nuname value, otherwise
-// nuname is ignored.
-func PackTattach(fc *Fcall, fid uint32, afid uint32, uname string, aname string, unamenum uint32, dotu bool) error {
+// Create a Tattach message in the specified Fcall. If the dialect is
+// 9P2000.u or 9P2000.L, the function will include the nuname value,
+// otherwise nuname is ignored.
+func PackTattach(fc *Fcall, fid uint32, afid uint32, uname string, aname string, unamenum uint32, dialect Dialect) error {
 	size := 4 + 4 + 2 + len(uname) + 2 + len(aname) /* fid[4] afid[4] uname[s] aname[s] */
-	if dotu {
+	if dialect.Dotu() {
 		size += 4
 	}
 
@@ -80,7 +80,7 @@ func PackTattach(fc *Fcall, fid uint32, afid uint32, uname string, aname string,
 	p = pint32(afid, p)
 	p = pstr(uname, p)
 	p = pstr(aname, p)
-	if dotu {
+	if dialect.Dotu() {
 		fc.Unamenum = unamenum
 		p = pint32(unamenum, p)
 	}
@@ -130,13 +130,13 @@ func PackTopen(fc *Fcall, fid uint32, mode uint8) error {
 	return nil
 }
 
-// Create a Tcreate message in the specified Fcall. If dotu is true,
-// the function will create a 9P2000.u message that includes ext.
-// Otherwise the ext value is ignored.
-func PackTcreate(fc *Fcall, fid uint32, name string, perm uint32, mode uint8, ext string, dotu bool) error {
+// Create a Tcreate message in the specified Fcall. If the dialect is
+// 9P2000.u or 9P2000.L, the function will create a message that includes
+// ext. Otherwise the ext value is ignored.
+func PackTcreate(fc *Fcall, fid uint32, name string, perm uint32, mode uint8, ext string, dialect Dialect) error {
 	size := 4 + 2 + len(name) + 4 + 1 /* fid[4] name[s] perm[4] mode[1] */
 
-	if dotu {
+	if dialect.Dotu() {
 		size += 2 + len(ext)
 	}
 
@@ -154,7 +154,7 @@ func PackTcreate(fc *Fcall, fid uint32, name string, perm uint32, mode uint8, ex
 	p = pint32(perm, p)
 	p = pint8(mode, p)
 
-	if dotu {
+	if dialect.Dotu() {
 		fc.Ext = ext
 		p = pstr(ext, p)
 	}
@@ -235,11 +235,11 @@ func PackTstat(fc *Fcall, fid uint32) error {
 	return nil
 }
 
-// Create a Twstat message in the specified Fcall. If dotu is true
-// the function will create 9P2000.u message, otherwise the 9P2000.u
-// specific fields from the Stat value will be ignored.
-func PackTwstat(fc *Fcall, fid uint32, d *Dir, dotu bool) error {
-	stsz := statsz(d, dotu)
+// Create a Twstat message in the specified Fcall. If the dialect is
+// 9P2000.u or 9P2000.L the function will include the 9P2000.u specific
+// fields from the Stat value, otherwise they will be ignored.
+func PackTwstat(fc *Fcall, fid uint32, d *Dir, dialect Dialect) error {
+	stsz := statsz(d, dialect)
 	size := 4 + 2 + stsz /* fid[4] stat[n] */
 	p, err := packCommon(fc, size, Twstat)
 	if err != nil {
@@ -250,6 +250,6 @@ func PackTwstat(fc *Fcall, fid uint32, d *Dir, dotu bool) error {
 	fc.Dir = *d
 	p = pint32(fid, p)
 	p = pint16(uint16(stsz), p)
-	p = pstat(d, p, dotu)
+	p = pstat(d, p, dialect)
 	return nil
 }
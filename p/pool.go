@@ -0,0 +1,48 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p
+
+import (
+	"sync"
+)
+
+// The FcallPool type recycles Fcalls with buffers of the same size.
+// It can be used by multiple goroutines.
+type FcallPool struct {
+	size uint32
+	pool sync.Pool
+}
+
+// Creates a pool of Fcalls with buffers of sz bytes.
+func NewFcallPool(sz uint32) *FcallPool {
+	fp := &FcallPool{size: sz}
+	fp.pool.New = func() interface{} { return NewFcall(sz) }
+	return fp
+}
+
+// Returns the size of the buffers of the pool's Fcalls.
+func (fp *FcallPool) Size() uint32 {
+	return fp.size
+}
+
+// Returns a Fcall from the pool, or allocates a new one.
+func (fp *FcallPool) Get() *Fcall {
+	return fp.pool.Get().(*Fcall)
+}
+
+// Returns the Fcall to the pool. The Fcall, its buffer and the
+// slices pointing to the buffer or reused by UnpackFcall (Pkt, Data,
+// Wname, Wqid) shouldn't be used afterwards. The buffer can be resliced to a smaller length,
+// Fcalls with buffers of different capacity are dropped.
+func (fp *FcallPool) Put(fc *Fcall) {
+	if fc == nil || cap(fc.Buf) != int(fp.size) {
+		return
+	}
+
+	fc.Buf = fc.Buf[:fp.size]
+	fc.Pkt = nil
+	fc.Data = nil
+	fp.pool.Put(fc)
+}
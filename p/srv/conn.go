@@ -5,8 +5,11 @@
 package srv
 
 import (
+	"bufio"
+	"context"
 	"github.com/lionkov/go9p/p"
 	"fmt"
+	"io"
 	"log"
 	"net"
 )
@@ -16,19 +19,31 @@ func (srv *Srv) NewConn(c net.Conn) {
 	conn.Srv = srv
 	conn.Msize = srv.Msize
 	conn.Dotu = srv.Dotu
+	if conn.Dotu {
+		conn.Dialect = p.Dialect9P2000u
+	}
 	conn.Debuglevel = srv.Debuglevel
 	conn.conn = c
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
 	conn.Fidpool = make(map[uint32]*Fid)
 	conn.Reqs = make(map[uint16]*Req)
 	conn.Reqout = make(chan *Req, srv.Maxpend)
 	conn.done = make(chan bool)
-	conn.rchan = make(chan *p.Fcall, 64)
+	conn.space = make(chan bool, 1)
 
+	// checked together with adding the connection, so Shutdown
+	// either refuses it or sees it
 	srv.Lock()
+	if srv.shutdown {
+		srv.Unlock()
+		c.Close()
+		return
+	}
 	if srv.conns == nil {
 		srv.conns = make(map[*Conn]*Conn)
 	}
 	srv.conns[conn] = conn
+	srv.connwg.Add(1)
 	srv.Unlock()
 
 	conn.Id = c.RemoteAddr().String()
@@ -45,6 +60,7 @@ func (srv *Srv) NewConn(c net.Conn) {
 }
 
 func (conn *Conn) close() {
+	conn.cancel()
 	conn.done <- true
 	conn.Srv.Lock()
 	delete(conn.Srv.conns, conn)
@@ -57,122 +73,141 @@ func (conn *Conn) close() {
 		op.ConnClosed(conn)
 	}
 
+	conn.Srv.locks.releaseConn(conn)
+
 	/* call FidDestroy for all remaining fids */
 	if op, ok := (conn.Srv.ops).(FidOps); ok {
 		for _, fid := range conn.Fidpool {
 			op.FidDestroy(fid)
 		}
 	}
+
+	conn.Srv.connwg.Done()
 }
 
-func (conn *Conn) recv() {
-	var err error
-	var n int
+// Size of the buffer used to read the messages.
+const recvBufSize = 8192
 
-	buf := make([]byte, conn.Msize*8)
-	pos := 0
+func (conn *Conn) recv() {
+	var sz [4]byte
+
+	// The messages are read into Fcalls from the server's pool,
+	// they are recycled once the responses are sent. The buffered
+	// reader is small, so the data of the large Twrites is read
+	// directly into the Fcalls and passed to the file server
+	// without copying.
+	rd := bufio.NewReaderSize(conn.conn, recvBufSize)
 	for {
-		if len(buf) < int(conn.Msize) {
-			b := make([]byte, conn.Msize*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
+		if _, err := io.ReadFull(rd, sz[:]); err != nil {
+			conn.close()
+			return
 		}
 
-		n, err = conn.conn.Read(buf[pos:])
-		if err != nil || n == 0 {
+		n, _ := p.Gint32(sz[:])
+		if n > conn.Msize || n < 7 {
+			log.Println("bad client connection: ", conn.conn.RemoteAddr())
+			conn.conn.Close()
 			conn.close()
 			return
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := p.Gint32(buf)
-			if sz > conn.Msize {
-				log.Println("bad client connection: ", conn.conn.RemoteAddr())
-				conn.conn.Close()
-				conn.close()
-				return
-			}
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, conn.Msize*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
-
-				break
-			}
-			fc, err, fcsize := p.Unpack(buf, conn.Dotu)
-			if err != nil {
-				log.Println(fmt.Sprintf("invalid packet : %v %v", err, buf))
-				conn.conn.Close()
-				conn.close()
-				return
-			}
+		fc := conn.newFcall()
+		copy(fc.Buf, sz[:])
+		if _, err := io.ReadFull(rd, fc.Buf[4:n]); err != nil {
+			conn.close()
+			return
+		}
 
-			tag := fc.Tag
-			req := new(Req)
-			select {
-			case req.Rc = <-conn.rchan:
-				break
-			default:
-				req.Rc = p.NewFcall(conn.Msize)
-			}
+		err, _ := p.UnpackFcall(fc, fc.Buf[0:n], conn.Dialect)
+		if err != nil {
+			log.Println(fmt.Sprintf("invalid packet : %v %v", err, fc.Buf[0:n]))
+			conn.conn.Close()
+			conn.close()
+			return
+		}
 
-			req.Conn = conn
-			req.Tc = fc
-			//			req.Rc = rc
-			if conn.Debuglevel > 0 {
-				conn.logFcall(req.Tc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println(">->", conn.Id, fmt.Sprint(req.Tc.Pkt))
-				}
+		// the flushes are accepted even if there are
+		// too many outstanding requests
+		if conn.Srv.Maxreqs > 0 && fc.Type != p.Tflush {
+			conn.throttle()
+		}
 
-				if conn.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println(">>>", conn.Id, req.Tc.String())
-				}
+		tag := fc.Tag
+		req := new(Req)
+		req.Rc = conn.newFcall()
+
+		req.Conn = conn
+		req.Tc = fc
+		req.init()
+		//			req.Rc = rc
+		if conn.Debuglevel > 0 {
+			conn.logFcall(req.Tc)
+			if conn.Debuglevel&DbgPrintPackets != 0 {
+				log.Println(">->", conn.Id, fmt.Sprint(req.Tc.Pkt))
 			}
 
-			conn.Lock()
-			conn.nreqs++
-			conn.tsz += uint64(fc.Size)
-			conn.npend++
-			if conn.npend > conn.maxpend {
-				conn.maxpend = conn.npend
+			if conn.Debuglevel&DbgPrintFcalls != 0 {
+				log.Println(">>>", conn.Id, req.Tc.String())
 			}
+		}
 
-			req.next = conn.Reqs[tag]
-			conn.Reqs[tag] = req
-			process := req.next == nil
-			if req.next != nil {
-				req.next.prev = req
-			}
-			conn.Unlock()
-			if process {
-				// Tversion may change some attributes of the
-				// connection, so we block on it. Otherwise,
-				// we may loop back to reading and that is a race.
-				// This fix brought to you by the race detector.
-				if req.Tc.Type == p.Tversion {
-					req.process()
-				} else {
-					go req.process()
-				}
-			}
+		conn.Lock()
+		conn.nreqs++
+		conn.tsz += uint64(fc.Size)
+		conn.npend++
+		if conn.npend > conn.maxpend {
+			conn.maxpend = conn.npend
+		}
+		conn.nout++
 
-			buf = buf[fcsize:]
-			pos -= fcsize
+		req.next = conn.Reqs[tag]
+		conn.Reqs[tag] = req
+		process := req.next == nil
+		if req.next != nil {
+			req.next.prev = req
+		}
+		conn.Unlock()
+		if process {
+			// Tversion may change some attributes of the
+			// connection, so we block on it. Otherwise,
+			// we may loop back to reading and that is a race.
+			// This fix brought to you by the race detector.
+			if req.Tc.Type == p.Tversion {
+				req.process()
+			} else {
+				conn.dispatch(req)
+			}
 		}
 	}
 }
 
+// Returns a Fcall with a buffer of the connection's Msize,
+// from the server's pool if possible.
+func (conn *Conn) newFcall() *p.Fcall {
+	pool := conn.Srv.fcpool
+	if conn.Msize > pool.Size() {
+		return p.NewFcall(conn.Msize)
+	}
+
+	fc := pool.Get()
+	fc.Buf = fc.Buf[0:conn.Msize]
+	return fc
+}
+
 func (conn *Conn) send() {
 	for {
 		select {
 		case <-conn.done:
-			return
+			conn.pipes.close()
+			// the responses that are not sent put their pipes
+			for {
+				select {
+				case req := <-conn.Reqout:
+					req.releaseData()
+				default:
+					return
+				}
+			}
 
 		case req := <-conn.Reqout:
 			p.SetTag(req.Rc, req.Tc.Tag)
@@ -181,6 +216,11 @@ func (conn *Conn) send() {
 			conn.npend--
 			conn.Unlock()
 			if conn.Debuglevel > 0 {
+				// the data is needed for the log
+				if req.rbufs != nil {
+					req.loadData()
+				}
+
 				conn.logFcall(req.Rc)
 				if conn.Debuglevel&DbgPrintPackets != 0 {
 					log.Println("<-<", conn.Id, fmt.Sprint(req.Rc.Pkt))
@@ -191,22 +231,16 @@ func (conn *Conn) send() {
 				}
 			}
 
-			for buf := req.Rc.Pkt; len(buf) > 0; {
-				n, err := conn.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
-					conn.conn.Close()
-					break
-				}
-
-				buf = buf[n:]
+			if err := conn.write(req); err != nil {
+				/* just close the socket, will get signal on conn.done */
+				log.Println("error while writing")
+				conn.conn.Close()
 			}
 
-			select {
-			case conn.rchan <- req.Rc:
-				break
-			default:
+			req.releaseData()
+			conn.Srv.fcpool.Put(req.Rc)
+			if !req.timedout {
+				conn.Srv.fcpool.Put(req.Tc)
 			}
 		}
 	}
@@ -233,6 +267,12 @@ func (conn *Conn) logFcall(fc *p.Fcall) {
 		f := new(p.Fcall)
 		*f = *fc
 		f.Pkt = nil
+
+		// the Fcall and its buffer are recycled
+		f.Buf = nil
+		f.Data = append([]byte(nil), fc.Data...)
+		f.Wname = append([]string(nil), fc.Wname...)
+		f.Wqid = append([]p.Qid(nil), fc.Wqid...)
 		conn.Srv.Log.Log(f, conn, DbgLogFcalls)
 	}
 }
@@ -251,9 +291,19 @@ func (srv *Srv) StartNetListener(ntype, addr string) error {
 // value, read messages from the socket, send them to the specified
 // server, and send back responses received from the server.
 func (srv *Srv) StartListener(l net.Listener) error {
+	if !srv.addListener(l) {
+		l.Close()
+		return Eshutdown
+	}
+	defer srv.removeListener(l)
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if srv.isShutdown() {
+				return Eshutdown
+			}
+
 			return &p.Error{err.Error(), p.EIO}
 		}
 
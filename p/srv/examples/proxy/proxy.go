@@ -0,0 +1,53 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Forwards the requests to another file server
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv/proxy"
+)
+
+var (
+	debug    = flag.Int("d", 0, "print debug messages")
+	addr     = flag.String("addr", ":5640", "network address")
+	upstream = flag.String("upstream", "", "network address of the upstream file server")
+	msize    = flag.Uint("msize", 8192, "message size of the upstream connection")
+	dotu     = flag.Bool("u", true, "speak 9P2000.u to the upstream file server")
+)
+
+func main() {
+	flag.Parse()
+	c, err := net.Dial("tcp", *upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the proxy doesn't forward 9P2000.L
+	dialect := p.Dialect9P2000
+	if *dotu {
+		dialect = p.Dialect9P2000u
+	}
+
+	up, err := clnt.ConnectDialect(c, uint32(*msize)+p.IOHDRSZ, dialect)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	px := proxy.New(up)
+	px.Id = "proxy"
+	px.Debuglevel = *debug
+	px.Start(px)
+
+	err = px.StartNetListener("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -15,12 +15,25 @@ var (
 	debug = flag.Int("d", 0, "print debug messages")
 	addr = flag.String("addr", ":5640", "network address")
 	user = flag.String("user", "", "user name")
+	exports = flag.String("exports", "", "export table")
+	special = flag.Bool("special", false, "allow creating the special files")
 )
 
 func main() {
 	flag.Parse()
+	var exps []*ufs.Export
+	if *exports != "" {
+		var err error
+		if exps, err = ufs.LoadExports(*exports); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	ufs := ufs.New()
+	ufs.Exports = exps
+	ufs.Special = *special
 	ufs.Dotu = true
+	ufs.Dotl = true
 	ufs.Id = "ufs"
 	ufs.Debuglevel = *debug
 	ufs.Start(ufs)
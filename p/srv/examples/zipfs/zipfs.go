@@ -0,0 +1,40 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Serves the contents of a zip archive (read-only)
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"log"
+
+	"github.com/lionkov/go9p/p/srv/iofs"
+)
+
+var (
+	debug = flag.Int("d", 0, "print debug messages")
+	addr  = flag.String("addr", ":5640", "network address")
+	file  = flag.String("zip", "", "zip archive to serve")
+)
+
+func main() {
+	flag.Parse()
+	z, err := zip.OpenReader(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer z.Close()
+
+	s := iofs.New(z)
+	s.Dotu = true
+	s.Id = "zipfs"
+	s.Debuglevel = *debug
+	s.Start(s)
+
+	err = s.StartNetListener("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+	}
+}
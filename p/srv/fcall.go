@@ -21,26 +21,20 @@ func (srv *Srv) version(req *Req) {
 		conn.Msize = tc.Msize
 	}
 
-	conn.Dotu = tc.Version == "9P2000.u" && srv.Dotu
-	ver := "9P2000"
-	if conn.Dotu {
-		ver = "9P2000.u"
+	// a 9P2000.L client is offered 9P2000.u (and then 9P2000)
+	// if the server doesn't support 9P2000.L
+	conn.Dialect = p.Dialect9P2000
+	if tc.Version == "9P2000.L" && srv.Dotl {
+		conn.Dialect = p.Dialect9P2000L
+	} else if (tc.Version == "9P2000.u" || tc.Version == "9P2000.L") && srv.Dotu {
+		conn.Dialect = p.Dialect9P2000u
 	}
 
-	/* make sure that the responses of all current requests will be ignored */
-	conn.Lock()
-	for tag, r := range conn.Reqs {
-		if tag == p.NOTAG {
-			continue
-		}
+	conn.Dotu = conn.Dialect.Dotu()
+	ver := conn.Dialect.String()
 
-		for rr := r; rr != nil; rr = rr.next {
-			rr.Lock()
-			rr.status |= reqFlush
-			rr.Unlock()
-		}
-	}
-	conn.Unlock()
+	/* make sure that the responses of all current requests will be ignored */
+	conn.flushAll()
 
 	req.RespondRversion(conn.Msize, ver)
 }
@@ -187,6 +181,7 @@ func (srv *Srv) flush(req *Req) {
 		r.status |= reqFlush
 	}
 	r.Unlock()
+	r.cancel()
 
 	if (status & (reqWork | reqSaved)) == 0 {
 		r.Respond()
@@ -274,6 +269,9 @@ func (srv *Srv) open(req *Req) {
 func (srv *Srv) openPost(req *Req) {
 	if req.Fid != nil {
 		req.Fid.opened = req.Rc != nil && req.Rc.Type == p.Ropen
+		if req.Fid.opened {
+			req.Fid.qid = req.Rc.Qid
+		}
 	}
 }
 
@@ -309,6 +307,7 @@ func (srv *Srv) create(req *Req) {
 func (srv *Srv) createPost(req *Req) {
 	if req.Rc != nil && req.Rc.Type == p.Rcreate && req.Fid != nil {
 		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.qid = req.Rc.Qid
 		req.Fid.opened = true
 	}
 }
@@ -321,6 +320,11 @@ func (srv *Srv) read(req *Req) {
 		return
 	}
 
+	if fid.xattr != nil {
+		srv.xattrRead(req)
+		return
+	}
+
 	if (fid.Type & p.QTAUTH) != 0 {
 		var n int
 
@@ -398,6 +402,11 @@ func (srv *Srv) write(req *Req) {
 		return
 	}
 
+	if fid.xattr != nil {
+		srv.xattrWrite(req)
+		return
+	}
+
 	if !fid.opened || (fid.Type&p.QTDIR) != 0 || (fid.Omode&3) == p.OREAD {
 		req.RespondError(Ebaduse)
 		return
@@ -424,11 +433,18 @@ func (srv *Srv) clunk(req *Req) {
 		return
 	}
 
+	if fid.xattr != nil {
+		srv.xattrClunk(req)
+		return
+	}
+
 	(req.Conn.Srv.ops).(ReqOps).Clunk(req)
 }
 
 func (srv *Srv) clunkPost(req *Req) {
-	if req.Rc != nil && req.Rc.Type == p.Rclunk && req.Fid != nil {
+	// the xattr fids are clunked even if the value can't be set
+	if req.Rc != nil && req.Fid != nil && (req.Rc.Type == p.Rclunk || req.Fid.xattr != nil) {
+		srv.locks.release(req.Fid)
 		req.Fid.DecRef()
 	}
 }
@@ -437,6 +453,7 @@ func (srv *Srv) remove(req *Req) { (req.Conn.Srv.ops).(ReqOps).Remove(req) }
 
 func (srv *Srv) removePost(req *Req) {
 	if req.Rc != nil && req.Fid != nil {
+		srv.locks.release(req.Fid)
 		req.Fid.DecRef()
 	}
 }
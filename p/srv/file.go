@@ -38,7 +38,8 @@ type FReadOp interface {
 // If the FWriteOp interface is implemented, the Write operation will be called
 // to write to the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes written, or the
-// error occured while writing.
+// error occured while writing. The data is only valid during the call, it
+// is reused for other requests once Write returns.
 type FWriteOp interface {
 	Write(fid *FFid, data []byte, offset uint64) (int, error)
 }
@@ -73,6 +74,18 @@ type FDestroyOp interface {
 	FidDestroy(fid *FFid)
 }
 
+// If the FXattrOp interface is implemented, the operations will be called
+// when a 9P2000.L client reads, lists, sets or removes the extended attributes
+// of the file. If not implemented, "operation not supported" error will be
+// send back. SetXattr is called when the client clunks the fid it wrote
+// the new value to.
+type FXattrOp interface {
+	GetXattr(fid *FFid, name string) ([]byte, error)
+	ListXattr(fid *FFid) ([]string, error)
+	SetXattr(fid *FFid, name string, value []byte, flags uint32) error
+	RemoveXattr(fid *FFid, name string) error
+}
+
 type FFlags int
 
 const (
@@ -94,7 +107,8 @@ type File struct {
 type FFid struct {
 	F    *File
 	Fid  *Fid
-	dirs []*File // used for readdir
+	dirs  []*File // used for readdir
+	ldirs []*File // used for 9P2000.L readdir
 }
 
 // The Fsrv can be used to create file servers that serve
@@ -434,7 +448,7 @@ func (*Fsrv) Read(req *Req) {
 				continue
 			}
 
-			nd := p.PackDir(&g.Dir, req.Conn.Dotu)
+			nd := p.PackDir(&g.Dir, req.Conn.Dialect)
 			g.Unlock()
 
 			if len(nd) > len(b) {
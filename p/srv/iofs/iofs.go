@@ -0,0 +1,727 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iofs serves file trees implemented by io/fs.FS. The tree is
+// read-only, unless the FS implements WritableFS.
+package iofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// The WritableFS interface is implemented by the file systems that can
+// be modified. The names passed to the methods are in the format
+// accepted by fs.ValidPath.
+type WritableFS interface {
+	fs.FS
+
+	// Opens the named file with the specified flags (os.O_RDWR etc.).
+	// If the file is created, its permissions are set to perm. The
+	// files opened for writing should implement io.WriterAt, or
+	// io.Writer and io.Seeker.
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+	Truncate(name string, size int64) error
+}
+
+type Fid struct {
+	sync.Mutex
+	path   string // name of the file in the FS
+	root   string // name of the directory the fid was attached to
+	file   fs.File
+	offset int64 // offset of the next read or write if the file can't seek
+
+	dirents [][]byte // packed directory entries that weren't read yet
+	diroff  uint64   // offset of the next directory read
+	direof  bool
+}
+
+// The Iofs type serves the file tree of FS. The Qid paths of the files
+// are assigned when the files are first accessed and don't change until
+// the files are removed.
+type Iofs struct {
+	srv.Srv
+	FS fs.FS
+
+	qidlock sync.Mutex
+	qids    map[string]uint64
+	qidnext uint64
+}
+
+var Eseek = &p.Error{Err: "file doesn't support seeking", Errornum: p.EINVAL}
+
+func toError(err error) error {
+	if _, ok := err.(*p.Error); ok {
+		return err
+	}
+
+	var errno syscall.Errno
+	ecode := uint32(p.EIO)
+	switch {
+	case errors.As(err, &errno):
+		ecode = uint32(errno)
+	case errors.Is(err, fs.ErrNotExist):
+		ecode = p.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		ecode = p.EPERM
+	case errors.Is(err, fs.ErrExist):
+		ecode = p.EEXIST
+	case errors.Is(err, fs.ErrInvalid):
+		ecode = p.EINVAL
+	}
+
+	return &p.Error{Err: err.Error(), Errornum: ecode}
+}
+
+func omode2flags(mode uint8) int {
+	ret := os.O_RDONLY
+	switch mode & 3 {
+	case p.OWRITE:
+		ret = os.O_WRONLY
+	case p.ORDWR:
+		ret = os.O_RDWR
+	}
+
+	if mode&p.OTRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+
+	return ret
+}
+
+func mode2QidType(mode fs.FileMode) uint8 {
+	ret := uint8(0)
+	if mode&fs.ModeDir != 0 {
+		ret |= p.QTDIR
+	}
+
+	if mode&fs.ModeAppend != 0 {
+		ret |= p.QTAPPEND
+	}
+
+	if mode&fs.ModeExclusive != 0 {
+		ret |= p.QTEXCL
+	}
+
+	if mode&fs.ModeTemporary != 0 {
+		ret |= p.QTTMP
+	}
+
+	if mode&fs.ModeSymlink != 0 {
+		ret |= p.QTSYMLINK
+	}
+
+	return ret
+}
+
+func mode2Npmode(mode fs.FileMode, dotu bool) uint32 {
+	ret := uint32(mode.Perm())
+	if mode&fs.ModeDir != 0 {
+		ret |= p.DMDIR
+	}
+
+	if mode&fs.ModeAppend != 0 {
+		ret |= p.DMAPPEND
+	}
+
+	if mode&fs.ModeExclusive != 0 {
+		ret |= p.DMEXCL
+	}
+
+	if mode&fs.ModeTemporary != 0 {
+		ret |= p.DMTMP
+	}
+
+	if dotu {
+		if mode&fs.ModeSymlink != 0 {
+			ret |= p.DMSYMLINK
+		}
+
+		if mode&fs.ModeSocket != 0 {
+			ret |= p.DMSOCKET
+		}
+
+		if mode&fs.ModeNamedPipe != 0 {
+			ret |= p.DMNAMEDPIPE
+		}
+
+		if mode&fs.ModeDevice != 0 {
+			ret |= p.DMDEVICE
+		}
+
+		if mode&fs.ModeSetuid != 0 {
+			ret |= p.DMSETUID
+		}
+
+		if mode&fs.ModeSetgid != 0 {
+			ret |= p.DMSETGID
+		}
+	}
+
+	return ret
+}
+
+// Returns the Qid of the named file.
+func (u *Iofs) qid(name string, fi fs.FileInfo) *p.Qid {
+	u.qidlock.Lock()
+	qpath, ok := u.qids[name]
+	if !ok {
+		qpath = u.qidnext
+		u.qidnext++
+		u.qids[name] = qpath
+	}
+	u.qidlock.Unlock()
+
+	return &p.Qid{
+		Type:    mode2QidType(fi.Mode()),
+		Version: uint32(fi.ModTime().UnixNano() / 1000000),
+		Path:    qpath,
+	}
+}
+
+// Moves the Qid paths of the renamed file and its children to
+// the new names.
+func (u *Iofs) rename(oldname, newname string) {
+	u.qidlock.Lock()
+	defer u.qidlock.Unlock()
+	moved := make(map[string]uint64)
+	for name, qpath := range u.qids {
+		if name == newname || strings.HasPrefix(name, newname+"/") {
+			delete(u.qids, name)
+		}
+
+		if name == oldname || strings.HasPrefix(name, oldname+"/") {
+			moved[newname+name[len(oldname):]] = qpath
+			delete(u.qids, name)
+		}
+	}
+
+	for name, qpath := range moved {
+		u.qids[name] = qpath
+	}
+}
+
+// Forgets the Qid path of the removed file.
+func (u *Iofs) remove(name string) {
+	u.qidlock.Lock()
+	delete(u.qids, name)
+	u.qidlock.Unlock()
+}
+
+func (u *Iofs) dir(name string, fi fs.FileInfo, dotu bool) *p.Dir {
+	d := new(p.Dir)
+	d.Qid = *u.qid(name, fi)
+	d.Mode = mode2Npmode(fi.Mode(), dotu)
+	d.Atime = uint32(fi.ModTime().Unix())
+	d.Mtime = d.Atime
+	if !fi.IsDir() {
+		d.Length = uint64(fi.Size())
+	}
+
+	d.Name = path.Base(name)
+	if name == "." {
+		d.Name = "/"
+	}
+
+	d.Uid = "none"
+	d.Gid = "none"
+	d.Muid = "none"
+	if dotu {
+		d.Uidnum = p.NOUID
+		d.Gidnum = p.NOUID
+		d.Muidnum = p.NOUID
+	}
+
+	return d
+}
+
+func (u *Iofs) stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(u.FS, name)
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	return fi, nil
+}
+
+// Returns the FS if it can be modified, or Eperm.
+func (u *Iofs) writable() (WritableFS, error) {
+	wfs, ok := u.FS.(WritableFS)
+	if !ok {
+		return nil, srv.Eperm
+	}
+
+	return wfs, nil
+}
+
+// Returns the name of the file in the directory dir. The names
+// that are not valid are rejected.
+func child(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", &p.Error{Err: "invalid file name", Errornum: p.EINVAL}
+	}
+
+	return path.Join(dir, name), nil
+}
+
+// Returns the name of the file the walk from dir to name leads to.
+// The walk can't go above the attach root.
+func (fid *Fid) walk(dir, name string) (string, error) {
+	if name != ".." {
+		return child(dir, name)
+	}
+
+	if dir == fid.root {
+		return dir, nil
+	}
+
+	return path.Dir(dir), nil
+}
+
+// Reads up to len(buf) bytes starting from offset.
+func (fid *Fid) readAt(buf []byte, offset int64) (int, error) {
+	var n int
+	var err error
+
+	switch f := fid.file.(type) {
+	case io.ReaderAt:
+		n, err = f.ReadAt(buf, offset)
+	case io.Seeker:
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			n, err = io.ReadFull(fid.file, buf)
+		}
+	default:
+		if offset != fid.offset {
+			return 0, Eseek
+		}
+
+		n, err = io.ReadFull(fid.file, buf)
+		fid.offset += int64(n)
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Writes buf starting from offset.
+func (fid *Fid) writeAt(buf []byte, offset int64) (int, error) {
+	w, ok := fid.file.(io.Writer)
+	if !ok {
+		return 0, srv.Eperm
+	}
+
+	switch f := fid.file.(type) {
+	case io.WriterAt:
+		return f.WriteAt(buf, offset)
+	case io.Seeker:
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	default:
+		if offset != fid.offset {
+			return 0, Eseek
+		}
+	}
+
+	n, err := w.Write(buf)
+	fid.offset = offset + int64(n)
+	return n, err
+}
+
+func (*Iofs) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*Fid)
+	if fid.file != nil {
+		fid.file.Close()
+	}
+}
+
+func (u *Iofs) Attach(req *srv.Req) {
+	if req.Afid != nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	// the attach name selects the subtree of FS served to the client
+	name := path.Clean("/" + req.Tc.Aname)[1:]
+	if name == "" {
+		name = "."
+	}
+
+	fi, err := u.stat(name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = &Fid{path: name, root: name}
+	req.RespondRattach(u.qid(name, fi))
+}
+
+func (*Iofs) Flush(req *srv.Req) {}
+
+func (u *Iofs) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	wqids := make([]p.Qid, len(tc.Wname))
+	name := fid.path
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		n, err := fid.walk(name, tc.Wname[i])
+		if err == nil {
+			var fi fs.FileInfo
+			if fi, err = u.stat(n); err == nil {
+				wqids[i] = *u.qid(n, fi)
+				name = n
+				continue
+			}
+		}
+
+		if i == 0 {
+			req.RespondError(err)
+			return
+		}
+
+		break
+	}
+
+	if i == len(tc.Wname) {
+		req.Newfid.Aux = &Fid{path: name, root: fid.root}
+	}
+
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (u *Iofs) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	mode := req.Tc.Mode
+
+	var f fs.File
+	var err error
+	if omode2flags(mode) == os.O_RDONLY {
+		f, err = u.FS.Open(fid.path)
+	} else {
+		var wfs WritableFS
+		if wfs, err = u.writable(); err == nil {
+			f, err = wfs.OpenFile(fid.path, omode2flags(mode), 0)
+		}
+	}
+
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		req.RespondError(toError(err))
+		return
+	}
+
+	fid.file = f
+	req.RespondRopen(u.qid(fid.path, fi), 0)
+}
+
+func (u *Iofs) Create(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	wfs, err := u.writable()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	name, err := child(fid.path, tc.Name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	var f fs.File
+	perm := fs.FileMode(tc.Perm & 0777)
+	switch {
+	case tc.Perm&p.DMDIR != 0:
+		if err = wfs.Mkdir(name, perm); err == nil {
+			f, err = wfs.Open(name)
+		}
+
+	case tc.Perm&(p.DMSYMLINK|p.DMLINK|p.DMNAMEDPIPE|p.DMDEVICE|p.DMSOCKET) != 0:
+		req.RespondError(srv.Enotsup)
+		return
+
+	default:
+		f, err = wfs.OpenFile(name, omode2flags(tc.Mode)|os.O_CREATE, perm)
+	}
+
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		req.RespondError(toError(err))
+		return
+	}
+
+	fid.path = name
+	fid.file = f
+	req.RespondRcreate(u.qid(name, fi), 0)
+}
+
+// Packs more directory entries. Sets direof if there are no more
+// entries in the directory.
+func (u *Iofs) readdir(fid *Fid, dotu bool, dialect p.Dialect) error {
+	dir, ok := fid.file.(fs.ReadDirFile)
+	if !ok {
+		return srv.Enotdir
+	}
+
+	ents, err := dir.ReadDir(64)
+	if err == io.EOF || (err == nil && len(ents) == 0) {
+		fid.direof = true
+		return nil
+	}
+
+	if err != nil {
+		return toError(err)
+	}
+
+	for _, ent := range ents {
+		fi, err := ent.Info()
+		if err != nil {
+			// the file was removed since the directory was read
+			continue
+		}
+
+		d := u.dir(path.Join(fid.path, ent.Name()), fi, dotu)
+		fid.dirents = append(fid.dirents, p.PackDir(d, dialect))
+	}
+
+	return nil
+}
+
+// Reads the directory. The entries are read from the FS as the
+// client reads the directory. The directory can only be read
+// sequentially or from the beginning.
+func (u *Iofs) readDir(req *srv.Req, fid *Fid, buf []byte) (int, error) {
+	tc := req.Tc
+	if tc.Offset == 0 && fid.diroff != 0 {
+		// fs.ReadDirFile can't seek, reopen the directory
+		f, err := u.FS.Open(fid.path)
+		if err != nil {
+			return 0, toError(err)
+		}
+
+		fid.file.Close()
+		fid.file = f
+		fid.dirents = nil
+		fid.diroff = 0
+		fid.direof = false
+	}
+
+	if tc.Offset != fid.diroff {
+		return 0, srv.Ebadoffset
+	}
+
+	count := 0
+	for {
+		for len(fid.dirents) > 0 && len(fid.dirents[0]) <= len(buf)-count {
+			count += copy(buf[count:], fid.dirents[0])
+			fid.dirents = fid.dirents[1:]
+		}
+
+		if len(fid.dirents) > 0 || fid.direof {
+			break
+		}
+
+		if err := u.readdir(fid, req.Conn.Dotu, req.Conn.Dialect); err != nil {
+			return 0, err
+		}
+	}
+
+	if count == 0 && len(fid.dirents) > 0 {
+		return 0, &p.Error{Err: "too small read size for dir entry", Errornum: p.EINVAL}
+	}
+
+	fid.diroff += uint64(count)
+	return count, nil
+}
+
+func (u *Iofs) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	p.InitRread(rc, tc.Count)
+	fid.Lock()
+	var count int
+	var err error
+	if req.Fid.Type&p.QTDIR != 0 {
+		count, err = u.readDir(req, fid, rc.Data)
+	} else {
+		count, err = fid.readAt(rc.Data, int64(tc.Offset))
+	}
+	fid.Unlock()
+
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	p.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (*Iofs) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	fid.Lock()
+	n, err := fid.writeAt(tc.Data, int64(tc.Offset))
+	fid.Unlock()
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (*Iofs) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (u *Iofs) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	wfs, err := u.writable()
+	if err == nil && fid.path == fid.root {
+		err = srv.Eperm
+	}
+
+	if err == nil {
+		err = wfs.Remove(fid.path)
+	}
+
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	u.remove(fid.path)
+	req.RespondRremove()
+}
+
+func (u *Iofs) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	fi, err := u.stat(fid.path)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRstat(u.dir(fid.path, fi, req.Conn.Dotu))
+}
+
+// Changes the mode, length and name of the file. The changes of
+// other attributes are not supported.
+func (u *Iofs) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dir := &req.Tc.Dir
+
+	fi, err := u.stat(fid.path)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if dir.Uid != "" || dir.Gid != "" || dir.Muid != "" || dir.Atime != ^uint32(0) || dir.Mtime != ^uint32(0) ||
+		(req.Conn.Dotu && (dir.Uidnum != p.NOUID || dir.Gidnum != p.NOUID)) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if dir.Mode == ^uint32(0) && dir.Length == ^uint64(0) && dir.Name == "" {
+		// nothing to change
+		req.RespondRwstat()
+		return
+	}
+
+	wfs, err := u.writable()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if dir.Mode != ^uint32(0) {
+		if (dir.Mode&p.DMDIR != 0) != fi.IsDir() {
+			req.RespondError(srv.Edirchange)
+			return
+		}
+
+		if err := wfs.Chmod(fid.path, fs.FileMode(dir.Mode&0777)); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
+	if dir.Length != ^uint64(0) {
+		if err := wfs.Truncate(fid.path, int64(dir.Length)); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
+	if dir.Name != "" && dir.Name != path.Base(fid.path) {
+		if fid.path == fid.root {
+			req.RespondError(srv.Eperm)
+			return
+		}
+
+		// the file can only be renamed within its directory
+		name, err := child(path.Dir(fid.path), dir.Name)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		if err := wfs.Rename(fid.path, name); err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+
+		u.rename(fid.path, name)
+		fid.path = name
+	}
+
+	req.RespondRwstat()
+}
+
+// Returns a file server that serves fsys.
+func New(fsys fs.FS) *Iofs {
+	return &Iofs{FS: fsys, qids: make(map[string]uint64)}
+}
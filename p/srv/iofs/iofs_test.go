@@ -0,0 +1,159 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iofs
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+)
+
+var debug = flag.Int("debug", 0, "print debug messages")
+
+// The osFS type is a WritableFS for a directory of the host file system.
+type osFS string
+
+func (dir osFS) path(name string) string { return path.Join(string(dir), name) }
+
+func (dir osFS) Open(name string) (fs.File, error)         { return os.Open(dir.path(name)) }
+func (dir osFS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(dir.path(name), perm) }
+func (dir osFS) Remove(name string) error                  { return os.Remove(dir.path(name)) }
+func (dir osFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(dir.path(name), mode) }
+func (dir osFS) Truncate(name string, size int64) error    { return os.Truncate(dir.path(name), size) }
+
+func (dir osFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(dir.path(name), flag, perm)
+}
+
+func (dir osFS) Rename(oldname, newname string) error {
+	return os.Rename(dir.path(oldname), dir.path(newname))
+}
+
+func iofsConnect(t *testing.T, fsys fs.FS, dialect p.Dialect) *clnt.Clnt {
+	s := New(fsys)
+	s.Dotu = true
+	s.Id = "iofs"
+	s.Debuglevel = *debug
+	if !s.Start(s) {
+		t.Fatal("iofs start failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.StartListener(l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c, err := clnt.ConnectDialect(conn, 8192, dialect)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := c.Attach(nil, p.OsUsers.Uid2User(os.Geteuid()), ""); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return c
+}
+
+func TestIofs(t *testing.T) {
+	mfs := fstest.MapFS{
+		"a":         {Data: []byte("file a")},
+		"dir/b":     {Data: []byte("file b")},
+		"dir/sub/c": {},
+	}
+	for i := 0; i < 200; i++ {
+		mfs[fmt.Sprintf("big/%03d", i)] = &fstest.MapFile{Data: []byte(strconv.Itoa(i))}
+	}
+
+	for _, dialect := range []p.Dialect{p.Dialect9P2000, p.Dialect9P2000u} {
+		c := iofsConnect(t, mfs, dialect)
+		defer c.Unmount()
+
+		if err := fstest.TestFS(c.FS(), "a", "dir/b", "dir/sub/c", "big/199"); err != nil {
+			t.Errorf("%v: %v", dialect, err)
+		}
+		if _, err := c.FCreate("new", 0644, p.OWRITE); err == nil {
+			t.Errorf("%v: FCreate succeeded on a read-only FS", dialect)
+		}
+
+		// the Qids don't change
+		d1, err := c.FStat("dir/b")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		d2, err := c.FStat("dir/sub/../b")
+		if err != nil || d1.Qid != d2.Qid {
+			t.Errorf("%v: FStat: got %v, %v, want %v", dialect, d2, err, d1.Qid)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "iofs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	c := iofsConnect(t, osFS(tmpDir), p.Dialect9P2000u)
+	defer c.Unmount()
+
+	f, err := c.FCreate("f", 0644, p.ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("0123456789"), 0); err != nil {
+		t.Errorf("WriteAt: %v", err)
+	}
+	f.Close()
+
+	d1, err := c.FStat("f")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fid, err := c.FWalk("f")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	d := p.NewWstatDir()
+	d.Name = "g"
+	d.Length = 5
+	if err := c.Wstat(fid, d); err != nil {
+		t.Errorf("Wstat: %v", err)
+	}
+	c.Clunk(fid)
+
+	if b, _ := ioutil.ReadFile(path.Join(tmpDir, "g")); string(b) != "01234" {
+		t.Errorf("Wstat: file contains %q, want \"01234\"", b)
+	}
+	if d2, err := c.FStat("g"); err != nil || d2.Qid.Path != d1.Qid.Path {
+		t.Errorf("FStat after rename: got %v, %v, want Qid path %v", d2, err, d1.Qid.Path)
+	}
+
+	if _, err := c.FCreate("dir", p.DMDIR|0755, p.OREAD); err != nil {
+		t.Errorf("FCreate dir: %v", err)
+	}
+	if err := c.FRemove("g"); err != nil {
+		t.Errorf("FRemove: %v", err)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "g")); !os.IsNotExist(err) {
+		t.Errorf("FRemove: file still exists")
+	}
+	if st, err := os.Stat(path.Join(tmpDir, "dir")); err != nil || !st.IsDir() {
+		t.Errorf("FCreate dir: got %v, %v", st, err)
+	}
+}
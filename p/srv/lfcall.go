@@ -0,0 +1,356 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"github.com/lionkov/go9p/p"
+)
+
+// Converts the Linux open flags (p.LO*) to 9P2000 open mode
+func lflags2omode(flags uint32) uint8 {
+	omode := uint8(flags & p.LOACCMODE)
+	if (flags & p.LOTRUNC) != 0 {
+		omode |= p.OTRUNC
+	}
+
+	if (flags & p.LOAPPEND) != 0 {
+		omode |= p.OAPPEND
+	}
+
+	return omode
+}
+
+// Looks up the dfid[4] of the request. The fid should refer to a directory.
+// Responds with an error and returns false if it doesn't.
+func (srv *Srv) getDfid(req *Req) bool {
+	req.Dfid = req.Conn.FidGet(req.Tc.Dfid)
+	if req.Dfid == nil {
+		req.RespondError(Eunknownfid)
+		return false
+	}
+
+	if (req.Dfid.Type & p.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return false
+	}
+
+	return true
+}
+
+// Responds with an error and returns false if the request's fid
+// is not a directory.
+func (srv *Srv) checkDir(req *Req) bool {
+	if (req.Fid.Type & p.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return false
+	}
+
+	return true
+}
+
+func (srv *Srv) lopen(req *Req) {
+	fid := req.Fid
+	tc := req.Tc
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if (fid.Type&p.QTDIR) != 0 && (tc.Flags&p.LOACCMODE) != p.LORDONLY {
+		req.RespondError(Eperm)
+		return
+	}
+
+	fid.Omode = lflags2omode(tc.Flags)
+	(srv.ops).(LinuxReqOps).Lopen(req)
+}
+
+func (srv *Srv) lopenPost(req *Req) {
+	if req.Fid != nil {
+		req.Fid.opened = req.Rc != nil && req.Rc.Type == p.Rlopen
+		if req.Fid.opened {
+			req.Fid.qid = req.Rc.Qid
+		}
+	}
+}
+
+func (srv *Srv) lcreate(req *Req) {
+	fid := req.Fid
+	tc := req.Tc
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if !srv.checkDir(req) {
+		return
+	}
+
+	fid.Omode = lflags2omode(tc.Flags)
+	(srv.ops).(LinuxReqOps).Lcreate(req)
+}
+
+func (srv *Srv) lcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == p.Rlcreate && req.Fid != nil {
+		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.qid = req.Rc.Qid
+		req.Fid.opened = true
+	}
+}
+
+func (srv *Srv) getattr(req *Req) { (srv.ops).(LinuxReqOps).Getattr(req) }
+
+func (srv *Srv) setattr(req *Req) { (srv.ops).(LinuxReqOps).Setattr(req) }
+
+func (srv *Srv) readdir(req *Req) {
+	tc := req.Tc
+	fid := req.Fid
+	if tc.Count+p.IOHDRSZ > req.Conn.Msize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	if !fid.opened || (fid.Type&p.QTDIR) == 0 {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	(srv.ops).(LinuxReqOps).Readdir(req)
+}
+
+func (srv *Srv) statfs(req *Req) { (srv.ops).(LinuxReqOps).Statfs(req) }
+
+func (srv *Srv) fsync(req *Req) { (srv.ops).(LinuxReqOps).Fsync(req) }
+
+func (srv *Srv) mkdir(req *Req) {
+	if srv.checkDir(req) {
+		(srv.ops).(LinuxReqOps).Mkdir(req)
+	}
+}
+
+func (srv *Srv) symlink(req *Req) {
+	if srv.checkDir(req) {
+		(srv.ops).(LinuxReqOps).Symlink(req)
+	}
+}
+
+func (srv *Srv) mknod(req *Req) {
+	if srv.checkDir(req) {
+		(srv.ops).(LinuxReqOps).Mknod(req)
+	}
+}
+
+func (srv *Srv) rename(req *Req) {
+	if srv.getDfid(req) {
+		(srv.ops).(LinuxReqOps).Rename(req)
+	}
+}
+
+func (srv *Srv) renameat(req *Req) {
+	if srv.checkDir(req) && srv.getDfid(req) {
+		(srv.ops).(LinuxReqOps).Renameat(req)
+	}
+}
+
+func (srv *Srv) unlinkat(req *Req) {
+	if srv.checkDir(req) {
+		(srv.ops).(LinuxReqOps).Unlinkat(req)
+	}
+}
+
+func (srv *Srv) link(req *Req) {
+	if srv.getDfid(req) {
+		(srv.ops).(LinuxReqOps).Link(req)
+	}
+}
+
+func (srv *Srv) readlink(req *Req) { (srv.ops).(LinuxReqOps).Readlink(req) }
+
+func (srv *Srv) lock(req *Req) {
+	if !req.Fid.opened {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	status, err := srv.locks.lock(req.Fid, &req.Tc.Flock)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRlock(status)
+}
+
+func (srv *Srv) getlock(req *Req) {
+	if !req.Fid.opened {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	fl, err := srv.locks.getlock(req.Fid, &req.Tc.Flock)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRgetlock(fl)
+}
+
+func (srv *Srv) xattrwalk(req *Req) {
+	var data []byte
+	var err error
+
+	fid := req.Fid
+	tc := req.Tc
+	op, ok := (srv.ops).(LinuxXattrOps)
+	if !ok {
+		req.RespondError(Enotsup)
+		return
+	}
+
+	req.Newfid = req.Conn.FidNew(tc.Newfid)
+	if req.Newfid == nil {
+		req.RespondError(Einuse)
+		return
+	}
+
+	if tc.Name == "" {
+		var names []string
+
+		names, err = op.FidListXattr(fid)
+		for _, name := range names {
+			data = append(data, name...)
+			data = append(data, 0)
+		}
+	} else {
+		data, err = op.FidGetXattr(fid, tc.Name)
+	}
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Newfid.User = fid.User
+	req.Newfid.Type = p.QTFILE
+	req.Newfid.xattr = &xattr{name: tc.Name, data: data}
+	req.RespondRxattrwalk(uint64(len(data)))
+}
+
+func (srv *Srv) xattrwalkPost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == p.Rxattrwalk && req.Newfid != nil {
+		req.Newfid.Omode = p.OREAD
+		req.Newfid.opened = true
+		req.Newfid.IncRef()
+	}
+}
+
+func (srv *Srv) xattrcreate(req *Req) {
+	fid := req.Fid
+	tc := req.Tc
+	if _, ok := (srv.ops).(LinuxXattrOps); !ok {
+		req.RespondError(Enotsup)
+		return
+	}
+
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if tc.Attrsize > XattrMaxSize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	fid.xattr = &xattr{
+		name:   tc.Name,
+		data:   make([]byte, 0, tc.Attrsize),
+		size:   tc.Attrsize,
+		flags:  tc.Flags,
+		create: true,
+	}
+	req.RespondRxattrcreate()
+}
+
+func (srv *Srv) xattrcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == p.Rxattrcreate && req.Fid != nil {
+		req.Fid.Type = p.QTFILE
+		req.Fid.Omode = p.OWRITE
+		req.Fid.opened = true
+	}
+}
+
+// Reads the value of the extended attribute from an xattr fid.
+func (srv *Srv) xattrRead(req *Req) {
+	tc := req.Tc
+	x := req.Fid.xattr
+	if x.create {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	var data []byte
+	if tc.Offset < uint64(len(x.data)) {
+		data = x.data[tc.Offset:]
+	}
+
+	if uint32(len(data)) > tc.Count {
+		data = data[0:tc.Count]
+	}
+
+	req.RespondRread(data)
+}
+
+// Writes the value of the extended attribute to the xattr fid.
+// The value is set when the fid is clunked.
+func (srv *Srv) xattrWrite(req *Req) {
+	tc := req.Tc
+	x := req.Fid.xattr
+	if !x.create {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	end := tc.Offset + uint64(len(tc.Data))
+	if end < tc.Offset || end > x.size {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	if end > uint64(len(x.data)) {
+		x.data = x.data[0:end]
+	}
+
+	copy(x.data[tc.Offset:], tc.Data)
+	req.RespondRwrite(uint32(len(tc.Data)))
+}
+
+// Clunks an xattr fid. If the fid was created by Txattrcreate,
+// sets (or removes, if the size is 0) the extended attribute.
+func (srv *Srv) xattrClunk(req *Req) {
+	var err error
+
+	fid := req.Fid
+	x := fid.xattr
+	if x.create {
+		op := (srv.ops).(LinuxXattrOps)
+		switch {
+		case uint64(len(x.data)) != x.size:
+			err = Exattrsize
+		case x.size == 0:
+			err = op.FidRemoveXattr(fid, x.name)
+		default:
+			err = op.FidSetXattr(fid, x.name, x.data, x.flags)
+		}
+	}
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRclunk()
+}
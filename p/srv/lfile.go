@@ -0,0 +1,420 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Unix file types and Linux directory entry types
+const (
+	sIFIFO  = 0010000
+	sIFDIR  = 0040000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFSOCK = 0140000
+	sISUID  = 0004000
+	sISGID  = 0002000
+)
+
+// Converts the 9P2000 file mode to Unix st_mode
+func dir2Umode(d *p.Dir) uint32 {
+	mode := d.Mode & 0777
+	switch {
+	case d.Mode&p.DMDIR != 0:
+		mode |= sIFDIR
+	case d.Mode&p.DMSYMLINK != 0:
+		mode |= sIFLNK
+	case d.Mode&p.DMNAMEDPIPE != 0:
+		mode |= sIFIFO
+	case d.Mode&p.DMSOCKET != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+
+	if d.Mode&p.DMSETUID != 0 {
+		mode |= sISUID
+	}
+
+	if d.Mode&p.DMSETGID != 0 {
+		mode |= sISGID
+	}
+
+	return mode
+}
+
+func (f *File) dirent(name string, offset uint64) p.Dirent {
+	return p.Dirent{
+		Qid:    f.Qid,
+		Offset: offset,
+		Type:   uint8(dir2Umode(&f.Dir) >> 12),
+		Name:   name,
+	}
+}
+
+func (*Fsrv) Lopen(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	mode := req.Fid.Omode
+
+	if !fid.F.CheckPerm(req.Fid.User, mode2Perm(mode)) {
+		req.RespondError(Eperm)
+		return
+	}
+
+	if op, ok := (fid.F.Ops).(FOpenOp); ok {
+		err := op.Open(fid, mode)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	fid.ldirs = nil
+	req.RespondRlopen(&fid.F.Qid, 0)
+}
+
+// Creates a file in the directory of the fid. Returns the
+// new file, or the error that should be sent to the client.
+func (fid *FFid) create(user p.User, name string, perm uint32) (*File, error) {
+	dir := fid.F
+	if !dir.CheckPerm(user, p.DMWRITE) {
+		return nil, Eperm
+	}
+
+	cop, ok := (dir.Ops).(FCreateOp)
+	if !ok {
+		return nil, Eperm
+	}
+
+	return cop.Create(fid, name, perm)
+}
+
+func (*Fsrv) Lcreate(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	tc := req.Tc
+
+	f, err := fid.create(req.Fid.User, tc.Name, tc.Perm&0777)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	fid.F = f
+	req.RespondRlcreate(&f.Qid, 0)
+}
+
+func (*Fsrv) Getattr(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	f := fid.F
+
+	if sop, ok := (f.Ops).(FStatOp); ok {
+		err := sop.Stat(fid)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	attr := &p.Attr{
+		Valid:   p.GetattrBasic,
+		Qid:     f.Qid,
+		Mode:    dir2Umode(&f.Dir),
+		Uid:     f.Uidnum,
+		Gid:     f.Gidnum,
+		Nlink:   1,
+		Size:    f.Length,
+		Blksize: 4096,
+		Blocks:  (f.Length + 511) / 512,
+		Atime:   p.Timespec{Sec: uint64(f.Atime)},
+		Mtime:   p.Timespec{Sec: uint64(f.Mtime)},
+		Ctime:   p.Timespec{Sec: uint64(f.Mtime)},
+	}
+
+	req.RespondRgetattr(attr)
+}
+
+// Converts the attribute changes to a Wstat request and passes it
+// to the FWstatOp of the file.
+func (*Fsrv) Setattr(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	f := fid.F
+	sa := &req.Tc.SetAttr
+
+	wop, ok := (f.Ops).(FWstatOp)
+	if !ok {
+		req.RespondError(Eperm)
+		return
+	}
+
+	d := p.NewWstatDir()
+	if sa.Valid&p.SetattrMode != 0 {
+		d.Mode = (f.Mode &^ 0777) | (sa.Mode & 0777)
+	}
+
+	if sa.Valid&p.SetattrUid != 0 {
+		d.Uidnum = sa.Uid
+	}
+
+	if sa.Valid&p.SetattrGid != 0 {
+		d.Gidnum = sa.Gid
+	}
+
+	if sa.Valid&p.SetattrSize != 0 {
+		d.Length = sa.Size
+	}
+
+	now := uint32(time.Now().Unix())
+	if sa.Valid&p.SetattrAtime != 0 {
+		d.Atime = now
+		if sa.Valid&p.SetattrAtimeSet != 0 {
+			d.Atime = uint32(sa.Atime.Sec)
+		}
+	}
+
+	if sa.Valid&p.SetattrMtime != 0 {
+		d.Mtime = now
+		if sa.Valid&p.SetattrMtimeSet != 0 {
+			d.Mtime = uint32(sa.Mtime.Sec)
+		}
+	}
+
+	err := wop.Wstat(fid, d)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRsetattr()
+}
+
+func (*Fsrv) Readdir(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	f := fid.F
+	tc := req.Tc
+	rc := req.Rc
+
+	// the entries keep their offsets until the directory
+	// is read again from the beginning
+	f.Lock()
+	if tc.Offset == 0 || fid.ldirs == nil {
+		fid.ldirs = []*File{f, f.Parent}
+		for g := f.cfirst; g != nil; g = g.next {
+			fid.ldirs = append(fid.ldirs, g)
+		}
+	}
+	f.Unlock()
+
+	if err := p.InitRreaddir(rc, tc.Count); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	count := 0
+	full := false
+	for i := tc.Offset; i < uint64(len(fid.ldirs)); i++ {
+		g := fid.ldirs[i]
+		name := ""
+		switch i {
+		case 0:
+			name = "."
+		case 1:
+			name = ".."
+		default:
+			g.Lock()
+			name = g.Name
+			if (g.flags & Fremoved) != 0 {
+				g.Unlock()
+				continue
+			}
+			g.Unlock()
+		}
+
+		d := g.dirent(name, i+1)
+		n := p.PackDirent(&d, rc.Data[count:])
+		if n == 0 {
+			full = true
+			break
+		}
+
+		count += n
+	}
+
+	if count == 0 && full {
+		req.RespondError(&p.Error{Err: "too small read size for dir entry", Errornum: p.EINVAL})
+		return
+	}
+
+	p.SetRreaddirCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (*Fsrv) Statfs(req *Req) {
+	req.RespondRstatfs(&p.Statfs{Bsize: 4096, Namelen: 255})
+}
+
+func (*Fsrv) Fsync(req *Req) {
+	req.RespondRfsync()
+}
+
+func (*Fsrv) Mkdir(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	tc := req.Tc
+
+	f, err := fid.create(req.Fid.User, tc.Name, p.DMDIR|(tc.Perm&0777))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRmkdir(&f.Qid)
+}
+
+func (*Fsrv) Symlink(req *Req) {
+	req.RespondError(Enotsup)
+}
+
+func (*Fsrv) Mknod(req *Req) {
+	req.RespondError(Enotsup)
+}
+
+// Renames the file. The file tree doesn't support moving
+// files between directories.
+func renameFile(fid *FFid, dir *File, name string) error {
+	f := fid.F
+	if f.Parent != dir {
+		return Eperm
+	}
+
+	wop, ok := (f.Ops).(FWstatOp)
+	if !ok {
+		return Eperm
+	}
+
+	d := p.NewWstatDir()
+	d.Name = name
+	return wop.Wstat(fid, d)
+}
+
+func (*Fsrv) Rename(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	dfid := req.Dfid.Aux.(*FFid)
+
+	err := renameFile(fid, dfid.F, req.Tc.Name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRrename()
+}
+
+func (*Fsrv) Renameat(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	dfid := req.Dfid.Aux.(*FFid)
+	tc := req.Tc
+
+	f := fid.F.Find(tc.Name)
+	if f == nil {
+		req.RespondError(Enoent)
+		return
+	}
+
+	err := renameFile(&FFid{F: f, Fid: req.Fid}, dfid.F, tc.Newname)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRrenameat()
+}
+
+func (*Fsrv) Unlinkat(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	tc := req.Tc
+
+	f := fid.F.Find(tc.Name)
+	if f == nil {
+		req.RespondError(Enoent)
+		return
+	}
+
+	f.Lock()
+	if f.cfirst != nil {
+		f.Unlock()
+		req.RespondError(Enotempty)
+		return
+	}
+	f.Unlock()
+
+	rop, ok := (f.Ops).(FRemoveOp)
+	if !ok {
+		req.RespondError(Eperm)
+		return
+	}
+
+	err := rop.Remove(&FFid{F: f, Fid: req.Fid})
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	f.Remove()
+	req.RespondRunlinkat()
+}
+
+func (*Fsrv) Link(req *Req) {
+	req.RespondError(Enotsup)
+}
+
+func (*Fsrv) Readlink(req *Req) {
+	fid := req.Fid.Aux.(*FFid)
+	f := fid.F
+
+	if f.Mode&p.DMSYMLINK == 0 {
+		req.RespondError(&p.Error{Err: "not a symbolic link", Errornum: p.EINVAL})
+		return
+	}
+
+	req.RespondRreadlink(f.Ext)
+}
+
+func (*Fsrv) FidGetXattr(fid *Fid, name string) ([]byte, error) {
+	ffid := fid.Aux.(*FFid)
+	if op, ok := (ffid.F.Ops).(FXattrOp); ok {
+		return op.GetXattr(ffid, name)
+	}
+
+	return nil, Enotsup
+}
+
+func (*Fsrv) FidListXattr(fid *Fid) ([]string, error) {
+	ffid := fid.Aux.(*FFid)
+	if op, ok := (ffid.F.Ops).(FXattrOp); ok {
+		return op.ListXattr(ffid)
+	}
+
+	return nil, Enotsup
+}
+
+func (*Fsrv) FidSetXattr(fid *Fid, name string, value []byte, flags uint32) error {
+	ffid := fid.Aux.(*FFid)
+	if op, ok := (ffid.F.Ops).(FXattrOp); ok {
+		return op.SetXattr(ffid, name, value, flags)
+	}
+
+	return Enotsup
+}
+
+func (*Fsrv) FidRemoveXattr(fid *Fid, name string) error {
+	ffid := fid.Aux.(*FFid)
+	if op, ok := (ffid.F.Ops).(FXattrOp); ok {
+		return op.RemoveXattr(ffid, name)
+	}
+
+	return Enotsup
+}
@@ -0,0 +1,291 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"math"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// The owner of a byte-range lock. As in POSIX, the locks are owned by a
+// process (the ClientId and ProcId of the Tlock request) and not by the
+// fid they were obtained through. The connection is part of the owner,
+// so the clients can't release or take over each other's locks by
+// sending the same ClientId.
+type lockOwner struct {
+	conn     *Conn
+	clientid string
+	procid   uint32
+}
+
+// A byte-range lock
+type flock struct {
+	owner lockOwner
+	fid   *Fid   // fid the lock was obtained through, released on clunk
+	typ   uint8  // p.LockTypeRdlck or p.LockTypeWrlck
+	start uint64 // first byte of the range
+	end   uint64 // last byte of the range (math.MaxUint64 if the lock extends to EOF)
+}
+
+// The locks of a file. The mutex serializes the lock requests for the
+// file, and is held while the LinuxLockOps methods are called.
+type lockFile struct {
+	sync.Mutex
+	refs  int // number of users of the lockFile, protected by the lockManager
+	locks []*flock
+}
+
+// The lock manager keeps track of the byte-range locks granted by the
+// server. The locks are kept per file (Qid.Path, which 9P requires to be
+// unique among the files of the server). Locks of the same owner never
+// conflict; a new lock replaces the overlapping parts of the owner's
+// older locks. The manager's mutex only protects the map of the files,
+// so a slow backend blocks only the requests for the same file.
+type lockManager struct {
+	sync.Mutex
+	files map[uint64]*lockFile
+}
+
+func lockEnd(start, length uint64) uint64 {
+	if length == 0 || start+length-1 < start {
+		return math.MaxUint64
+	}
+
+	return start + length - 1
+}
+
+func rangeFlock(typ uint8, start, end uint64) *p.Flock {
+	fl := &p.Flock{Type: typ, Start: start}
+	if end != math.MaxUint64 {
+		fl.Length = end - start + 1
+	}
+
+	return fl
+}
+
+func (l *flock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+func (l *flock) pflock() *p.Flock {
+	fl := rangeFlock(l.typ, l.start, l.end)
+	fl.ProcId = l.owner.procid
+	fl.ClientId = l.owner.clientid
+	return fl
+}
+
+// Returns the lockFile for the file, creating it if necessary. The
+// returned value should be released by put.
+func (lm *lockManager) get(path uint64) *lockFile {
+	lm.Lock()
+	defer lm.Unlock()
+
+	if lm.files == nil {
+		lm.files = make(map[uint64]*lockFile)
+	}
+
+	lf := lm.files[path]
+	if lf == nil {
+		lf = new(lockFile)
+		lm.files[path] = lf
+	}
+
+	lf.refs++
+	return lf
+}
+
+func (lm *lockManager) put(path uint64, lf *lockFile) {
+	lm.Lock()
+	lf.refs--
+	if lf.refs == 0 && len(lf.locks) == 0 {
+		delete(lm.files, path)
+	}
+	lm.Unlock()
+}
+
+// Returns the first lock of another owner that conflicts with the
+// specified one, or nil. Should be called with the lockFile locked.
+func (lf *lockFile) conflict(owner lockOwner, typ uint8, start, end uint64) *flock {
+	for _, l := range lf.locks {
+		if l.owner != owner && l.overlaps(start, end) && (typ == p.LockTypeWrlck || l.typ == p.LockTypeWrlck) {
+			return l
+		}
+	}
+
+	return nil
+}
+
+// Removes the parts of the matching locks that are in the range. Should
+// be called with the lockFile locked.
+func (lf *lockFile) unlock(match func(*flock) bool, start, end uint64) {
+	var locks []*flock
+
+	for _, l := range lf.locks {
+		if !match(l) || !l.overlaps(start, end) {
+			locks = append(locks, l)
+			continue
+		}
+
+		if l.start < start {
+			nl := *l
+			nl.end = start - 1
+			locks = append(locks, &nl)
+		}
+
+		if l.end > end {
+			nl := *l
+			nl.start = end + 1
+			locks = append(locks, &nl)
+		}
+	}
+
+	lf.locks = locks
+}
+
+// Locks again the ranges released at the backend by a request that
+// failed. The ranges that can't be locked again (another process could
+// have locked them meanwhile) are removed from the locks, so they match
+// the backend. Should be called with the lockFile locked.
+func (lf *lockFile) restore(op LinuxLockOps, released []*flock) {
+	for _, r := range released {
+		if status, err := op.FidLock(r.fid, r.pflock()); err == nil && status == p.LockSuccess {
+			continue
+		}
+
+		lf.unlock(func(l *flock) bool { return l.fid == r.fid && l.owner == r.owner }, r.start, r.end)
+	}
+}
+
+// Applies the lock (or unlock) request to the locks of the owner.
+// Returns one of the p.Lock* status values. A request that conflicts
+// with another owner's lock is answered with p.LockBlocked, even if it
+// has p.LockFlagsBlock set: waiting in the server would tie up a worker
+// that may be needed to process the unlock. The clients retry blocking
+// requests (the Linux kernel and clnt.File.Lock do).
+func (lm *lockManager) lock(fid *Fid, fl *p.Flock) (uint8, error) {
+	switch fl.Type {
+	case p.LockTypeUnlck, p.LockTypeRdlck, p.LockTypeWrlck:
+	default:
+		return p.LockError, nil
+	}
+
+	owner := lockOwner{fid.Fconn, fl.ClientId, fl.ProcId}
+	path := fid.qid.Path
+	end := lockEnd(fl.Start, fl.Length)
+	lf := lm.get(path)
+	defer lm.put(path, lf)
+
+	lf.Lock()
+	defer lf.Unlock()
+
+	if fl.Type != p.LockTypeUnlck && lf.conflict(owner, fl.Type, fl.Start, end) != nil {
+		return p.LockBlocked, nil
+	}
+
+	if op, ok := (fid.Fconn.Srv.ops).(LinuxLockOps); ok {
+		// the parts of the owner's locks obtained through other
+		// fids are released there first, so that the backend
+		// doesn't see them as conflicting. If the request fails,
+		// they are locked again.
+		var released []*flock
+		for _, l := range lf.locks {
+			if l.owner != owner || l.fid == fid || !l.overlaps(fl.Start, end) {
+				continue
+			}
+
+			ustart, uend := l.start, l.end
+			if ustart < fl.Start {
+				ustart = fl.Start
+			}
+			if uend > end {
+				uend = end
+			}
+
+			ul := rangeFlock(p.LockTypeUnlck, ustart, uend)
+			ul.ProcId, ul.ClientId = fl.ProcId, fl.ClientId
+			if status, err := op.FidLock(l.fid, ul); err != nil || status != p.LockSuccess {
+				lf.restore(op, released)
+				return status, err
+			}
+
+			released = append(released, &flock{l.owner, l.fid, l.typ, ustart, uend})
+		}
+
+		status, err := op.FidLock(fid, fl)
+		if err != nil || status != p.LockSuccess {
+			lf.restore(op, released)
+			return status, err
+		}
+	}
+
+	lf.unlock(func(l *flock) bool { return l.owner == owner }, fl.Start, end)
+	if fl.Type != p.LockTypeUnlck {
+		lf.locks = append(lf.locks, &flock{owner, fid, fl.Type, fl.Start, end})
+	}
+
+	return p.LockSuccess, nil
+}
+
+// Returns the first lock that would prevent the specified lock from
+// being granted. If there is no such lock, the returned value has
+// Type p.LockTypeUnlck.
+func (lm *lockManager) getlock(fid *Fid, fl *p.Flock) (*p.Flock, error) {
+	owner := lockOwner{fid.Fconn, fl.ClientId, fl.ProcId}
+	path := fid.qid.Path
+	lf := lm.get(path)
+	defer lm.put(path, lf)
+
+	lf.Lock()
+	defer lf.Unlock()
+
+	if l := lf.conflict(owner, fl.Type, fl.Start, lockEnd(fl.Start, fl.Length)); l != nil {
+		return l.pflock(), nil
+	}
+
+	if op, ok := (fid.Fconn.Srv.ops).(LinuxLockOps); ok {
+		cfl, err := op.FidGetlock(fid, fl)
+		if err != nil || cfl != nil {
+			return cfl, err
+		}
+	}
+
+	ret := *fl
+	ret.Type = p.LockTypeUnlck
+	return &ret, nil
+}
+
+// Releases all locks obtained through the fid.
+func (lm *lockManager) release(fid *Fid) {
+	if !fid.opened {
+		return
+	}
+
+	path := fid.qid.Path
+	lf := lm.get(path)
+	lf.Lock()
+	lf.unlock(func(l *flock) bool { return l.fid == fid }, 0, math.MaxUint64)
+	lf.Unlock()
+	lm.put(path, lf)
+}
+
+// Releases all locks held through the fids of the connection.
+func (lm *lockManager) releaseConn(conn *Conn) {
+	lm.Lock()
+	files := make(map[uint64]*lockFile, len(lm.files))
+	for path, lf := range lm.files {
+		lf.refs++
+		files[path] = lf
+	}
+	lm.Unlock()
+
+	for path, lf := range files {
+		lf.Lock()
+		lf.unlock(func(l *flock) bool { return l.owner.conn == conn }, 0, math.MaxUint64)
+		lf.Unlock()
+		lm.put(path, lf)
+	}
+}
@@ -0,0 +1,812 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ns serves a name space built by mounting file servers at
+// paths, similar to the Plan 9 bind and mount. Several trees can be
+// mounted at the same path, creating a union directory.
+package ns
+
+import (
+	"context"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Flags for Mount and Bind
+const (
+	MREPL   = 0x0000 // the mounted tree replaces the trees mounted at the path
+	MBEFORE = 0x0001 // the mounted tree is searched before the other trees in the union
+	MAFTER  = 0x0002 // the mounted tree is searched after the other trees in the union
+	MCREATE = 0x0004 // files created in the union directory are created in the mounted tree
+)
+
+var Enotmounted = &p.Error{Err: "nothing mounted", Errornum: p.EINVAL}
+var Enocreate = &p.Error{Err: "mounted directory forbids creation", Errornum: p.EPERM}
+var Einvalname = &p.Error{Err: "invalid file name", Errornum: p.EINVAL}
+
+// A tree mounted in the name space.
+type mount struct {
+	root *clnt.Fid
+	flag int
+	conn *clnt.Clnt // connection owned by the mount, closed when unmounted
+}
+
+type Fid struct {
+	sync.Mutex
+	path string      // name of the file in the name space
+	fids []*clnt.Fid // backing files, more than one for union directories
+	cdir *clnt.Fid   // the directory new files are created in, if allowed
+
+	dirents [][]byte // packed entries of the directory
+	dirpos  int      // index of the next entry to read
+	diroff  uint64   // offset of the next directory read
+}
+
+// The Ns type serves a name space. The directories that don't exist
+// in any mounted tree but lead to mount points are created by the
+// server. All operations on a mounted tree are done as the user that
+// attached to it. The Qids of the files are translated so the files
+// from different servers have different Qid paths.
+type Ns struct {
+	srv.Srv
+
+	mntlock sync.RWMutex
+	mounts  map[string][]*mount // mounted trees by mount point
+
+	qidlock sync.Mutex
+	qids    map[qidKey]uint64
+	qidnext uint64
+}
+
+// The Qid paths are translated per server connection. The directories
+// created by the server are identified by their names.
+type qidKey struct {
+	conn *clnt.Clnt
+	path uint64
+	name string
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Returns the name prefix of the files below the directory.
+func prefix(dir string) string {
+	if dir == "/" {
+		return dir
+	}
+
+	return dir + "/"
+}
+
+func (ns *Ns) mapQid(conn *clnt.Clnt, qid p.Qid, name string) p.Qid {
+	key := qidKey{conn: conn, path: qid.Path}
+	if conn == nil {
+		key.name = name
+	}
+
+	ns.qidlock.Lock()
+	qpath, ok := ns.qids[key]
+	if !ok {
+		qpath = ns.qidnext
+		ns.qidnext++
+		ns.qids[key] = qpath
+	}
+	ns.qidlock.Unlock()
+
+	qid.Path = qpath
+	return qid
+}
+
+// Returns the Qid of the file in the name space.
+func (ns *Ns) qid(fid *Fid) p.Qid {
+	if len(fid.fids) == 0 {
+		return ns.mapQid(nil, p.Qid{Type: p.QTDIR}, fid.path)
+	}
+
+	f := fid.fids[0]
+	return ns.mapQid(f.Clnt, f.Qid, "")
+}
+
+// Returns the longest mount point that is a prefix of the name,
+// or an empty string if there is none. Should be called with
+// mntlock held.
+func (ns *Ns) mountPoint(name string) string {
+	for m := name; ; m = path.Dir(m) {
+		if _, ok := ns.mounts[m]; ok {
+			return m
+		}
+
+		if m == "/" {
+			return ""
+		}
+	}
+}
+
+// Returns the names of the files in the directory that are mount points
+// or lead to mount points. Should be called with mntlock held.
+func (ns *Ns) mountChildren(dir string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	pfx := prefix(dir)
+	for m := range ns.mounts {
+		if m == dir || !strings.HasPrefix(m, pfx) {
+			continue
+		}
+
+		name := strings.SplitN(m[len(pfx):], "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Clones the fid and walks the clone to wnames. Returns the new fid,
+// or an Error if the file doesn't exist.
+func walk(ctx context.Context, fid *clnt.Fid, wnames []string) (*clnt.Fid, error) {
+	c := fid.Clnt
+	newfid := c.FidAlloc()
+	newfid.User = fid.User
+	qids, err := c.WalkContext(ctx, fid, newfid, wnames)
+	if err == nil && len(qids) != len(wnames) {
+		err = srv.Enoent
+	}
+
+	if err != nil {
+		c.Clunk(newfid)
+		return nil, err
+	}
+
+	newfid.Qid = fid.Qid
+	if len(qids) > 0 {
+		newfid.Qid = qids[len(qids)-1]
+	}
+
+	return newfid, nil
+}
+
+// Clunks the backing files.
+func (fid *Fid) clunk() {
+	for _, f := range fid.fids {
+		f.Clnt.Clunk(f)
+	}
+
+	fid.fids = nil
+	fid.cdir = nil
+}
+
+func (fid *Fid) clone(ctx context.Context) (*Fid, error) {
+	nfid := &Fid{path: fid.path}
+	for _, f := range fid.fids {
+		nf, err := walk(ctx, f, nil)
+		if err != nil {
+			nfid.clunk()
+			return nil, err
+		}
+
+		nfid.fids = append(nfid.fids, nf)
+		if f == fid.cdir {
+			nfid.cdir = nf
+		}
+	}
+
+	return nfid, nil
+}
+
+// Returns a Fid for the named file. The name is walked from the
+// closest mount point. If the name is a union directory, the files
+// are searched in all trees mounted at it.
+func (ns *Ns) resolve(ctx context.Context, name string) (*Fid, error) {
+	ns.mntlock.RLock()
+	mp := ns.mountPoint(name)
+	mnts := ns.mounts[mp]
+	below := len(ns.mountChildren(name)) > 0
+	ns.mntlock.RUnlock()
+
+	var wnames []string
+	if mp != "" && name != mp {
+		wnames = strings.Split(name[len(prefix(mp)):], "/")
+	}
+
+	fid := &Fid{path: name}
+	err := error(srv.Enoent)
+	for _, m := range mnts {
+		f, e := walk(ctx, m.root, wnames)
+		if e != nil {
+			err = e
+			continue
+		}
+
+		// only the directories are joined in unions
+		if len(fid.fids) > 0 && f.Qid.Type&p.QTDIR == 0 {
+			f.Clnt.Clunk(f)
+			continue
+		}
+
+		fid.fids = append(fid.fids, f)
+		if wnames != nil {
+			// below the mount point only the first match counts
+			fid.cdir = f
+			break
+		}
+
+		if fid.cdir == nil && m.flag&MCREATE != 0 {
+			fid.cdir = f
+		}
+
+		if f.Qid.Type&p.QTDIR == 0 {
+			break
+		}
+	}
+
+	if len(fid.fids) == 0 && !below && name != "/" {
+		return nil, err
+	}
+
+	return fid, nil
+}
+
+// Walks from the file to the named file in its directory.
+func (ns *Ns) step(ctx context.Context, fid *Fid, name string) (*Fid, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, Einvalname
+	}
+
+	n := path.Join(fid.path, name)
+	ns.mntlock.RLock()
+	_, ismnt := ns.mounts[n]
+	ns.mntlock.RUnlock()
+	if ismnt || name == "." || name == ".." {
+		return ns.resolve(ctx, n)
+	}
+
+	nfid := &Fid{path: n}
+	err := error(srv.Enoent)
+	for _, f := range fid.fids {
+		var nf *clnt.Fid
+		if nf, err = walk(ctx, f, []string{name}); err == nil {
+			nfid.fids = []*clnt.Fid{nf}
+			nfid.cdir = nf
+			return nfid, nil
+		}
+	}
+
+	ns.mntlock.RLock()
+	below := len(ns.mountChildren(n)) > 0
+	ns.mntlock.RUnlock()
+	if !below {
+		return nil, err
+	}
+
+	return nfid, nil
+}
+
+// Returns true if the file is a mount point.
+func (ns *Ns) isMount(fid *Fid) bool {
+	ns.mntlock.RLock()
+	defer ns.mntlock.RUnlock()
+	_, ok := ns.mounts[fid.path]
+	return ok
+}
+
+func (ns *Ns) stat(fid *Fid) (*p.Dir, error) {
+	name := path.Base(fid.path)
+	if len(fid.fids) == 0 {
+		d := &p.Dir{
+			Qid:     ns.qid(fid),
+			Mode:    p.DMDIR | 0555,
+			Name:    name,
+			Uid:     "none",
+			Gid:     "none",
+			Muid:    "none",
+			Uidnum:  p.NOUID,
+			Gidnum:  p.NOUID,
+			Muidnum: p.NOUID,
+		}
+
+		return d, nil
+	}
+
+	f := fid.fids[0]
+	d, err := f.Clnt.Stat(f)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Qid = ns.mapQid(f.Clnt, d.Qid, "")
+	d.Name = name
+	if !f.Clnt.Dialect.Dotu() {
+		d.Uidnum = p.NOUID
+		d.Gidnum = p.NOUID
+		d.Muidnum = p.NOUID
+	}
+
+	return d, nil
+}
+
+// Reads the entries of the directory. The entries of the union
+// directories are merged, the first entry with a name hides the
+// others. The entries that are mount points describe the mounted
+// trees.
+func (ns *Ns) readdir(ctx context.Context, fid *Fid, dialect p.Dialect) ([][]byte, error) {
+	ns.mntlock.RLock()
+	mnames := ns.mountChildren(fid.path)
+	ns.mntlock.RUnlock()
+
+	var ents [][]byte
+	seen := make(map[string]bool)
+	for _, name := range mnames {
+		seen[name] = true
+	}
+
+	for _, f := range fid.fids {
+		for offset := uint64(0); ; {
+			b, err := f.Clnt.ReadContext(ctx, f, offset, f.Iounit)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(b) == 0 {
+				break
+			}
+
+			offset += uint64(len(b))
+			for len(b) > 0 {
+				var d *p.Dir
+				d, b, _, err = p.UnpackDir(b, f.Clnt.Dialect)
+				if err != nil {
+					return nil, err
+				}
+
+				if seen[d.Name] {
+					continue
+				}
+
+				seen[d.Name] = true
+				d.Qid = ns.mapQid(f.Clnt, d.Qid, "")
+				if !f.Clnt.Dialect.Dotu() {
+					d.Uidnum = p.NOUID
+					d.Gidnum = p.NOUID
+					d.Muidnum = p.NOUID
+				}
+
+				ents = append(ents, p.PackDir(d, dialect))
+			}
+		}
+	}
+
+	for _, name := range mnames {
+		mfid, err := ns.resolve(ctx, path.Join(fid.path, name))
+		if err != nil {
+			continue
+		}
+
+		d, err := ns.stat(mfid)
+		mfid.clunk()
+		if err != nil {
+			continue
+		}
+
+		ents = append(ents, p.PackDir(d, dialect))
+	}
+
+	return ents, nil
+}
+
+// Adds the trees to the mount point.
+func (ns *Ns) mount(name string, mnts []*mount, flag int) {
+	name = clean(name)
+
+	// the trees are joined with the directory that is already there
+	var old []*mount
+	if flag&(MBEFORE|MAFTER) != 0 {
+		ns.mntlock.RLock()
+		_, ok := ns.mounts[name]
+		ns.mntlock.RUnlock()
+		if !ok {
+			if fid, err := ns.resolve(context.Background(), name); err == nil {
+				for _, f := range fid.fids {
+					old = append(old, &mount{root: f, flag: 0})
+				}
+			}
+		}
+	}
+
+	ns.mntlock.Lock()
+	defer ns.mntlock.Unlock()
+	cur, ok := ns.mounts[name]
+	if ok {
+		release(old)
+	} else {
+		cur = old
+	}
+
+	switch {
+	case flag&MBEFORE != 0:
+		cur = append(mnts, cur...)
+	case flag&MAFTER != 0:
+		cur = append(cur, mnts...)
+	default:
+		release(cur)
+		cur = mnts
+	}
+
+	ns.mounts[name] = cur
+}
+
+// Clunks the roots of the mounted trees and closes the connections
+// owned by them.
+func release(mnts []*mount) {
+	for _, m := range mnts {
+		m.root.Clnt.Clunk(m.root)
+		if m.conn != nil {
+			m.conn.Unmount()
+		}
+	}
+}
+
+// Mounts the file tree at the specified path in the name space. The
+// connection must speak 9P2000 or 9P2000.u. The name space takes over
+// the root fid and clunks it when the tree is unmounted.
+func (ns *Ns) Mount(name string, root *clnt.Fid, flag int) {
+	ns.mount(name, []*mount{{root: root, flag: flag}}, flag)
+}
+
+// Connects to the file server s (that was already started), attaches
+// to it as the specified user, and mounts the file tree at the
+// specified path in the name space. Returns nil if successful.
+func (ns *Ns) MountSrv(name string, s *srv.Srv, user p.User, aname string, flag int) error {
+	c1, c2 := net.Pipe()
+	s.NewConn(c1)
+
+	// the directories are read in the stat format, not 9P2000.L
+	dialect := p.Dialect9P2000
+	if s.Dotu {
+		dialect = p.Dialect9P2000u
+	}
+
+	conn, err := clnt.ConnectDialect(c2, s.Msize, dialect)
+	if err != nil {
+		c2.Close()
+		return err
+	}
+
+	root, err := conn.Attach(nil, user, aname)
+	if err != nil {
+		conn.Unmount()
+		return err
+	}
+
+	ns.mount(name, []*mount{{root: root, flag: flag, conn: conn}}, flag)
+	return nil
+}
+
+// Makes the file (or the union directory) old visible also at the
+// path new. Returns nil if successful.
+func (ns *Ns) Bind(old, new string, flag int) error {
+	fid, err := ns.resolve(context.Background(), clean(old))
+	if err != nil {
+		return err
+	}
+
+	if len(fid.fids) == 0 {
+		return &p.Error{Err: "can't bind a directory created by the server", Errornum: p.EINVAL}
+	}
+
+	var mnts []*mount
+	for _, f := range fid.fids {
+		mnts = append(mnts, &mount{root: f, flag: flag})
+	}
+
+	ns.mount(new, mnts, flag)
+	return nil
+}
+
+// Removes all trees mounted at the path. Returns nil if successful.
+func (ns *Ns) Unmount(name string) error {
+	name = clean(name)
+	ns.mntlock.Lock()
+	mnts, ok := ns.mounts[name]
+	delete(ns.mounts, name)
+	ns.mntlock.Unlock()
+	if !ok {
+		return Enotmounted
+	}
+
+	release(mnts)
+	return nil
+}
+
+func (*Ns) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	sfid.Aux.(*Fid).clunk()
+}
+
+func (ns *Ns) Attach(req *srv.Req) {
+	if req.Afid != nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	fid, err := ns.resolve(req.Context(), "/")
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = fid
+	qid := ns.qid(fid)
+	req.RespondRattach(&qid)
+}
+
+func (*Ns) Flush(req *srv.Req) {}
+
+func (ns *Ns) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	ctx := req.Context()
+
+	if len(tc.Wname) == 0 {
+		nfid, err := fid.clone(ctx)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		if req.Newfid != req.Fid {
+			req.Newfid.Aux = nfid
+		} else {
+			nfid.clunk()
+		}
+
+		req.RespondRwalk(nil)
+		return
+	}
+
+	wqids := make([]p.Qid, len(tc.Wname))
+	nfid := fid
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		f, err := ns.step(ctx, nfid, tc.Wname[i])
+		if err != nil {
+			if i == 0 {
+				req.RespondError(err)
+				return
+			}
+
+			break
+		}
+
+		if nfid != fid {
+			nfid.clunk()
+		}
+
+		nfid = f
+		wqids[i] = ns.qid(f)
+	}
+
+	if i == len(tc.Wname) {
+		if req.Newfid == req.Fid {
+			fid.clunk()
+		}
+
+		req.Newfid.Aux = nfid
+	} else {
+		nfid.clunk()
+	}
+
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (ns *Ns) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	mode := req.Tc.Mode
+
+	for _, f := range fid.fids {
+		err := f.Clnt.OpenContext(req.Context(), f, mode)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	qid := ns.qid(fid)
+	req.RespondRopen(&qid, 0)
+}
+
+func (ns *Ns) Create(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	if fid.cdir == nil {
+		req.RespondError(Enocreate)
+		return
+	}
+
+	nf, err := walk(req.Context(), fid.cdir, nil)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	err = nf.Clnt.Create(nf, tc.Name, tc.Perm, tc.Mode, tc.Ext)
+	if err != nil {
+		nf.Clnt.Clunk(nf)
+		req.RespondError(err)
+		return
+	}
+
+	fid.clunk()
+	fid.path = path.Join(fid.path, tc.Name)
+	fid.fids = []*clnt.Fid{nf}
+	qid := ns.qid(fid)
+	req.RespondRcreate(&qid, 0)
+}
+
+// Reads the directory. The entries are read from the mounted trees
+// when the directory is read from offset 0.
+func (ns *Ns) readDir(req *srv.Req, fid *Fid, buf []byte) (int, error) {
+	tc := req.Tc
+	if tc.Offset == 0 {
+		ents, err := ns.readdir(req.Context(), fid, req.Conn.Dialect)
+		if err != nil {
+			return 0, err
+		}
+
+		fid.dirents = ents
+		fid.dirpos = 0
+		fid.diroff = 0
+	}
+
+	if tc.Offset != fid.diroff {
+		return 0, srv.Ebadoffset
+	}
+
+	count := 0
+	for ; fid.dirpos < len(fid.dirents); fid.dirpos++ {
+		if len(fid.dirents[fid.dirpos]) > len(buf)-count {
+			break
+		}
+
+		count += copy(buf[count:], fid.dirents[fid.dirpos])
+	}
+
+	if count == 0 && fid.dirpos < len(fid.dirents) {
+		return 0, &p.Error{Err: "too small read size for dir entry", Errornum: p.EINVAL}
+	}
+
+	fid.diroff += uint64(count)
+	return count, nil
+}
+
+func (ns *Ns) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	p.InitRread(rc, tc.Count)
+	var count int
+	var err error
+	if req.Fid.Type&p.QTDIR != 0 {
+		fid.Lock()
+		count, err = ns.readDir(req, fid, rc.Data)
+		fid.Unlock()
+	} else {
+		var b []byte
+		f := fid.fids[0]
+		b, err = f.Clnt.ReadContext(req.Context(), f, tc.Offset, tc.Count)
+		count = copy(rc.Data, b)
+	}
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	p.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (*Ns) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	f := fid.fids[0]
+
+	// the mounted tree's connection may have a smaller msize
+	n := 0
+	for n < len(tc.Data) {
+		m, err := f.Clnt.WriteContext(req.Context(), f, tc.Data[n:], tc.Offset+uint64(n))
+		if err != nil {
+			if n == 0 {
+				req.RespondError(err)
+				return
+			}
+
+			break
+		}
+
+		if m == 0 {
+			break
+		}
+
+		n += m
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (*Ns) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (ns *Ns) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	if len(fid.fids) != 1 || ns.isMount(fid) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	f := fid.fids[0]
+	fid.fids = nil
+	fid.cdir = nil
+	err := f.Clnt.Remove(f)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (ns *Ns) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	d, err := ns.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRstat(d)
+}
+
+func (ns *Ns) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dir := &req.Tc.Dir
+
+	if len(fid.fids) == 0 || (dir.Name != "" && dir.Name != path.Base(fid.path) && ns.isMount(fid)) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	f := fid.fids[0]
+	err := f.Clnt.Wstat(f, dir)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRwstat()
+}
+
+// Returns a server for an empty name space.
+func New() *Ns {
+	return &Ns{
+		mounts: make(map[string][]*mount),
+		qids:   make(map[qidKey]uint64),
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ns
+
+import (
+	"flag"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/lionkov/go9p/p/srv/iofs"
+	"github.com/lionkov/go9p/p/srv/ufs"
+)
+
+var debug = flag.Int("debug", 0, "print debug messages")
+
+func TestNs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ns")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	start := func(fsys fs.FS) *srv.Srv {
+		s := iofs.New(fsys)
+		s.Dotu = true
+		s.Start(s)
+		return &s.Srv
+	}
+
+	n := New()
+	n.Dotu = true
+	n.Id = "ns"
+	n.Debuglevel = *debug
+	if !n.Start(n) {
+		t.Fatal("ns start failed")
+	}
+
+	x := fstest.MapFS{"x": {Data: []byte("x")}, "both": {Data: []byte("from x")}}
+	y := fstest.MapFS{"y": {Data: []byte("y")}, "both": {Data: []byte("from y")}}
+	if err := n.MountSrv("/a/b", start(fstest.MapFS{"c": {Data: []byte("c")}}), user, "", MREPL); err != nil {
+		t.Fatalf("MountSrv: %v", err)
+	}
+	if err := n.MountSrv("/u", start(x), user, "", MREPL); err != nil {
+		t.Fatalf("MountSrv: %v", err)
+	}
+	if err := n.MountSrv("/u", start(y), user, "", MAFTER); err != nil {
+		t.Fatalf("MountSrv: %v", err)
+	}
+	u := ufs.New()
+	u.Root = tmpDir
+	u.Dotu = true
+	u.Start(u)
+	if err := n.MountSrv("/u", &u.Srv, user, "", MBEFORE|MCREATE); err != nil {
+		t.Fatalf("MountSrv: %v", err)
+	}
+	if err := n.Bind("/u", "/v", MREPL); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go n.StartListener(l)
+	defer n.Close()
+
+	c, err := clnt.Mount("unix", l.Addr().String(), "", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer c.Unmount()
+
+	fsys := c.FS()
+	if err := fstest.TestFS(fsys, "a/b/c", "u/x", "u/y", "u/both", "v/x"); err != nil {
+		t.Errorf("%v", err)
+	}
+	if data, err := fsys.ReadFile("u/both"); err != nil || string(data) != "from x" {
+		t.Errorf("ReadFile: got %q, %v, want \"from x\"", data, err)
+	}
+
+	// the files from different servers have different Qids
+	dx, err := c.FStat("u/x")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	dy, err := c.FStat("u/y")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if dx.Qid.Path == dy.Qid.Path {
+		t.Errorf("u/x and u/y have the same Qid path %v", dx.Qid.Path)
+	}
+	if d, err := c.FStat("a/b/../../u/x"); err != nil || d.Qid != dx.Qid {
+		t.Errorf("FStat: got %v, %v, want Qid %v", d, err, dx.Qid)
+	}
+
+	// the files are created in the tree mounted with MCREATE
+	f, err := c.FCreate("u/new", 0644, p.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	if _, err := f.Write([]byte("new")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	f.Close()
+	if b, _ := ioutil.ReadFile(path.Join(tmpDir, "new")); string(b) != "new" {
+		t.Errorf("FCreate: file contains %q, want \"new\"", b)
+	}
+	if _, err := c.FCreate("a/new", 0644, p.OWRITE); err == nil {
+		t.Errorf("FCreate succeeded in a directory created by the server")
+	}
+
+	if err := n.Unmount("/a/b"); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+	if _, err := c.FStat("a"); err == nil {
+		t.Errorf("FStat succeeded after unmount")
+	}
+}
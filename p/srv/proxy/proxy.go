@@ -0,0 +1,387 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proxy implements a file server that forwards the requests
+// of its clients to another (upstream) file server.
+package proxy
+
+import (
+	"context"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// The Fid type maps a server fid to the fid on the upstream connection.
+type Fid struct {
+	fid *clnt.Fid
+
+	// used if the directory entries have to be converted
+	// between the dialects
+	dirents  [][]byte // converted entries that weren't read yet
+	diroff   uint64   // offset of the next directory read
+	updiroff uint64   // offset of the next directory read upstream
+	direof   bool
+}
+
+// The Proxy type forwards the requests to the Upstream connection. Each
+// fid is mapped to a fid on the upstream connection, the flushed requests
+// are flushed upstream too. If the message sizes of the connections
+// differ, the reads and writes are split. The directory entries and the
+// file metadata are converted if the dialects differ. The upstream
+// connection should speak 9P2000 or 9P2000.u, 9P2000.L is not forwarded.
+type Proxy struct {
+	srv.Srv
+	Upstream *clnt.Clnt
+}
+
+// The user passed to the upstream server. The proxy doesn't
+// check the users, the upstream server does.
+type user struct {
+	name string
+	id   int
+}
+
+func (u *user) Name() string            { return u.name }
+func (u *user) Id() int                 { return u.id }
+func (u *user) Groups() []p.Group       { return nil }
+func (u *user) IsMember(g p.Group) bool { return false }
+
+type group struct {
+	name string
+	id   int
+}
+
+func (g *group) Name() string      { return g.name }
+func (g *group) Id() int           { return g.id }
+func (g *group) Members() []p.User { return nil }
+
+// The users implementation accepts all users.
+type users struct{}
+
+func (users) Uid2User(uid int) p.User        { return &user{id: uid} }
+func (users) Uname2User(uname string) p.User { return &user{name: uname, id: int(p.NOUID)} }
+func (users) Gid2Group(gid int) p.Group      { return &group{id: gid} }
+func (users) Gname2Group(gname string) p.Group {
+	return &group{name: gname, id: int(p.NOUID)}
+}
+
+// Sends back the error returned by the upstream request. If the request
+// was flushed (or the connection closed), no response is sent.
+func respondError(req *srv.Req, err error) {
+	if req.Context().Err() == context.Canceled {
+		req.Flush()
+		return
+	}
+
+	req.RespondError(err)
+}
+
+// Returns the Iounit of the file, limited by the message size of the
+// client's connection.
+func iounit(req *srv.Req, fid *clnt.Fid) uint32 {
+	iounit := fid.Iounit
+	if max := req.Conn.Msize - p.IOHDRSZ; iounit > max {
+		iounit = max
+	}
+
+	return iounit
+}
+
+// Fixes the fields that the upstream dialect doesn't provide.
+func (px *Proxy) dir(d *p.Dir) *p.Dir {
+	if !px.Upstream.Dialect.Dotu() {
+		d.Uidnum = p.NOUID
+		d.Gidnum = p.NOUID
+		d.Muidnum = p.NOUID
+	}
+
+	return d
+}
+
+func (px *Proxy) AuthInit(afid *srv.Fid, aname string) (*p.Qid, error) {
+	fid, err := px.Upstream.Auth(afid.User, aname)
+	if err != nil {
+		return nil, err
+	}
+
+	afid.Aux = &Fid{fid: fid}
+	return &fid.Qid, nil
+}
+
+func (px *Proxy) AuthDestroy(afid *srv.Fid) {
+	px.FidDestroy(afid)
+}
+
+// The upstream server checks the authentication when the
+// client attaches.
+func (*Proxy) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	return nil
+}
+
+func (px *Proxy) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	fid := afid.Aux.(*Fid)
+	b, err := px.Upstream.Read(fid.fid, offset, uint32(len(data)))
+	return copy(data, b), err
+}
+
+func (px *Proxy) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	fid := afid.Aux.(*Fid)
+	return px.Upstream.Write(fid.fid, data, offset)
+}
+
+func (px *Proxy) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*Fid)
+	if fid.fid != nil {
+		px.Upstream.Clunk(fid.fid)
+		fid.fid = nil
+	}
+}
+
+func (px *Proxy) Attach(req *srv.Req) {
+	tc := req.Tc
+
+	var afid *clnt.Fid
+	if req.Afid != nil {
+		afid = req.Afid.Aux.(*Fid).fid
+	}
+
+	u := &user{name: tc.Uname, id: int(p.NOUID)}
+	if req.Conn.Dotu {
+		u.id = int(tc.Unamenum)
+	}
+
+	fid, err := px.Upstream.Attach(afid, u, tc.Aname)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.Fid.Aux = &Fid{fid: fid}
+	req.RespondRattach(&fid.Qid)
+}
+
+// The request's context is cancelled when the request is flushed,
+// which flushes the upstream request.
+func (*Proxy) Flush(req *srv.Req) {}
+
+func (px *Proxy) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	newfid := fid.fid
+	if req.Newfid != req.Fid {
+		newfid = px.Upstream.FidAlloc()
+		newfid.User = fid.fid.User
+	}
+
+	wqids, err := px.Upstream.WalkContext(req.Context(), fid.fid, newfid, tc.Wname)
+	if err == nil && len(wqids) == len(tc.Wname) {
+		if newfid != fid.fid {
+			req.Newfid.Aux = &Fid{fid: newfid}
+		}
+	} else if newfid != fid.fid {
+		px.Upstream.Clunk(newfid)
+	}
+
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRwalk(wqids)
+}
+
+func (px *Proxy) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	err := px.Upstream.OpenContext(req.Context(), fid.fid, req.Tc.Mode)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRopen(&fid.fid.Qid, iounit(req, fid.fid))
+}
+
+func (px *Proxy) Create(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	err := px.Upstream.CreateContext(req.Context(), fid.fid, tc.Name, tc.Perm, tc.Mode, tc.Ext)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRcreate(&fid.fid.Qid, iounit(req, fid.fid))
+}
+
+// Reads the directory and converts the entries to the dialect of the
+// client's connection.
+func (px *Proxy) readDir(req *srv.Req, fid *Fid, buf []byte) (int, error) {
+	tc := req.Tc
+	if tc.Offset == 0 {
+		fid.dirents = nil
+		fid.diroff = 0
+		fid.updiroff = 0
+		fid.direof = false
+	}
+
+	if tc.Offset != fid.diroff {
+		return 0, srv.Ebadoffset
+	}
+
+	count := 0
+	for {
+		for len(fid.dirents) > 0 && len(fid.dirents[0]) <= len(buf)-count {
+			count += copy(buf[count:], fid.dirents[0])
+			fid.dirents = fid.dirents[1:]
+		}
+
+		if len(fid.dirents) > 0 || fid.direof {
+			break
+		}
+
+		b, err := px.Upstream.ReadContext(req.Context(), fid.fid, fid.updiroff, fid.fid.Iounit)
+		if err != nil {
+			return 0, err
+		}
+
+		fid.updiroff += uint64(len(b))
+		fid.direof = len(b) == 0
+		for len(b) > 0 {
+			var d *p.Dir
+			d, b, _, err = p.UnpackDir(b, px.Upstream.Dialect)
+			if err != nil {
+				return 0, err
+			}
+
+			fid.dirents = append(fid.dirents, p.PackDir(px.dir(d), req.Conn.Dialect))
+		}
+	}
+
+	if count == 0 && len(fid.dirents) > 0 {
+		return 0, &p.Error{Err: "too small read size for dir entry", Errornum: p.EINVAL}
+	}
+
+	fid.diroff += uint64(count)
+	return count, nil
+}
+
+func (px *Proxy) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	p.InitRread(rc, tc.Count)
+	var count int
+	var err error
+	if req.Fid.Type&p.QTDIR != 0 && req.Conn.Dialect != px.Upstream.Dialect {
+		req.Fid.Lock()
+		count, err = px.readDir(req, fid, rc.Data)
+		req.Fid.Unlock()
+	} else {
+		var b []byte
+		b, err = px.Upstream.ReadContext(req.Context(), fid.fid, tc.Offset, tc.Count)
+		count = copy(rc.Data, b)
+	}
+
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	p.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (px *Proxy) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	// the upstream connection may have a smaller msize
+	n := 0
+	for n < len(tc.Data) {
+		m, err := px.Upstream.WriteContext(req.Context(), fid.fid, tc.Data[n:], tc.Offset+uint64(n))
+		if err != nil {
+			if n == 0 {
+				respondError(req, err)
+				return
+			}
+
+			break
+		}
+
+		if m == 0 {
+			break
+		}
+
+		n += m
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+// The upstream fid is released even if Tclunk fails, so the
+// error is not sent back.
+func (px *Proxy) Clunk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	px.Upstream.Clunk(fid.fid)
+	fid.fid = nil
+	req.RespondRclunk()
+}
+
+func (px *Proxy) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	f := fid.fid
+	fid.fid = nil
+	err := px.Upstream.RemoveContext(req.Context(), f)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (px *Proxy) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	d, err := px.Upstream.StatContext(req.Context(), fid.fid)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRstat(px.dir(d))
+}
+
+func (px *Proxy) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	err := px.Upstream.WstatContext(req.Context(), fid.fid, &req.Tc.Dir)
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRwstat()
+}
+
+// Returns a proxy that forwards the requests to the upstream
+// connection. The users are not checked by the proxy.
+func New(upstream *clnt.Clnt) *Proxy {
+	px := &Proxy{Upstream: upstream}
+	px.Dotu = true
+	px.Upool = users{}
+	return px
+}
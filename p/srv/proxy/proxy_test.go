@@ -0,0 +1,172 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/lionkov/go9p/p/srv/ufs"
+)
+
+var debug = flag.Int("debug", 0, "print debug messages")
+
+// Starts the proxy for the upstream server and returns a client
+// connected to the proxy.
+func proxyConnect(t *testing.T, s *srv.Srv, msize uint32, dialect p.Dialect) *clnt.Clnt {
+	c1, c2 := net.Pipe()
+	s.NewConn(c1)
+	up, err := clnt.ConnectDialect(c2, msize, dialect)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	px := New(up)
+	px.Id = "proxy"
+	px.Debuglevel = *debug
+	if !px.Start(px) {
+		t.Fatal("proxy start failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go px.StartListener(l)
+
+	c, err := clnt.Mount("unix", l.Addr().String(), "", 8192+p.IOHDRSZ, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+func TestProxy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i := 0; i < 100; i++ {
+		if err := ioutil.WriteFile(path.Join(tmpDir, fmt.Sprintf("f%03d", i)), nil, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	u := ufs.New()
+	u.Root = tmpDir
+	u.Dotu = true
+	u.Start(u)
+
+	// the upstream connection has a smaller msize and doesn't speak 9P2000.u
+	c := proxyConnect(t, &u.Srv, 1024+p.IOHDRSZ, p.Dialect9P2000)
+	defer c.Unmount()
+
+	data := bytes.Repeat([]byte("0123456789"), 800)
+	f, err := c.FCreate("f", 0644, p.ORDWR)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	if n, err := f.Writen(data, 0); err != nil || n != len(data) {
+		t.Errorf("Writen: got %d, %v, want %d", n, err, len(data))
+	}
+	buf := make([]byte, len(data))
+	if n, err := f.Readn(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Errorf("Readn: got %d bytes, %v, want %d", n, err, len(data))
+	}
+	f.Close()
+
+	d, err := c.FStat("f")
+	if err != nil || d.Length != uint64(len(data)) || d.Uidnum != p.NOUID {
+		t.Errorf("FStat: got %v, %v", d, err)
+	}
+
+	f, err = c.FOpen(".", p.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	dirs, err := f.Readdir(0)
+	if (err != nil && err != io.EOF) || len(dirs) != 101 {
+		t.Errorf("Readdir: got %d entries, %v, want 101", len(dirs), err)
+	}
+	f.Close()
+
+	if err := c.FRemove("f"); err != nil {
+		t.Errorf("FRemove: %v", err)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "f")); !os.IsNotExist(err) {
+		t.Errorf("FRemove: file still exists")
+	}
+}
+
+// Test server whose reads block until they are flushed.
+type blockSrv struct {
+	srv.Srv
+	flushed chan error
+}
+
+func (s *blockSrv) Attach(req *srv.Req) { req.RespondRattach(&p.Qid{Type: p.QTFILE}) }
+func (s *blockSrv) Walk(req *srv.Req)   { req.RespondRwalk(nil) }
+func (s *blockSrv) Open(req *srv.Req)   { req.RespondRopen(&p.Qid{Type: p.QTFILE}, 0) }
+func (s *blockSrv) Create(req *srv.Req) { req.RespondError(srv.Enotimpl) }
+func (s *blockSrv) Write(req *srv.Req)  { req.RespondError(srv.Enotimpl) }
+func (s *blockSrv) Clunk(req *srv.Req)  { req.RespondRclunk() }
+func (s *blockSrv) Remove(req *srv.Req) { req.RespondError(srv.Enotimpl) }
+func (s *blockSrv) Stat(req *srv.Req)   { req.RespondError(srv.Enotimpl) }
+func (s *blockSrv) Wstat(req *srv.Req)  { req.RespondError(srv.Enotimpl) }
+
+func (s *blockSrv) Read(req *srv.Req) {
+	ctx := req.Context()
+	<-ctx.Done()
+	s.flushed <- ctx.Err()
+	req.RespondError(ctx.Err())
+}
+
+func TestProxyFlush(t *testing.T) {
+	s := &blockSrv{flushed: make(chan error, 1)}
+	s.Id = "block"
+	s.Start(s)
+
+	c := proxyConnect(t, &s.Srv, 8192+p.IOHDRSZ, p.Dialect9P2000)
+	defer c.Unmount()
+
+	fid, err := c.FWalk("")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	if err := c.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx, fid, 0, 100); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the flush is forwarded to the upstream server
+	select {
+	case err := <-s.flushed:
+		if err != context.Canceled {
+			t.Errorf("upstream read: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the upstream read wasn't flushed")
+	}
+}
@@ -5,17 +5,18 @@
 package srv
 
 import "fmt"
+import "io"
 import "github.com/lionkov/go9p/p"
 
 // Respond to the request with Rerror message
 func (req *Req) RespondError(err interface{}) {
 	switch e := err.(type) {
 	case *p.Error:
-		p.PackRerror(req.Rc, e.Err, uint32(e.Errornum), req.Conn.Dotu)
+		p.PackRerror(req.Rc, e.Err, uint32(e.Errornum), req.Conn.Dialect)
 	case error:
-		p.PackRerror(req.Rc, e.Error(), uint32(p.EIO), req.Conn.Dotu)
+		p.PackRerror(req.Rc, e.Error(), uint32(p.EIO), req.Conn.Dialect)
 	default:
-		p.PackRerror(req.Rc, fmt.Sprintf("%v", e), uint32(p.EIO), req.Conn.Dotu)
+		p.PackRerror(req.Rc, fmt.Sprintf("%v", e), uint32(p.EIO), req.Conn.Dialect)
 	}
 
 	req.Respond()
@@ -101,6 +102,47 @@ func (req *Req) RespondRread(data []byte) {
 	}
 }
 
+// Respond to the request with Rread message with up to count bytes read
+// from r at offset. The data is read before the call returns. If r is an
+// *os.File, the data is spliced from the file to a pipe, and from the
+// pipe to the connection where supported, without copying it to Rc. If
+// fewer bytes can be read, a shorter Rread is sent; if nothing can be
+// read because of an error other than io.EOF, Rerror is sent instead.
+func (req *Req) RespondRreadAt(r io.ReaderAt, offset int64, count uint32) {
+	err := p.InitRread(req.Rc, count)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if err = req.readData(r, offset); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Respond()
+}
+
+// Respond to the request with Rread message with data consisting of
+// the concatenated slices. The slices are not copied to Rc, they are
+// sent with a single vectored write after the header and shouldn't be
+// modified after the call.
+func (req *Req) RespondRreadv(data ...[]byte) {
+	count := 0
+	for _, b := range data {
+		count += len(b)
+	}
+
+	err := p.InitRread(req.Rc, uint32(count))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.rbufs = data
+	req.Respond()
+}
+
 // Respond to the request with Rwrite message
 func (req *Req) RespondRwrite(count uint32) {
 	err := p.PackRwrite(req.Rc, count)
@@ -133,7 +175,7 @@ func (req *Req) RespondRremove() {
 
 // Respond to the request with Rstat message
 func (req *Req) RespondRstat(st *p.Dir) {
-	err := p.PackRstat(req.Rc, st, req.Conn.Dotu)
+	err := p.PackRstat(req.Rc, st, req.Conn.Dialect)
 	if err != nil {
 		req.RespondError(err)
 	} else {
@@ -150,3 +192,193 @@ func (req *Req) RespondRwstat() {
 		req.Respond()
 	}
 }
+
+// Respond to the request with Rlopen message
+func (req *Req) RespondRlopen(qid *p.Qid, iounit uint32) {
+	err := p.PackRlopen(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlcreate message
+func (req *Req) RespondRlcreate(qid *p.Qid, iounit uint32) {
+	err := p.PackRlcreate(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetattr message
+func (req *Req) RespondRgetattr(attr *p.Attr) {
+	err := p.PackRgetattr(req.Rc, attr)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsetattr message
+func (req *Req) RespondRsetattr() {
+	err := p.PackRsetattr(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreaddir message
+func (req *Req) RespondRreaddir(data []byte) {
+	err := p.PackRreaddir(req.Rc, data)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rstatfs message
+func (req *Req) RespondRstatfs(st *p.Statfs) {
+	err := p.PackRstatfs(req.Rc, st)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rfsync message
+func (req *Req) RespondRfsync() {
+	err := p.PackRfsync(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmkdir message
+func (req *Req) RespondRmkdir(qid *p.Qid) {
+	err := p.PackRmkdir(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsymlink message
+func (req *Req) RespondRsymlink(qid *p.Qid) {
+	err := p.PackRsymlink(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmknod message
+func (req *Req) RespondRmknod(qid *p.Qid) {
+	err := p.PackRmknod(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrename message
+func (req *Req) RespondRrename() {
+	err := p.PackRrename(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrenameat message
+func (req *Req) RespondRrenameat() {
+	err := p.PackRrenameat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Runlinkat message
+func (req *Req) RespondRunlinkat() {
+	err := p.PackRunlinkat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlink message
+func (req *Req) RespondRlink() {
+	err := p.PackRlink(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreadlink message
+func (req *Req) RespondRreadlink(target string) {
+	err := p.PackRreadlink(req.Rc, target)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlock message
+func (req *Req) RespondRlock(status uint8) {
+	err := p.PackRlock(req.Rc, status)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetlock message
+func (req *Req) RespondRgetlock(fl *p.Flock) {
+	err := p.PackRgetlock(req.Rc, fl)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrwalk message
+func (req *Req) RespondRxattrwalk(size uint64) {
+	err := p.PackRxattrwalk(req.Rc, size)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrcreate message
+func (req *Req) RespondRxattrcreate() {
+	err := p.PackRxattrcreate(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
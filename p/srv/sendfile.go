@@ -0,0 +1,90 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Returns true if the Rread data is not in Rc.
+func (req *Req) hasData() bool {
+	return req.Rc.Type == p.Rread && (req.rpipe != nil || req.rbufs != nil)
+}
+
+// Drops the references kept for the Rread data.
+func (req *Req) releaseData() {
+	req.rbufs = nil
+	if req.rpipe != nil {
+		req.Conn.pipes.put(req.rpipe)
+		req.rpipe = nil
+	}
+}
+
+// Reads the Rread data from r at offset. It is called by the worker
+// that handles the request, so the goroutine that sends the responses
+// doesn't wait for the file. The data is spliced from the file to a
+// pipe where supported, otherwise it is read to Rc.Data. The data is
+// not padded, Rc is shortened if fewer bytes can be read. Returns an
+// error if nothing could be read because of an error other than io.EOF.
+func (req *Req) readData(r io.ReaderAt, offset int64) error {
+	rc := req.Rc
+	// the data in Rc is needed for the debug log
+	if f, ok := r.(*os.File); ok && len(rc.Data) > 0 && req.Conn.Debuglevel == 0 {
+		if n := req.spliceData(f, offset); n > 0 {
+			p.SetRreadCount(rc, uint32(n))
+			return nil
+		}
+	}
+
+	n, err := r.ReadAt(rc.Data, offset)
+	if n == 0 && err != nil && err != io.EOF {
+		return err
+	}
+
+	p.SetRreadCount(rc, uint32(n))
+	return nil
+}
+
+// Copies the Rread data from the buffers to Rc.Data.
+func (req *Req) loadData() {
+	rc := req.Rc
+	n := 0
+	for _, b := range req.rbufs {
+		n += copy(rc.Data[n:], b)
+	}
+
+	req.rbufs = nil
+}
+
+// Writes the response to the connection. If the Rread data is not
+// in Rc, it is sent from the buffers with a single vectored write, or
+// from the pipe it was spliced to.
+func (conn *Conn) write(req *Req) error {
+	rc := req.Rc
+	if req.hasData() && req.rbufs != nil {
+		hdr := rc.Pkt[0 : len(rc.Pkt)-len(rc.Data)]
+		// some connections pass the empty writes to the reader
+		bufs := net.Buffers{hdr}
+		for _, b := range req.rbufs {
+			if len(b) > 0 {
+				bufs = append(bufs, b)
+			}
+		}
+
+		_, err := bufs.WriteTo(conn.conn)
+		return err
+	}
+
+	if req.hasData() {
+		return conn.writePipe(req)
+	}
+
+	_, err := conn.conn.Write(rc.Pkt)
+	return err
+}
@@ -0,0 +1,282 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const (
+	fSetpipeSz  = 1031 // F_SETPIPE_SZ
+	fGetpipeSz  = 1032 // F_GETPIPE_SZ
+	spliceFlags = 0x3  // SPLICE_F_MOVE | SPLICE_F_NONBLOCK
+
+	// Maximum number of pipes of a connection. If all are in use,
+	// the data is read to the responses.
+	maxSplicePipes = 16
+)
+
+// The pipe the Rread data is spliced through. It is filled by the
+// worker that handles the request and drained by the goroutine that
+// sends the responses.
+type splicePipe struct {
+	r, w int
+	size int // capacity of the pipe
+}
+
+// The pipes of a connection. The drained pipes are reused for other
+// requests, the ones that may still contain data are closed.
+type splicePipes struct {
+	sync.Mutex
+	free   []*splicePipe
+	n      int  // number of pipes in use or free
+	closed bool // if true, the connection is closed
+}
+
+// Returns a free pipe, or nil if there are too many of them.
+func (ps *splicePipes) get() *splicePipe {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.closed {
+		return nil
+	}
+
+	if n := len(ps.free); n > 0 {
+		pp := ps.free[n-1]
+		ps.free = ps.free[0 : n-1]
+		return pp
+	}
+
+	if ps.n >= maxSplicePipes {
+		return nil
+	}
+
+	pp, err := newSplicePipe()
+	if err != nil {
+		return nil
+	}
+
+	ps.n++
+	return pp
+}
+
+// Returns the empty pipe to the free ones.
+func (ps *splicePipes) put(pp *splicePipe) {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.closed {
+		pp.close()
+		return
+	}
+
+	ps.free = append(ps.free, pp)
+}
+
+// Closes the pipe that may still contain data.
+func (ps *splicePipes) discard(pp *splicePipe) {
+	ps.Lock()
+	ps.n--
+	ps.Unlock()
+	pp.close()
+}
+
+// Closes the free pipes, the ones in use are closed when they are put.
+func (ps *splicePipes) close() {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.closed = true
+	for _, pp := range ps.free {
+		pp.close()
+	}
+
+	ps.free = nil
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+
+	pp := &splicePipe{r: fds[0], w: fds[1]}
+	sz, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(pp.w), fGetpipeSz, 0)
+	if e == 0 {
+		pp.size = int(sz)
+	}
+
+	return pp, nil
+}
+
+func (pp *splicePipe) close() {
+	syscall.Close(pp.r)
+	syscall.Close(pp.w)
+}
+
+// Moves up to count bytes from the file at offset to the pipe. Returns
+// the number of bytes moved, fewer than count if the file is shorter or
+// the pipe can't grow. An error is returned only if nothing was moved.
+func (pp *splicePipe) fill(src syscall.RawConn, offset int64, count int) (n int, err error) {
+	if count > pp.size {
+		// if the pipe can't grow, fewer bytes are sent
+		sz, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(pp.w), fSetpipeSz, uintptr(count))
+		if e == 0 {
+			pp.size = int(sz)
+		}
+	}
+
+	cerr := src.Control(func(fd uintptr) {
+		for n < count {
+			off := offset + int64(n)
+			m, e := syscall.Splice(int(fd), &off, pp.w, nil, count-n, spliceFlags)
+			switch {
+			case e == syscall.EINTR:
+				continue
+			case e != nil:
+				// EAGAIN if the pipe is full
+				if n == 0 {
+					err = e
+				}
+				return
+			case m == 0:
+				// end of file
+				return
+			}
+
+			n += int(m)
+		}
+	})
+
+	if cerr != nil && n == 0 {
+		err = cerr
+	}
+
+	return n, err
+}
+
+// Moves the data in the pipe to the connection. If splice can't be used
+// for the connection, the data is read from the pipe to buf and written
+// to c. The length of buf is the number of bytes in the pipe.
+func (pp *splicePipe) drain(c net.Conn, buf []byte) error {
+	var dst syscall.RawConn
+	sc, ok := c.(syscall.Conn)
+	if ok {
+		dst, _ = sc.SyscallConn()
+	}
+
+	if dst == nil {
+		return pp.copy(c, 0, buf)
+	}
+
+	n := 0
+	var werr error
+	err := dst.Write(func(fd uintptr) bool {
+		for n < len(buf) {
+			m, e := syscall.Splice(pp.r, nil, int(fd), nil, len(buf)-n, spliceFlags)
+			switch {
+			case e == syscall.EAGAIN:
+				// wait until the socket is writable
+				return false
+			case e == syscall.EINTR:
+				continue
+			case e != nil:
+				werr = e
+				return true
+			case m == 0:
+				werr = io.ErrShortWrite
+				return true
+			}
+
+			n += int(m)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if werr != syscall.EINVAL {
+		return werr
+	}
+
+	// not supported for the connection
+	return pp.copy(c, n, buf)
+}
+
+// Reads the data in the pipe, after the n bytes already moved, to buf
+// and writes it to c.
+func (pp *splicePipe) copy(c net.Conn, n int, buf []byte) error {
+	for m := n; m < len(buf); {
+		k, err := syscall.Read(pp.r, buf[m:])
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if k == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		m += k
+	}
+
+	_, err := c.Write(buf[n:])
+	return err
+}
+
+// Moves up to len(Rc.Data) bytes from the file at offset to a pipe of
+// the connection with splice(2), and attaches the pipe to the request.
+// Returns the number of bytes moved, so the count in the header is the
+// number of bytes that could actually be read. Returns 0 if splice
+// can't be used for the file or the connection, there is no free pipe,
+// or nothing could be read from the file.
+func (req *Req) spliceData(f *os.File, offset int64) int {
+	conn := req.Conn
+	if _, ok := conn.conn.(syscall.Conn); !ok {
+		return 0
+	}
+
+	src, err := f.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	pp := conn.pipes.get()
+	if pp == nil {
+		return 0
+	}
+
+	n, _ := pp.fill(src, offset, len(req.Rc.Data))
+	if n == 0 {
+		// the caller reads the data again and reports the error
+		conn.pipes.put(pp)
+		return 0
+	}
+
+	req.rpipe = pp
+	return n
+}
+
+// Writes the header of the Rread and the data in the pipe attached to
+// the request to the connection.
+func (conn *Conn) writePipe(req *Req) error {
+	rc := req.Rc
+	_, err := conn.conn.Write(rc.Pkt[0 : len(rc.Pkt)-len(rc.Data)])
+	if err == nil {
+		err = req.rpipe.drain(conn.conn, rc.Data)
+	}
+
+	if err != nil {
+		// the pipe may still contain data
+		conn.pipes.discard(req.rpipe)
+		req.rpipe = nil
+	}
+
+	return err
+}
@@ -0,0 +1,30 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package srv
+
+import (
+	"os"
+	"syscall"
+)
+
+type splicePipe struct{}
+
+type splicePipes struct{}
+
+func (ps *splicePipes) put(pp *splicePipe) {}
+func (ps *splicePipes) close()             {}
+
+// The data is read by the caller on the systems without splice.
+func (req *Req) spliceData(f *os.File, offset int64) int {
+	return 0
+}
+
+// Not called, the requests never have pipes attached.
+func (conn *Conn) writePipe(req *Req) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,131 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// How often Shutdown checks if the outstanding requests are responded to
+var shutdownPollInterval = 10 * time.Millisecond
+
+// Adds the listener to the listeners closed on shutdown. Returns
+// false if the server is already shut down.
+func (srv *Srv) addListener(l net.Listener) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.shutdown {
+		return false
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+
+	srv.listeners[l] = true
+	return true
+}
+
+func (srv *Srv) removeListener(l net.Listener) {
+	srv.Lock()
+	delete(srv.listeners, l)
+	srv.Unlock()
+}
+
+func (srv *Srv) isShutdown() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.shutdown
+}
+
+// Returns true if the server is shut down and the connection's
+// new requests should be responded to with Eshutdown.
+func (conn *Conn) isClosing() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.closing
+}
+
+// Returns true if none of the connections has outstanding requests.
+func (srv *Srv) idle() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	for conn := range srv.conns {
+		conn.Lock()
+		n := len(conn.Reqs)
+		conn.Unlock()
+		if n > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Shuts down the server. Closes all listeners started by StartListener
+// (which then return Eshutdown), waits for the outstanding requests to
+// be responded to, and closes all connections. The requests that are
+// not processed yet, and the ones received while waiting, are responded
+// to with Eshutdown, so busy clients don't keep the server running. If ctx is done before
+// that, the remaining requests are flushed and ctx.Err() is returned.
+// When Shutdown returns, ConnClosed and FidDestroy are called for all
+// connections and fids.
+func (srv *Srv) Shutdown(ctx context.Context) error {
+	var err error
+
+	srv.Lock()
+	srv.shutdown = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for conn := range srv.conns {
+		conn.Lock()
+		conn.closing = true
+		conn.Unlock()
+	}
+	srv.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for err == nil && !srv.idle() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	srv.Lock()
+	conns := make([]*Conn, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.Unlock()
+
+	for _, conn := range conns {
+		conn.flushAll()
+		conn.conn.Close()
+		conn.cancel()
+	}
+
+	srv.connwg.Wait()
+	srv.stopWorkers()
+	if sop, ok := (interface{}(srv)).(StatsOps); ok {
+		sop.statsUnregister()
+	}
+
+	return err
+}
+
+// Closes all listeners and connections immediately. The outstanding
+// requests are flushed. Returns the error of Shutdown, context.Canceled
+// if there were outstanding requests.
+func (srv *Srv) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return srv.Shutdown(ctx)
+}
@@ -7,9 +7,11 @@
 package srv
 
 import (
+	"context"
 	"github.com/lionkov/go9p/p"
 	"net"
 	"sync"
+	"time"
 )
 
 type reqStatus int
@@ -41,6 +43,13 @@ var Ebadoffset error = &p.Error{"bad offset in directory read", p.EINVAL}
 var Edirchange error = &p.Error{"cannot convert between files and directories", p.EINVAL}
 var Enouser error = &p.Error{"unknown user", p.EINVAL}
 var Enotimpl error = &p.Error{"not implemented", p.EINVAL}
+var Enotsup error = &p.Error{Err: "operation not supported", Errornum: p.EOPNOTSUPP}
+var Exattrsize error = &p.Error{Err: "extended attribute size mismatch", Errornum: p.EINVAL}
+var Etimedout error = &p.Error{Err: "request timed out", Errornum: p.ETIMEDOUT}
+var Eshutdown error = &p.Error{Err: "server is shut down", Errornum: p.EIO}
+
+// Maximum size of an extended attribute value set through Txattrcreate
+var XattrMaxSize uint64 = 65536
 
 // Authentication operations. The file server should implement them if
 // it requires user authentication. The authentication in 9P2000 is
@@ -119,6 +128,8 @@ type FlushOp interface {
 
 // Request operations. This interface should be implemented by all file servers.
 // The operations correspond directly to most of the 9P2000 message types.
+// The request's Tc is only valid until the request is responded to,
+// see Req.
 type ReqOps interface {
 	Attach(*Req)
 	Walk(*Req)
@@ -132,6 +143,88 @@ type ReqOps interface {
 	Wstat(*Req)
 }
 
+// 9P2000.L request operations. This interface should be implemented by
+// file servers that want to speak 9P2000.L (for example to be mounted by
+// the Linux kernel with -o version=9p2000.L). The operations are called
+// only on connections that negotiated 9P2000.L, in addition to the ReqOps
+// operations that are shared between the dialects (Attach, Walk, Read,
+// Write, Clunk and Remove).
+type LinuxReqOps interface {
+	Lopen(*Req)
+	Lcreate(*Req)
+	Getattr(*Req)
+	Setattr(*Req)
+	Readdir(*Req)
+	Statfs(*Req)
+	Fsync(*Req)
+	Mkdir(*Req)
+	Symlink(*Req)
+	Mknod(*Req)
+	Rename(*Req)
+	Renameat(*Req)
+	Unlinkat(*Req)
+	Link(*Req)
+	Readlink(*Req)
+}
+
+// 9P2000.L lock operations. The byte-range locks requested by Tlock are
+// tracked by the server's lock manager. The locks are owned by the
+// ClientId and ProcId of the request, and are released when the fid they
+// were obtained through is clunked or its connection is closed. This
+// interface should be implemented if the file server needs to apply the
+// locks to the underlying files too. The calls for the same file are
+// serialized.
+type LinuxLockOps interface {
+	// FidLock is called after the lock manager verified that the lock
+	// doesn't conflict with the locks of other owners. It is also called
+	// with fl.Type set to p.LockTypeUnlck when the client releases a lock,
+	// or when the owner obtains a lock through another fid that overlaps
+	// a lock held through this one. Returns one of the p.Lock* status
+	// values. If the status is not p.LockSuccess, the lock is not granted,
+	// and the ranges released through the other fids are locked again
+	// (or forgotten, if that fails too). The locks that are not released explicitly should be released by
+	// FidDestroy.
+	FidLock(fid *Fid, fl *p.Flock) (uint8, error)
+
+	// FidGetlock is called by Tgetlock if the lock manager doesn't know of
+	// a conflicting lock. Returns the lock that conflicts with fl, or nil.
+	FidGetlock(fid *Fid, fl *p.Flock) (*p.Flock, error)
+}
+
+// 9P2000.L extended attribute operations. This interface should be
+// implemented if the file server supports extended attributes. The server
+// keeps the content of the xattr fids: the value read by Txattrwalk is
+// returned by the Tread messages for the new fid, and the value written
+// to the fid of Txattrcreate is set when the fid is clunked. The ReqOps
+// operations are not called for the xattr fids. If the interface is not
+// implemented, Txattrwalk and Txattrcreate requests fail with Enotsup.
+type LinuxXattrOps interface {
+	// FidGetXattr returns the value of the extended attribute of the
+	// file associated with the fid.
+	FidGetXattr(fid *Fid, name string) ([]byte, error)
+
+	// FidListXattr returns the names of the extended attributes of the
+	// file associated with the fid.
+	FidListXattr(fid *Fid) ([]string, error)
+
+	// FidSetXattr sets the value of the extended attribute. The flags
+	// are p.XattrCreate or p.XattrReplace, or zero.
+	FidSetXattr(fid *Fid, name string, value []byte, flags uint32) error
+
+	// FidRemoveXattr removes the extended attribute. It is called when
+	// the value set through Txattrcreate is empty.
+	FidRemoveXattr(fid *Fid, name string) error
+}
+
+// The state of an xattr fid (created by Txattrwalk or Txattrcreate)
+type xattr struct {
+	name   string
+	data   []byte // the value (or the list of names) of the attribute
+	size   uint64 // the size specified by Txattrcreate
+	flags  uint32 // the flags specified by Txattrcreate
+	create bool   // true if the fid was created by Txattrcreate
+}
+
 type StatsOps interface {
 	statsRegister()
 	statsUnregister()
@@ -147,32 +240,70 @@ type Srv struct {
 	Id         string  // Used for debugging and stats
 	Msize      uint32  // Maximum size of the 9P2000 messages supported by the server
 	Dotu       bool    // If true, the server supports the 9P2000.u extension
+	Dotl       bool    // If true, the server supports the 9P2000.L extension (ops should implement LinuxReqOps)
 	Debuglevel int     // debug level
 	Upool      p.Users // Interface for finding users and groups known to the file server
 	Maxpend    int     // Maximum pending outgoing requests
 	Log        *p.Logger
 
-	ops   interface{}     // operations
-	conns map[*Conn]*Conn // List of connections
+	// Limits for the processing of the requests. If Workers is not zero,
+	// the requests of all connections are processed by that many
+	// goroutines, otherwise a goroutine is started for each request.
+	// If ConnWorkers is not zero, at most that many requests of a
+	// connection are processed at the same time. If Maxreqs is not
+	// zero, the server stops reading from a connection that has that
+	// many outstanding requests until some of them are responded to.
+	Workers     int
+	ConnWorkers int
+	Maxreqs     int
+
+	// Maximum time to process a request of the specified type (p.T* values).
+	// If the request is not responded to in time, its context is cancelled
+	// and Etimedout is sent back. Tversion and Tflush are never timed out.
+	Timeouts map[uint8]time.Duration
+
+	ops       interface{}           // operations
+	conns     map[*Conn]*Conn       // List of connections
+	locks     lockManager           // byte-range locks (9P2000.L)
+	listeners map[net.Listener]bool // listeners started by StartListener
+	shutdown  bool                  // if true, the server doesn't accept new connections
+	connwg    sync.WaitGroup        // connections that are not closed yet
+
+	wlock    sync.Mutex
+	wcond    *sync.Cond // signalled when a request is queued for the workers
+	workq    []*Req     // requests waiting for a worker
+	wstop    bool       // if true, the workers exit once workq is empty
+	maxworkq int        // maximum length of workq
+
+	fcpool *p.FcallPool // Fcalls of the requests and responses
 }
 
 // The Conn type represents a connection from a client to the file server
 type Conn struct {
 	sync.Mutex
 	Srv        *Srv
-	Msize      uint32 // maximum size of 9P2000 messages for the connection
-	Dotu       bool   // if true, both the client and the server speak 9P2000.u
-	Id         string // used for debugging and stats
+	Msize      uint32    // maximum size of 9P2000 messages for the connection
+	Dotu       bool      // if true, both the client and the server speak 9P2000.u
+	Dialect    p.Dialect // protocol dialect spoken on the connection
+	Id         string    // used for debugging and stats
 	Debuglevel int
 
 	conn    net.Conn
+	pipes   splicePipes        // the Rread data is spliced through them
+	ctx     context.Context    // cancelled when the connection is closed
+	cancel  context.CancelFunc // cancels ctx
 	Fidpool map[uint32]*Fid
 	Reqs    map[uint16]*Req // all outstanding requests
+	closing bool            // if true, the server is shut down and the new requests are refused
 
 	Reqout chan *Req
-	rchan  chan *p.Fcall
 	done   chan bool
 
+	nout  int       // number of outstanding requests
+	nwork int       // number of requests scheduled for processing
+	workq []*Req    // requests waiting for one of the ConnWorkers
+	space chan bool // signalled when nout drops below Srv.Maxreqs
+
 	// stats
 	nreqs   int    // number of requests processed by the server
 	tsz     uint64 // total size of the T messages received
@@ -181,6 +312,13 @@ type Conn struct {
 	maxpend int    // maximum number of pending messages
 	nreads  int    // number of reads
 	nwrites int    // number of writes
+
+	maxqueue     int           // maximum length of workq
+	nwait        int           // number of requests that waited for processing
+	waittime     time.Duration // total time the requests waited for processing
+	maxwait      time.Duration // maximum time a request waited for processing
+	nthrottle    int           // number of times the reading was stopped
+	throttletime time.Duration // total time the reading was stopped
 }
 
 // The Fid type identifies a file on the file server.
@@ -193,6 +331,8 @@ type Fid struct {
 	fid       uint32
 	refcount  int
 	opened    bool        // True if the Fid is opened
+	qid       p.Qid       // Qid of the file, set when the Fid is opened
+	xattr     *xattr      // Extended attribute state, if the Fid is an xattr fid
 	Fconn     *Conn       // Connection the Fid belongs to
 	Omode     uint8       // Open mode (p.O* flags), if the fid is opened
 	Type      uint8       // Fid type (p.QT* flags)
@@ -206,18 +346,31 @@ type Fid struct {
 // override the default behavior, the implementation initializes Fid,
 // Afid and Newfid values and automatically keeps track on when the Fids
 // should be destroyed.
+//
+// The Tc and Rc Fcalls are recycled once the response is sent. The
+// file server shouldn't keep references to them, or to the slices
+// they contain (Tc.Data, Tc.Wname, etc.), after responding; the data
+// that is needed later should be copied.
 type Req struct {
 	sync.Mutex
 	Tc     *p.Fcall // Incoming 9P2000 message
 	Rc     *p.Fcall // Outgoing 9P2000 response
 	Fid    *Fid     // The Fid value for all messages that contain fid[4]
 	Afid   *Fid     // The Fid value for the messages that contain afid[4] (Tauth and Tattach)
-	Newfid *Fid     // The Fid value for the messages that contain newfid[4] (Twalk)
+	Newfid *Fid     // The Fid value for the messages that contain newfid[4] (Twalk and Txattrwalk)
+	Dfid   *Fid     // The Fid value for the messages that contain dfid[4] (Trename, Trenameat and Tlink)
 	Conn   *Conn    // Connection that the request belongs to
 
 	status     reqStatus
 	flushreq   *Req
 	prev, next *Req
+	ctx        context.Context
+	cancel     context.CancelFunc
+	timer      *time.Timer // sends Etimedout if the request takes too long
+	queued     time.Time   // when the request was scheduled for processing
+	timedout   bool        // Etimedout sent by timeout(), Tc is still in use
+	rbufs      [][]byte    // if not nil, the Rread data is sent from rbufs
+	rpipe      *splicePipe // if not nil, the Rread data is in rpipe
 }
 
 // The Start method should be called once the file server implementor
@@ -232,6 +385,10 @@ func (srv *Srv) Start(ops interface{}) bool {
 	}
 
 	srv.ops = ops
+	if _, ok := (ops).(LinuxReqOps); !ok {
+		srv.Dotl = false
+	}
+
 	if srv.Upool == nil {
 		srv.Upool = p.OsUsers
 	}
@@ -244,6 +401,12 @@ func (srv *Srv) Start(ops interface{}) bool {
 		srv.Log = p.NewLogger(1024)
 	}
 
+	srv.fcpool = p.NewFcallPool(srv.Msize)
+
+	if srv.Workers > 0 {
+		srv.startWorkers()
+	}
+
 	if sop, ok := (interface{}(srv)).(StatsOps); ok {
 		sop.statsRegister()
 	}
@@ -255,6 +418,59 @@ func (srv *Srv) String() string {
 	return srv.Id
 }
 
+// Returns the context of the request. The context is cancelled when
+// the request is flushed or timed out, when the connection is reset
+// by Tversion or closed, and after the response is sent.
+func (req *Req) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+
+	return req.ctx
+}
+
+// Sets up the context of a new request and starts the timer if the
+// server has a timeout for its message type.
+func (req *Req) init() {
+	conn := req.Conn
+	d := conn.Srv.Timeouts[req.Tc.Type]
+	if d <= 0 || req.Tc.Type == p.Tversion || req.Tc.Type == p.Tflush {
+		req.ctx, req.cancel = context.WithCancel(conn.ctx)
+		return
+	}
+
+	req.ctx, req.cancel = context.WithTimeout(conn.ctx, d)
+	req.timer = time.AfterFunc(d, req.timeout)
+}
+
+// Called when the request is not responded to in time. Sends Etimedout
+// back to the client and makes sure that the response produced by the
+// file server (if any) is ignored. The request stays in the list of
+// outstanding requests until the file server responds to it, so the
+// client's requests that reuse the tag wait for it.
+func (req *Req) timeout() {
+	conn := req.Conn
+	req.Lock()
+	if (req.status & (reqResponded | reqFlush)) != 0 {
+		req.Unlock()
+		return
+	}
+	req.status |= reqFlush
+	req.Unlock()
+
+	treq := &Req{Tc: req.Tc, Rc: p.NewFcall(conn.Msize), Conn: conn, timedout: true}
+	conn.packTimedout(treq.Rc)
+	select {
+	case conn.Reqout <- treq:
+	case <-conn.ctx.Done():
+	}
+}
+
+func (conn *Conn) packTimedout(rc *p.Fcall) {
+	e := Etimedout.(*p.Error)
+	p.PackRerror(rc, e.Err, uint32(e.Errornum), conn.Dialect)
+}
+
 func (req *Req) process() {
 	req.Lock()
 	flushed := (req.status & reqFlush) != 0
@@ -265,9 +481,12 @@ func (req *Req) process() {
 
 	if flushed {
 		req.Respond()
+		return
 	}
 
-	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
+	if req.Tc.Type != p.Tflush && req.Conn.isClosing() {
+		req.RespondError(Eshutdown)
+	} else if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
 		rop.ReqProcess(req)
 	} else {
 		req.Process()
@@ -282,7 +501,7 @@ func (req *Req) process() {
 }
 
 // Performs the default processing of a request. Initializes
-// the Fid, Afid and Newfid fields and calls the appropriate
+// the Fid, Afid, Newfid and Dfid fields and calls the appropriate
 // ReqOps operation for the message. The file server implementer
 // should call it only if the file server implements the ReqProcessOps
 // within the ReqProcess operation.
@@ -343,6 +562,63 @@ func (req *Req) Process() {
 
 	case p.Twstat:
 		srv.wstat(req)
+
+	case p.Tlopen:
+		srv.lopen(req)
+
+	case p.Tlcreate:
+		srv.lcreate(req)
+
+	case p.Tgetattr:
+		srv.getattr(req)
+
+	case p.Tsetattr:
+		srv.setattr(req)
+
+	case p.Treaddir:
+		srv.readdir(req)
+
+	case p.Tstatfs:
+		srv.statfs(req)
+
+	case p.Tfsync:
+		srv.fsync(req)
+
+	case p.Tmkdir:
+		srv.mkdir(req)
+
+	case p.Tsymlink:
+		srv.symlink(req)
+
+	case p.Tmknod:
+		srv.mknod(req)
+
+	case p.Trename:
+		srv.rename(req)
+
+	case p.Trenameat:
+		srv.renameat(req)
+
+	case p.Tunlinkat:
+		srv.unlinkat(req)
+
+	case p.Tlink:
+		srv.link(req)
+
+	case p.Treadlink:
+		srv.readlink(req)
+
+	case p.Tlock:
+		srv.lock(req)
+
+	case p.Tgetlock:
+		srv.getlock(req)
+
+	case p.Txattrwalk:
+		srv.xattrwalk(req)
+
+	case p.Txattrcreate:
+		srv.xattrcreate(req)
 	}
 }
 
@@ -378,6 +654,18 @@ func (req *Req) PostProcess() {
 
 	case p.Tremove:
 		srv.removePost(req)
+
+	case p.Tlopen:
+		srv.lopenPost(req)
+
+	case p.Tlcreate:
+		srv.lcreatePost(req)
+
+	case p.Txattrwalk:
+		srv.xattrwalkPost(req)
+
+	case p.Txattrcreate:
+		srv.xattrcreatePost(req)
 	}
 
 	if req.Fid != nil {
@@ -394,6 +682,11 @@ func (req *Req) PostProcess() {
 		req.Newfid.DecRef()
 		req.Newfid = nil
 	}
+
+	if req.Dfid != nil {
+		req.Dfid.DecRef()
+		req.Dfid = nil
+	}
 }
 
 // The Respond method sends response back to the client. The req.Rc value
@@ -414,6 +707,14 @@ func (req *Req) Respond() {
 		return
 	}
 
+	// the file server may see the deadline before the timer fires
+	if req.timer != nil {
+		req.timer.Stop()
+		if (status&reqFlush) == 0 && req.ctx.Err() == context.DeadlineExceeded {
+			conn.packTimedout(req.Rc)
+		}
+	}
+
 	/* remove the request and all requests flushing it */
 	conn.Lock()
 	nextreq := req.prev
@@ -438,6 +739,7 @@ func (req *Req) Respond() {
 		delete(conn.Reqs, req.Tc.Tag)
 		flushreqs = req.flushreq
 	}
+	conn.reqDone()
 	conn.Unlock()
 
 	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
@@ -448,11 +750,17 @@ func (req *Req) Respond() {
 
 	if (status & reqFlush) == 0 {
 		conn.Reqout <- req
+	} else {
+		req.releaseData()
+	}
+
+	if req.cancel != nil {
+		req.cancel()
 	}
 
 	// process the next request with the same tag (if available)
 	if nextreq != nil {
-		go nextreq.process()
+		conn.dispatch(nextreq)
 	}
 
 	// respond to the flush messages
@@ -472,6 +780,26 @@ func (req *Req) Flush() {
 	req.Respond()
 }
 
+// Marks all outstanding requests (except Tversion) as flushed and
+// cancels their contexts. The responses to the requests will not
+// be sent back to the client.
+func (conn *Conn) flushAll() {
+	conn.Lock()
+	for tag, r := range conn.Reqs {
+		if tag == p.NOTAG {
+			continue
+		}
+
+		for rr := r; rr != nil; rr = rr.next {
+			rr.Lock()
+			rr.status |= reqFlush
+			rr.Unlock()
+			rr.cancel()
+		}
+	}
+	conn.Unlock()
+}
+
 // Lookup a Fid struct based on the 32-bit identifier sent over the wire.
 // Returns nil if the fid is not found. Increases the reference count of
 // the returned fid. The user is responsible to call DecRef once it no
@@ -0,0 +1,496 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+)
+
+var debug = flag.Int("debug", 0, "print debug messages")
+
+// A file server with a single file. If data is set, the reads are
+// responded to with its content. If block is true, the reads wait
+// until their context is cancelled and send its error to cancelled,
+// otherwise they take 20ms. Counts the outstanding reads.
+type testSrv struct {
+	Srv
+	sync.Mutex
+	data        io.ReaderAt
+	block       bool
+	cancelled   chan error
+	outstanding int
+	max         int
+}
+
+func (s *testSrv) Attach(req *Req) { req.RespondRattach(&p.Qid{Type: p.QTFILE}) }
+func (s *testSrv) Walk(req *Req)   { req.RespondRwalk(nil) }
+func (s *testSrv) Open(req *Req)   { req.RespondRopen(&p.Qid{Type: p.QTFILE}, 0) }
+func (s *testSrv) Create(req *Req) { req.RespondError(Enotimpl) }
+func (s *testSrv) Write(req *Req)  { req.RespondError(Enotimpl) }
+func (s *testSrv) Clunk(req *Req)  { req.RespondRclunk() }
+func (s *testSrv) Remove(req *Req) { req.RespondError(Enotimpl) }
+func (s *testSrv) Stat(req *Req)   { req.RespondError(Enotimpl) }
+func (s *testSrv) Wstat(req *Req)  { req.RespondError(Enotimpl) }
+
+func (s *testSrv) Read(req *Req) {
+	if s.data != nil {
+		req.RespondRreadAt(s.data, int64(req.Tc.Offset), req.Tc.Count)
+		return
+	}
+
+	s.Lock()
+	s.outstanding++
+	if s.outstanding > s.max {
+		s.max = s.outstanding
+	}
+	s.Unlock()
+
+	ctx := req.Context()
+	var err error
+	if s.block {
+		<-ctx.Done()
+		err = ctx.Err()
+		s.cancelled <- err
+	} else {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	s.Lock()
+	s.outstanding--
+	s.Unlock()
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRread(make([]byte, req.Tc.Count))
+}
+
+// Starts the file server and returns a client with the file opened.
+func testMount(t *testing.T, s *testSrv, id string) (*clnt.Clnt, net.Listener) {
+	s.Id = id
+	s.Msize = 8192
+	s.Debuglevel = *debug
+	s.Start(s)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go s.StartListener(l)
+
+	c, err := clnt.Mount("unix", l.Addr().String(), "", 8192, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	if err = c.Open(c.Root, p.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	return c, l
+}
+
+func TestSrvContext(t *testing.T) {
+	s := &testSrv{block: true, cancelled: make(chan error, 1)}
+	s.Timeouts = map[uint8]time.Duration{p.Tread: time.Second}
+	c, l := testMount(t, s, "ctx")
+	defer l.Close()
+	defer c.Unmount()
+
+	// flushing the request cancels its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx, c.Root, 0, 16); err == nil {
+		t.Errorf("ReadContext: succeeded, want error")
+	}
+	select {
+	case err := <-s.cancelled:
+		if err != context.Canceled {
+			t.Errorf("flushed request: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flushed request: context not cancelled")
+	}
+
+	// the request that takes too long is responded with Etimedout
+	start := time.Now()
+	_, err := c.Read(c.Root, 0, 16)
+	if perr, ok := err.(*p.Error); !ok || perr.Err != Etimedout.(*p.Error).Err {
+		t.Errorf("Read: got %v, want %v", err, Etimedout)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Read: timed out after %v, want %v", d, time.Second)
+	}
+	if err = <-s.cancelled; err != context.DeadlineExceeded {
+		t.Errorf("timed out request: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := &testSrv{block: true, cancelled: make(chan error, 1)}
+	s.Id = "shutdown"
+	s.Msize = 8192
+	s.Start(s)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	lerr := make(chan error, 1)
+	go func() { lerr <- s.StartListener(l) }()
+
+	c, err := clnt.Mount("unix", l.Addr().String(), "", 8192, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer c.Unmount()
+	if err = c.Open(c.Root, p.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// the blocked read is flushed when the deadline expires
+	rerr := make(chan error, 1)
+	go func() {
+		_, err := c.Read(c.Root, 0, 16)
+		rerr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err = <-s.cancelled; err != context.Canceled {
+		t.Errorf("flushed request: got %v, want %v", err, context.Canceled)
+	}
+	if err = <-rerr; err == nil {
+		t.Errorf("Read: succeeded after shutdown")
+	}
+	if err = <-lerr; err != Eshutdown {
+		t.Errorf("StartListener: got %v, want %v", err, Eshutdown)
+	}
+	if err = s.StartListener(l); err != Eshutdown {
+		t.Errorf("StartListener: got %v, want %v", err, Eshutdown)
+	}
+
+	// an idle server shuts down without waiting
+	s = new(testSrv)
+	c, l = testMount(t, s, "idle")
+	defer c.Unmount()
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	// the clients that keep sending requests don't delay the shutdown,
+	// the new requests are refused
+	s = new(testSrv)
+	c, l = testMount(t, s, "busy")
+	defer c.Unmount()
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	refused := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := c.Read(c.Root, 0, 16); err != nil {
+					refused <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if len(refused) == 0 {
+		t.Errorf("Read: no request refused after shutdown")
+	}
+
+	// Close returns the error of Shutdown
+	s = &testSrv{block: true, cancelled: make(chan error, 1)}
+	c, l = testMount(t, s, "close")
+	defer c.Unmount()
+	go c.Read(c.Root, 0, 16)
+	time.Sleep(50 * time.Millisecond)
+	if err = s.Close(); err != context.Canceled {
+		t.Errorf("Close: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSrvWorkers(t *testing.T) {
+	tests := []struct {
+		workers, connWorkers, maxreqs int
+		want                          int
+	}{
+		{0, 0, 0, 6},
+		{2, 0, 0, 2},
+		{0, 3, 0, 3},
+		{0, 0, 4, 4},
+	}
+
+	for _, tt := range tests {
+		s := new(testSrv)
+		s.Workers = tt.workers
+		s.ConnWorkers = tt.connWorkers
+		s.Maxreqs = tt.maxreqs
+		c, _ := testMount(t, s, "workers")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if b, err := c.Read(c.Root, 0, 100); err != nil || len(b) != 100 {
+					t.Errorf("Read: got %d bytes, %v", len(b), err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		s.Lock()
+		if s.max != tt.want {
+			t.Errorf("%d workers, %d per connection, %d requests: got %d outstanding reads, want %d",
+				tt.workers, tt.connWorkers, tt.maxreqs, s.max, tt.want)
+		}
+		s.Unlock()
+
+		c.Unmount()
+		s.Close()
+	}
+}
+
+func TestRreadAt(t *testing.T) {
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	f, err := ioutil.TempFile("", "go9")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.Write(data[:100]); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the file is shorter than the requested count, as if it shrank
+	// after the server checked its size
+	for _, r := range []io.ReaderAt{f, strings.NewReader(string(data[:100]))} {
+		s := &testSrv{data: r}
+		c, l := testMount(t, s, "rreadat")
+
+		// through the pipe, the data is copied
+		c1, c2 := net.Pipe()
+		s.NewConn(c1)
+		pc, err := clnt.Connect(c2, 8192, false)
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if pc.Root, err = pc.Attach(nil, p.OsUsers.Uid2User(os.Geteuid()), ""); err != nil {
+			t.Fatalf("Attach: %v", err)
+		}
+		if err = pc.Open(pc.Root, p.OREAD); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+
+		for _, c := range []*clnt.Clnt{c, pc} {
+			tests := []struct {
+				offset uint64
+				want   []byte
+			}{
+				{0, data[:100]},
+				{60, data[60:100]},
+				{100, nil},
+				{200, nil},
+			}
+			for _, tt := range tests {
+				b, err := c.Read(c.Root, tt.offset, 5000)
+				if err != nil || !bytes.Equal(b, tt.want) {
+					t.Errorf("%T: Read 5000@%d: got %d bytes, %v, want %d bytes", r, tt.offset, len(b), err, len(tt.want))
+				}
+			}
+		}
+
+		pc.Unmount()
+		c.Unmount()
+		l.Close()
+		s.Close()
+	}
+}
+
+// Blocks the reads at offset 1000 until release is closed.
+type slowReader struct {
+	started chan bool
+	release chan bool
+}
+
+func (r *slowReader) ReadAt(b []byte, off int64) (int, error) {
+	if off == 1000 {
+		r.started <- true
+		<-r.release
+	}
+
+	return len(b), nil
+}
+
+// A slow read delays only its own response, the data is read before
+// the response is queued.
+func TestRreadAtSlow(t *testing.T) {
+	r := &slowReader{make(chan bool), make(chan bool)}
+	s := &testSrv{data: r}
+	c, l := testMount(t, s, "rreadatslow")
+	defer s.Close()
+	defer l.Close()
+	defer c.Unmount()
+
+	slow := make(chan error)
+	go func() {
+		_, err := c.Read(c.Root, 1000, 10)
+		slow <- err
+	}()
+	<-r.started
+
+	fast := make(chan error, 1)
+	go func() {
+		_, err := c.Read(c.Root, 0, 10)
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("Read: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Read: the response waits for the slow read")
+	}
+
+	close(r.release)
+	if err := <-slow; err != nil {
+		t.Errorf("Read: %v", err)
+	}
+}
+
+// The byte-range locks of the backend are owned by the fids, as the
+// open file description locks are. FidLock fails if fail returns true.
+type lockSrv struct {
+	testSrv
+	held lockFile
+	fail func(fid *Fid, fl *p.Flock) bool
+}
+
+func (s *lockSrv) FidLock(fid *Fid, fl *p.Flock) (uint8, error) {
+	if s.fail != nil && s.fail(fid, fl) {
+		return p.LockError, nil
+	}
+
+	end := lockEnd(fl.Start, fl.Length)
+	if fl.Type != p.LockTypeUnlck {
+		for _, l := range s.held.locks {
+			if l.fid != fid && l.overlaps(fl.Start, end) && (fl.Type == p.LockTypeWrlck || l.typ == p.LockTypeWrlck) {
+				return p.LockBlocked, nil
+			}
+		}
+	}
+
+	s.held.unlock(func(l *flock) bool { return l.fid == fid }, fl.Start, end)
+	if fl.Type != p.LockTypeUnlck {
+		s.held.locks = append(s.held.locks, &flock{fid: fid, typ: fl.Type, start: fl.Start, end: end})
+	}
+
+	return p.LockSuccess, nil
+}
+
+func (s *lockSrv) FidGetlock(fid *Fid, fl *p.Flock) (*p.Flock, error) {
+	return nil, nil
+}
+
+func TestLockRestore(t *testing.T) {
+	s := new(lockSrv)
+	s.ops = s
+	conn := &Conn{Srv: &s.Srv}
+	newfid := func() *Fid { return &Fid{Fconn: conn, opened: true, qid: p.Qid{Path: 1}} }
+	fid1, fid2, fid3 := newfid(), newfid(), newfid()
+
+	lock := func(fid *Fid, typ uint8, procid uint32) uint8 {
+		status, err := s.locks.lock(fid, &p.Flock{Type: typ, Start: 0, Length: 10, ProcId: procid, ClientId: "a"})
+		if err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+		return status
+	}
+
+	if status := lock(fid1, p.LockTypeWrlck, 1); status != p.LockSuccess {
+		t.Fatalf("lock fid1: got %d", status)
+	}
+
+	// the owner's lock through fid1 is released at the backend before
+	// locking through fid2, and locked again when that fails
+	s.fail = func(fid *Fid, fl *p.Flock) bool { return fid == fid2 }
+	if status := lock(fid2, p.LockTypeWrlck, 1); status != p.LockError {
+		t.Errorf("lock fid2: got %d, want %d", status, p.LockError)
+	}
+	if len(s.held.locks) != 1 || s.held.locks[0].fid != fid1 || s.held.locks[0].end != 9 {
+		t.Errorf("backend: fid1's lock not restored, got %v", s.held.locks)
+	}
+	if status := lock(fid3, p.LockTypeRdlck, 2); status != p.LockBlocked {
+		t.Errorf("lock fid3: got %d, want %d", status, p.LockBlocked)
+	}
+
+	// the ranges that can't be locked again are dropped from the
+	// manager too
+	s.fail = nil
+	if status := lock(fid1, p.LockTypeUnlck, 1); status != p.LockSuccess {
+		t.Fatalf("unlock fid1: got %d", status)
+	}
+	if status := lock(fid2, p.LockTypeRdlck, 1); status != p.LockSuccess {
+		t.Fatalf("lock fid2: got %d", status)
+	}
+	s.fail = func(fid *Fid, fl *p.Flock) bool { return fl.Type != p.LockTypeUnlck }
+	if status := lock(fid1, p.LockTypeWrlck, 1); status != p.LockError {
+		t.Errorf("lock fid1: got %d, want %d", status, p.LockError)
+	}
+	if len(s.held.locks) != 0 {
+		t.Errorf("backend: got %v, want no locks", s.held.locks)
+	}
+	if fl, err := s.locks.getlock(fid3, &p.Flock{Type: p.LockTypeWrlck, Start: 0, Length: 10, ProcId: 2, ClientId: "a"}); err != nil || fl.Type != p.LockTypeUnlck {
+		t.Errorf("getlock: got %v, %v, want no lock", fl, err)
+	}
+}
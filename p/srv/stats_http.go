@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 var mux sync.RWMutex
@@ -44,6 +45,14 @@ func (srv *Srv) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<html><body><h1>Server %s</h1>", srv.Id))
 	defer io.WriteString(c, "</body></html>")
 
+	// workers
+	if srv.Workers > 0 {
+		srv.wlock.Lock()
+		io.WriteString(c, fmt.Sprintf("<h2>Workers</h2><p>%d workers", srv.Workers))
+		io.WriteString(c, fmt.Sprintf("<br>Queued requests: %d max %d", len(srv.workq), srv.maxworkq))
+		srv.wlock.Unlock()
+	}
+
 	// connections
 	io.WriteString(c, "<h2>Connections</h2><p>")
 	srv.Lock()
@@ -78,6 +87,12 @@ func (conn *Conn) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", conn.npend, conn.maxpend))
 	io.WriteString(c, fmt.Sprintf("<br>Number of reads: %d", conn.nreads))
 	io.WriteString(c, fmt.Sprintf("<br>Number of writes: %d", conn.nwrites))
+	io.WriteString(c, fmt.Sprintf("<br>Outstanding requests: %d", conn.nout))
+	io.WriteString(c, fmt.Sprintf("<br>Requests waiting for a worker: %d max %d", len(conn.workq), conn.maxqueue))
+	if conn.nwait > 0 {
+		io.WriteString(c, fmt.Sprintf("<br>Wait time: average %v max %v", conn.waittime/time.Duration(conn.nwait), conn.maxwait))
+	}
+	io.WriteString(c, fmt.Sprintf("<br>Reading stopped %d times for %v", conn.nthrottle, conn.throttletime))
 	conn.Unlock()
 
 	// fcalls
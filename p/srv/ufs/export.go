@@ -0,0 +1,259 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// The Export type describes a host directory that the clients can
+// attach to by its attach name.
+//
+// If the server runs as root, the files created through an export are
+// owned by the user that attached, with the ids mapped by IdMap.
+type Export struct {
+	Aname          string   // attach name, "" is the same as "/"
+	Path           string   // host directory
+	ReadOnly       bool     // if true, the files can't be modified
+	Users          []string // users allowed to attach
+	Groups         []string // groups allowed to attach, by name or id
+	IdMap          *IdMap   // ids of the users, Ufs.IdMap is used if nil
+	FollowSymlinks bool     // if true, the walks follow the symlinks beneath Path
+
+	rlock sync.Mutex
+	rnode *node // the opened Path
+}
+
+var Enoexport = &p.Error{Err: "unknown attach name", Errornum: p.ENOENT}
+var Eaccess = &p.Error{Err: "permission denied", Errornum: p.EACCES}
+var Erofs = &p.Error{Err: "read-only file system", Errornum: p.EROFS}
+var Eperm = &p.Error{Err: "operation not permitted", Errornum: p.EPERM}
+
+// Returns the export for the attach name, or nil if there is none.
+func (u *Ufs) export(aname string) *Export {
+	aname = path.Join("/", aname)
+	for _, e := range u.Exports {
+		if path.Join("/", e.Aname) == aname {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the user can attach to the export. All users
+// can attach if neither Users nor Groups are set.
+func (e *Export) allowed(user p.User) bool {
+	if len(e.Users) == 0 && len(e.Groups) == 0 {
+		return true
+	}
+
+	for _, name := range e.Users {
+		if name == user.Name() {
+			return true
+		}
+	}
+
+	for _, g := range user.Groups() {
+		if g == nil {
+			continue
+		}
+
+		for _, name := range e.Groups {
+			if name == g.Name() || name == strconv.Itoa(g.Id()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the node of the exported directory, it is opened on
+// the first use and reopened if Path changes.
+func (e *Export) root() (*node, error) {
+	e.rlock.Lock()
+	defer e.rlock.Unlock()
+	return openRoot(&e.rnode, e.Path, e.FollowSymlinks)
+}
+
+// Reads an export table. Each line has the attach name, the
+// host directory and optionally a comma-separated list of options:
+//
+//	ro			the files can't be modified
+//	rw			the files can be modified (default)
+//	users=name:...		users allowed to attach
+//	groups=name:...		groups allowed to attach, by name or id
+//	squash=none|root|all	users mapped to the anonymous user
+//	anonuid=id		uid of the anonymous user (default 65534)
+//	anongid=id		gid of the anonymous user (default 65534)
+//	uidmap=client/host/count:...	client uids mapped to host uids
+//	gidmap=client/host/count:...	client gids mapped to host gids
+//	follow			the walks follow the symlinks
+//	nofollow		the walks don't follow the symlinks (default)
+//
+// The empty lines and the lines starting with # are ignored.
+func ReadExports(r io.Reader) ([]*Export, error) {
+	var exports []*Export
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: invalid export", line)
+		}
+
+		e := &Export{Aname: fields[0], Path: fields[1]}
+		if len(fields) == 3 {
+			if err := e.parseOptions(fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+
+		exports = append(exports, e)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+// Reads the export table from the file.
+func LoadExports(name string) ([]*Export, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	exports, err := ReadExports(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return exports, nil
+}
+
+// Returns the IdMap of the export, creating it if needed.
+func (e *Export) idmap() *IdMap {
+	if e.IdMap == nil {
+		e.IdMap = &IdMap{AnonUid: 65534, AnonGid: 65534}
+	}
+
+	return e.IdMap
+}
+
+func (e *Export) parseOptions(opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		name, val, hasval := strings.Cut(opt, "=")
+		var err error
+		switch {
+		case name == "ro" && !hasval:
+			e.ReadOnly = true
+		case name == "rw" && !hasval:
+			e.ReadOnly = false
+		case name == "follow" && !hasval:
+			e.FollowSymlinks = true
+		case name == "nofollow" && !hasval:
+			e.FollowSymlinks = false
+		case name == "users" && hasval:
+			e.Users = strings.Split(val, ":")
+		case name == "groups" && hasval:
+			e.Groups = strings.Split(val, ":")
+		case name == "squash" && val == "none":
+			e.idmap().Squash = SquashNone
+		case name == "squash" && val == "root":
+			e.idmap().Squash = SquashRoot
+		case name == "squash" && val == "all":
+			e.idmap().Squash = SquashAll
+		case name == "anonuid" && hasval:
+			e.idmap().AnonUid, err = strconv.Atoi(val)
+		case name == "anongid" && hasval:
+			e.idmap().AnonGid, err = strconv.Atoi(val)
+		case name == "uidmap" && hasval:
+			e.idmap().Uids, err = parseRanges(val)
+		case name == "gidmap" && hasval:
+			e.idmap().Gids, err = parseRanges(val)
+		default:
+			return fmt.Errorf("invalid option %q", opt)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid option %q", opt)
+		}
+	}
+
+	return nil
+}
+
+// Parses a list of ranges of ids, client/host/count separated by ":".
+func parseRanges(s string) ([]IdRange, error) {
+	var ranges []IdRange
+	for _, r := range strings.Split(s, ":") {
+		f := strings.Split(r, "/")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid range %q", r)
+		}
+
+		var ids [3]int
+		for i := range f {
+			var err error
+			if ids[i], err = strconv.Atoi(f[i]); err != nil || ids[i] < 0 {
+				return nil, fmt.Errorf("invalid range %q", r)
+			}
+		}
+
+		ranges = append(ranges, IdRange{Client: ids[0], Host: ids[1], Count: ids[2]})
+	}
+
+	return ranges, nil
+}
+
+// Returns an error if the files of the fid's export can't be modified.
+func (fid *Fid) writable() error {
+	if fid.exp != nil && fid.exp.ReadOnly {
+		return Erofs
+	}
+
+	return nil
+}
+
+// Returns an error if the fid's user can't change the owner of
+// the files to uid and gid.
+func (fid *Fid) chownable(uid, gid int) error {
+	if e := fid.writable(); e != nil {
+		return e
+	}
+
+	if fid.squashed && ((uid != -1 && uid != fid.uid) || (gid != -1 && gid != fid.gid)) {
+		return Eperm
+	}
+
+	return nil
+}
+
+// Sets the owner of the file created by the fid's user.
+func (fid *Fid) chown(dir *node, name string) error {
+	if fid.uid == -1 && fid.gid == -1 {
+		return nil
+	}
+
+	return dir.Lchown(name, fid.uid, fid.gid)
+}
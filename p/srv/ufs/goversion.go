@@ -0,0 +1,12 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.25
+// +build !go1.25
+
+package ufs
+
+// The names are resolved beneath the Root with os.Root, its Rename,
+// Link, Lchown, Symlink and Readlink methods need Go 1.25 or newer.
+var _ = ufs_requires_go1_25
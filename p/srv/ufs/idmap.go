@@ -0,0 +1,225 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Squashing of the users
+const (
+	SquashNone = iota // the users keep their ids
+	SquashRoot        // root is mapped to the anonymous user
+	SquashAll         // all users are mapped to the anonymous user
+)
+
+// The IdRange type maps Count ids starting at Client to the
+// ids starting at Host.
+type IdRange struct {
+	Client int
+	Host   int
+	Count  int
+}
+
+// The IdMap type maps the user and group ids of the clients to the ids
+// on the host. The client ids are mapped when the files are created or
+// their owner is changed, and the host ids are mapped back when the
+// files are stat'ed. The user and group names are the names of the client
+// ids in the server's Upool.
+//
+// If there are no ranges for the uids or the gids, the ids are not
+// shifted. Otherwise the client ids outside of the ranges are mapped to
+// the anonymous ids, and the host ids outside of them are reported as
+// p.NOUID. The squashed users are mapped to the anonymous ids before the
+// ranges are looked at, and can't give the files to other users.
+type IdMap struct {
+	Uids    []IdRange // client uids to host uids
+	Gids    []IdRange // client gids to host gids
+	Squash  int       // SquashNone, SquashRoot or SquashAll
+	AnonUid int       // host uid of the squashed and the unmapped users
+	AnonGid int       // host gid of the squashed and the unmapped groups
+}
+
+// Maps the id through the ranges. Returns the id and true if it is in
+// one of the ranges, or if there are no ranges.
+func mapId(ranges []IdRange, id int, tohost bool) (int, bool) {
+	if len(ranges) == 0 {
+		return id, true
+	}
+
+	for _, r := range ranges {
+		from, to := r.Client, r.Host
+		if !tohost {
+			from, to = r.Host, r.Client
+		}
+
+		if id >= from && id-from < r.Count {
+			return to + id - from, true
+		}
+	}
+
+	return -1, false
+}
+
+func (m *IdMap) squashed(uid int) bool {
+	return m != nil && (m.Squash == SquashAll || (m.Squash == SquashRoot && uid == 0))
+}
+
+// Returns the host uid of the client uid. The -1 uid is not mapped.
+func (m *IdMap) HostUid(uid int) int {
+	if m == nil || uid == -1 {
+		return uid
+	}
+
+	if m.squashed(uid) {
+		return m.AnonUid
+	}
+
+	if huid, ok := mapId(m.Uids, uid, true); ok {
+		return huid
+	}
+
+	return m.AnonUid
+}
+
+// Returns the host gid of the client gid. The -1 gid is not mapped.
+func (m *IdMap) HostGid(gid int) int {
+	if m == nil || gid == -1 {
+		return gid
+	}
+
+	if m.Squash == SquashAll || (m.Squash == SquashRoot && gid == 0) {
+		return m.AnonGid
+	}
+
+	if hgid, ok := mapId(m.Gids, gid, true); ok {
+		return hgid
+	}
+
+	return m.AnonGid
+}
+
+// Returns the client uid of the host uid, or -1 if it isn't mapped.
+func (m *IdMap) ClientUid(uid int) int {
+	if m == nil {
+		return uid
+	}
+
+	cuid, _ := mapId(m.Uids, uid, false)
+	return cuid
+}
+
+// Returns the client gid of the host gid, or -1 if it isn't mapped.
+func (m *IdMap) ClientGid(gid int) int {
+	if m == nil {
+		return gid
+	}
+
+	cgid, _ := mapId(m.Gids, gid, false)
+	return cgid
+}
+
+// Returns the host ids that own the files created by the user, or -1 if
+// the server can't change the owner, and true if the user is squashed.
+func (m *IdMap) owner(user p.User) (int, int, bool) {
+	uid, gid := user.Id(), -1
+	if groups := user.Groups(); len(groups) > 0 && groups[0] != nil {
+		gid = groups[0].Id()
+	}
+
+	squashed := m.squashed(uid)
+	uid, gid = m.HostUid(uid), m.HostGid(gid)
+	if os.Geteuid() != 0 {
+		uid, gid = -1, -1
+	}
+
+	return uid, gid, squashed
+}
+
+// Returns the names and the client ids of the owner of the file with the
+// host ids. Without a map the names are looked up in the host's users.
+func (m *IdMap) owners(uid, gid int, dotu bool, upool p.Users) (uname, gname string, cuid, cgid int) {
+	uname, gname = "none", "none"
+	if m == nil && !dotu {
+		uname, gname = strconv.Itoa(uid), strconv.Itoa(gid)
+
+		// BUG(akumar): LookupId will never find names for
+		// groups, as it only operates on user ids.
+		if u, err := user.LookupId(uname); err == nil {
+			uname = u.Username
+		}
+		if g, err := user.LookupId(gname); err == nil {
+			gname = g.Username
+		}
+
+		return uname, gname, uid, gid
+	}
+
+	cuid, cgid = m.ClientUid(uid), m.ClientGid(gid)
+	if cuid != -1 {
+		if u := upool.Uid2User(cuid); u != nil && u.Name() != "" {
+			uname = u.Name()
+		} else if !dotu {
+			uname = strconv.Itoa(cuid)
+		}
+	}
+
+	if cgid != -1 {
+		if g := upool.Gid2Group(cgid); g != nil && g.Name() != "" {
+			gname = g.Name()
+		} else if !dotu {
+			gname = strconv.Itoa(cgid)
+		}
+	}
+
+	return uname, gname, cuid, cgid
+}
+
+// Returns the host ids of the user and the group names, or -1 for
+// the empty names. Without a map the names are looked up in the
+// host's users.
+func (m *IdMap) lookup(uname, gname string, upool p.Users) (int, int, *p.Error) {
+	if m == nil {
+		uid, err := lookup(uname, false)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		// BUG(akumar): Lookup will never find gids
+		// corresponding to group names, because
+		// it only operates on user names.
+		gid, err := lookup(gname, true)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		return int(int32(uid)), int(int32(gid)), nil
+	}
+
+	uid, gid := -1, -1
+	if uname != "" {
+		u := upool.Uname2User(uname)
+		if u == nil {
+			return -1, -1, &p.Error{Err: "unknown user", Errornum: p.EINVAL}
+		}
+
+		uid = m.HostUid(u.Id())
+	}
+
+	if gname != "" {
+		g := upool.Gname2Group(gname)
+		if g == nil {
+			return -1, -1, &p.Error{Err: "unknown group", Errornum: p.EINVAL}
+		}
+
+		gid = m.HostGid(g.Id())
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,456 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/lionkov/go9p/p"
+)
+
+var Ebadname = &p.Error{Err: "invalid file name", Errornum: p.EINVAL}
+
+// The node type is a directory opened beneath the Root of the file
+// server as an os.Root. The fids refer to their files by name within a
+// node, so the names are resolved by the os.Root relative to the
+// directory's descriptor and can't leave the Root through ".." or
+// symlinks. The operations that involve two directories use both
+// descriptors. The fids are not affected when the directories above
+// them are renamed. The fids that walk to the same directory share
+// the node.
+type node struct {
+	*os.Root
+	parent *node  // nil for the Root of the file server
+	name   string // name of the directory in the parent
+	refs   int32
+	follow bool // if true, the walks follow the symlinks
+
+	mu       sync.Mutex
+	children map[string]*node // the subdirectories opened
+}
+
+func (n *node) incRef() {
+	atomic.AddInt32(&n.refs, 1)
+}
+
+// Closes the directory and releases its parent once the node
+// is not referenced.
+func (n *node) decRef() {
+	for n != nil {
+		parent := n.parent
+		if parent == nil {
+			if atomic.AddInt32(&n.refs, -1) == 0 {
+				n.Close()
+			}
+
+			return
+		}
+
+		// the node is found in the parent with the lock held
+		parent.mu.Lock()
+		if atomic.AddInt32(&n.refs, -1) != 0 {
+			parent.mu.Unlock()
+			return
+		}
+
+		if parent.children[n.name] == n {
+			delete(parent.children, n.name)
+		}
+		parent.mu.Unlock()
+		n.Close()
+		n = parent
+	}
+}
+
+// Returns the node of the Root of the file server.
+func (n *node) top() *node {
+	for n.parent != nil {
+		n = n.parent
+	}
+
+	return n
+}
+
+// Returns the name of the directory as seen by the clients.
+func (n *node) base() string {
+	if n.parent == nil {
+		return path.Base(n.Name())
+	}
+
+	return n.name
+}
+
+// Returns the file info of the file in the directory. The symlinks
+// are followed only if the node follows them.
+func (n *node) stat(name string) (os.FileInfo, error) {
+	if n.follow {
+		return n.Stat(name)
+	}
+
+	return n.Lstat(name)
+}
+
+// Opens the subdirectory, or returns its node if it is open
+// already. The symlinks are followed only if the node follows them.
+func (n *node) open(name string) (*node, error) {
+	st, err := n.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !st.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c := n.children[name]; c != nil {
+		// the directory can be replaced since it was opened
+		if cst, err := c.Lstat("."); err == nil && os.SameFile(st, cst) {
+			c.incRef()
+			return c, nil
+		}
+	}
+
+	r, err := n.OpenRoot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	n.incRef()
+	c := &node{Root: r, parent: n, name: name, refs: 1, follow: n.follow}
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+	n.children[name] = c
+	return c, nil
+}
+
+// Returns true if the name can be created in a directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Walks from the file name in dir to the element w. The ".." of the Root
+// is the Root itself. Returns the directory and the name of the file the
+// walk ends at, the nodes opened on the way are appended to opened.
+func walk1(dir *node, name, w string, opened *[]*node) (*node, string, os.FileInfo, error) {
+	switch {
+	case w == "" || strings.Contains(w, "/"):
+		return nil, "", nil, Ebadname
+
+	case w == ".":
+
+	case w == "..":
+		if name != "." {
+			name = "."
+		} else if dir.parent != nil {
+			name = dir.name
+			dir = dir.parent
+		}
+
+	default:
+		if name != "." {
+			n, err := dir.open(name)
+			if err != nil {
+				return nil, "", nil, err
+			}
+
+			*opened = append(*opened, n)
+			dir = n
+		}
+		name = w
+	}
+
+	st, err := dir.stat(name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return dir, name, st, nil
+}
+
+// Returns the directory and the name of the file at the path,
+// relative to the file name in dir.
+func resolve(dir *node, name, fpath string, opened *[]*node) (*node, string, error) {
+	for _, w := range strings.Split(fpath, "/") {
+		if w == "" {
+			continue
+		}
+
+		var err error
+		dir, name, _, err = walk1(dir, name, w, opened)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return dir, name, nil
+}
+
+// Returns the node of the directory at the path, relative
+// to the file name in dir.
+func resolveDir(dir *node, name, fpath string, opened *[]*node) (*node, error) {
+	dir, name, err := resolve(dir, name, fpath, opened)
+	if err != nil || name == "." {
+		return dir, err
+	}
+
+	n, err := dir.open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	*opened = append(*opened, n)
+	return n, nil
+}
+
+// Releases the nodes opened by a walk.
+func decRefs(nodes []*node) {
+	for _, n := range nodes {
+		n.decRef()
+	}
+}
+
+// Renames the file oname in odir to nname in ndir. The files in
+// different nodes are renamed relative to the descriptors of the
+// two directories, wherever they are now.
+func rename(odir *node, oname string, ndir *node, nname string) error {
+	if odir == ndir {
+		return odir.Rename(oname, nname)
+	}
+
+	return withDirs(odir, ndir, func(ofd, nfd int) error {
+		return renameat(ofd, oname, nfd, nname)
+	})
+}
+
+// Creates a hard link nname in ndir to the file oname in odir.
+func link(odir *node, oname string, ndir *node, nname string) error {
+	if odir == ndir {
+		return odir.Link(oname, nname)
+	}
+
+	return withDirs(odir, ndir, func(ofd, nfd int) error {
+		return linkat(ofd, oname, nfd, nname)
+	})
+}
+
+// Calls f with the descriptors of the two directories.
+func withDirs(odir, ndir *node, f func(ofd, nfd int) error) error {
+	of, err := odir.Open(".")
+	if err != nil {
+		return err
+	}
+
+	defer of.Close()
+	nf, err := ndir.Open(".")
+	if err != nil {
+		return err
+	}
+
+	defer nf.Close()
+	return f(int(of.Fd()), int(nf.Fd()))
+}
+
+// Returns the node of the Root directory, it is opened on the first
+// use and reopened if the Root changes.
+func (u *Ufs) root() (*node, error) {
+	u.rlock.Lock()
+	defer u.rlock.Unlock()
+
+	dir := u.Root
+	if dir == "" {
+		dir = "/"
+	}
+
+	return openRoot(&u.rnode, dir, false)
+}
+
+// Opens the directory as the top node in *rnode, unless it is open
+// already. The caller holds the lock that protects *rnode.
+func openRoot(rnode **node, dir string, follow bool) (*node, error) {
+	if *rnode != nil && (*rnode).Name() == dir && (*rnode).follow == follow {
+		return *rnode, nil
+	}
+
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the fids of the old node keep it open
+	if *rnode != nil {
+		(*rnode).decRef()
+	}
+
+	*rnode = &node{Root: r, refs: 1, follow: follow}
+	return *rnode, nil
+}
+
+// Sets the file the fid refers to. If the file is a directory, it
+// is opened, so the fid isn't affected if the directory is renamed.
+func (fid *Fid) set(dir *node, name string, isdir bool) {
+	// the directory is referred to by its name in the parent,
+	// so it can be removed or renamed
+	var n *node
+	if name == "." && dir.parent != nil {
+		n, dir, name = dir, dir.parent, dir.name
+		n.incRef()
+	}
+
+	dir.incRef()
+	fid.Lock()
+	odir, onode := fid.dir, fid.node
+	fid.dir, fid.name, fid.node = dir, name, n
+	fid.Unlock()
+
+	if odir != nil {
+		odir.decRef()
+	}
+
+	if onode != nil {
+		onode.decRef()
+	}
+
+	if isdir && n == nil {
+		fid.self()
+	}
+}
+
+// Returns the directory and the name the walks from the fid start from.
+func (fid *Fid) start() (*node, string) {
+	fid.Lock()
+	defer fid.Unlock()
+	if fid.node != nil {
+		return fid.node, "."
+	}
+
+	return fid.dir, fid.name
+}
+
+// Sets the new name of the file after it is renamed.
+func (fid *Fid) rename(dir *node, name string) {
+	dir.incRef()
+	fid.Lock()
+	odir := fid.dir
+	fid.dir, fid.name = dir, name
+	fid.Unlock()
+	odir.decRef()
+}
+
+// Returns the node of the directory the fid refers to.
+func (fid *Fid) self() (*node, error) {
+	fid.Lock()
+	defer fid.Unlock()
+	if fid.node == nil {
+		if fid.name == "." {
+			fid.dir.incRef()
+			fid.node = fid.dir
+		} else {
+			n, err := fid.dir.open(fid.name)
+			if err != nil {
+				return nil, err
+			}
+
+			fid.node = n
+		}
+	}
+
+	return fid.node, nil
+}
+
+func (fid *Fid) open(flags int, perm os.FileMode) (*os.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND|os.O_CREATE) != 0 {
+		if e := fid.writable(); e != nil {
+			return nil, e
+		}
+	}
+
+	return fid.dir.OpenFile(fid.name, flags, perm)
+}
+
+// Releases the nodes referenced by the fid.
+func (fid *Fid) release() {
+	if fid.node != nil {
+		fid.node.decRef()
+		fid.node = nil
+	}
+
+	if fid.dir != nil {
+		fid.dir.decRef()
+		fid.dir = nil
+	}
+}
+
+// Calls f with a path to the file that is resolved beneath the
+// descriptor of its directory. Only the last element of the path is
+// looked up by name, f should use the operations that don't follow
+// symlinks there (lgetxattr, ...), otherwise a symlink created in place
+// of the file would lead outside of the Root.
+func (fid *Fid) withPath(f func(string) error) error {
+	d, err := fid.dir.Open(".")
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	fpath, err := fdpath(d, fid.name)
+	if err != nil {
+		return err
+	}
+
+	return f(fpath)
+}
+
+// Truncates the file to size bytes.
+func (fid *Fid) truncate(size int64) error {
+	f, err := fid.open(os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+	f.Close()
+	return err
+}
+
+// Returns the node of the directory the fid refers to, checking that
+// the name can be created or removed in it.
+func (fid *Fid) newdir(name string) (*node, error) {
+	if !validName(name) {
+		return nil, Ebadname
+	}
+
+	if e := fid.writable(); e != nil {
+		return nil, e
+	}
+
+	return fid.self()
+}
+
+// Removes the file, or the empty directory if isdir is true.
+func unlinkat(dir *node, name string, isdir bool) error {
+	st, err := dir.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isdir && !st.IsDir():
+		err = syscall.ENOTDIR
+	case !isdir && st.IsDir():
+		err = syscall.EISDIR
+	default:
+		return dir.Remove(name)
+	}
+
+	return &os.PathError{Op: "unlinkat", Path: name, Err: err}
+}
@@ -0,0 +1,106 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// The bits of the Qid paths, the Qid guarantees are
+// described in the Ufs type.
+const (
+	qidInoBits  = 48        // the bits of the inode in the path
+	qidDevMax   = 1<<15 - 1 // the devices with an index
+	qidInoMask  = 1<<qidInoBits - 1
+	qidTableBit = 1 << 63 // the paths assigned from the table
+)
+
+// The maximum number of paths in the table. Once it is full, the
+// oldest entry is evicted for each new one.
+var qidTableMax = 1 << 16
+
+type devino struct {
+	dev, ino uint64
+}
+
+// The table of the devices and of the paths that don't fit,
+// shared by all the servers in the process.
+var qids struct {
+	sync.Mutex
+	devs  map[uint64]uint64 // index of each device
+	paths map[devino]uint64 // paths of the files that don't fit
+	order []devino          // the files in paths, in the order they were added
+	head  int               // index in order of the oldest file
+	next  uint64            // the next path from the table
+}
+
+// Returns the Qid path of the inode on the device. The top bit of the
+// path is 0, the next 15 bits are the index of the device in the order
+// the devices are seen, and the low 48 bits are the inode. The inodes
+// that don't fit in 48 bits, and the inodes on the devices past the
+// first 32767, get the paths with the top bit set, from a table that
+// maps their device and inode to a counter.
+//
+// The table keeps at most qidTableMax files, the oldest file is evicted
+// when a new one is added. The counter is never reused, so the paths
+// from the table never collide with each other or with the computed
+// paths. An evicted file gets a new path the next time it is seen, and
+// the clients see it as a different file.
+func qidPath(dev, ino uint64) uint64 {
+	qids.Lock()
+	defer qids.Unlock()
+
+	if qids.devs == nil {
+		qids.devs = make(map[uint64]uint64)
+	}
+
+	idx, ok := qids.devs[dev]
+	if !ok && len(qids.devs) < qidDevMax {
+		idx, ok = uint64(len(qids.devs)), true
+		qids.devs[dev] = idx
+	}
+
+	if ok && ino&^qidInoMask == 0 {
+		return idx<<qidInoBits | ino
+	}
+
+	di := devino{dev, ino}
+	path, ok := qids.paths[di]
+	if !ok {
+		if qids.paths == nil {
+			qids.paths = make(map[devino]uint64)
+		}
+
+		if len(qids.order) < qidTableMax {
+			qids.order = append(qids.order, di)
+		} else {
+			delete(qids.paths, qids.order[qids.head])
+			qids.order[qids.head] = di
+			qids.head = (qids.head + 1) % len(qids.order)
+		}
+
+		path = qidTableBit | qids.next
+		qids.next++
+		qids.paths[di] = path
+	}
+
+	return path
+}
+
+// Returns the Qid version for the modification and change times.
+func qidVersion(mtime, ctime time.Time) uint32 {
+	var b [32]byte
+
+	binary.LittleEndian.PutUint64(b[0:], uint64(mtime.Unix()))
+	binary.LittleEndian.PutUint64(b[8:], uint64(mtime.Nanosecond()))
+	binary.LittleEndian.PutUint64(b[16:], uint64(ctime.Unix()))
+	binary.LittleEndian.PutUint64(b[24:], uint64(ctime.Nanosecond()))
+	h := fnv.New32a()
+	h.Write(b[:])
+	return h.Sum32()
+}
@@ -11,7 +11,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,27 +20,74 @@ import (
 )
 
 type Fid struct {
-	path       string
+	sync.Mutex
+	dir        *node  // directory of the file
+	name       string // name of the file in dir, "." for dir itself
+	node       *node  // if the file is a directory, opened when needed
 	file       *os.File
 	dirs       []os.FileInfo
 	diroffset  uint64
 	direntends []int
 	dirents    []byte
+	ldirents   []p.Dirent // 9P2000.L directory entries, indexed by offset
 	st         os.FileInfo
+	exp        *Export // export the fid is attached to, nil if none
+	idmap      *IdMap  // ids of the users, nil if not mapped
+	uid, gid   int     // owner of the files created by the fid's user
+	squashed   bool    // true if the fid's user is squashed
 }
 
+// The Ufs type serves the files of a host directory tree. The Qids of
+// the files provide these guarantees to the clients:
+//
+// The Qid path is derived from the device and the inode of the file, so
+// two files served by the same server have the same path only if they are
+// the same file, even if they are on different devices. The path doesn't
+// change when the file is renamed and is the same for all hard links to
+// the file. The paths are stable for the lifetime of the server, but can
+// change when it is restarted. A removed file's inode can be reused by
+// the file system, and the new file gets the same path. The exception
+// are the files whose inodes don't fit in 48 bits, or that are on a
+// device past the first 32767: their paths come from a bounded table,
+// and a file evicted from it gets a new path.
+//
+// The Qid version is a hash of the modification and change times of the
+// file, with the nanoseconds the file system keeps. It changes whenever
+// the data or the metadata of the file change, unless the changes are
+// within the resolution of the file system's timestamps or the 32-bit
+// hashes collide. The clients can use the version to validate the
+// cached data of the file.
 type Ufs struct {
 	srv.Srv
-	Root string
+	Root    string
+	Exports []*Export // if not nil, the clients can attach only to the exports
+	IdMap   *IdMap    // ids of the users, nil if not mapped
+	Special bool      // if true, Create and Mknod make the devices, the named pipes and the sockets
+
+	rlock sync.Mutex
+	rnode *node // the opened Root
 }
 
 var root = flag.String("root", "/", "root filesystem")
 var Enoent = &p.Error{"file not found", p.ENOENT}
+var Enospecial = &p.Error{Err: "special files not allowed", Errornum: p.EPERM}
+var Ebaddevice = &p.Error{Err: "invalid device", Errornum: p.EINVAL}
 
 func toError(err error) *p.Error {
 	var ecode uint32
 
 	ename := err.Error()
+	switch e := err.(type) {
+	case *p.Error:
+		return e
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
 	if e, ok := err.(syscall.Errno); ok {
 		ecode = uint32(e)
 	} else {
@@ -73,7 +120,16 @@ func isChar(d os.FileInfo) bool {
 func (fid *Fid) stat() *p.Error {
 	var err error
 
-	fid.st, err = os.Lstat(fid.path)
+	// the open files and the directories are found
+	// even if they are renamed
+	switch {
+	case fid.file != nil:
+		fid.st, err = fid.file.Stat()
+	case fid.node != nil:
+		fid.st, err = fid.node.Lstat(".")
+	default:
+		fid.st, err = fid.dir.stat(fid.name)
+	}
 	if err != nil {
 		return toError(err)
 	}
@@ -108,6 +164,9 @@ func omode2uflags(mode uint8) int {
 	return ret
 }
 
+// Returns the Qid of the file. The Qid path is unique for the device
+// and the inode of the file, and the version is a hash of its
+// modification and change times (see qidPath and qidVersion).
 func dir2Qid(d os.FileInfo) *p.Qid {
 	var qid p.Qid
 	sysif := d.Sys()
@@ -116,8 +175,8 @@ func dir2Qid(d os.FileInfo) *p.Qid {
 	}
 	stat := sysif.(*syscall.Stat_t)
 
-	qid.Path = stat.Ino
-	qid.Version = uint32(d.ModTime().UnixNano() / 1000000)
+	qid.Path = qidPath(uint64(stat.Dev), uint64(stat.Ino))
+	qid.Version = qidVersion(d.ModTime(), ctime(stat))
 	qid.Type = dir2QidType(d)
 
 	return &qid
@@ -178,7 +237,7 @@ type Dir struct {
 	p.Dir
 }
 
-func dir2Dir(s string, d os.FileInfo, dotu bool, upool p.Users) (*p.Dir, error) {
+func dir2Dir(parent *node, s string, d os.FileInfo, dotu bool, upool p.Users, idmap *IdMap) (*p.Dir, error) {
 	sysif := d.Sys()
 	if sysif == nil {
 		return nil, &os.PathError{"dir2Dir", s, nil}
@@ -191,66 +250,47 @@ func dir2Dir(s string, d os.FileInfo, dotu bool, upool p.Users) (*p.Dir, error)
 		return nil, &os.PathError{"dir2Dir: sysif has wrong type", s, nil}
 	}
 
+	name := s
+	if name == "." {
+		name = parent.base()
+	}
+
 	dir := new(Dir)
 	dir.Qid = *dir2Qid(d)
 	dir.Mode = dir2Npmode(d, dotu)
 	dir.Atime = uint32(atime(sysMode).Unix())
 	dir.Mtime = uint32(d.ModTime().Unix())
 	dir.Length = uint64(d.Size())
-	dir.Name = s[strings.LastIndex(s, "/")+1:]
-
-	if dotu {
-		dir.dotu(s, d, upool, sysMode)
-		return &dir.Dir, nil
-	}
+	dir.Name = name
 
-	unixUid := int(sysMode.Uid)
-	unixGid := int(sysMode.Gid)
-	dir.Uid = strconv.Itoa(unixUid)
-	dir.Gid = strconv.Itoa(unixGid)
+	// the owner is reported with the client ids
+	uid, gid := int(sysMode.Uid), int(sysMode.Gid)
+	dir.Uid, dir.Gid, uid, gid = idmap.owners(uid, gid, dotu, upool)
 	dir.Muid = "none"
-
-	// BUG(akumar): LookupId will never find names for
-	// groups, as it only operates on user ids.
-	u, err := user.LookupId(dir.Uid)
-	if err == nil {
-		dir.Uid = u.Username
-	}
-	g, err := user.LookupId(dir.Gid)
-	if err == nil {
-		dir.Gid = g.Username
+	if dotu {
+		dir.dotu(parent, s, d, uid, gid, sysMode)
 	}
 
 	return &dir.Dir, nil
 }
 
-func (dir *Dir) dotu(path string, d os.FileInfo, upool p.Users, sysMode *syscall.Stat_t) {
-	u := upool.Uid2User(int(sysMode.Uid))
-	g := upool.Gid2Group(int(sysMode.Gid))
-	dir.Uid = u.Name()
-	if dir.Uid == "" {
-		dir.Uid = "none"
-	}
-
-	dir.Gid = g.Name()
-	if dir.Gid == "" {
-		dir.Gid = "none"
-	}
-	dir.Muid = "none"
+func (dir *Dir) dotu(parent *node, name string, d os.FileInfo, uid, gid int, sysMode *syscall.Stat_t) {
 	dir.Ext = ""
-	dir.Uidnum = uint32(u.Id())
-	dir.Gidnum = uint32(g.Id())
+	dir.Uidnum = uint32(uid)
+	dir.Gidnum = uint32(gid)
 	dir.Muidnum = p.NOUID
 	if d.Mode()&os.ModeSymlink != 0 {
 		var err error
-		dir.Ext, err = os.Readlink(path)
+		dir.Ext, err = parent.Readlink(name)
 		if err != nil {
 			dir.Ext = ""
 		}
 	} else if isBlock(d) {
-		dir.Ext = fmt.Sprintf("b %d %d", sysMode.Rdev>>24, sysMode.Rdev&0xFFFFFF)
+		major, minor := devnums(uint64(sysMode.Rdev))
+		dir.Ext = fmt.Sprintf("b %d %d", major, minor)
 	} else if isChar(d) {
-		dir.Ext = fmt.Sprintf("c %d %d", sysMode.Rdev>>24, sysMode.Rdev&0xFFFFFF)
+		major, minor := devnums(uint64(sysMode.Rdev))
+		dir.Ext = fmt.Sprintf("c %d %d", major, minor)
 	}
 }
 
@@ -277,6 +317,8 @@ func (*Ufs) FidDestroy(sfid *srv.Fid) {
 	if fid.file != nil {
 		fid.file.Close()
 	}
+
+	fid.release()
 }
 
 func (u *Ufs) Attach(req *srv.Req) {
@@ -287,11 +329,58 @@ func (u *Ufs) Attach(req *srv.Req) {
 
 	tc := req.Tc
 	fid := new(Fid)
+	fid.uid, fid.gid = -1, -1
+	aname := tc.Aname
+	var root *node
+	var e error
+	if u.Exports != nil {
+		// the clients attach to the exported directories only
+		fid.exp = u.export(aname)
+		if fid.exp == nil {
+			req.RespondError(Enoexport)
+			return
+		}
+
+		if !fid.exp.allowed(req.Fid.User) {
+			req.RespondError(Eaccess)
+			return
+		}
+
+		aname = ""
+		root, e = fid.exp.root()
+	} else {
+		root, e = u.root()
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	// the files created by the users of the exports and of the mapped
+	// ids are given to them
+	fid.idmap = u.IdMap
+	if fid.exp != nil && fid.exp.IdMap != nil {
+		fid.idmap = fid.exp.IdMap
+	}
+
+	if fid.exp != nil || fid.idmap != nil {
+		fid.uid, fid.gid, fid.squashed = fid.idmap.owner(req.Fid.User)
+	}
 
 	// You can think of the ufs.Root as a 'chroot' of a sort.
 	// client attaches are not allowed to go outside the
 	// directory represented by ufs.Root
-	fid.path = path.Join(u.Root, tc.Aname)
+	var opened []*node
+	dir, name, e := resolve(root, ".", aname, &opened)
+	if e != nil {
+		decRefs(opened)
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.set(dir, name, true)
+	decRefs(opened)
 
 	req.Fid.Aux = fid
 	err := fid.stat()
@@ -317,18 +406,22 @@ func (*Ufs) Walk(req *srv.Req) {
 	}
 
 	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = new(Fid)
+		req.Newfid.Aux = &Fid{exp: fid.exp, idmap: fid.idmap, uid: fid.uid, gid: fid.gid, squashed: fid.squashed}
 	}
 
+	// each element is looked up in the directory opened by the
+	// previous one, the symlinks are not followed
 	nfid := req.Newfid.Aux.(*Fid)
 	wqids := make([]p.Qid, len(tc.Wname))
-	path := fid.path
+	var opened []*node
+	dir, name := fid.start()
+	isdir := fid.st.IsDir()
 	i := 0
 	for ; i < len(tc.Wname); i++ {
-		p := path + "/" + tc.Wname[i]
-		st, err := os.Lstat(p)
+		d, n, st, err := walk1(dir, name, tc.Wname[i], &opened)
 		if err != nil {
 			if i == 0 {
+				decRefs(opened)
 				req.RespondError(Enoent)
 				return
 			}
@@ -337,10 +430,11 @@ func (*Ufs) Walk(req *srv.Req) {
 		}
 
 		wqids[i] = *dir2Qid(st)
-		path = p
+		dir, name, isdir = d, n, st.IsDir()
 	}
 
-	nfid.path = path
+	nfid.set(dir, name, isdir)
+	decRefs(opened)
 	req.RespondRwalk(wqids[0:i])
 }
 
@@ -354,7 +448,7 @@ func (*Ufs) Open(req *srv.Req) {
 	}
 
 	var e error
-	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
+	fid.file, e = fid.open(omode2uflags(tc.Mode), 0)
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -363,7 +457,39 @@ func (*Ufs) Open(req *srv.Req) {
 	req.RespondRopen(dir2Qid(fid.st), 0)
 }
 
-func (*Ufs) Create(req *srv.Req) {
+// Returns the mode and the device number of the special file
+// with the 9P2000.u permissions and extension. The devices are
+// described as "b major minor" or "c major minor".
+func special(perm uint32, ext string) (uint32, int, error) {
+	mode := perm & 0777
+	switch {
+	case perm&p.DMDEVICE != 0:
+		var typ rune
+		var major, minor uint32
+		if n, _ := fmt.Sscanf(ext, "%c %d %d", &typ, &major, &minor); n != 3 {
+			return 0, 0, Ebaddevice
+		}
+
+		switch typ {
+		case 'b':
+			mode |= syscall.S_IFBLK
+		case 'c':
+			mode |= syscall.S_IFCHR
+		default:
+			return 0, 0, Ebaddevice
+		}
+
+		return mode, mkdev(major, minor), nil
+
+	case perm&p.DMNAMEDPIPE != 0:
+		return mode | syscall.S_IFIFO, 0, nil
+
+	default:
+		return mode | syscall.S_IFSOCK, 0, nil
+	}
+}
+
+func (u *Ufs) Create(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 	err := fid.stat()
@@ -372,18 +498,24 @@ func (*Ufs) Create(req *srv.Req) {
 		return
 	}
 
-	path := fid.path + "/" + tc.Name
-	var e error = nil
+	dir, e := fid.newdir(tc.Name)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	name := tc.Name
 	var file *os.File = nil
 	switch {
 	case tc.Perm&p.DMDIR != 0:
-		e = os.Mkdir(path, os.FileMode(tc.Perm&0777))
+		e = dir.Mkdir(name, os.FileMode(tc.Perm&0777))
 
 	case tc.Perm&p.DMSYMLINK != 0:
-		e = os.Symlink(tc.Ext, path)
+		e = dir.Symlink(tc.Ext, name)
 
 	case tc.Perm&p.DMLINK != 0:
-		n, e := strconv.ParseUint(tc.Ext, 10, 0)
+		var n uint64
+		n, e = strconv.ParseUint(tc.Ext, 10, 0)
 		if e != nil {
 			break
 		}
@@ -394,13 +526,22 @@ func (*Ufs) Create(req *srv.Req) {
 			return
 		}
 
-		e = os.Link(ofid.Aux.(*Fid).path, path)
+		of := ofid.Aux.(*Fid)
+		e = link(of.dir, of.name, dir, name)
 		ofid.DecRef()
 
-	case tc.Perm&p.DMNAMEDPIPE != 0:
-	case tc.Perm&p.DMDEVICE != 0:
-		req.RespondError(&p.Error{"not implemented", p.EIO})
-		return
+	case tc.Perm&(p.DMDEVICE|p.DMNAMEDPIPE|p.DMSOCKET) != 0:
+		// creating the devices needs privileges
+		if !u.Special {
+			req.RespondError(Enospecial)
+			return
+		}
+
+		var mode uint32
+		var dev int
+		if mode, dev, e = special(tc.Perm, tc.Ext); e == nil {
+			e = mknodat(dir, name, mode, dev)
+		}
 
 	default:
 		var mode uint32 = tc.Perm & 0777
@@ -412,19 +553,30 @@ func (*Ufs) Create(req *srv.Req) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
+		file, e = dir.OpenFile(name, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
 	}
 
-	if file == nil && e == nil {
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0)
+	// the symlinks are not followed, and the special files are not
+	// opened until the client opens them
+	if file == nil && e == nil && tc.Perm&(p.DMSYMLINK|p.DMDEVICE|p.DMNAMEDPIPE|p.DMSOCKET) == 0 {
+		file, e = dir.OpenFile(name, omode2uflags(tc.Mode), 0)
+	}
+
+	// the hard links keep the owner of the file
+	if e == nil && tc.Perm&p.DMLINK == 0 {
+		e = fid.chown(dir, name)
 	}
 
 	if e != nil {
+		if file != nil {
+			file.Close()
+		}
+
 		req.RespondError(toError(e))
 		return
 	}
 
-	fid.path = path
+	fid.set(dir, name, tc.Perm&p.DMDIR != 0)
 	fid.file = file
 	err = fid.stat()
 	if err != nil {
@@ -446,6 +598,14 @@ func (u *Ufs) Read(req *srv.Req) {
 		return
 	}
 
+	// the data of the regular files is sent directly from the file,
+	// the size from the stat is not used, it can change or be wrong
+	// (/proc, sysfs)
+	if fid.st.Mode().IsRegular() {
+		req.RespondRreadAt(fid.file, int64(tc.Offset), tc.Count)
+		return
+	}
+
 	p.InitRread(rc, tc.Count)
 	var count int
 	var e error
@@ -455,34 +615,49 @@ func (u *Ufs) Read(req *srv.Req) {
 			// If we got here, it was open. Can't really seek
 			// in most cases, just close and reopen it.
 			fid.file.Close()
-			if fid.file, e = os.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0); e != nil {
+			if fid.file, e = fid.open(omode2uflags(req.Fid.Omode), 0); e != nil {
+				req.RespondError(toError(e))
+				return
+			}
+
+			dir, e := fid.self()
+			if e != nil {
 				req.RespondError(toError(e))
 				return
 			}
 
-			if fid.dirs, e = fid.file.Readdir(-1); e != nil {
+			names, e := fid.file.Readdirnames(-1)
+			if e != nil {
 				req.RespondError(toError(e))
 				return
 			}
 
+			// the entries are looked up in the directory, not by path
+			fid.dirs = nil
+			for _, name := range names {
+				if st, err := dir.Lstat(name); err == nil {
+					fid.dirs = append(fid.dirs, st)
+				}
+			}
+
 			if dbg {
 				log.Printf("Read: read %d entries", len(fid.dirs))
 			}
 			fid.dirents = nil
 			fid.direntends = nil
 			for i := 0; i < len(fid.dirs); i++ {
-				path := fid.path + "/" + fid.dirs[i].Name()
-				st, err := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool)
+				name := fid.dirs[i].Name()
+				st, err := dir2Dir(dir, name, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool, fid.idmap)
 				if err != nil {
 					if dbg {
-						log.Printf("dbg: stat of %v: %v", path, err)
+						log.Printf("dbg: stat of %v: %v", name, err)
 					}
 					continue
 				}
 				if dbg {
-					log.Printf("Stat: %v is %v", path, st)
+					log.Printf("Stat: %v is %v", name, st)
 				}
-				b := p.PackDir(st, req.Conn.Dotu)
+				b := p.PackDir(st, req.Conn.Dialect)
 				fid.dirents = append(fid.dirents, b...)
 				count += len(b)
 				fid.direntends = append(fid.direntends, count)
@@ -521,7 +696,10 @@ func (u *Ufs) Read(req *srv.Req) {
 			req.RespondError(&p.Error{"too small read size for dir entry", p.EINVAL})
 			return
 		}
-		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
+		// the entries are not modified, a new slice is allocated
+		// when the directory is read again
+		req.RespondRreadv(fid.dirents[tc.Offset : int(tc.Offset)+count])
+		return
 	} else {
 		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
 		if e != nil && e != io.EOF {
@@ -562,7 +740,11 @@ func (*Ufs) Remove(req *srv.Req) {
 		return
 	}
 
-	e := os.Remove(fid.path)
+	e := fid.writable()
+	if e == nil {
+		e = fid.dir.Remove(fid.name)
+	}
+
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -578,7 +760,7 @@ func (*Ufs) Stat(req *srv.Req) {
 		return
 	}
 
-	st, err := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool)
+	st, err := dir2Dir(fid.dir, fid.name, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool, fid.idmap)
 	if err != nil {
 		req.RespondError(err)
 		return
@@ -614,6 +796,11 @@ func (u *Ufs) Wstat(req *srv.Req) {
 		return
 	}
 
+	if e := fid.writable(); e != nil {
+		req.RespondError(e)
+		return
+	}
+
 	dir := &req.Tc.Dir
 	if dir.Mode != 0xFFFFFFFF {
 		changed = true
@@ -626,41 +813,37 @@ func (u *Ufs) Wstat(req *srv.Req) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		e := os.Chmod(fid.path, os.FileMode(mode))
+		e := fid.dir.Chmod(fid.name, os.FileMode(mode))
 		if e != nil {
 			req.RespondError(toError(e))
 			return
 		}
 	}
 
-	uid, gid := p.NOUID, p.NOUID
+	// the client ids are mapped to the host ids
+	uid, gid := -1, -1
 	if req.Conn.Dotu {
-		uid = dir.Uidnum
-		gid = dir.Gidnum
+		uid = fid.idmap.HostUid(int(int32(dir.Uidnum)))
+		gid = fid.idmap.HostGid(int(int32(dir.Gidnum)))
 	}
 
 	// Try to find local uid, gid by name.
 	if (dir.Uid != "" || dir.Gid != "") && !req.Conn.Dotu {
 		changed = true
-		uid, err = lookup(dir.Uid, false)
-		if err != nil {
-			req.RespondError(err)
-			return
-		}
-
-		// BUG(akumar): Lookup will never find gids
-		// corresponding to group names, because
-		// it only operates on user names.
-		gid, err = lookup(dir.Gid, true)
+		uid, gid, err = fid.idmap.lookup(dir.Uid, dir.Gid, req.Conn.Srv.Upool)
 		if err != nil {
 			req.RespondError(err)
 			return
 		}
 	}
 
-	if uid != p.NOUID || gid != p.NOUID {
+	if uid != -1 || gid != -1 {
 		changed = true
-		e := os.Chown(fid.path, int(uid), int(gid))
+		e := fid.chownable(uid, gid)
+		if e == nil {
+			e = fid.dir.Lchown(fid.name, uid, gid)
+		}
+
 		if e != nil {
 			req.RespondError(toError(e))
 			return
@@ -669,30 +852,43 @@ func (u *Ufs) Wstat(req *srv.Req) {
 
 	if dir.Name != "" {
 		changed = true
-		// If we path.Join dir.Name to / before adding it to
-		// the fid path, that ensures nobody gets to walk out of the
+		// The new name is looked up relative to the directory
+		// of the file, that ensures nobody gets to walk out of the
 		// root of this server.
-		newname := path.Join(path.Dir(fid.path), path.Join("/", dir.Name))
+		ndir := fid.dir
 
 		// absolute renaming. Ufs can do this, so let's support it.
 		// We'll allow an absolute path in the Name and, if it is,
 		// we will make it relative to root. This is a gigantic performance
 		// improvement in systems that allow it.
 		if filepath.IsAbs(dir.Name) {
-			newname = path.Join(u.Root, dir.Name)
+			ndir = fid.dir.top()
 		}
 
-		err := syscall.Rename(fid.path, newname)
-		if err != nil {
-			req.RespondError(toError(err))
+		var opened []*node
+		dname, nname := path.Split(path.Join("/", dir.Name))
+		ndir, e := resolveDir(ndir, ".", dname, &opened)
+		if e == nil && !validName(nname) {
+			e = Ebadname
+		}
+
+		if e == nil {
+			e = rename(fid.dir, fid.name, ndir, nname)
+		}
+
+		if e != nil {
+			decRefs(opened)
+			req.RespondError(toError(e))
 			return
 		}
-		fid.path = newname
+
+		fid.rename(ndir, nname)
+		decRefs(opened)
 	}
 
 	if dir.Length != 0xFFFFFFFFFFFFFFFF {
 		changed = true
-		e := os.Truncate(fid.path, int64(dir.Length))
+		e := fid.truncate(int64(dir.Length))
 		if e != nil {
 			req.RespondError(toError(e))
 			return
@@ -705,7 +901,7 @@ func (u *Ufs) Wstat(req *srv.Req) {
 		changed = true
 		mt, at := time.Unix(int64(dir.Mtime), 0), time.Unix(int64(dir.Atime), 0)
 		if cmt, cat := (dir.Mtime == ^uint32(0)), (dir.Atime == ^uint32(0)); cmt || cat {
-			st, e := os.Stat(fid.path)
+			st, e := fid.dir.Stat(fid.name)
 			if e != nil {
 				req.RespondError(toError(e))
 				return
@@ -717,7 +913,7 @@ func (u *Ufs) Wstat(req *srv.Req) {
 				at = atime(st.Sys().(*syscall.Stat_t))
 			}
 		}
-		e := os.Chtimes(fid.path, at, mt)
+		e := fid.dir.Chtimes(fid.name, at, mt)
 		if e != nil {
 			req.RespondError(toError(e))
 			return
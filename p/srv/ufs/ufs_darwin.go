@@ -5,10 +5,105 @@
 package ufs
 
 import (
+	"os"
 	"syscall"
 	"time"
+
+	"github.com/lionkov/go9p/p"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atimespec.Unix())
 }
+
+func ctime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctimespec.Unix())
+}
+
+func timespec(ts syscall.Timespec) p.Timespec {
+	return p.Timespec{Sec: uint64(ts.Sec), Nsec: uint64(ts.Nsec)}
+}
+
+// Fills the Darwin specific fields of the 9P2000.L attributes
+func statAttr(stat *syscall.Stat_t, attr *p.Attr) {
+	attr.Atime = timespec(stat.Atimespec)
+	attr.Mtime = timespec(stat.Mtimespec)
+	attr.Ctime = timespec(stat.Ctimespec)
+	attr.Btime = timespec(stat.Birthtimespec)
+	attr.Valid |= p.GetattrBtime
+}
+
+func mkdev(major, minor uint32) int {
+	return int(major<<24 | minor&0xffffff)
+}
+
+// Returns the major and the minor numbers of the device.
+func devnums(dev uint64) (uint32, uint32) {
+	return uint32(dev >> 24 & 0xff), uint32(dev & 0xffffff)
+}
+
+func statfs(f *os.File) (*p.Statfs, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+
+	return &p.Statfs{
+		Type:    st.Type,
+		Bsize:   st.Bsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		Namelen: 255,
+	}, nil
+}
+
+// There is no mknodat in the syscall package, and creating the file by
+// its path could follow a symlink out of the Root.
+func mknodat(dir *node, name string, mode uint32, dev int) error {
+	return &os.PathError{Op: "mknodat", Path: name, Err: syscall.ENOTSUP}
+}
+
+// There are no renameat and linkat in the syscall package, and
+// renaming the files by their paths could follow symlinks or use the
+// old paths of the directories. Only the renames and the links within
+// a directory are supported.
+func renameat(ofd int, oname string, nfd int, nname string) error {
+	return &os.LinkError{Op: "renameat", Old: oname, New: nname, Err: syscall.ENOTSUP}
+}
+
+func linkat(ofd int, oname string, nfd int, nname string) error {
+	return &os.LinkError{Op: "linkat", Old: oname, New: nname, Err: syscall.ENOTSUP}
+}
+
+// The directory descriptors can't be used in paths.
+func fdpath(f *os.File, name string) (string, error) {
+	return "", &os.PathError{Op: "open", Path: name, Err: syscall.ENOTSUP}
+}
+
+// The process-wide locks don't conflict between the fids, only with
+// the locks held by other processes.
+const (
+	fgetlk = syscall.F_GETLK
+	fsetlk = syscall.F_SETLK
+)
+
+func getxattr(path, name string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func listxattr(path string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func setxattr(path, name string, value []byte, flags uint32) error {
+	return syscall.ENOTSUP
+}
+
+func removexattr(path, name string) error {
+	return syscall.ENOTSUP
+}
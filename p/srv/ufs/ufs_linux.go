@@ -5,10 +5,219 @@
 package ufs
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"syscall"
 	"time"
+	"unsafe"
+
+	"github.com/lionkov/go9p/p"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atim.Unix())
 }
+
+func ctime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctim.Unix())
+}
+
+func timespec(ts syscall.Timespec) p.Timespec {
+	return p.Timespec{Sec: uint64(ts.Sec), Nsec: uint64(ts.Nsec)}
+}
+
+// Fills the Linux specific fields of the 9P2000.L attributes
+func statAttr(stat *syscall.Stat_t, attr *p.Attr) {
+	attr.Atime = timespec(stat.Atim)
+	attr.Mtime = timespec(stat.Mtim)
+	attr.Ctime = timespec(stat.Ctim)
+}
+
+func mkdev(major, minor uint32) int {
+	dev := uint64(minor&0xff) | uint64(major&0xfff)<<8
+	dev |= uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+	return int(dev)
+}
+
+// Returns the major and the minor numbers of the device.
+func devnums(dev uint64) (uint32, uint32) {
+	major := uint32(dev>>8&0xfff) | uint32(dev>>32&^0xfff)
+	minor := uint32(dev&0xff) | uint32(dev>>12&^0xff)
+	return major, minor
+}
+
+func statfs(f *os.File) (*p.Statfs, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+
+	return &p.Statfs{
+		Type:    uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		Namelen: uint32(st.Namelen),
+	}, nil
+}
+
+func mknodat(dir *node, name string, mode uint32, dev int) error {
+	f, err := dir.Open(".")
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return syscall.Mknodat(int(f.Fd()), name, mode, dev)
+}
+
+func renameat(ofd int, oname string, nfd int, nname string) error {
+	if err := syscall.Renameat(ofd, oname, nfd, nname); err != nil {
+		return &os.LinkError{Op: "renameat", Old: oname, New: nname, Err: err}
+	}
+
+	return nil
+}
+
+// The syscall package has linkat only unexported. Without the
+// AT_SYMLINK_FOLLOW flag a symlink is linked, not its target.
+func linkat(ofd int, oname string, nfd int, nname string) error {
+	op, err := syscall.BytePtrFromString(oname)
+	if err != nil {
+		return err
+	}
+
+	np, err := syscall.BytePtrFromString(nname)
+	if err != nil {
+		return err
+	}
+
+	_, _, e := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(ofd), uintptr(unsafe.Pointer(op)),
+		uintptr(nfd), uintptr(unsafe.Pointer(np)), 0, 0)
+	if e != 0 {
+		return &os.LinkError{Op: "linkat", Old: oname, New: nname, Err: e}
+	}
+
+	return nil
+}
+
+// Returns a path to the file name in the directory f that
+// is resolved through the directory's descriptor.
+func fdpath(f *os.File, name string) (string, error) {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", f.Fd(), name), nil
+}
+
+// Open file description locks (Linux 3.15+) are owned by the open file,
+// so the locks obtained through different fids conflict with each other.
+const (
+	fgetlk = 36 // F_OFD_GETLK
+	fsetlk = 37 // F_OFD_SETLK
+)
+
+// The l*xattr system calls don't follow the symlink the path ends with,
+// so a symlink created in place of the file can't redirect them outside
+// of the Root. The syscall package has only the variants that follow.
+func lxattr(trap uintptr, path, name string, buf []byte, flags int) (int, error) {
+	pp, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	np, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var bp unsafe.Pointer
+	if len(buf) > 0 {
+		bp = unsafe.Pointer(&buf[0])
+	}
+
+	r, _, e := syscall.Syscall6(trap, uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(np)), uintptr(bp), uintptr(len(buf)), uintptr(flags), 0)
+	if e != 0 {
+		return 0, e
+	}
+
+	return int(r), nil
+}
+
+func llistxattr(path string, buf []byte) (int, error) {
+	pp, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var bp unsafe.Pointer
+	if len(buf) > 0 {
+		bp = unsafe.Pointer(&buf[0])
+	}
+
+	r, _, e := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pp)), uintptr(bp), uintptr(len(buf)))
+	if e != 0 {
+		return 0, e
+	}
+
+	return int(r), nil
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	for {
+		sz, err := lxattr(syscall.SYS_LGETXATTR, path, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, sz)
+		n, err := lxattr(syscall.SYS_LGETXATTR, path, name, buf, 0)
+		if err == syscall.ERANGE {
+			// the value grew in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[0:n], nil
+	}
+}
+
+func listxattr(path string) ([]string, error) {
+	for {
+		sz, err := llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, sz)
+		n, err := llistxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range strings.Split(string(buf[0:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		return names, nil
+	}
+}
+
+func setxattr(path, name string, value []byte, flags uint32) error {
+	_, err := lxattr(syscall.SYS_LSETXATTR, path, name, value, int(flags))
+	return err
+}
+
+func removexattr(path, name string) error {
+	_, err := lxattr(syscall.SYS_LREMOVEXATTR, path, name, nil, 0)
+	return err
+}
@@ -0,0 +1,716 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+)
+
+var debug = flag.Int("debug", 0, "print debug messages")
+
+// Starts the file server and returns a client attached to aname.
+func ufsMount(t *testing.T, u *Ufs, aname string, user p.User) *clnt.Clnt {
+	u.Id = "ufs"
+	u.Debuglevel = *debug
+	u.Start(u)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go u.StartListener(l)
+
+	c, err := clnt.Mount("unix", l.Addr().String(), aname, u.Msize, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+// Returns a new client connected to the started file server
+// with the dialect, attached to the export "".
+func ufsConnect(t *testing.T, u *Ufs, dialect p.Dialect, user p.User) (*clnt.Clnt, error) {
+	c1, c2 := net.Pipe()
+	u.NewConn(c1)
+	c, err := clnt.ConnectDialect(c2, u.Msize, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Root, err = c.Attach(nil, user, ""); err != nil {
+		c.Unmount()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func TestReadWriteFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err = ioutil.WriteFile(path.Join(tmpDir, "f"), data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	u := new(Ufs)
+	u.Root = tmpDir
+	u.Msize = 65536 + p.IOHDRSZ
+
+	c := ufsMount(t, u, "", p.OsUsers.Uid2User(os.Geteuid()))
+	defer u.Close()
+	defer c.Unmount()
+
+	f, err := c.FOpen("f", p.ORDWR)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	defer f.Close()
+
+	// the reads are sent from the file
+	tests := []struct {
+		offset uint64
+		count  uint32
+		want   []byte
+	}{
+		{0, 65536, data[:65536]},
+		{99000, 65536, data[99000:]},
+		{12345, 1, data[12345:12346]},
+		{100000, 100, nil},
+		{200000, 100, nil},
+	}
+	for _, tt := range tests {
+		b, err := c.Read(f.Fid(), tt.offset, tt.count)
+		if err != nil || !bytes.Equal(b, tt.want) {
+			t.Errorf("Read %d@%d: got %d bytes, %v, want %d bytes", tt.count, tt.offset, len(b), err, len(tt.want))
+		}
+	}
+
+	// the data of the large writes is read directly from the connection
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	if n, err := f.Writen(data, 0); err != nil || n != len(data) {
+		t.Fatalf("Writen: got %d, %v", n, err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(tmpDir, "f")); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("ReadFile: got %d bytes, %v, want the written data", len(b), err)
+	}
+}
+
+func TestUfsEscape(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	root := path.Join(tmpDir, "export")
+	for _, d := range []string{root, path.Join(root, "d")} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	files := map[string]string{
+		path.Join(tmpDir, "secret"): "secret",
+		path.Join(root, "d", "f"):   "data",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	links := map[string]string{
+		"up":   "..",
+		"abs":  tmpDir,
+		"fsec": "../secret",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, path.Join(root, name)); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+
+	u := new(Ufs)
+	u.Root = root
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	c := ufsMount(t, u, "", user)
+	defer u.Close()
+	defer c.Unmount()
+
+	// the walks stop at the Root and at the symlinks
+	walks := []struct {
+		wnames []string
+		want   int
+	}{
+		{[]string{"..", "secret"}, 1},
+		{[]string{"..", "..", "export"}, 2},
+		{[]string{"d", "..", "..", "secret"}, 3},
+		{[]string{"up", "secret"}, 1},
+		{[]string{"abs", "secret"}, 1},
+		{[]string{"up", "..", "secret"}, 2},
+		{[]string{"d/../..", "secret"}, 0},
+	}
+	for _, tt := range walks {
+		fid := c.FidAlloc()
+		qids, err := c.Walk(c.Root, fid, tt.wnames)
+		if len(qids) != tt.want {
+			t.Errorf("Walk %v: got %d qids, %v, want %d", tt.wnames, len(qids), err, tt.want)
+		}
+		if len(qids) == len(tt.wnames) {
+			c.Clunk(fid)
+		}
+	}
+
+	fid := c.FidAlloc()
+	if qids, err := c.Walk(c.Root, fid, []string{"d", "..", ".."}); err != nil || len(qids) != 3 || qids[2].Path != c.Root.Qid.Path {
+		t.Errorf("Walk ../..: got %v, %v, want the Root", qids, err)
+	}
+	c.Clunk(fid)
+
+	// the symlinks are not followed out of the Root
+	for name := range links {
+		if f, err := c.FOpen(name, p.OREAD); err == nil {
+			f.Close()
+			t.Errorf("FOpen %v: opened the file outside of the Root", name)
+		}
+	}
+
+	rootfid := c.Root
+	afid, err := c.Attach(nil, user, "/../..")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	c.Root = rootfid
+	if afid.Qid.Path != rootfid.Qid.Path {
+		t.Errorf("Attach /../..: got %v, want the Root %v", afid.Qid, rootfid.Qid)
+	}
+	c.Clunk(afid)
+
+	f, err := c.FWalk("d")
+	if err == nil {
+		err = c.Create(f, "../x", 0600, p.OWRITE, "")
+	}
+	if err == nil {
+		t.Errorf("Create ../x: created the file")
+	}
+	c.Clunk(f)
+
+	// the renames are relative to the directory of the file
+	f, err = c.FWalk("d/f")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	if err = c.Rename(f, "../../moved"); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	if _, err = os.Stat(path.Join(root, "d", "moved")); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	if err = c.Rename(f, "f"); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	c.Clunk(f)
+
+	// the fids are not affected if the directories above
+	// them are renamed
+	dfid, err := c.FWalk("d")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	if err = os.Rename(path.Join(root, "d"), path.Join(root, "e")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	fid = c.FidAlloc()
+	if _, err = c.Walk(dfid, fid, []string{"f"}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if err = c.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if b, err := c.Read(fid, 0, 100); err != nil || string(b) != "data" {
+		t.Errorf("Read: got %q, %v, want %q", b, err, "data")
+	}
+	c.Clunk(fid)
+	c.Clunk(dfid)
+}
+
+func TestUfsExports(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, d := range []string{"pub", "priv", "pub/d"} {
+		if err := os.Mkdir(path.Join(tmpDir, d), 0700); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "pub", "d", "f"), []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Symlink("d", path.Join(tmpDir, "pub", "l")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	table := fmt.Sprintf(`# test exports
+ro	%s/pub	ro
+/rw	%s/pub	follow,squash=root,anonuid=1,anongid=1
+priv	%s/priv	users=nobody-here,groups=nogroup-here
+`, tmpDir, tmpDir, tmpDir)
+	exports, err := ReadExports(bytes.NewBufferString(table))
+	if err != nil {
+		t.Fatalf("ReadExports: %v", err)
+	}
+	if len(exports) != 3 || !exports[0].ReadOnly || !exports[1].FollowSymlinks || exports[1].IdMap == nil || exports[1].IdMap.Squash != SquashRoot || len(exports[2].Users) != 1 {
+		t.Fatalf("ReadExports: got %+v", exports)
+	}
+	for _, bad := range []string{"a", "a /b c d", "a /b squash=some", "a /b anonuid=x"} {
+		if _, err := ReadExports(bytes.NewBufferString(bad)); err == nil {
+			t.Errorf("ReadExports %q: no error", bad)
+		}
+	}
+
+	u := new(Ufs)
+	u.Exports = exports
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	c := ufsMount(t, u, "/rw", user)
+	defer u.Close()
+	defer c.Unmount()
+
+	rootfid := c.Root
+	for _, aname := range []string{"", "/pub", "priv", "/ro/d"} {
+		if fid, err := c.Attach(nil, user, aname); err == nil {
+			c.Clunk(fid)
+			t.Errorf("Attach %q: attached", aname)
+		}
+	}
+
+	rofid, err := c.Attach(nil, user, "ro/")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	c.Root = rootfid
+	defer c.Clunk(rofid)
+
+	// the read-only export and the symlinks that are not followed
+	fid := c.FidAlloc()
+	if qids, _ := c.Walk(rofid, fid, []string{"l", "f"}); len(qids) == 2 {
+		t.Errorf("Walk l/f: walked through the symlink")
+	}
+	if _, err := c.Walk(rofid, fid, []string{"d", "f"}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if err := c.Open(fid, p.OWRITE); err == nil {
+		t.Errorf("Open: opened the file for writing")
+	}
+	if err := c.Remove(fid); err == nil {
+		t.Errorf("Remove: removed the file")
+	}
+	fid = c.FidAlloc()
+	if _, err := c.Walk(rofid, fid, []string{"d"}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if err := c.Create(fid, "new", 0600, p.OWRITE, ""); err == nil {
+		t.Errorf("Create: created the file")
+	}
+	c.Clunk(fid)
+
+	// the writable export follows the symlinks
+	f, err := c.FOpen("l/f", p.ORDWR)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("DATA"), 0); err != nil {
+		t.Errorf("WriteAt: %v", err)
+	}
+	f.Close()
+	if b, err := ioutil.ReadFile(path.Join(tmpDir, "pub", "d", "f")); err != nil || string(b) != "DATA" {
+		t.Errorf("ReadFile: got %q, %v, want %q", b, err, "DATA")
+	}
+
+	// root is squashed to the anonymous user
+	if os.Geteuid() != 0 {
+		return
+	}
+	f, err = c.FCreate("new", 0600, p.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+	if st, err := os.Lstat(path.Join(tmpDir, "pub", "new")); err != nil || st.Sys().(*syscall.Stat_t).Uid != 1 {
+		t.Errorf("FCreate: got %v, %v, want the file owned by uid 1", st, err)
+	}
+
+	// and can't give the files to the other users
+	fid, err = c.FWalk("new")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	d := p.NewWstatDir()
+	d.Uid = "nobody"
+	if err := c.Wstat(fid, d); err == nil {
+		t.Errorf("Wstat: changed the owner to nobody")
+	}
+	c.Clunk(fid)
+}
+
+func TestUfsQid(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fname := path.Join(tmpDir, "f")
+	if err := ioutil.WriteFile(fname, []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	u := new(Ufs)
+	u.Root = tmpDir
+
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	c := ufsMount(t, u, "", user)
+	defer u.Close()
+	defer c.Unmount()
+
+	stat := func(name string) p.Qid {
+		d, err := c.FStat(name)
+		if err != nil {
+			t.Fatalf("FStat %v: %v", name, err)
+		}
+		return d.Qid
+	}
+
+	// the modifications within a second change the version
+	mtime := time.Unix(1000000000, 1000)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	qid := stat("f")
+	mtime = mtime.Add(time.Microsecond)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if nqid := stat("f"); nqid.Version == qid.Version {
+		t.Errorf("FStat: version %v didn't change", qid.Version)
+	}
+
+	// the path is the same for the hard links and after a rename
+	if err := os.Link(fname, path.Join(tmpDir, "g")); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if err := os.Rename(fname, path.Join(tmpDir, "h")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if g, h := stat("g"), stat("h"); g.Path != qid.Path || h.Path != qid.Path {
+		t.Errorf("FStat: got paths %v and %v, want %v", g.Path, h.Path, qid.Path)
+	}
+	if root := stat("."); root.Path == qid.Path {
+		t.Errorf("FStat: the Root has the path of the file, %v", qid.Path)
+	}
+}
+
+func TestUfsRenameMoved(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.MkdirAll(path.Join(tmpDir, "a", "b"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.Mkdir(path.Join(tmpDir, "c"), 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "a", "b", "f"), []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	u := new(Ufs)
+	u.Dotl = true
+	u.Root = tmpDir
+	u.Msize = 8192
+	u.Start(u)
+	defer u.Close()
+
+	c, err := ufsConnect(t, u, p.Dialect9P2000L, p.OsUsers.Uid2User(os.Geteuid()))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Unmount()
+
+	bfid, cfid := c.FidAlloc(), c.FidAlloc()
+	if _, err := c.Walk(c.Root, bfid, []string{"a", "b"}); err != nil {
+		t.Fatalf("Walk a/b: %v", err)
+	}
+	if _, err := c.Walk(c.Root, cfid, []string{"c"}); err != nil {
+		t.Fatalf("Walk c: %v", err)
+	}
+
+	// the parent of the fid's directory is renamed by another process
+	if err := os.Rename(path.Join(tmpDir, "a"), path.Join(tmpDir, "z")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := c.Renameat(bfid, "f", cfid, "g"); err != nil {
+		t.Fatalf("Renameat: %v", err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(tmpDir, "c", "g")); err != nil || string(b) != "data" {
+		t.Errorf("Renameat: got %q, %v in c/g", b, err)
+	}
+
+	gfid := c.FidAlloc()
+	if _, err := c.Walk(cfid, gfid, []string{"g"}); err != nil {
+		t.Fatalf("Walk g: %v", err)
+	}
+	if err := c.Link(bfid, gfid, "h"); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(tmpDir, "z", "b", "h")); err != nil || string(b) != "data" {
+		t.Errorf("Link: got %q, %v in z/b/h", b, err)
+	}
+}
+
+func TestQidPath(t *testing.T) {
+	qids.Lock()
+	max, paths, order, head := qidTableMax, qids.paths, qids.order, qids.head
+	qidTableMax, qids.paths, qids.order, qids.head = 2, nil, nil, 0
+	qids.Unlock()
+	defer func() {
+		qids.Lock()
+		qidTableMax, qids.paths, qids.order, qids.head = max, paths, order, head
+		qids.Unlock()
+	}()
+
+	// the inodes that don't fit get the paths from the table
+	const big = 1 << 50
+	a, b := qidPath(1, big), qidPath(1, big+1)
+	if a&qidTableBit == 0 || b&qidTableBit == 0 || a == b {
+		t.Errorf("qidPath: got %#x and %#x, want distinct paths from the table", a, b)
+	}
+	if n := qidPath(1, big); n != a {
+		t.Errorf("qidPath: got %#x, want %#x", n, a)
+	}
+	if n := qidPath(1, 5); n&qidTableBit != 0 || n&qidInoMask != 5 {
+		t.Errorf("qidPath: got %#x for a small inode", n)
+	}
+
+	// the table is bounded, the evicted file gets a new path
+	c := qidPath(1, big+2)
+	qids.Lock()
+	n := len(qids.paths)
+	qids.Unlock()
+	if n != 2 {
+		t.Errorf("qidPath: %d paths in the table, want 2", n)
+	}
+	if n := qidPath(1, big); n == a || n == b || n == c {
+		t.Errorf("qidPath: evicted file got %#x, want a new path", n)
+	}
+	if n := qidPath(1, big+2); n != c {
+		t.Errorf("qidPath: got %#x, want %#x", n, c)
+	}
+}
+
+func TestUfsIdMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the owners of the files can be changed only by root")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := ioutil.WriteFile(path.Join(tmpDir, "host"), []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// the client ids are shifted by 100000 on the host
+	idmap := &IdMap{
+		Uids:    []IdRange{{Client: 0, Host: 100000, Count: 65536}},
+		Gids:    []IdRange{{Client: 0, Host: 100000, Count: 65536}},
+		AnonUid: 65534,
+		AnonGid: 65534,
+	}
+	u := new(Ufs)
+	u.Dotu = true
+	u.Root = tmpDir
+	u.IdMap = idmap
+
+	user := p.OsUsers.Uid2User(0)
+	c := ufsMount(t, u, "", user)
+	defer u.Close()
+	defer c.Unmount()
+
+	owner := func(name string) (uint32, uint32) {
+		st, err := os.Lstat(path.Join(tmpDir, name))
+		if err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+		sys := st.Sys().(*syscall.Stat_t)
+		return sys.Uid, sys.Gid
+	}
+
+	f, err := c.FCreate("new", 0600, p.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+	if uid, gid := owner("new"); uid != 100000 || gid != 100000 {
+		t.Errorf("FCreate: got owner %d:%d, want 100000:100000", uid, gid)
+	}
+
+	d, err := c.FStat("new")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+	if d.Uidnum != 0 || d.Gidnum != 0 || d.Uid != "root" {
+		t.Errorf("FStat: got owner %v(%d):%d, want root(0):0", d.Uid, d.Uidnum, d.Gidnum)
+	}
+
+	// the host ids outside of the ranges are not mapped
+	if d, err := c.FStat("host"); err != nil || d.Uidnum != p.NOUID || d.Gidnum != p.NOUID {
+		t.Errorf("FStat: got %v, %v, want the NOUID owner", d, err)
+	}
+
+	fid, err := c.FWalk("new")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+	d = p.NewWstatDir()
+	d.Uidnum, d.Gidnum = 5, 7
+	if err := c.Wstat(fid, d); err != nil {
+		t.Fatalf("Wstat: %v", err)
+	}
+	if uid, gid := owner("new"); uid != 100005 || gid != 100007 {
+		t.Errorf("Wstat: got owner %d:%d, want 100005:100007", uid, gid)
+	}
+}
+
+func TestUfsSpecial(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "go9")
+	if err != nil {
+		t.Fatal("Can't create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, special := range []bool{false, true} {
+		u := new(Ufs)
+		u.Dotu = true
+		u.Dotl = true
+		u.Root = tmpDir
+		u.Special = special
+
+		user := p.OsUsers.Uid2User(os.Geteuid())
+		c := ufsMount(t, u, "", user)
+		defer u.Close()
+		defer c.Unmount()
+
+		files := []struct {
+			name string
+			perm uint32
+			ext  string
+			mode os.FileMode
+		}{
+			{"fifo", p.DMNAMEDPIPE | 0600, "", os.ModeNamedPipe},
+			{"sock", p.DMSOCKET | 0600, "", os.ModeSocket},
+		}
+		for _, tt := range files {
+			f, err := c.FWalk(".")
+			if err != nil {
+				t.Fatalf("FWalk: %v", err)
+			}
+			err = c.Create(f, tt.name, tt.perm, p.OREAD, tt.ext)
+			c.Clunk(f)
+			if !special {
+				if err == nil {
+					t.Errorf("Create %v: created the file without the option", tt.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Create %v: %v", tt.name, err)
+				continue
+			}
+			if st, err := os.Lstat(path.Join(tmpDir, tt.name)); err != nil || st.Mode()&os.ModeType != tt.mode {
+				t.Errorf("Create %v: got %v, %v, want mode %v", tt.name, st.Mode(), err, tt.mode)
+			}
+		}
+
+		// 9P2000.L creates them with Tmknod
+		lc, err := ufsConnect(t, u, p.Dialect9P2000L, user)
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		_, err = lc.Mknod(lc.Root, "lfifo", syscall.S_IFIFO|0600, 0, 0, p.NOUID)
+		lc.Unmount()
+		if !special {
+			if err == nil {
+				t.Errorf("Mknod: created the file without the option")
+			}
+		} else if st, err := os.Lstat(path.Join(tmpDir, "lfifo")); err != nil || st.Mode()&os.ModeType != os.ModeNamedPipe {
+			t.Errorf("Mknod: got %v, %v, want a named pipe", st, err)
+		}
+
+		if !special {
+			continue
+		}
+
+		f, err := c.FWalk(".")
+		if err != nil {
+			t.Fatalf("FWalk: %v", err)
+		}
+		if err := c.Create(f, "bad", p.DMDEVICE|0600, p.OREAD, "x 1 3"); err == nil {
+			t.Errorf("Create: created the device x 1 3")
+		}
+		c.Clunk(f)
+
+		// the devices are created as they are stat'ed
+		if os.Geteuid() != 0 {
+			continue
+		}
+		f, err = c.FWalk(".")
+		if err != nil {
+			t.Fatalf("FWalk: %v", err)
+		}
+		err = c.Create(f, "null", p.DMDEVICE|0600, p.OREAD, "c 1 3")
+		c.Clunk(f)
+		if err != nil {
+			t.Logf("Create null: %v", err)
+			continue
+		}
+		if d, err := c.FStat("null"); err != nil || d.Ext != "c 1 3" {
+			t.Errorf("FStat: got %v, %v, want the device c 1 3", d, err)
+		}
+	}
+}
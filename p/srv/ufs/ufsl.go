@@ -0,0 +1,681 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Converts the Linux open flags (p.LO*) to the flags used by os.OpenFile.
+// O_APPEND is not passed through because all writes are done at the
+// offsets specified by the client.
+func lflags2uflags(flags uint32) int {
+	ret := omode2uflags(uint8(flags & p.LOACCMODE))
+	if flags&p.LOCREATE != 0 {
+		ret |= os.O_CREATE
+	}
+
+	if flags&p.LOEXCL != 0 {
+		ret |= os.O_EXCL
+	}
+
+	if flags&p.LOTRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+
+	if flags&(p.LOSYNC|p.LODSYNC) != 0 {
+		ret |= os.O_SYNC
+	}
+
+	return ret
+}
+
+// Converts Unix permission bits to os.FileMode
+func umode2FileMode(mode uint32) os.FileMode {
+	ret := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		ret |= os.ModeSetuid
+	}
+
+	if mode&syscall.S_ISGID != 0 {
+		ret |= os.ModeSetgid
+	}
+
+	if mode&syscall.S_ISVTX != 0 {
+		ret |= os.ModeSticky
+	}
+
+	return ret
+}
+
+func dir2Attr(d os.FileInfo, idmap *IdMap) *p.Attr {
+	stat, ok := d.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	attr := &p.Attr{
+		Valid:   p.GetattrBasic,
+		Qid:     *dir2Qid(d),
+		Mode:    uint32(stat.Mode),
+		Uid:     uint32(idmap.ClientUid(int(stat.Uid))),
+		Gid:     uint32(idmap.ClientGid(int(stat.Gid))),
+		Nlink:   uint64(stat.Nlink),
+		Rdev:    uint64(stat.Rdev),
+		Size:    uint64(stat.Size),
+		Blksize: uint64(stat.Blksize),
+		Blocks:  uint64(stat.Blocks),
+	}
+	statAttr(stat, attr)
+
+	return attr
+}
+
+func dir2Dirent(name string, d os.FileInfo) p.Dirent {
+	var de p.Dirent
+
+	de.Qid = *dir2Qid(d)
+	de.Name = name
+	if stat, ok := d.Sys().(*syscall.Stat_t); ok {
+		de.Type = uint8((uint32(stat.Mode) & syscall.S_IFMT) >> 12)
+	}
+
+	return de
+}
+
+// Reads the content of the directory and stores it in fid.ldirents.
+// The entries keep their offsets until the directory is read again
+// from offset 0.
+func (u *Ufs) readldir(fid *Fid) error {
+	dir, err := fid.self()
+	if err != nil {
+		return err
+	}
+
+	file, err := dir.Open(".")
+	if err != nil {
+		return err
+	}
+
+	names, err := file.Readdirnames(-1)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// the parent of the Root is the Root itself
+	parent := fid.st
+	if dir.parent != nil {
+		if st, err := dir.parent.Lstat(dir.name); err == nil {
+			parent = st
+		}
+	}
+
+	fid.ldirents = make([]p.Dirent, 0, len(names)+2)
+	fid.ldirents = append(fid.ldirents, dir2Dirent(".", fid.st))
+	fid.ldirents = append(fid.ldirents, dir2Dirent("..", parent))
+	for _, name := range names {
+		if d, err := dir.Lstat(name); err == nil {
+			fid.ldirents = append(fid.ldirents, dir2Dirent(name, d))
+		}
+	}
+
+	for i := range fid.ldirents {
+		fid.ldirents[i].Offset = uint64(i + 1)
+	}
+
+	return nil
+}
+
+func (*Ufs) Lopen(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	var e error
+	fid.file, e = fid.open(lflags2uflags(tc.Flags&^(p.LOCREATE|p.LOEXCL)), 0)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.ldirents = nil
+	req.RespondRlopen(dir2Qid(fid.st), 0)
+}
+
+func (*Ufs) Lcreate(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	dir, e := fid.newdir(tc.Name)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	file, e := dir.OpenFile(tc.Name, lflags2uflags(tc.Flags)|os.O_CREATE, umode2FileMode(tc.Perm))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	if e = fid.chown(dir, tc.Name); e != nil {
+		file.Close()
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.set(dir, tc.Name, false)
+	fid.file = file
+	err = fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRlcreate(dir2Qid(fid.st), 0)
+}
+
+func (*Ufs) Getattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	attr := dir2Attr(fid.st, fid.idmap)
+	if attr == nil {
+		req.RespondError(&p.Error{Err: "cannot stat file", Errornum: p.EIO})
+		return
+	}
+
+	req.RespondRgetattr(attr)
+}
+
+func (*Ufs) Setattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	sa := &req.Tc.SetAttr
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if e := fid.writable(); e != nil {
+		req.RespondError(e)
+		return
+	}
+
+	if sa.Valid&p.SetattrMode != 0 {
+		e := fid.dir.Chmod(fid.name, umode2FileMode(sa.Mode))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&(p.SetattrUid|p.SetattrGid) != 0 {
+		uid, gid := -1, -1
+		if sa.Valid&p.SetattrUid != 0 {
+			uid = fid.idmap.HostUid(int(int32(sa.Uid)))
+		}
+
+		if sa.Valid&p.SetattrGid != 0 {
+			gid = fid.idmap.HostGid(int(int32(sa.Gid)))
+		}
+
+		e := fid.chownable(uid, gid)
+		if e == nil {
+			e = fid.dir.Lchown(fid.name, uid, gid)
+		}
+
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&p.SetattrSize != 0 {
+		e := fid.truncate(int64(sa.Size))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	// The times that are not changed are set to their current values.
+	if sa.Valid&(p.SetattrAtime|p.SetattrMtime) != 0 {
+		now := time.Now()
+		at, mt := atime(fid.st.Sys().(*syscall.Stat_t)), fid.st.ModTime()
+		if sa.Valid&p.SetattrAtime != 0 {
+			at = now
+			if sa.Valid&p.SetattrAtimeSet != 0 {
+				at = time.Unix(int64(sa.Atime.Sec), int64(sa.Atime.Nsec))
+			}
+		}
+
+		if sa.Valid&p.SetattrMtime != 0 {
+			mt = now
+			if sa.Valid&p.SetattrMtimeSet != 0 {
+				mt = time.Unix(int64(sa.Mtime.Sec), int64(sa.Mtime.Nsec))
+			}
+		}
+
+		e := fid.dir.Chtimes(fid.name, at, mt)
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	req.RespondRsetattr()
+}
+
+func (u *Ufs) Readdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if tc.Offset == 0 || fid.ldirents == nil {
+		if e := u.readldir(fid); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if e := p.InitRreaddir(rc, tc.Count); e != nil {
+		req.RespondError(e)
+		return
+	}
+
+	count := 0
+	for i := tc.Offset; i < uint64(len(fid.ldirents)); i++ {
+		n := p.PackDirent(&fid.ldirents[i], rc.Data[count:])
+		if n == 0 {
+			break
+		}
+
+		count += n
+	}
+
+	if count == 0 && tc.Offset < uint64(len(fid.ldirents)) {
+		req.RespondError(&p.Error{Err: "too small read size for dir entry", Errornum: p.EINVAL})
+		return
+	}
+
+	p.SetRreaddirCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (*Ufs) Statfs(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if err := fid.stat(); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	// a directory can be a mount point
+	dir := fid.dir
+	if fid.st.IsDir() {
+		var e error
+		if dir, e = fid.self(); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	file, e := dir.Open(".")
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	st, e := statfs(file)
+	file.Close()
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRstatfs(st)
+}
+
+func (*Ufs) Fsync(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file != nil {
+		e := fid.file.Sync()
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	req.RespondRfsync()
+}
+
+// Stats the newly created file and returns its Qid.
+func newQid(dir *node, name string) (*p.Qid, *p.Error) {
+	st, e := dir.Lstat(name)
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	return dir2Qid(st), nil
+}
+
+func (*Ufs) Mkdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	dir, e := fid.newdir(tc.Name)
+	if e == nil {
+		e = dir.Mkdir(tc.Name, umode2FileMode(tc.Perm))
+	}
+
+	if e == nil {
+		e = fid.chown(dir, tc.Name)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	qid, err := newQid(dir, tc.Name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRmkdir(qid)
+}
+
+func (*Ufs) Symlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	dir, e := fid.newdir(tc.Name)
+	if e == nil {
+		e = dir.Symlink(tc.Target, tc.Name)
+	}
+
+	if e == nil {
+		e = fid.chown(dir, tc.Name)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	qid, err := newQid(dir, tc.Name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRsymlink(qid)
+}
+
+func (u *Ufs) Mknod(req *srv.Req) {
+	// creating the devices needs privileges
+	if !u.Special {
+		req.RespondError(Enospecial)
+		return
+	}
+
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	dir, e := fid.newdir(tc.Name)
+	if e == nil {
+		e = mknodat(dir, tc.Name, tc.Perm, mkdev(tc.Major, tc.Minor))
+	}
+
+	if e == nil {
+		e = fid.chown(dir, tc.Name)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	qid, err := newQid(dir, tc.Name)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRmknod(qid)
+}
+
+func (*Ufs) Rename(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	dir, e := dfid.newdir(req.Tc.Name)
+	if e == nil {
+		e = rename(fid.dir, fid.name, dir, req.Tc.Name)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.rename(dir, req.Tc.Name)
+	req.RespondRrename()
+}
+
+func (*Ufs) Renameat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	tc := req.Tc
+	odir, e := fid.newdir(tc.Name)
+	if e == nil {
+		var ndir *node
+		if ndir, e = dfid.newdir(tc.Newname); e == nil {
+			e = rename(odir, tc.Name, ndir, tc.Newname)
+		}
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRrenameat()
+}
+
+func (*Ufs) Unlinkat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	dir, e := fid.newdir(tc.Name)
+	if e == nil {
+		e = unlinkat(dir, tc.Name, tc.Flags&p.AtRemovedir != 0)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRunlinkat()
+}
+
+func (*Ufs) Link(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	dir, e := dfid.newdir(req.Tc.Name)
+	if e == nil {
+		e = link(fid.dir, fid.name, dir, req.Tc.Name)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlink()
+}
+
+func (*Ufs) Readlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	target, e := fid.dir.Readlink(fid.name)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRreadlink(target)
+}
+
+func ltype2utype(typ uint8) int16 {
+	switch typ {
+	case p.LockTypeRdlck:
+		return syscall.F_RDLCK
+	case p.LockTypeWrlck:
+		return syscall.F_WRLCK
+	}
+
+	return syscall.F_UNLCK
+}
+
+func (*Ufs) FidLock(sfid *srv.Fid, fl *p.Flock) (uint8, error) {
+	fid := sfid.Aux.(*Fid)
+	if fid.file == nil {
+		return p.LockError, nil
+	}
+
+	lk := syscall.Flock_t{
+		Type:   ltype2utype(fl.Type),
+		Whence: int16(io.SeekStart),
+		Start:  int64(fl.Start),
+		Len:    int64(fl.Length),
+	}
+
+	e := syscall.FcntlFlock(fid.file.Fd(), fsetlk, &lk)
+	switch e {
+	case nil:
+		return p.LockSuccess, nil
+	case syscall.EAGAIN, syscall.EACCES:
+		return p.LockBlocked, nil
+	}
+
+	return p.LockError, toError(e)
+}
+
+func (*Ufs) FidGetlock(sfid *srv.Fid, fl *p.Flock) (*p.Flock, error) {
+	fid := sfid.Aux.(*Fid)
+	if fid.file == nil {
+		return nil, nil
+	}
+
+	lk := syscall.Flock_t{
+		Type:   ltype2utype(fl.Type),
+		Whence: int16(io.SeekStart),
+		Start:  int64(fl.Start),
+		Len:    int64(fl.Length),
+	}
+
+	e := syscall.FcntlFlock(fid.file.Fd(), fgetlk, &lk)
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	if lk.Type == syscall.F_UNLCK {
+		return nil, nil
+	}
+
+	cfl := &p.Flock{
+		Type:   p.LockTypeRdlck,
+		Start:  uint64(lk.Start),
+		Length: uint64(lk.Len),
+		ProcId: uint32(lk.Pid),
+	}
+	if lk.Type == syscall.F_WRLCK {
+		cfl.Type = p.LockTypeWrlck
+	}
+
+	return cfl, nil
+}
+
+func (*Ufs) FidGetXattr(sfid *srv.Fid, name string) ([]byte, error) {
+	fid := sfid.Aux.(*Fid)
+	var value []byte
+	e := fid.withPath(func(path string) (err error) {
+		value, err = getxattr(path, name)
+		return err
+	})
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	return value, nil
+}
+
+func (*Ufs) FidListXattr(sfid *srv.Fid) ([]string, error) {
+	fid := sfid.Aux.(*Fid)
+	var names []string
+	e := fid.withPath(func(path string) (err error) {
+		names, err = listxattr(path)
+		return err
+	})
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	return names, nil
+}
+
+func (*Ufs) FidSetXattr(sfid *srv.Fid, name string, value []byte, flags uint32) error {
+	fid := sfid.Aux.(*Fid)
+	if e := fid.writable(); e != nil {
+		return e
+	}
+
+	e := fid.withPath(func(path string) error {
+		return setxattr(path, name, value, flags)
+	})
+	if e != nil {
+		return toError(e)
+	}
+
+	return nil
+}
+
+func (*Ufs) FidRemoveXattr(sfid *srv.Fid, name string) error {
+	fid := sfid.Aux.(*Fid)
+	if e := fid.writable(); e != nil {
+		return e
+	}
+
+	e := fid.withPath(func(path string) error {
+		return removexattr(path, name)
+	})
+	if e != nil {
+		return toError(e)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Starts the goroutines that process the requests if the
+// server has a fixed number of Workers.
+func (srv *Srv) startWorkers() {
+	srv.wcond = sync.NewCond(&srv.wlock)
+	for i := 0; i < srv.Workers; i++ {
+		go srv.worker()
+	}
+}
+
+// Stops the workers once the queued requests are processed.
+func (srv *Srv) stopWorkers() {
+	if srv.wcond == nil {
+		return
+	}
+
+	srv.wlock.Lock()
+	srv.wstop = true
+	srv.wcond.Broadcast()
+	srv.wlock.Unlock()
+}
+
+func (srv *Srv) worker() {
+	for {
+		srv.wlock.Lock()
+		for len(srv.workq) == 0 && !srv.wstop {
+			srv.wcond.Wait()
+		}
+
+		if len(srv.workq) == 0 {
+			srv.wlock.Unlock()
+			return
+		}
+
+		req := srv.workq[0]
+		srv.workq[0] = nil
+		srv.workq = srv.workq[1:]
+		srv.wlock.Unlock()
+
+		req.run()
+	}
+}
+
+// Passes the request to a worker, or starts a goroutine for it
+// if the server doesn't limit the number of workers.
+func (srv *Srv) schedule(req *Req) {
+	if srv.Workers <= 0 {
+		go req.run()
+		return
+	}
+
+	srv.wlock.Lock()
+	srv.workq = append(srv.workq, req)
+	if len(srv.workq) > srv.maxworkq {
+		srv.maxworkq = len(srv.workq)
+	}
+	srv.wcond.Signal()
+	srv.wlock.Unlock()
+}
+
+// Schedules the request for processing. The flushes are processed
+// right away, so the requests they flush don't need to finish first.
+// The other requests wait if the connection has ConnWorkers requests
+// in processing.
+func (conn *Conn) dispatch(req *Req) {
+	srv := conn.Srv
+	req.queued = time.Now()
+	if req.Tc.Type == p.Tflush {
+		go req.process()
+		return
+	}
+
+	conn.Lock()
+	if srv.ConnWorkers > 0 && conn.nwork >= srv.ConnWorkers {
+		conn.workq = append(conn.workq, req)
+		if len(conn.workq) > conn.maxqueue {
+			conn.maxqueue = len(conn.workq)
+		}
+		conn.Unlock()
+		return
+	}
+	conn.nwork++
+	conn.Unlock()
+
+	srv.schedule(req)
+}
+
+// Processes the request and schedules the next request waiting
+// for a worker of the connection.
+func (req *Req) run() {
+	conn := req.Conn
+	wait := time.Since(req.queued)
+	conn.Lock()
+	conn.nwait++
+	conn.waittime += wait
+	if wait > conn.maxwait {
+		conn.maxwait = wait
+	}
+	conn.Unlock()
+
+	req.process()
+
+	conn.Lock()
+	if len(conn.workq) == 0 {
+		conn.nwork--
+		conn.Unlock()
+		return
+	}
+
+	next := conn.workq[0]
+	conn.workq[0] = nil
+	conn.workq = conn.workq[1:]
+	conn.Unlock()
+	conn.Srv.schedule(next)
+}
+
+// If the connection has Srv.Maxreqs outstanding requests, stops
+// reading from the connection until some of them are responded
+// to, or the connection is closed.
+func (conn *Conn) throttle() {
+	conn.Lock()
+	full := conn.nout >= conn.Srv.Maxreqs
+	conn.Unlock()
+	if !full {
+		return
+	}
+
+	start := time.Now()
+	for full {
+		select {
+		case <-conn.space:
+		case <-conn.ctx.Done():
+			return
+		}
+
+		conn.Lock()
+		full = conn.nout >= conn.Srv.Maxreqs
+		conn.Unlock()
+	}
+
+	conn.Lock()
+	conn.nthrottle++
+	conn.throttletime += time.Since(start)
+	conn.Unlock()
+}
+
+// Called with the connection locked when an outstanding request
+// is removed.
+func (conn *Conn) reqDone() {
+	conn.nout--
+	if conn.Srv.Maxreqs > 0 && conn.nout < conn.Srv.Maxreqs {
+		select {
+		case conn.space <- true:
+		default:
+		}
+	}
+}
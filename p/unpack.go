@@ -8,20 +8,40 @@ import (
 	"fmt"
 )
 
-// Creates a Fcall value from the on-the-wire representation. If
-// dotu is true, reads 9P2000.u messages. Returns the unpacked message,
-// error and how many bytes from the buffer were used by the message.
-func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
+// Creates a Fcall value from the on-the-wire representation. The dialect
+// selects the variant of the messages: 9P2000.u fields are read for both
+// 9P2000.u and 9P2000.L, and the 9P2000.L specific messages are accepted
+// only for 9P2000.L. Returns the unpacked message, error and how many
+// bytes from the buffer were used by the message.
+func Unpack(buf []byte, dialect Dialect) (fc *Fcall, err error, fcsz int) {
+	fc = new(Fcall)
+	err, fcsz = UnpackFcall(fc, buf, dialect)
+	if err != nil {
+		return nil, err, 0
+	}
+
+	return fc, nil, fcsz
+}
+
+// Same as Unpack, but decodes the message into fc instead of allocating
+// a new Fcall. All fields except Buf are overwritten. The Wname and Wqid
+// slices of fc are reused if they have enough capacity, Pkt and Data
+// point to buf. The strings (Uname, Aname, Wname elements, etc.) are
+// copied out of buf and stay valid after buf is reused, the slices
+// don't. Returns the error and how many bytes from the buffer were used
+// by the message.
+func UnpackFcall(fc *Fcall, buf []byte, dialect Dialect) (err error, fcsz int) {
 	var m uint16
 
 	if len(buf) < 7 {
-		return nil, &Error{"buffer too short", EINVAL}, 0
+		return &Error{"buffer too short", EINVAL}, 0
 	}
 
-	fc = new(Fcall)
+	*fc = Fcall{Buf: fc.Buf, Wname: fc.Wname[:0], Wqid: fc.Wqid[:0]}
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
+	fc.Dfid = NOFID
 
 	p := buf
 	fc.Size, p = gint32(p)
@@ -29,34 +49,36 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	fc.Tag, p = gint16(p)
 
 	if int(fc.Size) > len(buf) || fc.Size < 7 {
-		return nil, &Error{fmt.Sprintf("buffer too short: %d expected %d",
-				len(buf), fc.Size),
-				EINVAL},
-			0
+		return &Error{fmt.Sprintf("buffer too short: %d expected %d",
+			len(buf), fc.Size),
+			EINVAL}, 0
 	}
 
 	p = p[0 : fc.Size-7]
 	fc.Pkt = buf[0:fc.Size]
 	fcsz = int(fc.Size)
-	if fc.Type < Tversion || fc.Type >= Tlast {
-		return nil, &Error{"invalid id", EINVAL}, 0
-	}
 
 	var sz uint32
-	if dotu {
-		sz = minFcusize[fc.Type-Tversion]
+	if fc.Type >= Tversion && fc.Type < Tlast {
+		if dialect.Dotu() {
+			sz = minFcusize[fc.Type-Tversion]
+		} else {
+			sz = minFcsize[fc.Type-Tversion]
+		}
+	} else if lsz, ok := minFclsize[fc.Type]; ok && dialect.Dotl() {
+		sz = lsz
 	} else {
-		sz = minFcsize[fc.Type-Tversion]
+		return &Error{"invalid id", EINVAL}, 0
 	}
 
-	if fc.Size < sz {
+	if fc.Size-7 < sz {
 		goto szerror
 	}
 
 	err = nil
 	switch fc.Type {
 	default:
-		return nil, &Error{"invalid message id", EINVAL}, 0
+		return &Error{"invalid message id", EINVAL}, 0
 
 	case Tversion, Rversion:
 		fc.Msize, p = gint32(p)
@@ -78,7 +100,10 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		}
 
 		fc.Unamenum = NOUID
-		if dotu && len(p) > 0 {
+		if dialect.Dotu() && len(p) > 0 {
+			if len(p) < 4 {
+				goto szerror
+			}
 			fc.Unamenum, p = gint32(p)
 		}
 
@@ -102,7 +127,10 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		}
 
 		fc.Unamenum = NOUID
-		if dotu && len(p) > 0 {
+		if dialect.Dotu() && len(p) > 0 {
+			if len(p) < 4 {
+				goto szerror
+			}
 			fc.Unamenum, p = gint32(p)
 		}
 
@@ -111,7 +139,7 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		if p == nil {
 			goto szerror
 		}
-		if dotu {
+		if dialect.Dotu() {
 			fc.Errornum, p = gint32(p)
 		} else {
 			fc.Errornum = 0
@@ -121,7 +149,11 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		fc.Fid, p = gint32(p)
 		fc.Newfid, p = gint32(p)
 		m, p = gint16(p)
-		fc.Wname = make([]string, m)
+		if cap(fc.Wname) >= int(m) {
+			fc.Wname = fc.Wname[:m]
+		} else {
+			fc.Wname = make([]string, m)
+		}
 		for i := 0; i < int(m); i++ {
 			fc.Wname[i], p = gstr(p)
 			if p == nil {
@@ -131,7 +163,11 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 
 	case Rwalk:
 		m, p = gint16(p)
-		fc.Wqid = make([]Qid, m)
+		if cap(fc.Wqid) >= int(m) {
+			fc.Wqid = fc.Wqid[:m]
+		} else {
+			fc.Wqid = make([]Qid, m)
+		}
 		for i := 0; i < int(m); i++ {
 			p = gqid(p, &fc.Wqid[i])
 		}
@@ -152,7 +188,7 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		}
 		fc.Perm, p = gint32(p)
 		fc.Mode, p = gint8(p)
-		if dotu {
+		if dialect.Dotu() {
 			fc.Ext, p = gstr(p)
 			if p == nil {
 				goto szerror
@@ -193,17 +229,236 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 
 	case Rstat:
 		m, p = gint16(p)
-		p, err = gstat(p, &fc.Dir, dotu)
+		p, err = gstat(p, &fc.Dir, dialect)
 		if err != nil {
-			return nil, err, 0
+			return err, 0
 		}
 
 	case Twstat:
 		fc.Fid, p = gint32(p)
 		m, p = gint16(p)
-		p, _ = gstat(p, &fc.Dir, dotu)
+		p, _ = gstat(p, &fc.Dir, dialect)
 
 	case Rflush, Rclunk, Rremove, Rwstat:
+
+	case Rlerror:
+		fc.Errornum, p = gint32(p)
+
+	case Tstatfs, Treadlink:
+		fc.Fid, p = gint32(p)
+
+	case Rstatfs:
+		fc.Statfs.Type, p = gint32(p)
+		fc.Statfs.Bsize, p = gint32(p)
+		fc.Statfs.Blocks, p = gint64(p)
+		fc.Statfs.Bfree, p = gint64(p)
+		fc.Statfs.Bavail, p = gint64(p)
+		fc.Statfs.Files, p = gint64(p)
+		fc.Statfs.Ffree, p = gint64(p)
+		fc.Statfs.Fsid, p = gint64(p)
+		fc.Statfs.Namelen, p = gint32(p)
+
+	case Tlopen:
+		fc.Fid, p = gint32(p)
+		fc.Flags, p = gint32(p)
+
+	case Rlopen, Rlcreate:
+		p = gqid(p, &fc.Qid)
+		fc.Iounit, p = gint32(p)
+
+	case Tlcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Flags, p = gint32(p)
+		fc.Perm, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Tsymlink:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 6 {
+			goto szerror
+		}
+		fc.Target, p = gstr(p)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Ngid, p = gint32(p)
+
+	case Rsymlink, Rmknod, Rmkdir:
+		p = gqid(p, &fc.Qid)
+
+	case Tmknod:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 16 {
+			goto szerror
+		}
+		fc.Perm, p = gint32(p)
+		fc.Major, p = gint32(p)
+		fc.Minor, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Trename:
+		fc.Fid, p = gint32(p)
+		fc.Dfid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rreadlink:
+		fc.Target, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tgetattr:
+		fc.Fid, p = gint32(p)
+		fc.Mask, p = gint64(p)
+
+	case Rgetattr:
+		a := &fc.Attr
+		a.Valid, p = gint64(p)
+		p = gqid(p, &a.Qid)
+		a.Mode, p = gint32(p)
+		a.Uid, p = gint32(p)
+		a.Gid, p = gint32(p)
+		a.Nlink, p = gint64(p)
+		a.Rdev, p = gint64(p)
+		a.Size, p = gint64(p)
+		a.Blksize, p = gint64(p)
+		a.Blocks, p = gint64(p)
+		p = gtime(p, &a.Atime)
+		p = gtime(p, &a.Mtime)
+		p = gtime(p, &a.Ctime)
+		p = gtime(p, &a.Btime)
+		a.Gen, p = gint64(p)
+		a.DataVersion, p = gint64(p)
+
+	case Tsetattr:
+		sa := &fc.SetAttr
+		fc.Fid, p = gint32(p)
+		sa.Valid, p = gint32(p)
+		sa.Mode, p = gint32(p)
+		sa.Uid, p = gint32(p)
+		sa.Gid, p = gint32(p)
+		sa.Size, p = gint64(p)
+		p = gtime(p, &sa.Atime)
+		p = gtime(p, &sa.Mtime)
+
+	case Txattrwalk:
+		fc.Fid, p = gint32(p)
+		fc.Newfid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rxattrwalk:
+		fc.Attrsize, p = gint64(p)
+
+	case Txattrcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Attrsize, p = gint64(p)
+		fc.Flags, p = gint32(p)
+
+	case Treaddir:
+		fc.Fid, p = gint32(p)
+		fc.Offset, p = gint64(p)
+		fc.Count, p = gint32(p)
+
+	case Rreaddir:
+		fc.Count, p = gint32(p)
+		if len(p) < int(fc.Count) {
+			goto szerror
+		}
+		fc.Data = p
+		p = p[fc.Count:]
+
+	case Tfsync:
+		fc.Fid, p = gint32(p)
+		// older clients don't send datasync
+		if len(p) >= 4 {
+			fc.Datasync, p = gint32(p)
+		}
+
+	case Tlock:
+		fl := &fc.Flock
+		fc.Fid, p = gint32(p)
+		fl.Type, p = gint8(p)
+		fl.Flags, p = gint32(p)
+		fl.Start, p = gint64(p)
+		fl.Length, p = gint64(p)
+		fl.ProcId, p = gint32(p)
+		fl.ClientId, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rlock:
+		fc.Status, p = gint8(p)
+
+	case Tgetlock:
+		fc.Fid, p = gint32(p)
+		fallthrough
+
+	case Rgetlock:
+		fl := &fc.Flock
+		fl.Type, p = gint8(p)
+		fl.Start, p = gint64(p)
+		fl.Length, p = gint64(p)
+		fl.ProcId, p = gint32(p)
+		fl.ClientId, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tlink:
+		fc.Dfid, p = gint32(p)
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tmkdir:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 8 {
+			goto szerror
+		}
+		fc.Perm, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Trenameat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 6 {
+			goto szerror
+		}
+		fc.Dfid, p = gint32(p)
+		fc.Newname, p = gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tunlinkat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstr(p)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Flags, p = gint32(p)
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
 	}
 
 	if len(p) > 0 {
@@ -213,5 +468,5 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	return
 
 szerror:
-	return nil, &Error{"invalid size", EINVAL}, 0
+	return &Error{"invalid size", EINVAL}, 0
 }